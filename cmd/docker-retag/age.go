@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SourceAge is when the source image was built, from the created time
+// of its config, or of the newest platform of an index
+type SourceAge struct {
+	Created time.Time `json:"created"`
+	// AgeSeconds is how long before the check the image was created
+	AgeSeconds int64 `json:"age_seconds"`
+}
+
+// age returns how long before the check the image was created
+func (a *SourceAge) age() time.Duration {
+	return time.Duration(a.AgeSeconds) * time.Second
+}
+
+// formatAge returns d in days and hours once it is longer than a day,
+// such as 12d3h, as durations of images are mostly that long
+func formatAge(d time.Duration) string {
+	if d < 24*time.Hour {
+		return d.String()
+	}
+	return fmt.Sprintf("%dd%dh", d/(24*time.Hour), d%(24*time.Hour)/time.Hour)
+}
+
+// sourceCreated returns the created time of the image config of m, or
+// for an index the newest created time of its platforms, leaving out
+// attestation manifests. It is zero if no config has one: reproducible
+// builds leave it out or set it to the epoch.
+func sourceCreated(src imageSource, m Manifest) (time.Time, error) {
+	if m.isIndex() {
+		var newest time.Time
+		for _, d := range m.Manifests {
+			if isAttestation(d) {
+				continue
+			}
+			child, err := src.manifest(d.Digest)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("getting manifest %s from %s: %w", d.Digest, src, err)
+			}
+			created, err := sourceCreated(src, child)
+			if err != nil {
+				return time.Time{}, err
+			}
+			if created.After(newest) {
+				newest = created
+			}
+		}
+		return newest, nil
+	}
+	c, err := fetchConfig(src, m)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("reading image config from %s: %w", src, err)
+	}
+	if c.Created == "" {
+		return time.Time{}, nil
+	}
+	created, err := time.Parse(time.RFC3339Nano, c.Created)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parsing created time of %s: %w", src, err)
+	}
+	if created.Unix() <= 0 {
+		return time.Time{}, nil
+	}
+	return created, nil
+}
+
+// checkSourceAge fails if the source m was created longer than maxAge
+// ago. A source without a created time passes with a warning, or fails
+// with strict. The age found is returned for the report, nil if the
+// source has no created time.
+func checkSourceAge(src imageSource, m Manifest, maxAge time.Duration, strict bool) (*SourceAge, error) {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "checkSourceAge",
+		"image":   src.String(),
+	})
+	created, err := sourceCreated(src, m)
+	if err != nil {
+		l.Error("Error getting created time: ", err)
+		return nil, err
+	}
+	if created.IsZero() {
+		if strict {
+			return nil, fmt.Errorf("source %s has no created time, its age cannot be checked against --max-source-age with --strict-age", src)
+		}
+		l.Warn("Source has no created time, as reproducible builds leave it out, so --max-source-age passes it")
+		return nil, nil
+	}
+	age := &SourceAge{Created: created.UTC(), AgeSeconds: int64(time.Since(created) / time.Second)}
+	if age.age() > maxAge {
+		return age, fmt.Errorf("source %s was created %s ago at %s, older than --max-source-age %s", src, formatAge(age.age()), age.Created.Format(time.RFC3339), maxAge)
+	}
+	l.WithField("created", age.Created.Format(time.RFC3339)).Debug("Source is ", formatAge(age.age()), " old")
+	return age, nil
+}
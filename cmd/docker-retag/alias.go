@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// aliasTag is a tag considered by alias and whether it can be chosen
+type aliasTag struct {
+	tag     string
+	version semver
+	created time.Time
+	// reason is why the tag cannot be chosen, empty if it can
+	reason string
+}
+
+// chooseAlias returns the tag with the highest version among candidates
+// and why it was chosen. Tags of the same version, such as 1.2.0 and
+// v1.2.0 or builds differing in metadata, are ordered by the created time
+// of their config, read with created, and then by name.
+func chooseAlias(candidates []*aliasTag, created func(*aliasTag) time.Time) (*aliasTag, string) {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].version.compare(candidates[j].version) > 0
+	})
+	top := candidates[0]
+	var tied []*aliasTag
+	for _, t := range candidates {
+		if t.version.compare(top.version) == 0 {
+			tied = append(tied, t)
+		}
+	}
+	if len(tied) == 1 {
+		return top, fmt.Sprintf("highest version %s of %d candidates", top.version, len(candidates))
+	}
+	for _, t := range tied {
+		t.created = created(t)
+	}
+	sort.SliceStable(tied, func(i, j int) bool {
+		if !tied[i].created.Equal(tied[j].created) {
+			return tied[i].created.After(tied[j].created)
+		}
+		return tied[i].tag < tied[j].tag
+	})
+	top = tied[0]
+	others := "another tag"
+	if len(tied) > 2 {
+		others = fmt.Sprintf("%d other tags", len(tied)-1)
+	}
+	why := fmt.Sprintf("highest version %s of %d candidates, tied with %s", top.version, len(candidates), others)
+	if top.created.IsZero() || top.created.Equal(tied[1].created) {
+		return top, why + " and first by name"
+	}
+	return top, why + fmt.Sprintf(" and created last at %s", top.created.Format(time.RFC3339))
+}
+
+// aliasCmd points a floating tag, such as v1, at the tag of the highest
+// semantic version matching a pattern and range, such as v1.4.2. It only
+// pushes when the tag points elsewhere, so it can run from cron.
+func aliasCmd(args []string) int {
+	fs := flag.NewFlagSet("alias", flag.ContinueOnError)
+	pattern := fs.String("pattern", "", "Regular expression tags must fully match to be considered, such as v1\\..*; by default every tag")
+	target := fs.String("target", "", "Tag to point at the chosen tag, such as v1")
+	rangeFlag := fs.String("semver-range", "", "Only consider versions in this range, such as \">=1.2 <2\"; comparisons separated by spaces must all hold and || separates alternatives")
+	prerelease := fs.Bool("include-prerelease", false, "Consider prerelease versions such as 1.4.0-rc.1, which are skipped by default")
+	dryRun := fs.Bool("dry-run", false, "Print the tag that would be chosen and why other tags were not, without pushing")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s alias <repository> --target <tag> [--pattern <regexp>] [--semver-range <range>] [--include-prerelease] [--dry-run]\n", commandName())
+		fs.PrintDefaults()
+	}
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return 1
+	}
+	if len(positional) != 1 || *target == "" {
+		fs.Usage()
+		return 1
+	}
+	l := log.WithFields(log.Fields{
+		"package":    "main",
+		"fn":         "aliasCmd",
+		"repository": positional[0],
+	})
+	expr := *pattern
+	if expr == "" {
+		expr = ".*"
+	}
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error: invalid --pattern:", err)
+		return 1
+	}
+	var versions *semverRange
+	if *rangeFlag != "" {
+		if versions, err = parseSemverRange(*rangeFlag); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			return 1
+		}
+	}
+	pr, err := newPlanRef("repository", positional[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	if pr.Ref.Digest != "" {
+		fmt.Fprintln(os.Stderr, "Error: alias takes a repository, not a digest")
+		return 1
+	}
+	ref := pr.Ref
+	dst := ref.withReference(*target)
+	if err := checkRegistryPolicy([]PlanRef{pr}); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	if isProtectedTag(dst) && !AllowProtected {
+		fmt.Fprintf(os.Stderr, "Error: %s is a protected tag, pass --allow-protected to move it\n", *target)
+		return 1
+	}
+	names, err := listTags(context.Background(), ref)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error listing tags:", err)
+		return 1
+	}
+	sort.Strings(names)
+	var candidates, skipped []*aliasTag
+	for _, name := range names {
+		if name == *target || !re.MatchString(name) {
+			continue
+		}
+		t := &aliasTag{tag: name}
+		if t.version, err = parseSemver(name); err != nil {
+			t.reason = "not a semantic version"
+		} else if len(t.version.prerelease) > 0 && !*prerelease {
+			t.reason = "a prerelease, pass --include-prerelease to consider it"
+		} else if versions != nil && !versions.allows(t.version) {
+			t.reason = fmt.Sprintf("outside --semver-range %s", versions)
+		}
+		if t.reason != "" {
+			skipped = append(skipped, t)
+			continue
+		}
+		candidates = append(candidates, t)
+	}
+	if *dryRun {
+		for _, t := range skipped {
+			fmt.Printf("skip %s: %s\n", t.tag, t.reason)
+		}
+	}
+	if len(candidates) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: no semantic version tag of %s matches --pattern %q", ref.Repository(), expr)
+		if versions != nil {
+			fmt.Fprintf(os.Stderr, " and --semver-range %s", versions)
+		}
+		fmt.Fprintln(os.Stderr)
+		return 1
+	}
+	chosen, why := chooseAlias(candidates, func(t *aliasTag) time.Time {
+		m, err := fetchManifest(ref, t.tag)
+		if err != nil {
+			l.Warnf("Unable to get the manifest of %s: %s", t.tag, err)
+			return time.Time{}
+		}
+		created, err := imageCreated(ref, m)
+		if err != nil {
+			l.Warnf("Unable to get the creation time of %s: %s", t.tag, err)
+		}
+		return created
+	})
+	m, err := fetchManifest(ref, chosen.tag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s: %s\n", chosen.tag, err)
+		return 1
+	}
+	fmt.Printf("chose %s (%s): %s\n", chosen.tag, m.Digest(), why)
+	current, exists, err := manifestDigest(ref, *target)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s: %s\n", *target, err)
+		return 1
+	}
+	switch {
+	case exists && current == m.Digest():
+		fmt.Printf("%s already points at %s, nothing to do\n", *target, chosen.tag)
+		return 0
+	case *dryRun && exists:
+		fmt.Printf("would move %s from %s to %s\n", *target, current, chosen.tag)
+		return 0
+	case *dryRun:
+		fmt.Printf("would create %s pointing at %s\n", *target, chosen.tag)
+		return 0
+	}
+	if _, _, err := putManifest(dst, *target, m); err != nil {
+		fmt.Fprintf(os.Stderr, "Error pointing %s at %s: %s\n", *target, chosen.tag, err)
+		return 1
+	}
+	if exists {
+		fmt.Printf("moved %s from %s to %s\n", *target, current, chosen.tag)
+	} else {
+		fmt.Printf("created %s pointing at %s\n", *target, chosen.tag)
+	}
+	return 0
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// mergeAnnotations sets the annotations in add on the raw annotations
+// object, which may be empty
+func mergeAnnotations(raw json.RawMessage, add map[string]string) (json.RawMessage, error) {
+	annotations := map[string]string{}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &annotations); err != nil {
+			return nil, err
+		}
+	}
+	for k, v := range add {
+		annotations[k] = v
+	}
+	return json.Marshal(annotations)
+}
+
+// annotateManifest returns a copy of m with annotations added. For an
+// image manifest annotations are set on the manifest itself. For an index
+// they are set on every entry and indexAnnotations on the index. The
+// manifest is edited as raw JSON so fields docker-retag does not know
+// about are kept, and the result has a new digest.
+func annotateManifest(m Manifest, annotations, indexAnnotations map[string]string) (Manifest, error) {
+	if m.isSchema1(m.ContentType) {
+		return m, errors.New("schema1 manifests cannot be annotated")
+	}
+	if !m.isIndex() && len(indexAnnotations) > 0 {
+		return m, errors.New("--index-annotation needs an index as source, use --annotation for single platform images")
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(m.Raw, &doc); err != nil {
+		return m, err
+	}
+	var err error
+	if m.isIndex() {
+		if len(annotations) > 0 {
+			var entries []map[string]json.RawMessage
+			if err := json.Unmarshal(doc["manifests"], &entries); err != nil {
+				return m, err
+			}
+			for _, e := range entries {
+				if e["annotations"], err = mergeAnnotations(e["annotations"], annotations); err != nil {
+					return m, err
+				}
+			}
+			if doc["manifests"], err = json.Marshal(entries); err != nil {
+				return m, err
+			}
+		}
+		annotations = indexAnnotations
+	}
+	if len(annotations) > 0 {
+		if doc["annotations"], err = mergeAnnotations(doc["annotations"], annotations); err != nil {
+			return m, err
+		}
+	}
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return m, err
+	}
+	return parseManifest(raw, m.ContentType)
+}
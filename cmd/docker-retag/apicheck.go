@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// registryAPIVersion is the Docker-Distribution-Api-Version of registries
+// that implement the v2 API
+const registryAPIVersion = "registry/2.0"
+
+// NoAPICheck skips probing registries with GET /v2/ before the first
+// manifest request
+var NoAPICheck bool
+
+var (
+	apiChecksMu sync.Mutex
+	apiChecks   = map[string]*apiCheck{}
+)
+
+// apiCheck is the result of probing one registry. Only a registry that
+// passed is remembered for the run, so a probe that failed on a network
+// blip or a 5xx is retried by the next request, such as the next --watch
+// sync, instead of failing the registry for good.
+type apiCheck struct {
+	mu sync.Mutex
+	ok bool
+}
+
+// forgetAPIChecks drops the registries that passed the API check, so
+// the next --watch sync checks them again
+func forgetAPIChecks() {
+	apiChecksMu.Lock()
+	defer apiChecksMu.Unlock()
+	apiChecks = map[string]*apiCheck{}
+}
+
+// checkRegistryAPI checks that the registry of ref implements the Docker
+// Registry v2 API, so a host that is not a registry fails with an error
+// that says so instead of a confusing response to a manifest request.
+// Registries that pass are not probed again.
+func checkRegistryAPI(ref ImageRef) error {
+	if NoAPICheck {
+		return nil
+	}
+	root := ref.apiRoot()
+	apiChecksMu.Lock()
+	c, ok := apiChecks[root]
+	if !ok {
+		c = &apiCheck{}
+		apiChecks[root] = c
+	}
+	apiChecksMu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ok {
+		return nil
+	}
+	if err := probeRegistryAPI(ref.Registry, root); err != nil {
+		return err
+	}
+	c.ok = true
+	return nil
+}
+
+// unreachable explains why a request to the registry failed before any
+// response, returning the step that broke: dns, tls or connect
+func unreachable(registry string, err error) (string, error) {
+	var dnsErr *net.DNSError
+	var caErr x509.UnknownAuthorityError
+	var hostErr x509.HostnameError
+	var certErr x509.CertificateInvalidError
+	var recordErr tls.RecordHeaderError
+	switch {
+	case errors.As(err, &dnsErr):
+		return "dns", fmt.Errorf("registry %s cannot be resolved, check the host name: %w", registry, err)
+	case errors.As(err, &caErr):
+		return "tls", fmt.Errorf("registry %s presents an untrusted certificate, set a ca-file for it in the config file or pass --tls-skip-verify: %w", registry, err)
+	case errors.As(err, &hostErr):
+		return "tls", fmt.Errorf("the certificate of registry %s is not for that host: %w", registry, err)
+	case errors.As(err, &certErr):
+		return "tls", fmt.Errorf("registry %s presents an invalid certificate: %w", registry, err)
+	case errors.As(err, &recordErr):
+		return "tls", fmt.Errorf("registry %s does not speak TLS, pass --plain-http %s if it serves plain HTTP: %w", registry, registry, err)
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connect", fmt.Errorf("registry %s refused the connection, check the host and port: %w", registry, err)
+	}
+	return "connect", fmt.Errorf("registry %s cannot be reached: %w", registry, err)
+}
+
+// probeRegistryAPI sends GET /v2/ to the registry and interprets the
+// response. A 401 with a challenge is what a registry requiring auth
+// answers, so only responses a registry would not send fail the check.
+func probeRegistryAPI(registry, root string) error {
+	l := log.WithFields(log.Fields{
+		"package":  "main",
+		"fn":       "probeRegistryAPI",
+		"registry": registry,
+		"url":      root,
+	})
+	l.Debug("Checking registry API")
+	req, err := http.NewRequest("GET", root, nil)
+	if err != nil {
+		l.Error("Error creating request: ", err)
+		return err
+	}
+	resp, err := followRedirects(req)
+	if err != nil {
+		_, err = unreachable(registry, err)
+		return err
+	}
+	defer resp.Body.Close()
+	version := resp.Header.Get("Docker-Distribution-Api-Version")
+	l = l.WithFields(log.Fields{
+		"status":      resp.Status,
+		"api_version": version,
+	})
+	if version != "" && version != registryAPIVersion {
+		return fmt.Errorf("registry %s reports API version %q, docker-retag needs %s", registry, version, registryAPIVersion)
+	}
+	switch {
+	case notRegistryAPI(resp):
+		return fmt.Errorf("%s does not implement the Docker Registry v2 API, GET %s returned %s", registry, root, resp.Status)
+	case resp.StatusCode == http.StatusOK:
+	case resp.StatusCode == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") != "":
+	default:
+		l.Debug("Unexpected response to registry API check, continuing")
+		return nil
+	}
+	l.Debug("Registry API available")
+	return nil
+}
+
+// notRegistryAPI reports whether the response to GET /v2/ cannot be from
+// a registry: a 404, or an HTML page such as a login page or the error
+// page of a proxy, whatever its status
+func notRegistryAPI(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusNotFound || strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html")
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCheckRegistryAPIRetriesFailures(t *testing.T) {
+	r := newTestRegistry(t)
+	failures := 1
+	r.hook = func(w http.ResponseWriter, req *http.Request) bool {
+		if req.URL.Path != "/v2/" || failures == 0 {
+			return false
+		}
+		failures--
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("<html>bad gateway</html>"))
+		return true
+	}
+	ref := r.ref(t, "app", "1.0")
+	if err := checkRegistryAPI(ref); err == nil {
+		t.Fatal("checkRegistryAPI passed a proxy error page")
+	}
+	if err := checkRegistryAPI(ref); err != nil {
+		t.Fatalf("checkRegistryAPI did not probe again after a failure: %v", err)
+	}
+	if err := checkRegistryAPI(ref); err != nil {
+		t.Fatal(err)
+	}
+	probes := 0
+	for _, req := range r.requested() {
+		if req == "GET /v2/" {
+			probes++
+		}
+	}
+	if probes != 2 {
+		t.Errorf("registry was probed %d times, want 2: a passed check is remembered", probes)
+	}
+}
+
+func TestCheckRegistryAPIRejectsHTMLWithStatusOK(t *testing.T) {
+	r := newTestRegistry(t)
+	r.hook = func(w http.ResponseWriter, req *http.Request) bool {
+		if req.URL.Path != "/v2/" {
+			return false
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte("<html>Sign in</html>"))
+		return true
+	}
+	err := checkRegistryAPI(r.ref(t, "app", "1.0"))
+	if err == nil || !strings.Contains(err.Error(), "does not implement the Docker Registry v2 API") {
+		t.Errorf("checkRegistryAPI of a login page = %v, want an error saying it is not a registry", err)
+	}
+}
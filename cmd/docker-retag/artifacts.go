@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+)
+
+// Kinds of manifests, as classified by manifestKind
+const (
+	kindImage    = "image"
+	kindIndex    = "index"
+	kindArtifact = "artifact"
+)
+
+// statusArtifact is the status of a destination that was not pushed
+// because its source is an artifact and --exclude-artifacts is set
+const statusArtifact = "skipped (artifact)"
+
+// ExcludeArtifacts skips sources that are attestations, signatures or
+// other referrer artifacts rather than images, such as the sha256-*
+// fallback tags buildkit and cosign push next to an image
+var ExcludeArtifacts bool
+
+// imageLayer reports whether the media type is that of a filesystem layer
+func imageLayer(mediaType string) bool {
+	return strings.Contains(mediaType, ".rootfs.") || strings.Contains(mediaType, ".image.layer.")
+}
+
+// manifestKind classifies m as an image, an index of images or an
+// artifact. Artifacts are manifests with a subject or artifactType, OCI
+// artifact manifests, manifests whose config is not an image config or
+// that have no filesystem layers, such as in-toto attestations and cosign
+// signatures, and indexes of only artifacts, such as the index a
+// referrers fallback tag points at.
+func manifestKind(m Manifest) string {
+	if m.isIndex() {
+		for _, d := range m.Manifests {
+			if d.ArtifactType == "" && !isAttestation(d) {
+				return kindIndex
+			}
+		}
+		return kindArtifact
+	}
+	if m.Subject != nil || m.ArtifactType != "" || m.ContentType == mediaTypeOCIArtifact {
+		return kindArtifact
+	}
+	if m.Config != nil {
+		switch m.Config.MediaType {
+		case mediaTypeDockerConfig, mediaTypeOCIConfig:
+		default:
+			return kindArtifact
+		}
+	}
+	for _, l := range m.Layers {
+		if imageLayer(l.MediaType) || l.nonDistributable() {
+			return kindImage
+		}
+	}
+	if len(m.Layers) == 0 && m.Config != nil {
+		// images built from scratch without files
+		return kindImage
+	}
+	return kindArtifact
+}
+
+// artifactResults returns the results of the destinations of a group
+// whose source is an artifact excluded by --exclude-artifacts
+func artifactResults(g *retagGroup, digest string) []UploadResult {
+	var results []UploadResult
+	for i, d := range g.destinations {
+		results = append(results, UploadResult{
+			Index:       g.offset + i,
+			Source:      g.source,
+			Destination: d,
+			Digest:      digest,
+			Kind:        kindArtifact,
+			Status:      statusArtifact,
+		})
+	}
+	return results
+}
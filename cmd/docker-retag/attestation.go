@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// attestationReferenceType is the vnd.docker.reference.type annotation
+// buildkit sets on the attestation manifests it adds to an index
+const attestationReferenceType = "attestation-manifest"
+
+// isAttestation reports whether the index entry is an attestation
+// manifest rather than an image for a platform
+func isAttestation(d Descriptor) bool {
+	if d.Annotations["vnd.docker.reference.type"] == attestationReferenceType {
+		return true
+	}
+	return d.Platform != nil && d.Platform.OS == "unknown" && d.Platform.Architecture == "unknown"
+}
+
+// stripAttestations returns a copy of the index m without its attestation
+// manifests, and the entries that were removed. The index is edited as
+// raw JSON like annotateManifest, so the result has a new digest. Image
+// manifests and indexes without attestations are returned unchanged.
+func stripAttestations(m Manifest) (Manifest, []Descriptor, error) {
+	if !m.isIndex() {
+		return m, nil, nil
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(m.Raw, &doc); err != nil {
+		return m, nil, err
+	}
+	var entries []json.RawMessage
+	if err := json.Unmarshal(doc["manifests"], &entries); err != nil {
+		return m, nil, err
+	}
+	if len(entries) != len(m.Manifests) {
+		return m, nil, errors.New("index entries do not match its manifests")
+	}
+	var kept []json.RawMessage
+	var removed []Descriptor
+	for i, d := range m.Manifests {
+		if isAttestation(d) {
+			removed = append(removed, d)
+			continue
+		}
+		kept = append(kept, entries[i])
+	}
+	if len(removed) == 0 {
+		return m, nil, nil
+	}
+	if len(kept) == 0 {
+		return m, nil, errors.New("the index only has attestation manifests")
+	}
+	var err error
+	if doc["manifests"], err = json.Marshal(kept); err != nil {
+		return m, nil, err
+	}
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return m, nil, err
+	}
+	stripped, err := parseManifest(raw, m.ContentType)
+	return stripped, removed, err
+}
+
+// logStrippedAttestations lists the attestation manifests that were
+// removed, so it is clear that their provenance was not copied
+func logStrippedAttestations(source string, removed []Descriptor) {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "logStrippedAttestations",
+		"source":  source,
+	})
+	for _, d := range removed {
+		subject := d.Annotations["vnd.docker.reference.digest"]
+		if subject == "" {
+			subject = "the index"
+		}
+		l.Warnf("Stripped attestation manifest %s for %s, its provenance is not copied", d.Digest, subject)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// auditLog records mutating registry operations when --audit-log or
+// DOCKER_RETAG_AUDIT_LOG is set
+var auditLog *auditLogger
+
+// auditLogger appends one JSON line per operation, synced to disk before
+// the next operation so a crash does not lose records
+type auditLogger struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// auditEntry is a single audit record. It never contains credentials.
+type auditEntry struct {
+	Time           time.Time `json:"time"`
+	Action         string    `json:"action"`
+	Actor          string    `json:"actor"`
+	Digest         string    `json:"digest"`
+	Destination    string    `json:"destination"`
+	Status         int       `json:"status,omitempty"`
+	ResponseDigest string    `json:"response_digest,omitempty"`
+	Error          string    `json:"error,omitempty"`
+}
+
+// openAuditLog opens the audit log at path for appending
+func openAuditLog(path string) (*auditLogger, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLogger{f: f}, nil
+}
+
+// audit records an operation on dst and its outcome. resp may be nil if
+// the request failed before a response was received.
+func audit(action string, ref ImageRef, dst string, digest string, resp *http.Response, err error) {
+	if auditLog == nil {
+		return
+	}
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "audit",
+		"action":  action,
+	})
+	e := auditEntry{
+		Time:        time.Now().UTC(),
+		Action:      action,
+		Actor:       registryActor(ref),
+		Digest:      digest,
+		Destination: dst,
+	}
+	if resp != nil {
+		e.Status = resp.StatusCode
+		e.ResponseDigest = resp.Header.Get("Docker-Content-Digest")
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	bd, merr := json.Marshal(e)
+	if merr != nil {
+		l.Error("Error encoding audit entry: ", merr)
+		return
+	}
+	auditLog.mu.Lock()
+	defer auditLog.mu.Unlock()
+	if _, werr := auditLog.f.Write(append(bd, '\n')); werr != nil {
+		l.Error("Error writing audit log: ", werr)
+		return
+	}
+	if serr := auditLog.f.Sync(); serr != nil {
+		l.Error("Error syncing audit log: ", serr)
+	}
+}
+
+// registryActor returns the username docker-retag authenticates to the
+// registry of ref as, or "anonymous"
+func registryActor(ref ImageRef) string {
+	cred, err := ref.authProvider().ResolveCredentials(ref.Registry)
+	if err == nil && cred.IdentityToken != "" {
+		return "identity token"
+	}
+	if err != nil || cred.basicAuth() == "" {
+		return "anonymous"
+	}
+	return cred.Username
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// dockerConfigKeys returns the keys the registry may be stored under
+// in the auths section of the docker config
+func dockerConfigKeys(registry string) []string {
+	if isDockerHub(registry) {
+		return []string{
+			"https://index.docker.io/v1/",
+			"index.docker.io",
+			"docker.io",
+			"registry-1.docker.io",
+		}
+	}
+	hosts := []string{registry}
+	if c := canonicalHost(registry); c != registry {
+		hosts = append(hosts, c)
+	}
+	var keys []string
+	for _, h := range hosts {
+		keys = append(keys, h, "https://"+h, "http://"+h)
+	}
+	return keys
+}
+
+// Credential is the username and password docker-retag authenticates to
+// a registry with
+type Credential struct {
+	Username string
+	Password string
+	// IdentityToken is the refresh token docker login stores for SSO
+	// logins, such as az acr login and Docker Desktop, in place of a
+	// password. It is exchanged for bearer tokens with the OAuth2 refresh
+	// token grant; registries reject it as basic auth.
+	IdentityToken string
+}
+
+// basicAuth returns the base64 encoded basic auth of the credential, or
+// an empty string if it is incomplete or an identity token
+func (c Credential) basicAuth() string {
+	if c.Username == "" || c.Password == "" || c.IdentityToken != "" {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString([]byte(c.Username + ":" + c.Password))
+}
+
+// AuthProvider resolves the credentials for a registry. It is created once
+// and passed along with the references requests are made for, so clients
+// with different identities can run at once.
+type AuthProvider interface {
+	ResolveCredentials(registry string) (Credential, error)
+}
+
+// defaultAuth is the provider for references that were not given one,
+// set once in main before any request is made
+var defaultAuth AuthProvider = newCredentialChain(Credential{})
+
+// credentialChain resolves credentials from the flags and the credential
+// sources in resolveRegistryAuth. They are resolved once per registry, so
+// workers pushing to the same registry do not read the credential sources
+// for every request.
+type credentialChain struct {
+	explicit Credential
+	mu       sync.Mutex
+	resolved map[string]Credential
+}
+
+// newCredentialChain returns a provider that uses explicit, the -u and
+// -p flags, before the other credential sources
+func newCredentialChain(explicit Credential) *credentialChain {
+	return &credentialChain{explicit: explicit, resolved: map[string]Credential{}}
+}
+
+func (c *credentialChain) ResolveCredentials(registry string) (Credential, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cred, ok := c.resolved[registry]; ok {
+		return cred, nil
+	}
+	cred, err := resolveRegistryAuth(registry, c.explicit)
+	if err != nil {
+		return Credential{}, err
+	}
+	c.resolved[registry] = cred
+	return cred, nil
+}
+
+// authorize adds the credentials of ref to the request, if any. Once the
+// registry has sent a bearer challenge, a token for the request scope is
+// used instead.
+func authorize(req *http.Request, ref ImageRef) error {
+	defer metrics.observe("auth", ref.Registry, time.Now())
+	token, err := tokens.token(req.URL.Host, requestScope(req), ref.authProvider())
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+		return nil
+	}
+	auth, err := registryAuth(ref.authProvider(), ref.Registry)
+	if err != nil {
+		return err
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", "Basic "+auth)
+	}
+	return nil
+}
+
+// registryAuth returns the base64 encoded basic auth credentials the
+// provider has for the registry
+func registryAuth(auth AuthProvider, registry string) (string, error) {
+	cred, err := auth.ResolveCredentials(registry)
+	if err != nil {
+		return "", err
+	}
+	return cred.basicAuth(), nil
+}
+
+// resolveRegistryAuth returns the credentials for the registry.
+// Credentials are resolved in order from:
+//  1. explicit, the -u flag with -p, -P or --password-file
+//  2. the registry entry of --creds-fd
+//  3. DOCKER_RETAG_USERNAME and DOCKER_RETAG_PASSWORD
+//  4. DOCKER_USER and DOCKER_PASS
+//  5. the registry section of the config file
+//  6. the auths section of the docker config ($DOCKER_CONFIG or .docker/config.json in the home directory),
+//     with the identitytoken of SSO logins in place of the password
+//  7. the machine entry for the registry host in $NETRC or .netrc in the home directory
+func resolveRegistryAuth(registry string, explicit Credential) (Credential, error) {
+	l := log.WithFields(log.Fields{
+		"package":  "main",
+		"registry": registry,
+		"fn":       "resolveRegistryAuth",
+	})
+	l.Debug("Getting registry auth")
+	if explicit.basicAuth() != "" {
+		l.Debug("Using username and password")
+		return explicit, nil
+	}
+	if cred, ok := credentialsFor(fdCredentials, registry); ok {
+		l.Debug("Using --creds-fd credentials")
+		return cred, nil
+	}
+	if os.Getenv("DOCKER_RETAG_USERNAME") != "" && os.Getenv("DOCKER_RETAG_PASSWORD") != "" {
+		l.Debug("Using docker-retag credentials from environment")
+		return Credential{Username: os.Getenv("DOCKER_RETAG_USERNAME"), Password: os.Getenv("DOCKER_RETAG_PASSWORD")}, nil
+	}
+	if os.Getenv("DOCKER_USER") != "" && os.Getenv("DOCKER_PASS") != "" {
+		l.Debug("Using docker credentials")
+		return Credential{Username: os.Getenv("DOCKER_USER"), Password: os.Getenv("DOCKER_PASS")}, nil
+	}
+	user, pass, err := FileConfig.registry(registry).credentials()
+	if err != nil {
+		l.Error("Error reading config file credentials: ", err)
+		return Credential{}, err
+	}
+	if user != "" && pass != "" {
+		l.Debug("Using config file credentials")
+		return Credential{Username: user, Password: pass}, nil
+	}
+	// check docker config
+	dockerConfig := processEnv.dockerConfigPath()
+	if NoDockerConfig {
+		l.Debug("Skipping docker config, --no-docker-config is set")
+	} else if dockerConfig == "" {
+		l.Debug("Skipping docker config, neither DOCKER_CONFIG nor a home directory is set")
+	} else if _, err := os.Stat(dockerConfig); err == nil {
+		l.Debug("Using docker config ", dockerConfig)
+		// docker config found
+		// read and parse docker config
+		dc, err := readDockerConfig(dockerConfig)
+		if err != nil {
+			l.Error("Error reading docker config: ", err)
+			return Credential{}, err
+		}
+		// get auth for registry
+		for _, key := range dockerConfigKeys(registry) {
+			auth, ok := dc.Auths[key]
+			if !ok || (auth.Auth == "" && auth.IdentityToken == "") {
+				continue
+			}
+			l.Debug("Using docker config auth for ", key)
+			bd, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				l.Error("Error decoding docker config auth: ", err)
+				return Credential{}, err
+			}
+			user, pass, _ := strings.Cut(string(bd), ":")
+			if auth.IdentityToken != "" {
+				l.Debug("Using docker config identity token for ", key)
+				return Credential{Username: user, IdentityToken: auth.IdentityToken}, nil
+			}
+			return Credential{Username: user, Password: pass}, nil
+		}
+	} else {
+		l.Debug("Docker config not found at ", dockerConfig)
+	}
+	user, pass, err = netrcCredentials(processEnv.netrcPath(), registry)
+	if err != nil {
+		l.Error("Error reading netrc: ", err)
+		return Credential{}, err
+	}
+	if user != "" && pass != "" {
+		l.Debug("Using netrc credentials")
+		return Credential{Username: user, Password: pass}, nil
+	}
+	if NoCIAuth {
+		l.Debug("Skipping CI job token, --no-ci-auth is set")
+	} else if user, pass, source := ciCredentials(registry); user != "" && pass != "" {
+		l.Debug("Using CI job token from ", source)
+		return Credential{Username: user, Password: pass}, nil
+	}
+	l.Debug("No auth found for registry, using anonymous access")
+	return Credential{}, nil
+}
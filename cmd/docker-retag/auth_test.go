@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// useEnv looks up per-user files in an environment of vars until the
+// test ends
+func useEnv(t *testing.T, goos string, vars map[string]string) {
+	t.Helper()
+	saved := processEnv
+	processEnv = userEnv{goos: goos, getenv: func(name string) string { return vars[name] }}
+	t.Cleanup(func() { processEnv = saved })
+}
+
+// writeDockerAuth writes a docker config in dir with credentials for
+// registry.example.com
+func writeDockerAuth(t *testing.T, dir, user, pass string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	auth := base64.StdEncoding.EncodeToString([]byte(user + ":" + pass))
+	config := `{"auths":{"registry.example.com":{"auth":"` + auth + `"}}}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDockerConfigPath(t *testing.T) {
+	tests := []struct {
+		goos string
+		vars map[string]string
+		want string
+	}{
+		{"linux", nil, ""},
+		{"linux", map[string]string{"HOME": "/home/ci"}, filepath.Join("/home/ci", ".docker", "config.json")},
+		{"linux", map[string]string{"HOME": "/home/ci", "DOCKER_CONFIG": "/etc/docker-ci"}, filepath.Join("/etc/docker-ci", "config.json")},
+		{"linux", map[string]string{"DOCKER_CONFIG": "/etc/docker-ci"}, filepath.Join("/etc/docker-ci", "config.json")},
+		{"windows", map[string]string{"USERPROFILE": `C:\Users\ci`, "HOME": "/home/ci"}, filepath.Join(`C:\Users\ci`, ".docker", "config.json")},
+		{"windows", map[string]string{"HOMEDRIVE": "D:", "HOMEPATH": `\ci`}, filepath.Join(`D:\ci`, ".docker", "config.json")},
+	}
+	for _, tt := range tests {
+		e := userEnv{goos: tt.goos, getenv: func(name string) string { return tt.vars[name] }}
+		if got := e.dockerConfigPath(); got != tt.want {
+			t.Errorf("dockerConfigPath on %s with %v = %q, want %q", tt.goos, tt.vars, got, tt.want)
+		}
+	}
+}
+
+func TestResolveRegistryAuthDockerConfig(t *testing.T) {
+	for _, name := range []string{"DOCKER_RETAG_USERNAME", "DOCKER_RETAG_PASSWORD", "DOCKER_USER", "DOCKER_PASS"} {
+		t.Setenv(name, "")
+	}
+	home := t.TempDir()
+	writeDockerAuth(t, filepath.Join(home, ".docker"), "home-user", "home-pass")
+	override := filepath.Join(t.TempDir(), "docker-ci")
+	writeDockerAuth(t, override, "ci-user", "ci-pass")
+	tests := []struct {
+		name string
+		vars map[string]string
+		want Credential
+	}{
+		{"HOME unset", nil, Credential{}},
+		{"HOME missing", map[string]string{"HOME": filepath.Join(home, "missing")}, Credential{}},
+		{"HOME", map[string]string{"HOME": home}, Credential{Username: "home-user", Password: "home-pass"}},
+		{"DOCKER_CONFIG", map[string]string{"HOME": home, "DOCKER_CONFIG": override}, Credential{Username: "ci-user", Password: "ci-pass"}},
+		{"DOCKER_CONFIG missing", map[string]string{"HOME": home, "DOCKER_CONFIG": filepath.Join(home, "missing")}, Credential{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useEnv(t, "linux", tt.vars)
+			got, err := resolveRegistryAuth("registry.example.com", Credential{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("resolveRegistryAuth = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+	t.Run("no-docker-config", func(t *testing.T) {
+		useEnv(t, "linux", map[string]string{"HOME": home})
+		NoDockerConfig = true
+		defer func() { NoDockerConfig = false }()
+		if got, err := resolveRegistryAuth("registry.example.com", Credential{}); err != nil || got != (Credential{}) {
+			t.Errorf("resolveRegistryAuth with --no-docker-config = %+v, %v, want no credentials", got, err)
+		}
+	})
+}
+
+func TestAuthProvidersConcurrently(t *testing.T) {
+	realm := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _, ok := r.BasicAuth()
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"token":"token-` + user + `"}`))
+	}))
+	defer realm.Close()
+	r := newTestRegistry(t)
+	// each identity sees its own manifest under the same tag
+	served := map[string][]byte{"alice": testImageManifest(1), "bob": testImageManifest(2)}
+	r.hook = func(w http.ResponseWriter, req *http.Request) bool {
+		user := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer token-")
+		body, ok := served[user]
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+realm.URL+`/token",service="registry.example.com"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return true
+		}
+		w.Header().Set("Content-Type", mediaTypeOCIManifest)
+		w.Header().Set("Docker-Content-Digest", digestOf(body))
+		w.Write(body)
+		return true
+	}
+	providers := map[string]AuthProvider{
+		"alice": newCredentialChain(Credential{Username: "alice", Password: "a"}),
+		"bob":   newCredentialChain(Credential{Username: "bob", Password: "b"}),
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 50; i++ {
+		for user, auth := range providers {
+			wg.Add(1)
+			go func(user string, auth AuthProvider) {
+				defer wg.Done()
+				ref := r.ref(t, "app", "1.0").withAuth(auth)
+				m, err := fetchManifest(ref, "1.0")
+				if err != nil {
+					errs <- err
+					return
+				}
+				if m.Digest() != digestOf(served[user]) {
+					errs <- fmt.Errorf("%s got the manifest of another identity", user)
+				}
+			}(user, auth)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestCredentialChainConcurrently(t *testing.T) {
+	chain := newCredentialChain(Credential{Username: "ci", Password: "secret"})
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			registry := fmt.Sprintf("registry-%d.example.com", i%4)
+			cred, err := chain.ResolveCredentials(registry)
+			if err != nil || cred.Username != "ci" {
+				t.Errorf("ResolveCredentials(%s) = %+v, %v", registry, cred, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if len(chain.resolved) != 4 {
+		t.Errorf("resolved %d registries, want each of the 4 once", len(chain.resolved))
+	}
+}
@@ -0,0 +1,672 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type blobCheck struct {
+	once sync.Once
+	err  error
+}
+
+var (
+	blobChecksMu sync.Mutex
+	blobChecks   = map[string]*blobCheck{}
+)
+
+// forgetBlobChecks drops the blob and manifest content checks of the
+// run, so a later --watch sync checks the destinations again: a check
+// that failed is retried, and a blob deleted from a destination since is
+// pushed again
+func forgetBlobChecks() {
+	blobChecksMu.Lock()
+	blobChecks = map[string]*blobCheck{}
+	blobChecksMu.Unlock()
+	contentChecksMu.Lock()
+	contentChecks = map[string]*blobCheck{}
+	contentChecksMu.Unlock()
+}
+
+// copiedBlob is the repository a blob was copied to on a destination
+// registry. Its lock is held while the blob is copied, so other
+// repositories on the registry wait and mount it from there.
+type copiedBlob struct {
+	mu    sync.Mutex
+	image string
+}
+
+var (
+	copiedBlobsMu sync.Mutex
+	copiedBlobs   = map[string]*copiedBlob{}
+)
+
+// copiedBlobOn returns the record of the blob on dst's registry
+func copiedBlobOn(dst ImageRef, digest string) *copiedBlob {
+	key := dst.apiHost() + "/" + dst.apiPath() + "@" + digest
+	copiedBlobsMu.Lock()
+	defer copiedBlobsMu.Unlock()
+	c, ok := copiedBlobs[key]
+	if !ok {
+		c = &copiedBlob{}
+		copiedBlobs[key] = c
+	}
+	return c
+}
+
+func blobExists(ref ImageRef, digest string) (bool, error) {
+	st, err := statBlob(ref, digest)
+	return st != nil, err
+}
+
+// blobStat is what a registry reports about a blob in reply to a HEAD
+// request: its Content-Length, or -1, and its Docker-Content-Digest
+type blobStat struct {
+	size   int64
+	digest string
+}
+
+// statBlob returns what the registry reports about the blob in ref's
+// repository, or nil if the repository does not have it
+func statBlob(ref ImageRef, digest string) (*blobStat, error) {
+	l := log.WithFields(log.Fields{
+		"package":  "main",
+		"fn":       "statBlob",
+		"registry": ref.Registry,
+		"image":    ref.Image,
+		"digest":   digest,
+	})
+	l.Debug("Checking blob existence")
+	defer metrics.observe("blob_check", ref.Registry, time.Now())
+	req, err := http.NewRequest("HEAD", ref.apiURL("blobs", digest), nil)
+	if err != nil {
+		l.Error("Error creating request: ", err)
+		return nil, err
+	}
+	if err := authorize(req, ref); err != nil {
+		l.Error("Error getting registry auth: ", err)
+		return nil, err
+	}
+	resp, err := registryDo(req, ref.authProvider())
+	if err != nil {
+		l.Error("Error checking blob: ", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return &blobStat{size: resp.ContentLength, digest: resp.Header.Get("Docker-Content-Digest")}, nil
+	case http.StatusNotFound:
+		return nil, nil
+	}
+	l.Error("Error checking blob: ", resp.Status)
+	return nil, errors.New(resp.Status)
+}
+
+// openBlob opens the blob in ref's repository for reading
+func openBlob(ref ImageRef, digest string) (io.ReadCloser, error) {
+	l := log.WithFields(log.Fields{
+		"package":  "main",
+		"fn":       "openBlob",
+		"registry": ref.Registry,
+		"image":    ref.Image,
+		"digest":   digest,
+	})
+	l.Debug("Opening blob")
+	req, err := http.NewRequest("GET", ref.apiURL("blobs", digest), nil)
+	if err != nil {
+		l.Error("Error creating request: ", err)
+		return nil, err
+	}
+	if err := authorize(req, ref); err != nil {
+		l.Error("Error getting registry auth: ", err)
+		return nil, err
+	}
+	resp, err := registryDo(req, ref.authProvider())
+	if err != nil {
+		l.Error("Error getting blob: ", err)
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		l.Error("Error getting blob: ", resp.Status)
+		return nil, errors.New(resp.Status)
+	}
+	if VerifyBlobs != "" {
+		return verifyingReadCloser{newVerifyingReader(resp.Body, Descriptor{Digest: digest}).in(ref.Repository()), resp.Body}, nil
+	}
+	return resp.Body, nil
+}
+
+// uploadLocation resolves the Location header of a blob upload response
+func uploadLocation(resp *http.Response) (*url.URL, error) {
+	loc := resp.Header.Get("Location")
+	if loc == "" {
+		return nil, errors.New("registry did not return an upload location")
+	}
+	return resp.Request.URL.Parse(loc)
+}
+
+// startUpload starts a blob upload session in ref's repository. query may
+// request a cross repository mount, in which case mounted is true when the
+// registry completed the mount instead of starting an upload.
+func startUpload(ref ImageRef, query url.Values) (loc *url.URL, mounted bool, err error) {
+	l := log.WithFields(log.Fields{
+		"package":  "main",
+		"fn":       "startUpload",
+		"registry": ref.Registry,
+		"image":    ref.Image,
+	})
+	u := ref.apiURL("blobs", "uploads", "")
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest("POST", u, nil)
+	if err != nil {
+		l.Error("Error creating request: ", err)
+		return nil, false, err
+	}
+	if err := authorize(req, ref); err != nil {
+		l.Error("Error getting registry auth: ", err)
+		return nil, false, err
+	}
+	resp, err := registryDo(req, ref.authProvider())
+	if query.Get("mount") != "" {
+		audit("blob_mount", ref, ref.Repository(), query.Get("mount"), resp, err)
+	}
+	if err != nil {
+		l.Error("Error starting upload: ", err)
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return nil, true, nil
+	case http.StatusAccepted:
+		loc, err := uploadLocation(resp)
+		return loc, false, err
+	}
+	bd := readErrorBody(resp.Body)
+	l.Error("Error starting upload: ", resp.Status, " ", logBody(bd))
+	return nil, false, pushError(ref, resp, bd)
+}
+
+// finishUpload completes an upload session by sending the remaining size
+// bytes of content with the final PUT
+func finishUpload(ref ImageRef, loc *url.URL, desc Descriptor, r io.Reader, size int64) error {
+	l := log.WithFields(log.Fields{
+		"package":  "main",
+		"fn":       "finishUpload",
+		"registry": ref.Registry,
+		"image":    ref.Image,
+		"digest":   desc.Digest,
+	})
+	q := loc.Query()
+	q.Set("digest", desc.Digest)
+	u := *loc
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequest("PUT", u.String(), r)
+	if err != nil {
+		l.Error("Error creating request: ", err)
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if err := authorize(req, ref); err != nil {
+		l.Error("Error getting registry auth: ", err)
+		return err
+	}
+	resp, err := registryDo(req, ref.authProvider())
+	audit("blob_upload", ref, ref.Repository(), desc.Digest, resp, err)
+	if err != nil {
+		l.Error("Error uploading blob: ", err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		bd := readErrorBody(resp.Body)
+		l.Error("Error uploading blob: ", resp.Status, " ", logBody(bd))
+		return pushError(ref, resp, bd)
+	}
+	return nil
+}
+
+// uploadStatus queries how much of an interrupted upload the registry
+// has committed, returning the current upload location and the offset to
+// continue from
+func uploadStatus(ref ImageRef, loc *url.URL) (*url.URL, int64, error) {
+	l := log.WithFields(log.Fields{
+		"package":  "main",
+		"fn":       "uploadStatus",
+		"registry": ref.Registry,
+		"image":    ref.Image,
+	})
+	req, err := http.NewRequest("GET", loc.String(), nil)
+	if err != nil {
+		l.Error("Error creating request: ", err)
+		return nil, 0, err
+	}
+	if err := authorize(req, ref); err != nil {
+		l.Error("Error getting registry auth: ", err)
+		return nil, 0, err
+	}
+	resp, err := registryDo(req, ref.authProvider())
+	if err != nil {
+		l.Error("Error getting upload status: ", err)
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		l.Error("Error getting upload status: ", resp.Status)
+		return nil, 0, errors.New(resp.Status)
+	}
+	next, err := uploadLocation(resp)
+	if err != nil {
+		next = loc
+	}
+	offset, err := parseUploadRange(resp.Header.Get("Range"))
+	if err != nil {
+		l.Error("Error parsing upload range: ", err)
+		return nil, 0, err
+	}
+	return next, offset, nil
+}
+
+// parseUploadRange returns the offset following the committed range of
+// an upload, given as "0-<last>"
+func parseUploadRange(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	_, last, ok := strings.Cut(strings.TrimPrefix(s, "bytes="), "-")
+	if !ok {
+		return 0, fmt.Errorf("invalid range %q", s)
+	}
+	n, err := strconv.ParseInt(last, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid range %q", s)
+	}
+	return n + 1, nil
+}
+
+// uploadChunk sends chunk, which starts at offset start of the blob, with
+// a PATCH. If the request fails the upload status is queried and only the
+// part of the chunk the registry has not committed is sent again, up to
+// Retries times.
+func uploadChunk(ref ImageRef, loc *url.URL, chunk []byte, start int64, stats *transferStats) (*url.URL, error) {
+	l := log.WithFields(log.Fields{
+		"package":  "main",
+		"fn":       "uploadChunk",
+		"registry": ref.Registry,
+		"image":    ref.Image,
+		"offset":   start,
+	})
+	var sent int64
+	for attempt := 0; ; attempt++ {
+		err := func() error {
+			body := chunk[sent:]
+			req, err := http.NewRequest("PATCH", loc.String(), bytes.NewReader(body))
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Content-Type", "application/octet-stream")
+			req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", start+sent, start+int64(len(chunk))-1))
+			if err := authorize(req, ref); err != nil {
+				return err
+			}
+			resp, err := registryDo(req, ref.authProvider())
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusAccepted {
+				return fmt.Errorf("%s %s", resp.Status, logBody(readErrorBody(resp.Body)))
+			}
+			next, err := uploadLocation(resp)
+			if err != nil {
+				return err
+			}
+			loc = next
+			sent = int64(len(chunk))
+			return nil
+		}()
+		if err == nil {
+			return loc, nil
+		}
+		if attempt >= Retries {
+			l.Error("Error uploading chunk: ", err)
+			return nil, err
+		}
+		l.Warn("Error uploading chunk, resuming: ", err)
+		stats.addRetry()
+		metrics.add("upload_retries", ref.Registry, 1)
+		time.Sleep(time.Duration(attempt+1) * time.Second)
+		next, offset, serr := uploadStatus(ref, loc)
+		if serr != nil {
+			continue
+		}
+		if offset < start || offset > start+int64(len(chunk)) {
+			return nil, fmt.Errorf("cannot resume upload: registry has %d bytes, expected between %d and %d", offset, start, start+int64(len(chunk)))
+		}
+		loc, sent = next, offset-start
+		if sent == int64(len(chunk)) {
+			return loc, nil
+		}
+	}
+}
+
+// sendBlob sends the content of r to an upload session. Blobs up to
+// ChunkSize go in a single PUT; larger blobs are sent in chunks that can
+// be resumed when the connection drops.
+func sendBlob(ref ImageRef, loc *url.URL, desc Descriptor, r io.Reader, stats *transferStats) error {
+	r = newVerifyingReader(r, desc)
+	if ChunkSize <= 0 || desc.Size <= int64(ChunkSize) {
+		return finishUpload(ref, loc, desc, r, desc.Size)
+	}
+	buf := make([]byte, ChunkSize)
+	var offset int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		if n > 0 {
+			next, cerr := uploadChunk(ref, loc, buf[:n], offset, stats)
+			if cerr != nil {
+				return cerr
+			}
+			loc = next
+			offset += int64(n)
+		}
+		if err != nil {
+			break
+		}
+	}
+	return finishUpload(ref, loc, desc, nil, 0)
+}
+
+// uploadBlob uploads the content of r as the blob described by desc
+func uploadBlob(ref ImageRef, desc Descriptor, r io.Reader, stats *transferStats) error {
+	loc, _, err := startUpload(ref, nil)
+	if err != nil {
+		return err
+	}
+	return sendBlob(ref, loc, desc, r, stats)
+}
+
+// copyBlob copies the blob from the source to the destination repository,
+// mounting it instead when both live on the same registry or when it was
+// already copied to another repository on the destination registry
+func copyBlob(src imageSource, dst ImageRef, desc Descriptor, stats *transferStats) (err error) {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "copyBlob",
+		"source":  src.String(),
+		"dest":    dst.Repository(),
+		"digest":  desc.Digest,
+	})
+	defer metrics.observe("blob_copy", dst.Registry, time.Now())
+	sp := tracing.start("copy blob "+desc.Digest, stats.traceSpan())
+	sp.set("registry", dst.Registry)
+	sp.set("repository", dst.Image)
+	sp.set("digest", desc.Digest)
+	sp.set("bytes", desc.Size)
+	status := "copied"
+	defer func() {
+		if err != nil {
+			status = "failed"
+		}
+		sp.set("status", status)
+		sp.finish(err)
+	}()
+	var loc *url.URL
+	if rs, ok := baseRegistrySource(src); ok && rs.ref.apiHost() == dst.apiHost() && rs.ref.apiPath() == dst.apiPath() {
+		l.Debug("Mounting blob from ", rs.ref.Image)
+		var mounted bool
+		var err error
+		loc, mounted, err = startUpload(dst, url.Values{
+			"mount": {desc.Digest},
+			"from":  {rs.ref.Image},
+		})
+		if err != nil {
+			return err
+		}
+		if mounted {
+			l.Debug("Mounted blob")
+			metrics.add("blobs_mounted", dst.Registry, 1)
+			status = "mounted"
+			return verifyBlob(dst, desc)
+		}
+	}
+	copied := copiedBlobOn(dst, desc.Digest)
+	copied.mu.Lock()
+	defer copied.mu.Unlock()
+	if copied.image != "" && copied.image != dst.Image {
+		l.Debug("Mounting blob from ", copied.image)
+		next, mounted, err := startUpload(dst, url.Values{
+			"mount": {desc.Digest},
+			"from":  {copied.image},
+		})
+		if err != nil {
+			return err
+		}
+		if mounted {
+			l.Debug("Mounted blob")
+			metrics.add("blobs_mounted", dst.Registry, 1)
+			status = "mounted"
+			return verifyBlob(dst, desc)
+		}
+		loc = next
+	}
+	l.Debug("Copying blob")
+	rc, err := src.openBlob(desc)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	r, done := progress.track(desc, rc, stats)
+	defer done()
+	if loc == nil {
+		err = uploadBlob(dst, desc, r, stats)
+	} else {
+		err = sendBlob(dst, loc, desc, r, stats)
+	}
+	var mismatch *blobMismatchError
+	if errors.As(err, &mismatch) {
+		// the content failed its check while being read, not the upload
+		err = mismatch
+	}
+	if err == nil {
+		metrics.add("blob_bytes_copied", dst.Registry, desc.Size)
+		copied.image = dst.Image
+	}
+	return err
+}
+
+// ensureBlob makes sure the blob exists in the destination repository,
+// copying it from the source if it is missing. The work is done at most
+// once per repository and digest so fanning out to many tags in the same
+// repository only checks each blob once.
+func ensureBlob(src imageSource, dst ImageRef, desc Descriptor, stats *transferStats) error {
+	key := dst.Repository() + "@" + desc.Digest
+	blobChecksMu.Lock()
+	c, ok := blobChecks[key]
+	if !ok {
+		c = &blobCheck{}
+		blobChecks[key] = c
+	}
+	blobChecksMu.Unlock()
+	c.once.Do(func() {
+		st, err := statBlob(dst, desc.Digest)
+		if err != nil {
+			c.err = err
+			return
+		}
+		if st != nil {
+			c.err = checkBlobStat(dst, desc, st)
+			return
+		}
+		c.err = copyBlob(src, dst, desc, stats)
+	})
+	return c.err
+}
+
+var (
+	contentChecksMu sync.Mutex
+	// contentChecks are the manifests whose content was ensured in a
+	// destination repository, by repository and digest
+	contentChecks = map[string]*blobCheck{}
+)
+
+// ensureManifestContent runs ensureContent once per destination
+// repository and manifest digest. Tags that alias the same digest in a
+// repository, within a group or across groups, wait for the first to
+// copy the content and are then pushed with just a manifest PUT.
+func ensureManifestContent(src imageSource, m Manifest, dst ImageRef, stats *transferStats) error {
+	key := dst.Repository() + "@" + m.Digest()
+	contentChecksMu.Lock()
+	c, ok := contentChecks[key]
+	if !ok {
+		c = &blobCheck{}
+		contentChecks[key] = c
+	}
+	contentChecksMu.Unlock()
+	ran := false
+	c.once.Do(func() {
+		ran = true
+		c.err = ensureContent(src, m, dst, stats)
+	})
+	if !ran {
+		log.WithFields(log.Fields{
+			"package": "main",
+			"fn":      "ensureManifestContent",
+			"dest":    dst.String(),
+			"digest":  m.Digest(),
+		}).Debug("Content already ensured for another tag of the repository")
+	}
+	return c.err
+}
+
+// ensureContent makes sure every blob and child manifest referenced by the
+// manifest exists in the destination repository, so the manifest push does
+// not fail with an opaque BLOB_UNKNOWN or MANIFEST_UNKNOWN error
+func ensureContent(src imageSource, m Manifest, dst ImageRef, stats *transferStats) error {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "ensureContent",
+		"source":  src.String(),
+		"dest":    dst.Repository(),
+	})
+	l.Debug("Checking destination content")
+	if m.MediaType == mediaTypeSchema1Signed {
+		l.Debug("Skipping blob check for schema1 manifest")
+		return nil
+	}
+	if m.isIndex() {
+		for _, d := range m.Manifests {
+			exists, err := manifestExists(dst, d.Digest)
+			if err != nil {
+				return fmt.Errorf("checking manifest %s in %s: %w", d.Digest, dst.Repository(), err)
+			}
+			if exists {
+				continue
+			}
+			child, err := src.manifest(d.Digest)
+			if err != nil {
+				return fmt.Errorf("getting manifest %s from %s: %w", d.Digest, src, err)
+			}
+			if err := ensureContent(src, child, dst, stats); err != nil {
+				return err
+			}
+			if _, _, err := putManifest(dst, d.Digest, child); err != nil {
+				return fmt.Errorf("pushing manifest %s to %s: %w", d.Digest, dst.Repository(), err)
+			}
+		}
+		return nil
+	}
+	var missing []string
+	for _, b := range m.blobs() {
+		if b.Digest == "" {
+			continue
+		}
+		if skipExternal(b) {
+			l.Debug("Skipping layer ", b.Digest, " served from its urls")
+			continue
+		}
+		if err := ensureBlob(src, dst, b, stats); err != nil {
+			var notFound *repositoryNotFoundError
+			if errors.As(err, &notFound) {
+				return err
+			}
+			l.Error("Error ensuring blob: ", err)
+			missing = append(missing, fmt.Sprintf("%s (%v)", b.Digest, err))
+		}
+	}
+	if len(missing) > 0 {
+		l.Error("Missing blobs: ", missing)
+		return fmt.Errorf("repository %s is missing %d blob(s) referenced by %s that could not be copied: %s", dst.Repository(), len(missing), src, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// verifyingReader verifies the size and digest of the content read
+// through it, returning a *blobMismatchError instead of io.EOF on
+// mismatch
+type verifyingReader struct {
+	r    io.Reader
+	desc Descriptor
+	h    hash.Hash
+	n    int64
+	// repository is where the content is read from, named in errors
+	repository string
+}
+
+func newVerifyingReader(r io.Reader, desc Descriptor) *verifyingReader {
+	return &verifyingReader{r: r, desc: desc, h: sha256.New()}
+}
+
+// in sets the repository the content is read from
+func (v *verifyingReader) in(repository string) *verifyingReader {
+	v.repository = repository
+	return v
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	v.n += int64(n)
+	if err == io.EOF {
+		if v.desc.Size > 0 && v.n != v.desc.Size {
+			return n, &blobMismatchError{
+				Digest:     v.desc.Digest,
+				Repository: v.repository,
+				Check:      "size",
+				Detail:     fmt.Sprintf("content is %d bytes, expected %d", v.n, v.desc.Size),
+			}
+		}
+		if strings.HasPrefix(v.desc.Digest, "sha256:") {
+			if got := "sha256:" + hex.EncodeToString(v.h.Sum(nil)); got != v.desc.Digest {
+				return n, &blobMismatchError{
+					Digest:     v.desc.Digest,
+					Repository: v.repository,
+					Check:      "digest",
+					Detail:     "content has digest " + got,
+				}
+			}
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestForgetBlobChecksRetriesFailedChecks(t *testing.T) {
+	r := newTestRegistry(t)
+	content := []byte("layer")
+	digest := r.putBlob(content)
+	failing := true
+	r.hook = func(w http.ResponseWriter, req *http.Request) bool {
+		if failing && req.Method == "HEAD" && strings.HasSuffix(req.URL.Path, "/blobs/"+digest) {
+			w.WriteHeader(http.StatusInternalServerError)
+			return true
+		}
+		return false
+	}
+	dst := r.ref(t, "watched", "1.0")
+	desc := Descriptor{MediaType: mediaTypeOCILayer, Digest: digest, Size: int64(len(content))}
+	if err := ensureBlob(nil, dst, desc, nil); err == nil {
+		t.Fatal("ensureBlob passed while the registry failed the blob check")
+	}
+	failing = false
+	if err := ensureBlob(nil, dst, desc, nil); err == nil {
+		t.Fatal("ensureBlob checked the blob again within a sync")
+	}
+	forgetBlobChecks()
+	if err := ensureBlob(nil, dst, desc, nil); err != nil {
+		t.Errorf("ensureBlob after forgetBlobChecks = %v, want the blob checked again", err)
+	}
+}
+
+// chunkedUpload sets a chunk size of 1 KiB and returns a 3000 byte blob,
+// which goes in three chunks
+func chunkedUpload(t *testing.T) ([]byte, Descriptor) {
+	t.Helper()
+	chunkSize, retries := ChunkSize, Retries
+	ChunkSize, Retries = 1024, 1
+	t.Cleanup(func() { ChunkSize, Retries = chunkSize, retries })
+	content := bytes.Repeat([]byte("0123456789"), 300)
+	return content, Descriptor{MediaType: mediaTypeOCILayer, Digest: digestOf(content), Size: int64(len(content))}
+}
+
+func TestUploadBlobChunked(t *testing.T) {
+	content, desc := chunkedUpload(t)
+	r := newTestRegistry(t)
+	var ranges []string
+	r.hook = func(w http.ResponseWriter, req *http.Request) bool {
+		if req.Method == "PATCH" {
+			ranges = append(ranges, req.Header.Get("Content-Range"))
+		}
+		return false
+	}
+	if err := uploadBlob(r.ref(t, "app", "1.0"), desc, bytes.NewReader(content), nil); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"0-1023", "1024-2047", "2048-2999"}; fmt.Sprint(ranges) != fmt.Sprint(want) {
+		t.Errorf("chunks sent with Content-Range %q, want %q", ranges, want)
+	}
+	if got := r.blobs[desc.Digest]; !bytes.Equal(got, content) {
+		t.Errorf("registry has %d bytes of the blob, want the %d sent", len(got), len(content))
+	}
+}
+
+func TestUploadBlobChunkedResumesAfterConnectionLoss(t *testing.T) {
+	content, desc := chunkedUpload(t)
+	r := newTestRegistry(t)
+	var ranges []string
+	killed := false
+	r.hook = func(w http.ResponseWriter, req *http.Request) bool {
+		if req.Method != "PATCH" {
+			return false
+		}
+		ranges = append(ranges, req.Header.Get("Content-Range"))
+		if killed || len(ranges) != 2 {
+			return false
+		}
+		// commit part of the second chunk, then drop the connection
+		killed = true
+		part := make([]byte, 300)
+		if _, err := io.ReadFull(req.Body, part); err != nil {
+			t.Error(err)
+		}
+		id := req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:]
+		r.mu.Lock()
+		r.uploads[id] = append(r.uploads[id], part...)
+		r.mu.Unlock()
+		if conn, _, err := w.(http.Hijacker).Hijack(); err == nil {
+			conn.Close()
+		} else {
+			t.Error(err)
+		}
+		return true
+	}
+	if err := uploadBlob(r.ref(t, "app", "1.0"), desc, bytes.NewReader(content), nil); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"0-1023", "1024-2047", "1324-2047", "2048-2999"}; fmt.Sprint(ranges) != fmt.Sprint(want) {
+		t.Errorf("chunks sent with Content-Range %q, want %q: the rest of the chunk after the committed range", ranges, want)
+	}
+	status := false
+	for _, req := range r.requested() {
+		status = status || strings.HasPrefix(req, "GET /v2/app/blobs/uploads/")
+	}
+	if !status {
+		t.Error("the upload status was not queried before resuming")
+	}
+	if got := r.blobs[desc.Digest]; !bytes.Equal(got, content) {
+		t.Errorf("registry has %d bytes of the blob after resuming, want the %d sent", len(got), len(content))
+	}
+}
+
+func TestParseUploadRange(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"", 0, true},
+		{"0-1023", 1024, true},
+		{"bytes=0-99", 100, true},
+		{"1023", 0, false},
+		{"0-x", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseUploadRange(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseUploadRange(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+// patternReader returns size bytes of a repeating pattern
+func patternReader(size int64) io.Reader {
+	return io.LimitReader(&repeatReader{pattern: []byte("docker-retag streams blobs\n")}, size)
+}
+
+type repeatReader struct {
+	pattern []byte
+	off     int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = r.pattern[r.off]
+		r.off = (r.off + 1) % len(r.pattern)
+	}
+	return len(p), nil
+}
+
+func TestCopyBlobStreams(t *testing.T) {
+	const size = 64 << 20
+	h := sha256.New()
+	io.Copy(h, patternReader(size))
+	desc := Descriptor{MediaType: mediaTypeOCILayer, Digest: "sha256:" + hex.EncodeToString(h.Sum(nil)), Size: size}
+	chunkSize := ChunkSize
+	ChunkSize = 0
+	defer func() { ChunkSize = chunkSize }()
+
+	source := newTestRegistry(t)
+	source.hook = func(w http.ResponseWriter, req *http.Request) bool {
+		if req.URL.Path != "/v2/src/blobs/"+desc.Digest {
+			return false
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(size))
+		io.Copy(w, patternReader(size))
+		return true
+	}
+	var received string
+	dest := newTestRegistry(t)
+	dest.hook = func(w http.ResponseWriter, req *http.Request) bool {
+		if req.Method != "PUT" || !strings.Contains(req.URL.Path, "/blobs/uploads/") {
+			return false
+		}
+		h := sha256.New()
+		io.Copy(h, req.Body)
+		received = "sha256:" + hex.EncodeToString(h.Sum(nil))
+		w.Header().Set("Docker-Content-Digest", received)
+		w.WriteHeader(http.StatusCreated)
+		return true
+	}
+	src, err := newImageSource(source.host + "/src:1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	if err := copyBlob(src, dest.ref(t, "app", "1.0"), desc, nil); err != nil {
+		t.Fatal(err)
+	}
+	runtime.ReadMemStats(&after)
+	if received != desc.Digest {
+		t.Errorf("destination received %s, want %s", received, desc.Digest)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 8<<20 {
+		t.Errorf("copying a %s blob allocated %s, want it streamed", formatBytes(size), formatBytes(int64(allocated)))
+	}
+}
+
+func TestReadErrorBodyIsBounded(t *testing.T) {
+	bd := readErrorBody(patternReader(10 << 20))
+	if len(bd) != maxErrorBody {
+		t.Errorf("readErrorBody read %d bytes, want %d", len(bd), maxErrorBody)
+	}
+	if got := logBody(bd); len(got) > maxLoggedBody+64 || !strings.HasSuffix(got, fmt.Sprintf("(%d bytes truncated)", maxErrorBody-maxLoggedBody)) {
+		t.Errorf("logBody returned %d bytes ending in %q, want it cut at %d", len(got), got[len(got)-30:], maxLoggedBody)
+	}
+	if got := logBody([]byte("short")); got != "short" {
+		t.Errorf("logBody of a short body = %q", got)
+	}
+}
+
+// pushIndexFixture stores an index of two images with a config and a
+// layer each in repo, tagged tag, and returns its digest
+func pushIndexFixture(t *testing.T, r *testRegistry, repo, tag string) string {
+	t.Helper()
+	var entries []string
+	for i, arch := range []string{"amd64", "arm64"} {
+		config := []byte(fmt.Sprintf(`{"architecture":%q,"os":"linux"}`, arch))
+		layer := []byte(fmt.Sprintf("layer %d", i))
+		body := []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"config":{"mediaType":%q,"digest":%q,"size":%d},"layers":[{"mediaType":%q,"digest":%q,"size":%d}]}`,
+			mediaTypeOCIManifest, mediaTypeOCIConfig, r.putBlob(config), len(config), mediaTypeOCILayer, r.putBlob(layer), len(layer)))
+		digest := r.putManifest(repo, digestOf(body), mediaTypeOCIManifest, body)
+		entries = append(entries, fmt.Sprintf(`{"mediaType":%q,"digest":%q,"size":%d,"platform":{"os":"linux","architecture":%q}}`, mediaTypeOCIManifest, digest, len(body), arch))
+	}
+	index := []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"manifests":[%s]}`, mediaTypeOCIIndex, strings.Join(entries, ",")))
+	return r.putManifest(repo, tag, mediaTypeOCIIndex, index)
+}
+
+func TestEnsureManifestContentOncePerDigest(t *testing.T) {
+	forgetBlobChecks()
+	t.Cleanup(forgetBlobChecks)
+	source := newTestRegistry(t)
+	pushIndexFixture(t, source, "src", "1.0")
+	dest := newTestRegistry(t)
+	src, err := newImageSource(source.host + "/src:1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := src.root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := []string{"a", "b", "c", "d"}
+	var destinations []string
+	for _, tag := range tags {
+		destinations = append(destinations, dest.host+"/app:"+tag)
+	}
+	jobs := newJobQueue(len(tags), destinations)
+	for i, d := range destinations {
+		jobs.push(UploadJob{Index: i, Manifest: m, Src: src, Source: source.host + "/src:1.0", Image: d})
+	}
+	jobs.close()
+	results := make(chan UploadResult, len(destinations))
+	var wg sync.WaitGroup
+	for range tags {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			manifestUploadWorker(newCredentialChain(Credential{}), jobs, results)
+		}()
+	}
+	wg.Wait()
+	close(results)
+	for res := range results {
+		if res.Err != nil {
+			t.Fatalf("%s: %v", res.Destination, res.Err)
+		}
+	}
+
+	counts := map[string]int{}
+	for _, req := range dest.requested() {
+		method, path, _ := strings.Cut(req, " ")
+		switch {
+		case strings.HasPrefix(path, "/v2/app/manifests/sha256:"):
+			counts[method+" child manifest"]++
+		case strings.HasPrefix(path, "/v2/app/manifests/"):
+			counts[method+" tag"]++
+		case strings.HasPrefix(path, "/v2/app/blobs/uploads/") && method == "POST":
+			counts["blob upload"]++
+		case strings.HasPrefix(path, "/v2/app/blobs/"):
+			counts[method+" blob"]++
+		}
+	}
+	want := map[string]int{
+		// each child manifest is checked and pushed once, not per tag
+		"HEAD child manifest": 2,
+		"PUT child manifest":  2,
+		"blob upload":         4,
+		"PUT tag":             4,
+	}
+	for k, n := range want {
+		if counts[k] != n {
+			t.Errorf("destination received %d %s requests, want %d (all: %v)", counts[k], k, n, counts)
+		}
+	}
+	if counts["HEAD blob"] > 4 {
+		t.Errorf("destination received %d blob checks for 4 blobs", counts["HEAD blob"])
+	}
+}
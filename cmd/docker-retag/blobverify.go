@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// VerifyBlobs is the --verify-blobs mode: empty when off, fail or warn
+var VerifyBlobs blobVerifyFlag
+
+// blobMismatchError is a blob whose content, or what a registry reports
+// about it, does not match its descriptor
+type blobMismatchError struct {
+	Digest string
+	// Repository holds the blob, empty if it was not read from a registry
+	Repository string
+	// Check is the check that failed: the digest or size of the content
+	// read, or the content-length or docker-content-digest reported
+	Check  string
+	Detail string
+}
+
+func (e *blobMismatchError) Error() string {
+	if e.Repository == "" {
+		return fmt.Sprintf("blob %s failed the %s check: %s", e.Digest, e.Check, e.Detail)
+	}
+	return fmt.Sprintf("blob %s in %s failed the %s check: %s", e.Digest, e.Repository, e.Check, e.Detail)
+}
+
+// verifyingReadCloser verifies blob content read from a registry and
+// closes the response body it reads
+type verifyingReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// checkBlobStat compares what the registry reported about a blob that
+// was not copied, as it was already in ref's repository or was mounted,
+// with its descriptor. A content-length differing from the descriptor
+// size, or a docker-content-digest differing from its digest, fails the
+// blob with --verify-blobs and is logged with --verify-blobs=warn.
+func checkBlobStat(ref ImageRef, desc Descriptor, st *blobStat) error {
+	if VerifyBlobs == "" {
+		return nil
+	}
+	var err *blobMismatchError
+	switch {
+	case st.size >= 0 && desc.Size > 0 && st.size != desc.Size:
+		err = &blobMismatchError{Check: "content-length", Detail: fmt.Sprintf("registry reports %d bytes, expected %d", st.size, desc.Size)}
+	case st.digest != "" && st.digest != desc.Digest:
+		err = &blobMismatchError{Check: "docker-content-digest", Detail: "registry reports digest " + st.digest}
+	default:
+		return nil
+	}
+	err.Digest = desc.Digest
+	err.Repository = ref.Repository()
+	if VerifyBlobs == "warn" {
+		log.WithFields(log.Fields{
+			"package":    "main",
+			"fn":         "checkBlobStat",
+			"repository": err.Repository,
+			"digest":     err.Digest,
+			"check":      err.Check,
+		}).Warn(err)
+		return nil
+	}
+	return err
+}
+
+// verifyBlob checks a blob mounted into ref's repository with
+// --verify-blobs, which needs a HEAD request as the mount response does
+// not include the size
+func verifyBlob(ref ImageRef, desc Descriptor) error {
+	if VerifyBlobs == "" {
+		return nil
+	}
+	st, err := statBlob(ref, desc.Digest)
+	if err != nil {
+		return err
+	}
+	if st == nil {
+		return fmt.Errorf("blob %s is not in %s after it was mounted", desc.Digest, ref.Repository())
+	}
+	return checkBlobStat(ref, desc, st)
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// checkRepository is the repository check asks for a pull token for when
+// none is given. It need not exist, as token services issue tokens for
+// repositories the caller cannot see, only granting no access.
+const checkRepository = "docker-retag/check"
+
+// RegistryCheck is the outcome of checking a single registry
+type RegistryCheck struct {
+	Registry   string `json:"registry"`
+	Repository string `json:"repository"`
+	OK         bool   `json:"ok"`
+	// Optional is set for registries given with --optional, whose failure
+	// does not fail the check
+	Optional bool `json:"optional,omitempty"`
+	// Identity is the user the credentials are for, or anonymous
+	Identity string `json:"identity"`
+	// Auth is how the registry authenticates: none, basic or bearer
+	Auth       string `json:"auth,omitempty"`
+	APIVersion string `json:"api_version,omitempty"`
+	// Pulled is set when the tags of the repository were listed
+	Pulled bool `json:"pulled"`
+	// LatencyMS is how long GET /v2/ took
+	LatencyMS int64 `json:"latency_ms"`
+	// Step is the step that failed: credentials, dns, connect, tls, api,
+	// auth or scope
+	Step  string `json:"step,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// fail records that step failed with err
+func (c *RegistryCheck) fail(step string, err error) *RegistryCheck {
+	c.Step, c.Error = step, err.Error()
+	return c
+}
+
+// checkCmd checks that each registry can be reached and authenticated to
+// with the credentials docker-retag would use, without pushing anything.
+// It exits 0 if every registry not given with --optional passes, 1 if any
+// fails and 2 on a usage error.
+func checkCmd(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	jsonOut := fs.Bool("json", OutputFormat == "json", "Print the results as JSON")
+	repository := fs.String("repository", "", "Repository to request a pull token for and list the tags of, for registries given without one; by default a token is requested for "+checkRepository+" and no tags are listed")
+	var optional stringListFlag
+	fs.Var(&optional, "optional", "Registry whose failure is reported but does not fail the check (repeatable)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s check [--json] [--repository <repository>] [--optional <registry>] <registry>[/<repository>] ...\n", commandName())
+		fs.PrintDefaults()
+	}
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return 2
+	}
+	if len(positional) == 0 {
+		fs.Usage()
+		return 2
+	}
+	code := 0
+	var results []*RegistryCheck
+	for _, arg := range positional {
+		host, repo, explicit := strings.Cut(arg, "/")
+		if !explicit && *repository != "" {
+			repo, explicit = *repository, true
+		}
+		if !explicit {
+			repo = checkRepository
+		}
+		var c *RegistryCheck
+		if !validHost(host) {
+			c = (&RegistryCheck{Registry: host, Repository: repo}).fail("dns", fmt.Errorf("%q is not a valid registry host", host))
+		} else {
+			ref, err := urlToImageTag(host + "/" + repo)
+			if err != nil {
+				c = (&RegistryCheck{Registry: host, Repository: repo}).fail("scope", err)
+			} else {
+				c = checkRegistry(ref, explicit)
+			}
+		}
+		c.Optional = matchRegistry(optional, host)
+		c.OK = c.Error == ""
+		if !c.OK && !c.Optional {
+			code = 1
+		}
+		results = append(results, c)
+		if !*jsonOut {
+			printRegistryCheck(c)
+		}
+	}
+	if *jsonOut {
+		jd, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			return 1
+		}
+		fmt.Println(string(jd))
+	}
+	return code
+}
+
+// printRegistryCheck prints a line for the result of checking a registry
+func printRegistryCheck(c *RegistryCheck) {
+	switch {
+	case !c.OK && c.Optional:
+		fmt.Printf("warn %s: %s: %s\n", c.Registry, c.Step, c.Error)
+		return
+	case !c.OK:
+		fmt.Printf("FAIL %s: %s: %s\n", c.Registry, c.Step, c.Error)
+		return
+	}
+	details := []string{"anonymous"}
+	if c.Identity != "anonymous" {
+		details[0] = "authenticated as " + c.Identity
+	}
+	switch c.Auth {
+	case "bearer":
+		details = append(details, "pull token for "+c.Repository)
+	case "basic":
+		details = append(details, "basic auth")
+	default:
+		details = append(details, "no auth required")
+	}
+	if c.Pulled {
+		details = append(details, "can pull "+c.Repository)
+	}
+	details = append(details, "API "+c.APIVersion, fmt.Sprintf("%dms", c.LatencyMS))
+	fmt.Printf("ok   %s: %s\n", c.Registry, strings.Join(details, ", "))
+}
+
+// checkRegistry resolves the credentials for the registry of ref, probes
+// its API and authenticates for pull on the repository of ref. With
+// listTags, the tags of the repository are listed to check that the
+// credentials can read it, which for a repository that was not given
+// would fail even with valid ones.
+func checkRegistry(ref ImageRef, listTags bool) *RegistryCheck {
+	l := log.WithFields(log.Fields{
+		"package":  "main",
+		"fn":       "checkRegistry",
+		"registry": ref.Registry,
+	})
+	c := &RegistryCheck{Registry: ref.Registry, Repository: ref.Image, Identity: "anonymous"}
+	auth := ref.authProvider()
+	cred, err := auth.ResolveCredentials(ref.Registry)
+	if err != nil {
+		return c.fail("credentials", err)
+	}
+	switch {
+	case cred.IdentityToken != "":
+		c.Identity = cred.Username + " (identity token)"
+	case cred.Username != "":
+		c.Identity = cred.Username
+	}
+	root := ref.apiRoot()
+	req, err := http.NewRequest("GET", root, nil)
+	if err != nil {
+		return c.fail("connect", err)
+	}
+	// behind a proxy the proxy resolves the host
+	if proxy, err := http.ProxyFromEnvironment(req); err == nil && proxy == nil {
+		host := req.URL.Hostname()
+		if net.ParseIP(host) == nil {
+			if _, err := net.LookupHost(host); err != nil {
+				return c.fail(unreachable(ref.Registry, err))
+			}
+		}
+	}
+	l.Debug("Probing registry API")
+	start := time.Now()
+	resp, err := followRedirects(req)
+	c.LatencyMS = time.Since(start).Milliseconds()
+	if err != nil {
+		return c.fail(unreachable(ref.Registry, err))
+	}
+	resp.Body.Close()
+	c.APIVersion = resp.Header.Get("Docker-Distribution-Api-Version")
+	switch {
+	case c.APIVersion != "" && c.APIVersion != registryAPIVersion:
+		return c.fail("api", fmt.Errorf("registry %s reports API version %q, docker-retag needs %s", ref.Registry, c.APIVersion, registryAPIVersion))
+	case notRegistryAPI(resp):
+		return c.fail("api", fmt.Errorf("%s does not implement the Docker Registry v2 API, GET %s returned %s", ref.Registry, root, resp.Status))
+	case resp.StatusCode == http.StatusOK:
+		c.Auth = "none"
+	case resp.StatusCode != http.StatusUnauthorized:
+		return c.fail("api", fmt.Errorf("%s does not implement the Docker Registry v2 API, GET %s returned %s", ref.Registry, root, resp.Status))
+	}
+	if c.APIVersion == "" {
+		c.APIVersion = "unknown"
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	if resp.StatusCode == http.StatusUnauthorized {
+		scheme, _, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+		switch strings.ToLower(scheme) {
+		case "bearer":
+			c.Auth = "bearer"
+			ch, ok := parseBearerChallenge(challenge)
+			if !ok {
+				return c.fail("auth", fmt.Errorf("registry %s sent a bearer challenge without a realm: %s", ref.Registry, challenge))
+			}
+			tokens.setChallenge(req.URL.Host, ch)
+			scope := "repository:" + ref.Image + ":pull"
+			if _, err := tokens.token(req.URL.Host, scope, auth); err != nil {
+				return c.fail("auth", fmt.Errorf("requesting a token with pull scope on %s as %s: %w", ref.Image, c.Identity, err))
+			}
+		case "basic":
+			c.Auth = "basic"
+			if err := checkBasicAuth(root, cred); err != nil {
+				return c.fail("auth", fmt.Errorf("registry %s rejected %s: %w", ref.Registry, c.Identity, err))
+			}
+		default:
+			return c.fail("auth", fmt.Errorf("registry %s asks for unsupported authentication %q", ref.Registry, scheme))
+		}
+	}
+	if !listTags {
+		return c
+	}
+	if err := checkPull(ref); err != nil {
+		return c.fail("scope", err)
+	}
+	c.Pulled = true
+	return c
+}
+
+// checkBasicAuth sends GET /v2/ with the credential as basic auth
+func checkBasicAuth(root string, cred Credential) error {
+	basic := cred.basicAuth()
+	if basic == "" {
+		return fmt.Errorf("the registry requires credentials and none were found")
+	}
+	req, err := http.NewRequest("GET", root, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Basic "+basic)
+	resp, err := followRedirects(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %s", root, resp.Status)
+	}
+	return nil
+}
+
+// checkPull lists a single tag of the repository of ref, the cheapest
+// request needing pull access to it
+func checkPull(ref ImageRef) error {
+	req, err := http.NewRequest("GET", ref.apiURL("tags", "list")+"?n=1", nil)
+	if err != nil {
+		return err
+	}
+	if err := authorize(req, ref); err != nil {
+		return err
+	}
+	resp, err := authorizedDo(req, ref.authProvider())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return fmt.Errorf("repository %s does not exist or is not visible to the credentials", ref.Repository())
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fmt.Errorf("the credentials do not grant pull on %s: %s", ref.Repository(), resp.Status)
+	}
+	return fmt.Errorf("listing the tags of %s: %s", ref.Repository(), resp.Status)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// NoCIAuth disables the CI job token credentials, for runs that want
+// anonymous access where no other credentials are found
+var NoCIAuth bool
+
+// gitLabRegistry is the container registry of gitlab.com
+const gitLabRegistry = "registry.gitlab.com"
+
+// ciCredentials returns the job token credentials CI systems provide for
+// their own registries: CI_JOB_TOKEN for the GitLab registry, also a
+// self-hosted one named by CI_REGISTRY, and GITHUB_ACTOR and GITHUB_TOKEN
+// for ghcr.io. It returns empty credentials outside such a job.
+func ciCredentials(registry string) (string, string, string) {
+	host := strings.ToLower(canonicalHost(registry))
+	if token := os.Getenv("CI_JOB_TOKEN"); token != "" {
+		if host == gitLabRegistry || (os.Getenv("CI_REGISTRY") != "" && host == strings.ToLower(canonicalHost(os.Getenv("CI_REGISTRY")))) {
+			return "gitlab-ci-token", token, "CI_JOB_TOKEN"
+		}
+	}
+	if host == "ghcr.io" && os.Getenv("GITHUB_ACTOR") != "" && os.Getenv("GITHUB_TOKEN") != "" {
+		return os.Getenv("GITHUB_ACTOR"), os.Getenv("GITHUB_TOKEN"), "GITHUB_TOKEN"
+	}
+	return "", "", ""
+}
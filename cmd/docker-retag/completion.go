@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// completeTagsCmd is the hidden subcommand completion scripts call
+	// to complete tag names for the repository typed so far
+	completeTagsCmd = "__complete-tags"
+	// completeTagsTimeout bounds tag lookups so completion never hangs
+	completeTagsTimeout = 3 * time.Second
+)
+
+// fileFlags take a path as their value and complete file names
+var fileFlags = map[string]bool{
+	"notify-token-file": true,
+	"audit-log":         true,
+	"report":            true,
+	"resume":            true,
+	"metrics-file":      true,
+	"config":            true,
+	"password-file":     true,
+	"dest-file":         true,
+	"events-file":       true,
+}
+
+type completionFlag struct {
+	Name   string
+	Usage  string
+	IsBool bool
+	IsFile bool
+}
+
+// completionFlags introspects the flag set for completion generation
+func completionFlags(fs *flag.FlagSet) []completionFlag {
+	var flags []completionFlag
+	fs.VisitAll(func(f *flag.Flag) {
+		cf := completionFlag{
+			Name:   f.Name,
+			Usage:  f.Usage,
+			IsFile: fileFlags[f.Name],
+		}
+		if bf, ok := f.Value.(interface{ IsBoolFlag() bool }); ok {
+			cf.IsBool = bf.IsBoolFlag()
+		}
+		flags = append(flags, cf)
+	})
+	return flags
+}
+
+// dashed returns the flag as it is usually typed
+func (f completionFlag) dashed() string {
+	if len(f.Name) == 1 {
+		return "-" + f.Name
+	}
+	return "--" + f.Name
+}
+
+func subcommandArgs(args string) []string {
+	return strings.FieldsFunc(args, func(r rune) bool { return r == '|' || r == ' ' })
+}
+
+func bashCompletion(fs *flag.FlagSet) string {
+	var flags, files, cmds []string
+	for _, f := range completionFlags(fs) {
+		flags = append(flags, f.dashed())
+		if f.IsFile {
+			files = append(files, f.dashed())
+		}
+	}
+	var b strings.Builder
+	b.WriteString("# bash completion for docker-retag\n")
+	b.WriteString("_docker_retag() {\n")
+	b.WriteString("    local cur prev\n")
+	b.WriteString("    if declare -F _get_comp_words_by_ref >/dev/null; then\n")
+	b.WriteString("        _get_comp_words_by_ref -n : cur prev\n")
+	b.WriteString("    else\n")
+	b.WriteString("        cur=\"${COMP_WORDS[COMP_CWORD]}\"\n")
+	b.WriteString("        prev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n")
+	b.WriteString("    fi\n")
+	if len(files) > 0 {
+		fmt.Fprintf(&b, "    case \"$prev\" in\n    %s)\n", strings.Join(files, "|"))
+		b.WriteString("        COMPREPLY=( $(compgen -f -- \"$cur\") )\n        return\n        ;;\n")
+		for _, c := range subcommands {
+			fmt.Fprintf(&b, "    %s)\n        COMPREPLY=( $(compgen -W \"%s\" -- \"$cur\") )\n        return\n        ;;\n", c.Name, strings.Join(subcommandArgs(c.Args), " "))
+		}
+		b.WriteString("    esac\n")
+	}
+	b.WriteString("    case \"$cur\" in\n")
+	fmt.Fprintf(&b, "    -*)\n        COMPREPLY=( $(compgen -W \"%s\" -- \"$cur\") )\n        ;;\n", strings.Join(flags, " "))
+	fmt.Fprintf(&b, "    *:*)\n        COMPREPLY=( $(docker-retag %s \"$cur\" 2>/dev/null) )\n", completeTagsCmd)
+	b.WriteString("        declare -F __ltrim_colon_completions >/dev/null && __ltrim_colon_completions \"$cur\"\n        ;;\n")
+	for _, c := range subcommands {
+		cmds = append(cmds, c.Name)
+	}
+	fmt.Fprintf(&b, "    *)\n        COMPREPLY=( $(compgen -W \"%s\" -- \"$cur\") )\n        ;;\n", strings.Join(cmds, " "))
+	b.WriteString("    esac\n")
+	b.WriteString("}\n")
+	b.WriteString("complete -F _docker_retag docker-retag\n")
+	return b.String()
+}
+
+func zshEscape(s string) string {
+	r := strings.NewReplacer("'", `'\''`, "[", `\[`, "]", `\]`, ":", `\:`)
+	return r.Replace(s)
+}
+
+func zshCompletion(fs *flag.FlagSet) string {
+	var b strings.Builder
+	b.WriteString("#compdef docker-retag\n\n")
+	b.WriteString("_docker_retag_args() {\n")
+	b.WriteString("  if [[ $PREFIX == *:* ]]; then\n")
+	b.WriteString("    local -a tags\n")
+	fmt.Fprintf(&b, "    tags=(${(f)\"$(docker-retag %s \"$PREFIX\" 2>/dev/null)\"})\n", completeTagsCmd)
+	b.WriteString("    compadd -U -- $tags\n")
+	b.WriteString("    return\n")
+	b.WriteString("  fi\n")
+	b.WriteString("  case ${words[CURRENT-1]} in\n")
+	var cmds []string
+	for _, c := range subcommands {
+		fmt.Fprintf(&b, "    %s) compadd %s ;;\n", c.Name, strings.Join(subcommandArgs(c.Args), " "))
+		cmds = append(cmds, c.Name)
+	}
+	fmt.Fprintf(&b, "    *) compadd %s ;;\n", strings.Join(cmds, " "))
+	b.WriteString("  esac\n")
+	b.WriteString("}\n\n")
+	b.WriteString("_docker_retag() {\n")
+	b.WriteString("  _arguments -s \\\n")
+	for _, f := range completionFlags(fs) {
+		spec := fmt.Sprintf("'%s[%s]", f.dashed(), zshEscape(f.Usage))
+		switch {
+		case f.IsFile:
+			spec += ":file:_files"
+		case !f.IsBool:
+			spec += ":value: "
+		}
+		fmt.Fprintf(&b, "    %s' \\\n", spec)
+	}
+	b.WriteString("    '*:image:_docker_retag_args'\n")
+	b.WriteString("}\n\n")
+	b.WriteString("_docker_retag \"$@\"\n")
+	return b.String()
+}
+
+func fishEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s)
+}
+
+func fishCompletion(fs *flag.FlagSet) string {
+	var b strings.Builder
+	b.WriteString("# fish completion for docker-retag\n")
+	b.WriteString("complete -c docker-retag -f\n")
+	for _, f := range completionFlags(fs) {
+		opt := "-l " + f.Name
+		if len(f.Name) == 1 {
+			opt = "-s " + f.Name
+		}
+		extra := ""
+		switch {
+		case f.IsFile:
+			extra = " -r -F"
+		case !f.IsBool:
+			extra = " -r"
+		}
+		fmt.Fprintf(&b, "complete -c docker-retag %s -d '%s'%s\n", opt, fishEscape(f.Usage), extra)
+	}
+	var cmds []string
+	for _, c := range subcommands {
+		cmds = append(cmds, c.Name)
+		fmt.Fprintf(&b, "complete -c docker-retag -n '__fish_seen_subcommand_from %s' -a '%s'\n", c.Name, strings.Join(subcommandArgs(c.Args), " "))
+	}
+	fmt.Fprintf(&b, "complete -c docker-retag -n 'not __fish_seen_subcommand_from %s' -a '%s'\n", strings.Join(cmds, " "), strings.Join(cmds, " "))
+	fmt.Fprintf(&b, "complete -c docker-retag -a '(docker-retag %s (commandline -ct) 2>/dev/null)'\n", completeTagsCmd)
+	return b.String()
+}
+
+// completionCmd prints the completion script for the requested shell
+func completionCmd(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: docker-retag completion bash|zsh|fish")
+		return 1
+	}
+	switch args[0] {
+	case "bash":
+		fmt.Print(bashCompletion(dockerRetagFlags))
+	case "zsh":
+		fmt.Print(zshCompletion(dockerRetagFlags))
+	case "fish":
+		fmt.Print(fishCompletion(dockerRetagFlags))
+	default:
+		fmt.Fprintf(os.Stderr, "unsupported shell %q, expected bash, zsh or fish\n", args[0])
+		return 1
+	}
+	return 0
+}
+
+// completeTags prints repository:tag candidates for a partially typed
+// reference. Errors are silent so completion degrades to no suggestions.
+func completeTags(args []string) int {
+	if len(args) != 1 {
+		return 1
+	}
+	word := args[0]
+	i := strings.LastIndex(word, ":")
+	if i < 0 || i < strings.LastIndex(word, "/") {
+		return 0
+	}
+	repo, prefix := word[:i], word[i+1:]
+	ref, err := urlToImageTag(repo)
+	if err != nil {
+		return 0
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), completeTagsTimeout)
+	defer cancel()
+	tags, err := listTags(ctx, ref)
+	if err != nil {
+		return 0
+	}
+	sort.Strings(tags)
+	for _, t := range tags {
+		if strings.HasPrefix(t, prefix) {
+			fmt.Println(repo + ":" + t)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultConfigFile = ".docker-retag.yaml"
+
+// RegistryConfig holds per-registry settings from the config file
+type RegistryConfig struct {
+	Insecure     bool
+	CAFile       string
+	Username     string
+	Password     string
+	PasswordFile string
+	PasswordEnv  string
+	// RateLimit is the maximum number of requests per second, 0 is unlimited
+	RateLimit float64
+	// ProtectedTags are tag patterns that may only be overwritten with
+	// --allow-protected
+	ProtectedTags []string
+}
+
+// Config is the parsed config file
+type Config struct {
+	Path       string
+	Flags      map[string]interface{}
+	Registries map[string]*RegistryConfig
+}
+
+// FileConfig is the config loaded at startup, empty when no file exists
+var FileConfig = &Config{
+	Flags:      map[string]interface{}{},
+	Registries: map[string]*RegistryConfig{},
+}
+
+// configPath returns the config file given with --config in args, or the
+// default path in the home directory. explicit is true if the user chose the path.
+func configPath(args []string) (path string, explicit bool) {
+	for i, a := range args {
+		if a == "--" {
+			break
+		}
+		name := strings.TrimLeft(a, "-")
+		if !strings.HasPrefix(a, "-") || (name != "config" && !strings.HasPrefix(name, "config=")) {
+			continue
+		}
+		if v := strings.TrimPrefix(name, "config="); v != name {
+			return v, true
+		}
+		if i+1 < len(args) {
+			return args[i+1], true
+		}
+	}
+	return processEnv.configFilePath(), false
+}
+
+// loadConfig reads the config file at path. A missing file is only an
+// error if the path was given explicitly.
+func loadConfig(path string, explicit bool) (*Config, error) {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "loadConfig",
+		"path":    path,
+	})
+	l.Debug("Loading config")
+	c := &Config{
+		Path:       path,
+		Flags:      map[string]interface{}{},
+		Registries: map[string]*RegistryConfig{},
+	}
+	bd, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		l.Debug("Config file not found")
+		c.Path = ""
+		return c, nil
+	}
+	if err != nil {
+		l.Error("Error reading config: ", err)
+		return nil, err
+	}
+	doc, err := parseYAML(bd)
+	if err != nil {
+		l.Error("Error parsing config: ", err)
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for k, v := range doc {
+		if k != "registries" {
+			c.Flags[k] = v
+			continue
+		}
+		regs, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s: registries must be a mapping of registry host to settings", path)
+		}
+		for host, rv := range regs {
+			rc, err := parseRegistryConfig(host, rv)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			c.Registries[host] = rc
+		}
+	}
+	return c, nil
+}
+
+func parseRegistryConfig(host string, v interface{}) (*RegistryConfig, error) {
+	l := log.WithFields(log.Fields{
+		"package":  "main",
+		"fn":       "parseRegistryConfig",
+		"registry": host,
+	})
+	rc := &RegistryConfig{}
+	if v == "" {
+		return rc, nil
+	}
+	settings, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("registries.%s must be a mapping", host)
+	}
+	for k, sv := range settings {
+		if k == "protected-tags" {
+			var tags stringListFlag
+			switch tv := sv.(type) {
+			case string:
+				tags.Set(tv)
+			case []interface{}:
+				for _, e := range tv {
+					tags.Set(fmt.Sprint(e))
+				}
+			}
+			rc.ProtectedTags = tags
+			continue
+		}
+		s, ok := sv.(string)
+		if !ok {
+			return nil, fmt.Errorf("registries.%s.%s must be a scalar", host, k)
+		}
+		var err error
+		switch k {
+		case "insecure":
+			rc.Insecure, err = strconv.ParseBool(s)
+		case "ca-file":
+			rc.CAFile = s
+		case "username":
+			rc.Username = s
+		case "password":
+			rc.Password = s
+		case "password-file":
+			rc.PasswordFile = s
+		case "password-env":
+			rc.PasswordEnv = s
+		case "rate-limit":
+			rc.RateLimit, err = strconv.ParseFloat(s, 64)
+		default:
+			l.Warnf("Unknown config key registries.%s.%s", host, k)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("registries.%s.%s: %w", host, k, err)
+		}
+	}
+	return rc, nil
+}
+
+// applyFlags sets flag defaults from the config file. It must be called
+// before the command line is parsed so that flags take precedence.
+func (c *Config) applyFlags(fs *flag.FlagSet) error {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "applyFlags",
+	})
+	for k, v := range c.Flags {
+		if k == "config" || fs.Lookup(k) == nil {
+			l.Warnf("Unknown config key %s", k)
+			continue
+		}
+		var values []string
+		switch tv := v.(type) {
+		case string:
+			values = []string{tv}
+		case []interface{}:
+			for _, e := range tv {
+				values = append(values, fmt.Sprint(e))
+			}
+		case map[string]interface{}:
+			for mk, mv := range tv {
+				values = append(values, fmt.Sprintf("%s=%v", mk, mv))
+			}
+		}
+		for _, value := range values {
+			if err := fs.Set(k, value); err != nil {
+				return fmt.Errorf("%s: %s: %w", c.Path, k, err)
+			}
+		}
+	}
+	return nil
+}
+
+// envFlags are flags that can also be set from the environment, which
+// replaces any value from the config file
+var envFlags = map[string]string{
+	"allowed-registries": "DOCKER_RETAG_ALLOWED_REGISTRIES",
+	"denied-registries":  "DOCKER_RETAG_DENIED_REGISTRIES",
+	"default-registry":   "DOCKER_RETAG_DEFAULT_REGISTRY",
+}
+
+// applyEnvFlags sets flag defaults from the environment. It must be
+// called after applyFlags and before the command line is parsed.
+func applyEnvFlags(fs *flag.FlagSet) error {
+	for name, env := range envFlags {
+		v, ok := os.LookupEnv(env)
+		if !ok {
+			continue
+		}
+		if lf, ok := fs.Lookup(name).Value.(*stringListFlag); ok {
+			*lf = nil
+		}
+		if err := fs.Set(name, v); err != nil {
+			return fmt.Errorf("%s: %w", env, err)
+		}
+	}
+	return nil
+}
+
+// registry returns the settings for the registry host, or nil
+func (c *Config) registry(host string) *RegistryConfig {
+	if rc, ok := c.Registries[host]; ok {
+		return rc
+	}
+	for k, rc := range c.Registries {
+		if canonicalHost(k) == canonicalHost(host) || (isDockerHub(k) && isDockerHub(host)) {
+			return rc
+		}
+	}
+	return nil
+}
+
+// protectedTags returns the protected tag patterns configured for the
+// repository. Settings may be given for a registry host or for a
+// repository path below it, such as registry.example.com/team/app.
+func (c *Config) protectedTags(ref ImageRef) []string {
+	var patterns []string
+	if rc := c.registry(ref.Registry); rc != nil {
+		patterns = append(patterns, rc.ProtectedTags...)
+	}
+	repo := strings.TrimPrefix(ref.Repository(), ref.Registry+"/")
+	for k, rc := range c.Registries {
+		host, path, ok := strings.Cut(k, "/")
+		if !ok || canonicalHost(host) != canonicalHost(ref.Registry) {
+			continue
+		}
+		if repo == path || strings.HasPrefix(repo, path+"/") {
+			patterns = append(patterns, rc.ProtectedTags...)
+		}
+	}
+	return patterns
+}
+
+// credentials resolves the username and password configured for the registry
+func (rc *RegistryConfig) credentials() (string, string, error) {
+	if rc == nil || rc.Username == "" {
+		return "", "", nil
+	}
+	switch {
+	case rc.Password != "":
+		return rc.Username, rc.Password, nil
+	case rc.PasswordEnv != "":
+		return rc.Username, os.Getenv(rc.PasswordEnv), nil
+	case rc.PasswordFile != "":
+		bd, err := ioutil.ReadFile(rc.PasswordFile)
+		if err != nil {
+			return "", "", err
+		}
+		return rc.Username, strings.TrimSpace(string(bd)), nil
+	}
+	return rc.Username, "", nil
+}
+
+// secretFlags are masked when printing the effective configuration
+var secretFlags = map[string]bool{
+	"p": true,
+}
+
+func mask(s string) string {
+	if s == "" {
+		return ""
+	}
+	return "********"
+}
+
+// configShow prints the effective configuration after merging the config
+// file, environment and flags, with secrets masked
+func configShow(fs *flag.FlagSet) {
+	if FileConfig.Path != "" {
+		fmt.Printf("config: %s\n", strconv.Quote(FileConfig.Path))
+	}
+	fmt.Println("flags:")
+	fs.VisitAll(func(f *flag.Flag) {
+		v := f.Value.String()
+		if secretFlags[f.Name] {
+			v = mask(v)
+		}
+		fmt.Printf("  %s: %s\n", f.Name, strconv.Quote(v))
+	})
+	var env []string
+	for _, e := range []string{"DOCKER_RETAG_USERNAME", "DOCKER_RETAG_PASSWORD", "DOCKER_USER", "DOCKER_PASS", "DOCKER_RETAG_ALLOWED_REGISTRIES", "DOCKER_RETAG_DENIED_REGISTRIES", "DOCKER_RETAG_AUDIT_LOG", "INSECURE_REGISTRY", "LOG_LEVEL"} {
+		if v, ok := os.LookupEnv(e); ok {
+			if e == "DOCKER_PASS" || e == "DOCKER_RETAG_PASSWORD" {
+				v = mask(v)
+			}
+			env = append(env, fmt.Sprintf("  %s: %s", e, strconv.Quote(v)))
+		}
+	}
+	if len(env) > 0 {
+		fmt.Println("env:")
+		fmt.Println(strings.Join(env, "\n"))
+	}
+	if len(FileConfig.Registries) == 0 {
+		return
+	}
+	fmt.Println("registries:")
+	var hosts []string
+	for h := range FileConfig.Registries {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+	for _, h := range hosts {
+		rc := FileConfig.Registries[h]
+		fmt.Printf("  %s:\n", strconv.Quote(h))
+		fmt.Printf("    insecure: %t\n", rc.Insecure || registryProtocol(h) == "http")
+		if rc.CAFile != "" {
+			fmt.Printf("    ca-file: %s\n", strconv.Quote(rc.CAFile))
+		}
+		if rc.Username != "" {
+			fmt.Printf("    username: %s\n", strconv.Quote(rc.Username))
+		}
+		if rc.Password != "" {
+			fmt.Printf("    password: %s\n", strconv.Quote(mask(rc.Password)))
+		}
+		if rc.PasswordFile != "" {
+			fmt.Printf("    password-file: %s\n", strconv.Quote(rc.PasswordFile))
+		}
+		if rc.PasswordEnv != "" {
+			fmt.Printf("    password-env: %s\n", strconv.Quote(rc.PasswordEnv))
+		}
+		if rc.RateLimit > 0 {
+			fmt.Printf("    rate-limit: %g\n", rc.RateLimit)
+		}
+		if len(rc.ProtectedTags) > 0 {
+			fmt.Printf("    protected-tags: %s\n", strconv.Quote(strings.Join(rc.ProtectedTags, ",")))
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	mediaTypeDockerConfig = "application/vnd.docker.container.image.v1+json"
+	mediaTypeDockerLayer  = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	mediaTypeOCIConfig    = "application/vnd.oci.image.config.v1+json"
+	mediaTypeOCILayer     = "application/vnd.oci.image.layer.v1.tar+gzip"
+)
+
+// formatMediaTypes maps media types to their equivalent in each manifest
+// format. Media types without an equivalent cannot be converted.
+var formatMediaTypes = map[string]map[string]string{
+	"oci": {
+		mediaTypeSchema2:      mediaTypeOCIManifest,
+		mediaTypeManifestList: mediaTypeOCIIndex,
+		mediaTypeDockerConfig: mediaTypeOCIConfig,
+		mediaTypeDockerLayer:  mediaTypeOCILayer,
+		mediaTypeOCIManifest:  mediaTypeOCIManifest,
+		mediaTypeOCIIndex:     mediaTypeOCIIndex,
+		mediaTypeOCIConfig:    mediaTypeOCIConfig,
+		mediaTypeOCILayer:     mediaTypeOCILayer,
+	},
+	"docker": {
+		mediaTypeOCIManifest:  mediaTypeSchema2,
+		mediaTypeOCIIndex:     mediaTypeManifestList,
+		mediaTypeOCIConfig:    mediaTypeDockerConfig,
+		mediaTypeOCILayer:     mediaTypeDockerLayer,
+		mediaTypeSchema2:      mediaTypeSchema2,
+		mediaTypeManifestList: mediaTypeManifestList,
+		mediaTypeDockerConfig: mediaTypeDockerConfig,
+		mediaTypeDockerLayer:  mediaTypeDockerLayer,
+	},
+}
+
+// convertingSource serves the manifests of another source converted to
+// the docker or oci format. Only the media types change, so blobs are
+// read from the underlying source as they are, while converted child
+// manifests are served by their new digest.
+type convertingSource struct {
+	imageSource
+	format string
+
+	mu        sync.Mutex
+	converted map[string]Manifest
+}
+
+// newConvertingSource converts the manifests of src to format, docker or
+// oci
+func newConvertingSource(src imageSource, format string) *convertingSource {
+	return &convertingSource{
+		imageSource: src,
+		format:      format,
+		converted:   map[string]Manifest{},
+	}
+}
+
+func (s *convertingSource) root() (Manifest, error) {
+	m, err := s.imageSource.root()
+	if err != nil {
+		return m, err
+	}
+	return s.convert(m)
+}
+
+func (s *convertingSource) manifest(reference string) (Manifest, error) {
+	s.mu.Lock()
+	m, ok := s.converted[reference]
+	s.mu.Unlock()
+	if ok {
+		return m, nil
+	}
+	m, err := s.imageSource.manifest(reference)
+	if err != nil {
+		return m, err
+	}
+	return s.convert(m)
+}
+
+func (s *convertingSource) openBlob(desc Descriptor) (io.ReadCloser, error) {
+	return s.imageSource.openBlob(desc)
+}
+
+func (s *convertingSource) unwrap() imageSource {
+	return s.imageSource
+}
+
+// convertMediaType returns the equivalent of mediaType in the target
+// format, failing if the conversion would lose information
+func (s *convertingSource) convertMediaType(mediaType string) (string, error) {
+	if (Descriptor{MediaType: mediaType}).nonDistributable() {
+		return "", fmt.Errorf("cannot convert foreign layer %s to %s format without changing how it is distributed", mediaType, s.format)
+	}
+	converted, ok := formatMediaTypes[s.format][mediaType]
+	if !ok {
+		return "", fmt.Errorf("cannot convert media type %q to %s format", mediaType, s.format)
+	}
+	return converted, nil
+}
+
+// setMediaType converts the mediaType field of a raw descriptor,
+// returning whether it changed
+func (s *convertingSource) setMediaType(d map[string]json.RawMessage) (bool, error) {
+	var mediaType string
+	if err := json.Unmarshal(d["mediaType"], &mediaType); err != nil {
+		return false, fmt.Errorf("descriptor without media type: %w", err)
+	}
+	converted, err := s.convertMediaType(mediaType)
+	if err != nil || converted == mediaType {
+		return false, err
+	}
+	d["mediaType"], err = json.Marshal(converted)
+	return true, err
+}
+
+// convert returns m in the target format, or m itself if it already is.
+// The manifest is edited as raw JSON so other fields are kept. Manifests
+// of an index are converted too, and the index refers to them by their
+// new digests.
+func (s *convertingSource) convert(m Manifest) (Manifest, error) {
+	if m.isSchema1(m.ContentType) {
+		return m, fmt.Errorf("schema1 manifests cannot be converted to %s format", s.format)
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(m.Raw, &doc); err != nil {
+		return m, err
+	}
+	if s.format == "docker" {
+		for _, field := range []string{"subject", "artifactType"} {
+			if _, ok := doc[field]; ok {
+				return m, fmt.Errorf("manifest has a %s, which the docker format cannot represent", field)
+			}
+		}
+	}
+	mediaType := m.MediaType
+	if mediaType == "" {
+		mediaType = m.ContentType
+	}
+	converted, err := s.convertMediaType(mediaType)
+	if err != nil {
+		return m, err
+	}
+	changed := converted != mediaType
+	if changed {
+		doc["mediaType"], _ = json.Marshal(converted)
+	}
+	field := "layers"
+	if m.isIndex() {
+		field = "manifests"
+	} else {
+		var config map[string]json.RawMessage
+		if err := json.Unmarshal(doc["config"], &config); err != nil {
+			return m, fmt.Errorf("manifest without config: %w", err)
+		}
+		c, err := s.setMediaType(config)
+		if err != nil {
+			return m, err
+		}
+		if c {
+			changed = true
+			if doc["config"], err = json.Marshal(config); err != nil {
+				return m, err
+			}
+		}
+	}
+	var descriptors []map[string]json.RawMessage
+	if err := json.Unmarshal(doc[field], &descriptors); err != nil {
+		return m, err
+	}
+	for i, d := range descriptors {
+		if !m.isIndex() {
+			c, err := s.setMediaType(d)
+			if err != nil {
+				return m, err
+			}
+			changed = changed || c
+			continue
+		}
+		digest := m.Manifests[i].Digest
+		child, err := s.imageSource.manifest(digest)
+		if err != nil {
+			return m, fmt.Errorf("getting manifest %s: %w", digest, err)
+		}
+		if child, err = s.convert(child); err != nil {
+			return m, fmt.Errorf("converting manifest %s: %w", digest, err)
+		}
+		if child.Digest() == digest {
+			continue
+		}
+		changed = true
+		d["mediaType"], _ = json.Marshal(child.MediaType)
+		d["digest"], _ = json.Marshal(child.Digest())
+		d["size"], _ = json.Marshal(len(child.Raw))
+	}
+	if !changed {
+		return m, nil
+	}
+	if doc[field], err = json.Marshal(descriptors); err != nil {
+		return m, err
+	}
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return m, err
+	}
+	out, err := parseManifest(raw, converted)
+	if err != nil {
+		return m, err
+	}
+	s.mu.Lock()
+	s.converted[out.Digest()] = out
+	s.mu.Unlock()
+	return out, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// createdFlag is --reset-created, an RFC 3339 time or now. now is the
+// time the flag is parsed, so every image of the run gets the same time.
+type createdFlag struct {
+	raw  string
+	time time.Time
+}
+
+func (f *createdFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.raw
+}
+
+func (f *createdFlag) Set(s string) error {
+	if strings.EqualFold(s, "now") {
+		f.raw, f.time = s, time.Now().UTC().Truncate(time.Second)
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return fmt.Errorf("expected an RFC 3339 time such as 2024-01-02T15:04:05Z or now, got %q", s)
+	}
+	f.raw, f.time = s, t.UTC()
+	return nil
+}
+
+// isSet reports whether --reset-created was given
+func (f *createdFlag) isSet() bool {
+	return f.raw != ""
+}
+
+// isNow reports whether --reset-created is now, which plan files cannot
+// record as the time changes at apply
+func (f *createdFlag) isNow() bool {
+	return strings.EqualFold(f.raw, "now")
+}
+
+// newCreatedSource sets the created time of the image configs of src, and
+// with history that of every history entry
+func newCreatedSource(src imageSource, created time.Time, history bool) *configSource {
+	return newConfigSource(src, "given a created time", func(doc map[string]json.RawMessage) error {
+		return setCreated(doc, created, history)
+	})
+}
+
+// setCreated sets the created time of the config document doc, and with
+// history of the history entries that have one
+func setCreated(doc map[string]json.RawMessage, created time.Time, history bool) error {
+	ts, err := json.Marshal(created.Format(time.RFC3339Nano))
+	if err != nil {
+		return err
+	}
+	doc["created"] = ts
+	raw, ok := doc["history"]
+	if !history || !ok || string(raw) == "null" {
+		return nil
+	}
+	var entries []map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		return fmt.Errorf("decoding history: %w", err)
+	}
+	for _, e := range entries {
+		if _, ok := e["created"]; ok {
+			e["created"] = ts
+		}
+	}
+	doc["history"], err = json.Marshal(entries)
+	return err
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// fdCredentials are the credentials read from --creds-fd by registry
+// host, set once in main before any request is made
+var fdCredentials map[string]Credential
+
+// fdCredential is a registry entry of the --creds-fd document
+type fdCredential struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Token is an identity token, as docker login stores for SSO logins
+	Token string `json:"token"`
+}
+
+// readCredentialsFD reads the --creds-fd document from the inherited file
+// descriptor fd and zeroes the bytes read once they are parsed. The
+// document maps registry hosts to a username and password or a token.
+func readCredentialsFD(fd int) (map[string]Credential, error) {
+	if fd < 0 || fd == 1 || fd == 2 {
+		return nil, fmt.Errorf("--creds-fd %d is not a descriptor credentials can be read from, use another descriptor such as 3", fd)
+	}
+	f := os.NewFile(uintptr(fd), "creds")
+	if f == nil {
+		return nil, fmt.Errorf("--creds-fd %d is not open", fd)
+	}
+	defer f.Close()
+	bd, err := ioutil.ReadAll(f)
+	defer zero(bd)
+	if err != nil {
+		return nil, fmt.Errorf("reading --creds-fd %d: %w", fd, err)
+	}
+	return parseCredentials(bd)
+}
+
+// parseCredentials parses a --creds-fd document. Errors give the line and
+// column of the problem, but never the document, which holds secrets.
+func parseCredentials(bd []byte) (map[string]Credential, error) {
+	var doc map[string]fdCredential
+	d := json.NewDecoder(bytes.NewReader(bd))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&doc); err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &syntaxErr):
+			line, col := lineColumn(bd, syntaxErr.Offset)
+			return nil, fmt.Errorf("--creds-fd line %d column %d: %s", line, col, syntaxErr.Error())
+		case errors.As(err, &typeErr):
+			line, col := lineColumn(bd, typeErr.Offset)
+			return nil, fmt.Errorf("--creds-fd line %d column %d: expected an object of registry hosts with username and password or token", line, col)
+		}
+		return nil, fmt.Errorf("--creds-fd: %w", err)
+	}
+	creds := map[string]Credential{}
+	for host, c := range doc {
+		switch {
+		case c.Token != "" && c.Password != "":
+			return nil, fmt.Errorf("--creds-fd entry %s has a password and a token, only one may be given", host)
+		case c.Token == "" && (c.Username == "" || c.Password == ""):
+			return nil, fmt.Errorf("--creds-fd entry %s needs a username and password or a token", host)
+		}
+		creds[host] = Credential{Username: c.Username, Password: c.Password, IdentityToken: c.Token}
+	}
+	return creds, nil
+}
+
+// credentialsFor returns the --creds-fd credentials of the registry,
+// stored under any of the names the docker config accepts for it
+func credentialsFor(creds map[string]Credential, registry string) (Credential, bool) {
+	for _, key := range dockerConfigKeys(registry) {
+		if c, ok := creds[key]; ok {
+			return c, true
+		}
+	}
+	return Credential{}, false
+}
+
+// lineColumn returns the line and column, counting from 1, of the byte
+// before offset in bd, which is where the json decoder reports an error
+func lineColumn(bd []byte, offset int64) (int, int) {
+	if offset > int64(len(bd)) {
+		offset = int64(len(bd))
+	}
+	if offset > 0 {
+		offset--
+	}
+	line, col := 1, 1
+	for _, c := range bd[:offset] {
+		if c == '\n' {
+			line++
+			col = 1
+			continue
+		}
+		col++
+	}
+	return line, col
+}
+
+// zero overwrites b, so secrets read into it do not stay in memory
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// dockerDaemonScheme prefixes source images read from the local docker
+	// daemon, such as docker-daemon:app:dev
+	dockerDaemonScheme = "docker-daemon:"
+	// defaultDockerHost is the Docker Engine API socket used when
+	// DOCKER_HOST is not set
+	defaultDockerHost = "unix:///var/run/docker.sock"
+	// mediaTypeOCILayerTar is an uncompressed layer, as the docker daemon
+	// exports them
+	mediaTypeOCILayerTar = "application/vnd.oci.image.layer.v1.tar"
+)
+
+// isLocalSource reports whether the source is read from the local machine
+// rather than a registry: an OCI layout or the docker daemon
+func isLocalSource(arg string) bool {
+	return strings.HasPrefix(arg, ociLayoutScheme) || strings.HasPrefix(arg, dockerDaemonScheme)
+}
+
+var (
+	daemonExportsMu sync.Mutex
+	// daemonExports are the images exported from the docker daemon in
+	// this run, by source argument, so an image is exported once
+	daemonExports = map[string]*dockerDaemonSource{}
+)
+
+// dockerDaemonSource reads an image exported from the docker daemon. The
+// export is converted into an OCI layout in a temporary directory that
+// is removed when the run ends.
+type dockerDaemonSource struct {
+	*ociLayoutSource
+	arg string
+}
+
+func (s *dockerDaemonSource) String() string {
+	return s.arg
+}
+
+// newDockerDaemonSource exports the image named in arg from the docker
+// daemon, or returns the export made earlier in the run
+func newDockerDaemonSource(arg string) (*dockerDaemonSource, error) {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "newDockerDaemonSource",
+		"arg":     arg,
+	})
+	daemonExportsMu.Lock()
+	defer daemonExportsMu.Unlock()
+	if s, ok := daemonExports[arg]; ok {
+		return s, nil
+	}
+	name := strings.TrimPrefix(arg, dockerDaemonScheme)
+	if name == "" {
+		return nil, fmt.Errorf("%s names no image", arg)
+	}
+	dir, err := ioutil.TempDir("", "docker-retag-daemon-")
+	if err != nil {
+		return nil, err
+	}
+	if err := exportDaemonImage(name, dir); err != nil {
+		os.RemoveAll(dir)
+		l.Error("Error exporting image from docker daemon: ", err)
+		return nil, err
+	}
+	layout, err := newOCILayoutSource(ociLayoutScheme + dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	s := &dockerDaemonSource{ociLayoutSource: layout, arg: arg}
+	daemonExports[arg] = s
+	return s, nil
+}
+
+// removeDaemonExports removes the temporary directories of the images
+// exported from the docker daemon
+func removeDaemonExports() {
+	daemonExportsMu.Lock()
+	defer daemonExportsMu.Unlock()
+	for arg, s := range daemonExports {
+		if err := os.RemoveAll(s.dir); err != nil {
+			log.WithFields(log.Fields{
+				"package": "main",
+				"fn":      "removeDaemonExports",
+				"dir":     s.dir,
+			}).Error("Error removing docker daemon export: ", err)
+		}
+		delete(daemonExports, arg)
+	}
+}
+
+// dockerEngineClient returns the client and base URL for the Docker
+// Engine API at DOCKER_HOST: a unix socket, or TCP with the TLS client
+// certificates in DOCKER_CERT_PATH when DOCKER_TLS_VERIFY is set. The
+// docker CLI does not need to be installed.
+func dockerEngineClient() (*http.Client, string, error) {
+	host := os.Getenv("DOCKER_HOST")
+	if host == "" {
+		host = defaultDockerHost
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, "", fmt.Errorf("parsing DOCKER_HOST %q: %w", host, err)
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		t.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}
+		return &http.Client{Transport: t}, "http://docker", nil
+	case "tcp":
+		if os.Getenv("DOCKER_TLS_VERIFY") == "" {
+			return &http.Client{Transport: t}, "http://" + u.Host, nil
+		}
+		certs := processEnv.dockerCertPath()
+		cert, err := tls.LoadX509KeyPair(filepath.Join(certs, "cert.pem"), filepath.Join(certs, "key.pem"))
+		if err != nil {
+			return nil, "", fmt.Errorf("loading docker client certificate from %s: %w", certs, err)
+		}
+		ca, err := ioutil.ReadFile(filepath.Join(certs, "ca.pem"))
+		if err != nil {
+			return nil, "", fmt.Errorf("reading docker CA from %s: %w", certs, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, "", fmt.Errorf("no certificates found in %s", filepath.Join(certs, "ca.pem"))
+		}
+		t.TLSClientConfig = &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: pool}
+		return &http.Client{Transport: t}, "https://" + u.Host, nil
+	}
+	return nil, "", fmt.Errorf("DOCKER_HOST %q is not supported, use a unix:// socket or tcp://", host)
+}
+
+// exportDaemonImage saves the image from the docker daemon and writes it
+// to dir as an OCI layout holding just that image
+func exportDaemonImage(name, dir string) error {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "exportDaemonImage",
+		"image":   name,
+	})
+	client, base, err := dockerEngineClient()
+	if err != nil {
+		return err
+	}
+	l.Debug("Exporting image from docker daemon at ", base)
+	resp, err := client.Get(base + "/images/" + url.PathEscape(name) + "/get")
+	if err != nil {
+		return fmt.Errorf("connecting to the docker daemon: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		bd := readErrorBody(resp.Body)
+		var e struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(bd, &e) == nil && e.Message != "" {
+			return fmt.Errorf("exporting %s from the docker daemon: %s", name, e.Message)
+		}
+		return fmt.Errorf("exporting %s from the docker daemon: %s", name, resp.Status)
+	}
+	extracted := filepath.Join(dir, "export")
+	links, err := extractImageTar(resp.Body, extracted)
+	if err != nil {
+		return fmt.Errorf("reading export of %s: %w", name, err)
+	}
+	m, err := layoutFromExport(extracted, links, dir)
+	if err != nil {
+		return fmt.Errorf("converting export of %s: %w", name, err)
+	}
+	l.Debugf("Exported %s as %s", name, m.Digest())
+	return os.RemoveAll(extracted)
+}
+
+// extractImageTar writes the regular files of a docker save archive to
+// dir and returns its symlinks, which docker save uses for layers shared
+// by several images, as cleaned archive paths
+func extractImageTar(r io.Reader, dir string) (map[string]string, error) {
+	links := map[string]string{}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return links, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := path.Clean(h.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return nil, fmt.Errorf("archive entry %q is outside the archive", h.Name)
+		}
+		switch h.Typeflag {
+		case tar.TypeSymlink:
+			links[name] = path.Join(path.Dir(name), h.Linkname)
+		case tar.TypeReg:
+			p := filepath.Join(dir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				return nil, err
+			}
+			f, err := os.Create(p)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return nil, err
+			}
+			if err := f.Close(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// layoutFromExport converts the first image of the docker save archive
+// extracted to src into an OCI image manifest with uncompressed layers,
+// written with its blobs to the OCI layout dir
+func layoutFromExport(src string, links map[string]string, dir string) (Manifest, error) {
+	bd, err := ioutil.ReadFile(filepath.Join(src, "manifest.json"))
+	if err != nil {
+		return Manifest{}, err
+	}
+	var images []struct {
+		Config string
+		Layers []string
+	}
+	if err := json.Unmarshal(bd, &images); err != nil {
+		return Manifest{}, fmt.Errorf("parsing manifest.json: %w", err)
+	}
+	if len(images) == 0 {
+		return Manifest{}, errors.New("manifest.json lists no images")
+	}
+	w := &ociLayoutWriter{dir: dir}
+	if err := os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0755); err != nil {
+		return Manifest{}, err
+	}
+	// files are moved into the layout, so layers listed twice are only
+	// moved the first time
+	moved := map[string]Descriptor{}
+	blob := func(name, mediaType string) (Descriptor, error) {
+		name = path.Clean(name)
+		for i := 0; i < 10; i++ {
+			target, ok := links[name]
+			if !ok {
+				break
+			}
+			name = target
+		}
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return Descriptor{}, fmt.Errorf("%q is outside the archive", name)
+		}
+		if desc, ok := moved[name]; ok {
+			return desc, nil
+		}
+		p := filepath.Join(src, filepath.FromSlash(name))
+		f, err := os.Open(p)
+		if err != nil {
+			return Descriptor{}, err
+		}
+		magic := make([]byte, 4)
+		n, _ := io.ReadFull(f, magic)
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			f.Close()
+			return Descriptor{}, err
+		}
+		h := sha256.New()
+		size, err := io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return Descriptor{}, err
+		}
+		desc := Descriptor{MediaType: mediaType, Digest: "sha256:" + hex.EncodeToString(h.Sum(nil)), Size: size}
+		if mediaType == mediaTypeOCILayerTar {
+			desc.MediaType = layerMediaType(magic[:n])
+		}
+		bp, err := w.blobPath(desc.Digest)
+		if err != nil {
+			return Descriptor{}, err
+		}
+		moved[name] = desc
+		if _, err := os.Stat(bp); err == nil {
+			return desc, nil
+		}
+		return desc, os.Rename(p, bp)
+	}
+	config, err := blob(images[0].Config, mediaTypeOCIConfig)
+	if err != nil {
+		return Manifest{}, err
+	}
+	m := Manifest{SchemaVersion: 2, MediaType: mediaTypeOCIManifest, Config: &config, Layers: []Descriptor{}}
+	for _, layer := range images[0].Layers {
+		d, err := blob(layer, mediaTypeOCILayerTar)
+		if err != nil {
+			return Manifest{}, err
+		}
+		m.Layers = append(m.Layers, d)
+	}
+	if m.Raw, err = json.Marshal(m); err != nil {
+		return Manifest{}, err
+	}
+	m.ContentType = mediaTypeOCIManifest
+	if err := w.writeManifest(m); err != nil {
+		return Manifest{}, err
+	}
+	return m, w.tagImage(m, "latest")
+}
+
+// layerMediaType returns the OCI media type of a layer from its first
+// bytes. The classic docker image store exports uncompressed layers, the
+// containerd image store the compressed blobs it pulled.
+func layerMediaType(magic []byte) string {
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return mediaTypeOCILayer
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return mediaTypeOCILayerTar + "+zstd"
+	}
+	return mediaTypeOCILayerTar
+}
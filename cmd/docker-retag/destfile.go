@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// destinationLine is a destination read from a --dest-file, with where it
+// came from for errors
+type destinationLine struct {
+	file string
+	line int
+	// raw is the line before --expand-env
+	raw string
+	ref string
+}
+
+func (d destinationLine) origin() string {
+	if d.raw != d.ref {
+		return fmt.Sprintf("%s line %d (%s)", d.file, d.line, d.raw)
+	}
+	return fmt.Sprintf("%s line %d", d.file, d.line)
+}
+
+// unsetVariablesError lists the variables a line of a --dest-file
+// references that are not set, which would otherwise expand to empty
+// tags or repositories
+type unsetVariablesError struct {
+	file      string
+	line      int
+	variables []string
+}
+
+func (e *unsetVariablesError) Error() string {
+	if len(e.variables) == 1 {
+		return fmt.Sprintf("%s line %d: environment variable %s is not set", e.file, e.line, e.variables[0])
+	}
+	return fmt.Sprintf("%s line %d: environment variables %s are not set", e.file, e.line, strings.Join(e.variables, ", "))
+}
+
+// readDestFile reads the destinations in path, one per line, or from
+// stdin if path is -. Blank lines and lines starting with # are skipped.
+// With expand, ${VAR} and $VAR are replaced with the value of the
+// environment variable, and $$ is a literal $. Every destination is
+// validated after expansion, so an error names the expanded reference
+// and the line it came from.
+func readDestFile(path string, expand bool, lookup func(string) (string, bool)) ([]destinationLine, error) {
+	var r io.Reader = os.Stdin
+	name := "stdin"
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+		name = path
+	}
+	var dests []destinationLine
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		raw := strings.TrimSpace(s.Text())
+		if raw == "" || strings.HasPrefix(raw, "#") {
+			continue
+		}
+		d := destinationLine{file: name, line: n, raw: raw, ref: raw}
+		if expand {
+			ref, unset, err := expandEnv(raw, lookup)
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d: %w", name, n, err)
+			}
+			if len(unset) > 0 {
+				return nil, &unsetVariablesError{file: name, line: n, variables: unset}
+			}
+			d.ref = ref
+		}
+		if err := validateDestination(strings.TrimPrefix(d.ref, optionalPrefix)); err != nil {
+			return nil, fmt.Errorf("destination %s from %s: %w", d.ref, d.origin(), err)
+		}
+		dests = append(dests, d)
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", name, err)
+	}
+	return dests, nil
+}
+
+// validateDestination makes the checks newPlan makes of a destination,
+// without its warnings, which are logged once the run is planned
+func validateDestination(ref string) error {
+	switch {
+	case strings.HasPrefix(ref, ociLayoutScheme):
+		return nil
+	case strings.HasPrefix(ref, dockerDaemonScheme):
+		return fmt.Errorf("%s images can only be a source", dockerDaemonScheme)
+	}
+	parsed, err := urlToImageTag(ref)
+	if err != nil {
+		return err
+	}
+	if err := parsed.checkPushable(); err != nil {
+		return err
+	}
+	if RequireExplicitTags && !hasExplicitTag(ref) {
+		return errors.New("no tag or digest, --require-explicit-tags does not allow defaulting to latest")
+	}
+	return nil
+}
+
+// expandEnv replaces ${VAR} and $VAR in s with the values lookup returns,
+// and $$ with $. It returns the variables that are not set instead of
+// expanding them to nothing. A $ not followed by a name is kept.
+func expandEnv(s string, lookup func(string) (string, bool)) (string, []string, error) {
+	var b strings.Builder
+	var unset []string
+	seen := map[string]bool{}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		var name string
+		switch {
+		case s[i+1] == '$':
+			b.WriteByte('$')
+			i++
+			continue
+		case s[i+1] == '{':
+			end := strings.IndexByte(s[i+2:], '}')
+			if end < 0 {
+				return "", nil, fmt.Errorf("unterminated ${ in %q", s)
+			}
+			name = s[i+2 : i+2+end]
+			if !isEnvName(name) {
+				return "", nil, fmt.Errorf("invalid variable name %q in %q", name, s)
+			}
+			i += 2 + end
+		default:
+			j := i + 1
+			for j < len(s) && isEnvNameByte(s[j], j == i+1) {
+				j++
+			}
+			if j == i+1 {
+				b.WriteByte('$')
+				continue
+			}
+			name = s[i+1 : j]
+			i = j - 1
+		}
+		v, ok := lookup(name)
+		if !ok && !seen[name] {
+			seen[name] = true
+			unset = append(unset, name)
+		}
+		b.WriteString(v)
+	}
+	return b.String(), unset, nil
+}
+
+// isEnvName reports whether name is a shell variable name
+func isEnvName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isEnvNameByte(name[i], i == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+func isEnvNameByte(c byte, first bool) bool {
+	switch {
+	case c == '_', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		return true
+	case c >= '0' && c <= '9':
+		return !first
+	}
+	return false
+}
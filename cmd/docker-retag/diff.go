@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// imageConfig holds the parts of an image config blob that are compared
+type imageConfig struct {
+	Created      string `json:"created,omitempty"`
+	Architecture string `json:"architecture,omitempty"`
+	OS           string `json:"os,omitempty"`
+	OSVersion    string `json:"os.version,omitempty"`
+	Variant      string `json:"variant,omitempty"`
+	Config       struct {
+		Labels map[string]string `json:"Labels,omitempty"`
+	} `json:"config"`
+}
+
+// fetchConfig reads the config blob of an image manifest
+func fetchConfig(src imageSource, m Manifest) (imageConfig, error) {
+	var c imageConfig
+	if m.Config == nil {
+		return c, nil
+	}
+	rc, err := src.openBlob(*m.Config)
+	if err != nil {
+		return c, err
+	}
+	defer rc.Close()
+	bd, err := ioutil.ReadAll(newVerifyingReader(rc, *m.Config))
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(bd, &c)
+	return c, err
+}
+
+// PlatformChange is a platform whose manifest differs between two indexes
+type PlatformChange struct {
+	Platform string `json:"platform"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+}
+
+// LabelChange is a config label whose value differs between two images
+type LabelChange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// ImageDiff describes the differences between two images
+type ImageDiff struct {
+	From             string                 `json:"from"`
+	To               string                 `json:"to"`
+	FromDigest       string                 `json:"from_digest"`
+	ToDigest         string                 `json:"to_digest"`
+	Identical        bool                   `json:"identical"`
+	FromMediaType    string                 `json:"from_media_type"`
+	ToMediaType      string                 `json:"to_media_type"`
+	LayersAdded      []Descriptor           `json:"layers_added,omitempty"`
+	LayersRemoved    []Descriptor           `json:"layers_removed,omitempty"`
+	PlatformsAdded   []string               `json:"platforms_added,omitempty"`
+	PlatformsRemoved []string               `json:"platforms_removed,omitempty"`
+	PlatformsChanged []PlatformChange       `json:"platforms_changed,omitempty"`
+	LabelsAdded      map[string]string      `json:"labels_added,omitempty"`
+	LabelsRemoved    map[string]string      `json:"labels_removed,omitempty"`
+	LabelsChanged    map[string]LabelChange `json:"labels_changed,omitempty"`
+}
+
+// diffLayers compares the layers of two image manifests by digest
+func diffLayers(a, b Manifest) (added, removed []Descriptor) {
+	inA := map[string]bool{}
+	for _, l := range a.Layers {
+		inA[l.Digest] = true
+	}
+	inB := map[string]bool{}
+	for _, l := range b.Layers {
+		inB[l.Digest] = true
+		if !inA[l.Digest] {
+			added = append(added, l)
+		}
+	}
+	for _, l := range a.Layers {
+		if !inB[l.Digest] {
+			removed = append(removed, l)
+		}
+	}
+	return added, removed
+}
+
+// diffPlatforms compares the platform manifests of two indexes
+func diffPlatforms(a, b Manifest) (added, removed []string, changed []PlatformChange) {
+	platforms := func(m Manifest) map[string]string {
+		p := map[string]string{}
+		for _, d := range m.Manifests {
+			p[d.Platform.String()] = d.Digest
+		}
+		return p
+	}
+	pa, pb := platforms(a), platforms(b)
+	for p, d := range pb {
+		if da, ok := pa[p]; !ok {
+			added = append(added, p)
+		} else if da != d {
+			changed = append(changed, PlatformChange{Platform: p, From: da, To: d})
+		}
+	}
+	for p := range pa {
+		if _, ok := pb[p]; !ok {
+			removed = append(removed, p)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Slice(changed, func(i, j int) bool { return changed[i].Platform < changed[j].Platform })
+	return added, removed, changed
+}
+
+// diffLabels compares the config labels of two images
+func diffLabels(a, b map[string]string) (added, removed map[string]string, changed map[string]LabelChange) {
+	added, removed, changed = map[string]string{}, map[string]string{}, map[string]LabelChange{}
+	for k, v := range b {
+		if va, ok := a[k]; !ok {
+			added[k] = v
+		} else if va != v {
+			changed[k] = LabelChange{From: va, To: v}
+		}
+	}
+	for k, v := range a {
+		if _, ok := b[k]; !ok {
+			removed[k] = v
+		}
+	}
+	return added, removed, changed
+}
+
+// diffImages fetches and compares two images
+func diffImages(from, to string) (*ImageDiff, error) {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "diffImages",
+		"from":    from,
+		"to":      to,
+	})
+	d := &ImageDiff{From: from, To: to}
+	var srcs [2]imageSource
+	var ms [2]Manifest
+	for i, arg := range []string{from, to} {
+		src, err := newImageSource(arg)
+		if err != nil {
+			l.Error("Error opening image: ", err)
+			return nil, err
+		}
+		m, err := src.root()
+		if err != nil {
+			l.Error("Error getting manifest: ", err)
+			return nil, err
+		}
+		srcs[i], ms[i] = src, m
+	}
+	a, b := ms[0], ms[1]
+	d.FromDigest, d.ToDigest = a.Digest(), b.Digest()
+	d.FromMediaType, d.ToMediaType = a.MediaType, b.MediaType
+	d.Identical = d.FromDigest == d.ToDigest
+	if d.Identical {
+		return d, nil
+	}
+	if a.isIndex() || b.isIndex() {
+		d.PlatformsAdded, d.PlatformsRemoved, d.PlatformsChanged = diffPlatforms(a, b)
+		return d, nil
+	}
+	d.LayersAdded, d.LayersRemoved = diffLayers(a, b)
+	var cs [2]imageConfig
+	for i := range cs {
+		c, err := fetchConfig(srcs[i], ms[i])
+		if err != nil {
+			l.Error("Error getting config: ", err)
+			return nil, err
+		}
+		cs[i] = c
+	}
+	d.LabelsAdded, d.LabelsRemoved, d.LabelsChanged = diffLabels(cs[0].Config.Labels, cs[1].Config.Labels)
+	return d, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// print writes the diff as text
+func (d *ImageDiff) print() {
+	if d.Identical {
+		fmt.Printf("identical: %s\n", d.FromDigest)
+		return
+	}
+	fmt.Printf("digest: %s -> %s\n", d.FromDigest, d.ToDigest)
+	if d.FromMediaType != d.ToMediaType {
+		fmt.Printf("media type: %s -> %s\n", d.FromMediaType, d.ToMediaType)
+	}
+	if len(d.LayersAdded)+len(d.LayersRemoved) > 0 {
+		fmt.Println("layers:")
+		for _, l := range d.LayersRemoved {
+			fmt.Printf("  - %s (%s)\n", l.Digest, formatBytes(l.Size))
+		}
+		for _, l := range d.LayersAdded {
+			fmt.Printf("  + %s (%s)\n", l.Digest, formatBytes(l.Size))
+		}
+	}
+	if len(d.PlatformsAdded)+len(d.PlatformsRemoved)+len(d.PlatformsChanged) > 0 {
+		fmt.Println("platforms:")
+		for _, p := range d.PlatformsRemoved {
+			fmt.Printf("  - %s\n", p)
+		}
+		for _, p := range d.PlatformsAdded {
+			fmt.Printf("  + %s\n", p)
+		}
+		for _, c := range d.PlatformsChanged {
+			fmt.Printf("  ~ %s %s -> %s\n", c.Platform, c.From, c.To)
+		}
+	}
+	if len(d.LabelsAdded)+len(d.LabelsRemoved)+len(d.LabelsChanged) > 0 {
+		fmt.Println("labels:")
+		for _, k := range sortedKeys(d.LabelsRemoved) {
+			fmt.Printf("  - %s=%s\n", k, d.LabelsRemoved[k])
+		}
+		for _, k := range sortedKeys(d.LabelsAdded) {
+			fmt.Printf("  + %s=%s\n", k, d.LabelsAdded[k])
+		}
+		var changed []string
+		for k := range d.LabelsChanged {
+			changed = append(changed, k)
+		}
+		sort.Strings(changed)
+		for _, k := range changed {
+			fmt.Printf("  ~ %s: %s -> %s\n", k, d.LabelsChanged[k].From, d.LabelsChanged[k].To)
+		}
+	}
+}
+
+// diffCmd compares two images. It exits 0 when they are identical, 1 when
+// they differ and 2 on error.
+func diffCmd(args []string) int {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	jsonOut := fs.Bool("json", OutputFormat == "json", "Print the differences as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s diff [--json] <image> <image>\n", commandName())
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+	d, err := diffImages(fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 2
+	}
+	if *jsonOut {
+		jd, err := json.MarshalIndent(d, "", "  ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			return 2
+		}
+		fmt.Println(string(jd))
+	} else {
+		d.print()
+	}
+	if d.Identical {
+		return 0
+	}
+	return 1
+}
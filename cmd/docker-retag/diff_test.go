@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// layerFixture returns the descriptor of a layer numbered n
+func layerFixture(n int) Descriptor {
+	return Descriptor{MediaType: mediaTypeOCILayer, Digest: fmt.Sprintf("sha256:%064d", n), Size: int64(n * 1000)}
+}
+
+// imageFixture returns an image manifest with the config and the layers
+// numbered layers
+func imageFixture(t *testing.T, config Descriptor, layers ...int) Manifest {
+	t.Helper()
+	var ls []string
+	for _, n := range layers {
+		l := layerFixture(n)
+		ls = append(ls, fmt.Sprintf(`{"mediaType":%q,"digest":%q,"size":%d}`, l.MediaType, l.Digest, l.Size))
+	}
+	bd := fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"config":{"mediaType":%q,"digest":%q,"size":%d},"layers":[%s]}`,
+		mediaTypeOCIManifest, mediaTypeOCIConfig, config.Digest, config.Size, strings.Join(ls, ","))
+	m, err := parseManifest([]byte(bd), mediaTypeOCIManifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// indexFixture returns an index of the platforms, as os/architecture, to
+// the digests of their manifests
+func indexFixture(t *testing.T, platforms map[string]string) Manifest {
+	t.Helper()
+	var ms []string
+	for p, d := range platforms {
+		osName, arch, _ := strings.Cut(p, "/")
+		ms = append(ms, fmt.Sprintf(`{"mediaType":%q,"digest":%q,"size":100,"platform":{"os":%q,"architecture":%q}}`, mediaTypeOCIManifest, d, osName, arch))
+	}
+	bd := fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"manifests":[%s]}`, mediaTypeOCIIndex, strings.Join(ms, ","))
+	m, err := parseManifest([]byte(bd), mediaTypeOCIIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestDiffLayers(t *testing.T) {
+	config := Descriptor{Digest: fmt.Sprintf("sha256:%064d", 0), Size: 2}
+	tests := []struct {
+		name           string
+		a, b           []int
+		added, removed []int
+	}{
+		{"identical", []int{1, 2}, []int{1, 2}, nil, nil},
+		{"added", []int{1}, []int{1, 2, 3}, []int{2, 3}, nil},
+		{"removed", []int{1, 2, 3}, []int{1}, nil, []int{2, 3}},
+		{"replaced", []int{1, 2}, []int{1, 3}, []int{3}, []int{2}},
+		{"reordered", []int{1, 2}, []int{2, 1}, nil, nil},
+		{"from scratch", nil, []int{1}, []int{1}, nil},
+	}
+	descriptors := func(ns []int) []Descriptor {
+		var ds []Descriptor
+		for _, n := range ns {
+			ds = append(ds, layerFixture(n))
+		}
+		return ds
+	}
+	for _, tt := range tests {
+		added, removed := diffLayers(imageFixture(t, config, tt.a...), imageFixture(t, config, tt.b...))
+		if !reflect.DeepEqual(added, descriptors(tt.added)) || !reflect.DeepEqual(removed, descriptors(tt.removed)) {
+			t.Errorf("%s: diffLayers = +%v -%v, want +%v -%v", tt.name, added, removed, descriptors(tt.added), descriptors(tt.removed))
+		}
+	}
+}
+
+func TestDiffPlatforms(t *testing.T) {
+	d := func(n int) string { return fmt.Sprintf("sha256:%064d", n) }
+	tests := []struct {
+		name           string
+		a, b           map[string]string
+		added, removed []string
+		changed        []PlatformChange
+	}{
+		{"identical", map[string]string{"linux/amd64": d(1)}, map[string]string{"linux/amd64": d(1)}, nil, nil, nil},
+		{"added", map[string]string{"linux/amd64": d(1)}, map[string]string{"linux/amd64": d(1), "linux/arm64": d(2)}, []string{"linux/arm64"}, nil, nil},
+		{"removed", map[string]string{"linux/amd64": d(1), "linux/arm64": d(2), "linux/s390x": d(3)}, map[string]string{"linux/amd64": d(1)}, nil, []string{"linux/arm64", "linux/s390x"}, nil},
+		{"changed", map[string]string{"linux/amd64": d(1), "linux/arm64": d(2)}, map[string]string{"linux/amd64": d(3), "linux/arm64": d(4)}, nil, nil,
+			[]PlatformChange{{"linux/amd64", d(1), d(3)}, {"linux/arm64", d(2), d(4)}}},
+		{"all at once", map[string]string{"linux/amd64": d(1), "linux/arm64": d(2)}, map[string]string{"linux/amd64": d(3), "windows/amd64": d(4)},
+			[]string{"windows/amd64"}, []string{"linux/arm64"}, []PlatformChange{{"linux/amd64", d(1), d(3)}}},
+	}
+	for _, tt := range tests {
+		added, removed, changed := diffPlatforms(indexFixture(t, tt.a), indexFixture(t, tt.b))
+		if !reflect.DeepEqual(added, tt.added) || !reflect.DeepEqual(removed, tt.removed) || !reflect.DeepEqual(changed, tt.changed) {
+			t.Errorf("%s: diffPlatforms = +%v -%v ~%v, want +%v -%v ~%v", tt.name, added, removed, changed, tt.added, tt.removed, tt.changed)
+		}
+	}
+}
+
+func TestDiffLabels(t *testing.T) {
+	tests := []struct {
+		name           string
+		a, b           map[string]string
+		added, removed map[string]string
+		changed        map[string]LabelChange
+	}{
+		{"identical", map[string]string{"version": "1.0"}, map[string]string{"version": "1.0"}, map[string]string{}, map[string]string{}, map[string]LabelChange{}},
+		{"none", nil, nil, map[string]string{}, map[string]string{}, map[string]LabelChange{}},
+		{"added", nil, map[string]string{"team": "infra"}, map[string]string{"team": "infra"}, map[string]string{}, map[string]LabelChange{}},
+		{"removed", map[string]string{"team": "infra"}, nil, map[string]string{}, map[string]string{"team": "infra"}, map[string]LabelChange{}},
+		{"changed", map[string]string{"version": "1.0", "team": "infra"}, map[string]string{"version": "1.4.0", "team": "infra"},
+			map[string]string{}, map[string]string{}, map[string]LabelChange{"version": {From: "1.0", To: "1.4.0"}}},
+		{"changed to empty", map[string]string{"version": "1.0"}, map[string]string{"version": ""},
+			map[string]string{}, map[string]string{}, map[string]LabelChange{"version": {From: "1.0", To: ""}}},
+	}
+	for _, tt := range tests {
+		added, removed, changed := diffLabels(tt.a, tt.b)
+		if !reflect.DeepEqual(added, tt.added) || !reflect.DeepEqual(removed, tt.removed) || !reflect.DeepEqual(changed, tt.changed) {
+			t.Errorf("%s: diffLabels = +%v -%v ~%v, want +%v -%v ~%v", tt.name, added, removed, changed, tt.added, tt.removed, tt.changed)
+		}
+	}
+}
+
+func TestDiffImages(t *testing.T) {
+	r := newTestRegistry(t)
+	push := func(tag string, labels string, layers ...int) {
+		config := []byte(`{"architecture":"amd64","os":"linux","config":{"Labels":` + labels + `}}`)
+		desc := Descriptor{Digest: r.putBlob(config), Size: int64(len(config))}
+		r.putManifest("app", tag, mediaTypeOCIManifest, imageFixture(t, desc, layers...).Raw)
+	}
+	push("stable", `{"version":"1.0","team":"infra"}`, 1, 2)
+	push("same", `{"version":"1.0","team":"infra"}`, 1, 2)
+	push("1.4.0", `{"version":"1.4.0","commit":"abc"}`, 1, 3)
+	d := func(n int) string { return fmt.Sprintf("sha256:%064d", n) }
+	r.putManifest("app", "multi-1", mediaTypeOCIIndex, indexFixture(t, map[string]string{"linux/amd64": d(1), "linux/arm64": d(2)}).Raw)
+	r.putManifest("app", "multi-2", mediaTypeOCIIndex, indexFixture(t, map[string]string{"linux/amd64": d(3)}).Raw)
+
+	image := func(tag string) string { return r.host + "/app:" + tag }
+	same, err := diffImages(image("stable"), image("same"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !same.Identical || same.LayersAdded != nil || same.LabelsChanged != nil {
+		t.Errorf("diff of identical images = %+v, want identical", same)
+	}
+
+	changed, err := diffImages(image("stable"), image("1.4.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &ImageDiff{
+		From: image("stable"), To: image("1.4.0"),
+		FromDigest: same.FromDigest, ToDigest: changed.ToDigest,
+		FromMediaType: mediaTypeOCIManifest, ToMediaType: mediaTypeOCIManifest,
+		LayersAdded:   []Descriptor{layerFixture(3)},
+		LayersRemoved: []Descriptor{layerFixture(2)},
+		LabelsAdded:   map[string]string{"commit": "abc"},
+		LabelsRemoved: map[string]string{"team": "infra"},
+		LabelsChanged: map[string]LabelChange{"version": {From: "1.0", To: "1.4.0"}},
+	}
+	if changed.Identical || !reflect.DeepEqual(changed, want) {
+		t.Errorf("diff of changed images = %+v, want %+v", changed, want)
+	}
+
+	index, err := diffImages(image("multi-1"), image("multi-2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index.Identical || !reflect.DeepEqual(index.PlatformsRemoved, []string{"linux/arm64"}) ||
+		!reflect.DeepEqual(index.PlatformsChanged, []PlatformChange{{"linux/amd64", d(1), d(3)}}) || index.LayersAdded != nil {
+		t.Errorf("diff of indexes = %+v, want linux/arm64 removed and linux/amd64 changed", index)
+	}
+}
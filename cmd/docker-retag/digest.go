@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// resolveDigest resolves the reference to a manifest digest. With a
+// platform, an index is resolved to the manifest for that platform.
+func resolveDigest(ref ImageRef, platform *Platform) (string, error) {
+	if platform == nil {
+		digest, exists, err := manifestDigest(ref, ref.Reference())
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return "", fmt.Errorf("%s not found", ref)
+		}
+		return digest, nil
+	}
+	m, err := fetchManifest(ref, ref.Reference())
+	if err != nil {
+		return "", err
+	}
+	if !m.isIndex() {
+		return m.Digest(), nil
+	}
+	d, err := m.platformManifest(*platform)
+	if err != nil {
+		return "", err
+	}
+	return d.Digest, nil
+}
+
+// digestCmd prints the digest of each reference, one per line. Failures
+// are reported on stderr and make the exit code non-zero.
+func digestCmd(args []string) int {
+	fs := flag.NewFlagSet("digest", flag.ContinueOnError)
+	platformFlag := fs.String("platform", "", "Resolve multi-arch images to the manifest for this platform (os/architecture[/variant])")
+	fullRef := fs.Bool("full-ref", false, "Print registry/repository@digest instead of the bare digest")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s digest [--platform os/arch] [--full-ref] <image> ...\n", commandName())
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	var platform *Platform
+	if *platformFlag != "" {
+		p, err := parsePlatform(*platformFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			return 2
+		}
+		platform = &p
+	}
+	code := 0
+	for _, arg := range fs.Args() {
+		ref, err := urlToImageTag(arg)
+		var digest string
+		if err == nil {
+			digest, err = resolveDigest(ref, platform)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", arg, err)
+			code = 1
+			continue
+		}
+		if *fullRef {
+			fmt.Printf("%s@%s\n", ref.Repository(), digest)
+			continue
+		}
+		fmt.Println(digest)
+	}
+	return code
+}
@@ -1,307 +1,264 @@
 package main
 
 import (
-	"bytes"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"net/http"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
 var (
-	Version          string = "dev"
-	Username         string
-	Password         string
-	dockerRetagFlags = flag.NewFlagSet("docker-retag", flag.ExitOnError)
+	Version                 string = "dev"
+	BuildDate               string
+	AcceptSchema1           bool
+	SkipBlobCheck           bool
+	IncludeNonDistributable bool
+	OutputFormat            string
+	RegistryPrefixes        = keyValueFlag{}
+	PlainHTTP               stringListFlag
+	AllowedRegistries       stringListFlag
+	DeniedRegistries        stringListFlag
+	ProtectedTags           stringListFlag
+	AllowProtected          bool
+	RequireExplicitTags     bool
+	NoDockerConfig          bool
+	NotifyURLs              stringListFlag
+	ChunkSize               = byteSizeFlag(64 << 20)
+	Retries                 int
+	Deadline                time.Duration
+	dockerRetagFlags        = flag.NewFlagSet("docker-retag", flag.ExitOnError)
 )
 
-type Manifest struct {
-	MediaType     string `json:"mediaType"`
-	SchemaVersion int    `json:"schemaVersion"`
-	Config        struct {
-		MediaType string `json:"mediaType"`
-		Digest    string `json:"digest"`
-		Size      int    `json:"size"`
-	} `json:"config"`
-	Layers []struct {
-		MediaType string `json:"mediaType"`
-		Digest    string `json:"digest"`
-		Size      int    `json:"size"`
-	} `json:"layers"`
+func init() {
+	ll, err := log.ParseLevel(os.Getenv("LOG_LEVEL"))
+	if err != nil {
+		ll = log.InfoLevel
+	}
+	log.SetLevel(ll)
 }
 
-func registryProtocol(registry string) string {
-	l := log.WithFields(log.Fields{
-		"package":  "main",
-		"fn":       "registryProtocol",
-		"registry": registry,
-	})
-	l.Debug("Getting registry protocol")
-	if os.Getenv("INSECURE_REGISTRY") == "true" {
-		return "http"
-	}
-	return "https"
+type UploadJob struct {
+	Index    int
+	Manifest Manifest
+	Src      imageSource
+	Source   string
+	Image    string
+	// Signature is the verified signature of the source, if checked
+	Signature *SignatureCheck
+	// Optional is set for destinations whose failure does not fail the run
+	Optional bool
+	// registry is what the job is queued by, set by jobQueue.push
+	registry string
 }
 
-func registryAuth(registry string) (string, error) {
-	l := log.WithFields(log.Fields{
-		"package":  "main",
-		"registry": registry,
-		"fn":       "registryAuth",
-	})
-	l.Debug("Getting registry auth")
-	// get auth from keychain
-	// if no auth is found, return empty string
-	// if auth is found, return base64 encoded string
-	if Username != "" && Password != "" {
-		l.Debug("Using username and password")
-		return base64.StdEncoding.EncodeToString([]byte(Username + ":" + Password)), nil
-	}
-	if os.Getenv("DOCKER_USER") != "" && os.Getenv("DOCKER_PASS") != "" {
-		l.Debug("Using docker credentials")
-		return base64.StdEncoding.EncodeToString([]byte(os.Getenv("DOCKER_USER") + ":" + os.Getenv("DOCKER_PASS"))), nil
-	}
-	// check docker config
-	l.Debug("Checking docker config")
-	dockerConfig := os.Getenv("HOME") + "/.docker/config.json"
-	if _, err := os.Stat(dockerConfig); err == nil {
-		l.Debug("Docker config found")
-		// docker config found
-		// read docker config
-		bd, err := ioutil.ReadFile(dockerConfig)
-		if err != nil {
-			l.Error("Error reading docker config: ", err)
-			return "", err
+// UploadResult records the outcome of pushing to a single destination
+type UploadResult struct {
+	Index       int     `json:"-"`
+	Source      string  `json:"source"`
+	Destination string  `json:"destination"`
+	Digest      string  `json:"digest,omitempty"`
+	Bytes       int64   `json:"bytes"`
+	Duration    float64 `json:"duration_seconds"`
+	Attempts    int     `json:"attempts"`
+	Status      string  `json:"status"`
+	Error       string  `json:"error,omitempty"`
+	Err         error   `json:"-"`
+	// Manifest is created, or unchanged if the registry reported that it
+	// already had the manifest under the tag
+	Manifest string `json:"manifest,omitempty"`
+	// MediaType is the media type the manifest was negotiated and pushed as
+	MediaType string `json:"media_type,omitempty"`
+	// Kind is whether the source is an image, an index or an artifact
+	Kind string `json:"kind,omitempty"`
+	// Optional is set for destinations whose failure does not fail the run
+	Optional bool `json:"optional,omitempty"`
+	// RepairedBlobs is how many blobs the registry reported missing when
+	// the manifest was pushed, which were copied before pushing it again
+	RepairedBlobs int `json:"repaired_blobs,omitempty"`
+	// Signature is the result of --verify-signature for the source
+	Signature *SignatureCheck `json:"signature,omitempty"`
+	// TraceID is the trace of the run, set in printed results
+	TraceID string `json:"trace_id,omitempty"`
+}
+
+// manifestUploadWorker pushes the manifest of each job to its destination,
+// authenticating with auth
+func manifestUploadWorker(auth AuthProvider, jobs *jobQueue, results chan<- UploadResult) {
+	for {
+		j, ok := jobs.pop()
+		if !ok {
+			return
 		}
-		// parse docker config
-		var dc map[string]interface{}
-		err = json.Unmarshal(bd, &dc)
-		if err != nil {
-			l.Error("Error parsing docker config: ", err)
-			return "", err
-		}
-		// get auths
-		auths := dc["auths"].(map[string]interface{})
-		// get auth for registry
-		auth := auths[registry].(map[string]interface{})
-		// get auth string
-		if auth == nil || auth["auth"] == nil {
-			l.Debug("No auth found for registry")
-			return "", nil
-		}
-		authString := auth["auth"].(string)
-		return authString, nil
-	}
-	l.Debug("Docker config not found")
-	return "", nil
+		start := time.Now()
+		stats := &transferStats{source: j.Source, destination: j.Image, span: tracing.start("push "+j.Image, nil)}
+		if dst, err := urlToImageTag(j.Image); err == nil {
+			stats.span.setRef(dst)
+		}
+		r := UploadResult{
+			Index:       j.Index,
+			Source:      j.Source,
+			Destination: j.Image,
+			MediaType:   j.Manifest.ContentType,
+			Kind:        manifestKind(j.Manifest),
+			Signature:   j.Signature,
+			Optional:    j.Optional,
+			Status:      "running",
+		}
+		report.record(r)
+		events.emit(Event{Type: EventDestinationStarted, Source: j.Source, Destination: j.Image})
+		if strings.HasPrefix(j.Image, ociLayoutScheme) {
+			r.Digest, r.Err = exportOCILayout(j.Src, j.Manifest, j.Image, sourceTag(j.Source), stats)
+		} else {
+			if !SkipBlobCheck {
+				var dst ImageRef
+				dst, r.Err = urlToImageTag(j.Image)
+				dst = dst.withAuth(auth)
+				if r.Err == nil {
+					r.Err = ensureManifestContent(j.Src, j.Manifest, dst, stats)
+				}
+			}
+			if r.Err == nil && RollbackOnFailure {
+				var dst ImageRef
+				if dst, r.Err = urlToImageTag(j.Image); r.Err == nil {
+					r.Err = rollbacks.before(j.Index, dst.withAuth(auth))
+				}
+			}
+			if r.Err == nil {
+				var created bool
+				r.Digest, created, r.RepairedBlobs, r.Err = uploadManifestRepairing(j.Src, j.Image, auth, j.Manifest, stats)
+				if r.Err == nil {
+					r.Manifest = "unchanged"
+					if created {
+						r.Manifest = "created"
+					}
+				}
+				rollbacks.pushed(j.Index, r.Digest, r.Err)
+			}
+		}
+		r = r.complete(start, stats)
+		stats.span.set("digest", r.Digest)
+		stats.span.set("bytes", r.Bytes)
+		stats.span.set("status", r.Status)
+		stats.span.finish(r.Err)
+		jobs.done(j)
+		report.record(r)
+		results <- r
+	}
 }
 
-func urlToImageTag(url string) (string, string, string, error) {
-	l := log.WithFields(log.Fields{
-		"package": "main",
-		"fn":      "urlToImageTag",
-		"url":     url,
-	})
-	l.Debug("Getting image and tag from url")
-	// split the url into the registry, image, and tag
-	// url in format: hello.example.com:5000/myimage/path:latest
-	// it can also be in format: myimage/path:latest
-	// if no registry is specified, it will use the default registry (docker.io)
-	// if no tag is specified, it will use the default tag (latest)
-	// registry: hello.example.com:5000
-	// image: myimage/path
-	// tag: latest
-	var registry, image, tag string
-	if strings.Contains(url, "/") {
-		// url has a registry
-		// split the url into registry and image
-		splitUrl := strings.Split(url, "/")
-		registry = splitUrl[0]
-		image = strings.Join(splitUrl[1:], "/")
-	} else {
-		// url does not have a registry
-		// use the default registry
-		registry = "index.docker.io"
-		image = url
-	}
-	if strings.Contains(image, ":") {
-		// image has a tag
-		// split the image into image and tag
-		splitImage := strings.Split(image, ":")
-		image = splitImage[0]
-		tag = splitImage[1]
-	} else {
-		// image does not have a tag
-		// use the default tag
-		tag = "latest"
-	}
-	l = l.WithFields(log.Fields{
-		"registry": registry,
-		"image":    image,
-		"tag":      tag,
-	})
-	l.Debug("Got image and tag from url")
-	return registry, image, tag, nil
+// complete sets the status and transfer fields of the result
+func (r UploadResult) complete(start time.Time, stats *transferStats) UploadResult {
+	if stats != nil {
+		r.Bytes = atomic.LoadInt64(&stats.bytes)
+		r.Attempts = 1 + int(atomic.LoadInt64(&stats.retries))
+	}
+	r.Duration = time.Since(start).Seconds()
+	r.Status = "success"
+	if r.Err != nil {
+		r.Status = r.failedStatus()
+		r.Error = r.Err.Error()
+	}
+	return r
 }
 
-func getManifest(url string) (Manifest, error) {
-	l := log.WithFields(log.Fields{
-		"package": "main",
-		"func":    "getManifest",
-		"url":     url,
-	})
-	l.Debug("Getting manifest from ", url)
-	var m Manifest
-	registry, image, tag, err := urlToImageTag(url)
-	if err != nil {
-		l.Error("Error getting image and tag from url: ", err)
-		return m, err
-	}
-	protocol := registryProtocol(registry)
-	l.Debug("Registry: ", registry)
-	l.Debug("Image: ", image)
-	l.Debug("Tag: ", tag)
-	auth, err := registryAuth(registry)
-	if err != nil {
-		l.Error("Error getting registry auth: ", err)
-		return m, err
-	}
-	manifestUrl := fmt.Sprintf("%s://%s/v2/%s/manifests/%s", protocol, registry, image, tag)
-	l = l.WithFields(log.Fields{
-		"manifestUrl": manifestUrl,
-	})
-	l.Debug("Manifest url: ", manifestUrl)
-	c := &http.Client{}
-	req, err := http.NewRequest("GET", manifestUrl, nil)
-	if err != nil {
-		l.Error("Error creating request: ", err)
-		return m, err
-	}
-	req.Header.Add("Accept", "application/vnd.docker.distribution.manifest.v2+json")
-	if auth != "" {
-		req.Header.Add("Authorization", "Basic "+auth)
-	}
-	resp, err := c.Do(req)
-	if err != nil {
-		l.Error("Error getting manifest: ", err)
-		return m, err
-	}
-	defer resp.Body.Close()
-	bd, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		l.Error("Error reading response body: ", err)
-		return m, err
-	}
-	if resp.StatusCode != 200 {
-		l.Error("Error getting manifest: ", resp.Status)
-		return m, errors.New(resp.Status)
-	}
-	l.Debug("Manifest: ", string(bd))
-	err = json.Unmarshal(bd, &m)
-	if err != nil {
-		l.Error("Error unmarshalling manifest: ", err)
-		return m, err
+// statusDuplicate is the status of a destination that repeats an earlier
+// one and was not pushed
+const statusDuplicate = "skipped (duplicate)"
+
+// skip marks the destination as skipped without pushing
+func (r UploadResult) skip() UploadResult {
+	r.Status = "skipped"
+	return r
+}
+
+// skipped reports whether the destination was not pushed, as an existing
+// tag, a duplicate or an excluded artifact
+func (r UploadResult) skipped() bool {
+	return r.Status == "skipped" || r.Status == statusDuplicate || r.Status == statusArtifact
+}
+
+// sourceTag returns the tag of the source image, used to name
+// images exported to OCI layouts without an explicit tag
+func sourceTag(source string) string {
+	if strings.HasPrefix(source, ociLayoutScheme) {
+		if _, tag := splitOCILayoutArg(source); tag != "" {
+			return tag
+		}
+	} else if ref, err := urlToImageTag(strings.TrimPrefix(source, dockerDaemonScheme)); err == nil && ref.Tag != "" {
+		return ref.Tag
 	}
-	return m, nil
+	return "latest"
 }
 
-func uploadManifest(url string, manifest Manifest) error {
+// printResult reports a destination as soon as it is done: it is logged,
+// and with ndjson output printed as a JSON line
+func printResult(r UploadResult) error {
 	l := log.WithFields(log.Fields{
-		"package": "main",
-		"func":    "uploadManifest",
-		"url":     url,
+		"destination": r.Destination,
+		"digest":      r.Digest,
+		"elapsed":     time.Duration(r.Duration * float64(time.Second)).Round(time.Millisecond).String(),
 	})
-	l.Debug("Uploading manifest to ", url)
-	registry, image, tag, err := urlToImageTag(url)
-	if err != nil {
-		l.Error("Error getting image and tag from url: ", err)
-		return err
-	}
-	protocol := registryProtocol(registry)
-	l.Debug("Registry: ", registry)
-	l.Debug("Image: ", image)
-	l.Debug("Tag: ", tag)
-	auth, err := registryAuth(registry)
-	if err != nil {
-		l.Error("Error getting registry auth: ", err)
-		return err
-	}
-	manifestUrl := fmt.Sprintf("%s://%s/v2/%s/manifests/%s", protocol, registry, image, tag)
-	l = l.WithFields(log.Fields{
-		"manifestUrl": manifestUrl,
-	})
-	l.Debug("Manifest url: ", manifestUrl)
-	l.Debug("Manifest: ", manifest)
-	c := &http.Client{}
-	jd, err := json.Marshal(manifest)
-	if err != nil {
-		l.Error("Error marshalling manifest: ", err)
-		return err
+	switch {
+	case r.Err != nil && r.Optional:
+		l.Warn("Error uploading manifest to optional destination: ", r.Err)
+	case r.Err != nil:
+		l.Error("Error uploading manifest: ", r.Err)
+	case r.Status == statusDuplicate:
+		l.Info("Skipped duplicate of an earlier destination")
+	case r.Status == statusArtifact:
+		l.Info("Skipped ", r.Source, ", an artifact excluded by --exclude-artifacts")
+	case r.Status == "skipped":
+		l.Info("Skipped ", r.Source)
+	default:
+		l.Info("Retagged ", r.Source)
+	}
+	if OutputFormat == "ndjson" {
+		r.TraceID = tracing.traceID
+		jd, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(jd))
 	}
-	data := bytes.NewBuffer(jd)
-	req, err := http.NewRequest("PUT", manifestUrl, data)
-	if err != nil {
-		l.Error("Error creating request: ", err)
-		return err
+	return nil
+}
+
+// printResults prints the results of all destinations, in the order they
+// were given, once the run is done
+func printResults(results []UploadResult) error {
+	if OutputFormat != "json" {
+		return nil
 	}
-	req.Header.Add("Content-Type", manifest.MediaType)
-	if auth != "" {
-		req.Header.Add("Authorization", "Basic "+auth)
+	for i := range results {
+		results[i].TraceID = tracing.traceID
 	}
-	resp, err := c.Do(req)
+	jd, err := json.MarshalIndent(results, "", "  ")
 	if err != nil {
-		l.Error("Error getting manifest: ", err)
 		return err
 	}
-	defer resp.Body.Close()
-	bd, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		l.Error("Error reading response body: ", err)
-		return err
-	}
-	l.Debug("Response: ", string(bd))
-	if resp.StatusCode != 201 {
-		l.Error("Error uploading manifest: ", resp.Status)
-		return errors.New(resp.Status)
-	}
+	fmt.Println(string(jd))
 	return nil
 }
 
-func init() {
-	ll, err := log.ParseLevel(os.Getenv("LOG_LEVEL"))
-	if err != nil {
-		ll = log.InfoLevel
-	}
-	log.SetLevel(ll)
-}
-
-type UploadJob struct {
-	Manifest Manifest
-	Image    string
-}
-
-func manifestUploadWorker(jobs <-chan UploadJob, results chan<- error) {
-	for j := range jobs {
-		err := uploadManifest(j.Image, j.Manifest)
-		results <- err
-	}
-}
-
 func usage() {
-	fmt.Println("Usage: docker-retag [flags] <image> <new tag> ...")
+	fmt.Printf("Usage: %s [flags] <image> <new tag> ... [-- <image> <new tag> ...]\n", commandName())
+	for _, c := range subcommands {
+		fmt.Printf("       %s [flags] %s %s\n", commandName(), c.Name, c.Args)
+	}
 	fmt.Println("Flags:")
 	dockerRetagFlags.PrintDefaults()
-}
-
-func version() {
-	fmt.Println("docker-retag version: ", Version)
+	if !pluginMode {
+		fmt.Println()
+		fmt.Println("To use as a docker CLI plugin (docker retag ...), copy this binary to ~/.docker/cli-plugins/docker-retag")
+	}
 }
 
 func main() {
@@ -310,72 +267,618 @@ func main() {
 		"func":    "main",
 	})
 	l.Debug("Starting docker-retag")
+	cliArgs := pluginDispatch(os.Args[1:])
 	dockerRetagFlags.Usage = usage
-	username := dockerRetagFlags.String("u", "", "Username for registry")
-	password := dockerRetagFlags.String("p", "", "Password for registry")
-	passwordStdin := dockerRetagFlags.Bool("P", false, "Read password from stdin")
-	versionFlag := dockerRetagFlags.Bool("v", false, "Print version and exit")
-	dockerRetagFlags.Parse(os.Args[1:])
+	opts := defineFlags(dockerRetagFlags)
+	cfg, err := loadConfig(configPath(cliArgs))
+	if err != nil {
+		l.Error("Error loading config: ", err)
+		os.Exit(1)
+	}
+	FileConfig = cfg
+	if err := FileConfig.applyFlags(dockerRetagFlags); err != nil {
+		l.Error("Error applying config: ", err)
+		os.Exit(1)
+	}
+	if err := applyEnvFlags(dockerRetagFlags); err != nil {
+		l.Error("Error applying environment: ", err)
+		os.Exit(1)
+	}
+	dockerRetagFlags.Parse(cliArgs)
 	args := dockerRetagFlags.Args()
 	l.Debug("Args: ", args)
+	// flags are the flags given on the command line, which plan records
+	// and apply adds to the recorded ones
+	flags := append([]string{}, cliArgs[:len(cliArgs)-len(args)]...)
+	promote := len(args) > 0 && args[0] == "promote"
+	planning := len(args) > 0 && args[0] == "plan"
+	applying := len(args) > 0 && args[0] == "apply"
+	if promote || planning || applying {
+		// these subcommands accept the same flags after the subcommand
+		rest := args[1:]
+		dockerRetagFlags.Parse(rest)
+		args = dockerRetagFlags.Args()
+		flags = append(flags, rest[:len(rest)-len(args)]...)
+	}
+	var applied *PlanFile
+	if applying {
+		if len(args) != 1 {
+			usage()
+			os.Exit(1)
+		}
+		applied, err = loadPlanFile(args[0])
+		if err != nil {
+			l.Error("Error reading plan: ", err)
+			os.Exit(1)
+		}
+		dockerRetagFlags.Parse(applied.Flags)
+		dockerRetagFlags.Parse(flags)
+		// the plan has the destinations of templates and files already
+		// rendered
+		DestTemplates = nil
+		*opts.destFile = ""
+		args = applied.args()
+	}
 	// usage of the function
 	// "docker-retag [flags] <image> <new tag> ..."
-	if *versionFlag {
-		version()
+	if *opts.versionFlag {
+		if err := printVersion(*opts.outputFormat); err != nil {
+			l.Error(err)
+			os.Exit(1)
+		}
 		os.Exit(0)
 	}
-	if len(args) < 2 {
-		usage()
+	if len(args) > 0 {
+		switch args[0] {
+		case "config":
+			if len(args) == 2 && args[1] == "show" {
+				configShow(dockerRetagFlags)
+				os.Exit(0)
+			}
+		case "completion":
+			os.Exit(completionCmd(args[1:]))
+		case completeTagsCmd:
+			os.Exit(completeTags(args[1:]))
+		}
+	}
+	cred := Credential{Username: *opts.username, Password: *opts.password}
+	AcceptSchema1 = *opts.acceptSchema1
+	SkipBlobCheck = *opts.skipBlobCheck
+	IncludeNonDistributable = *opts.includeNonDistributable
+	OutputFormat = *opts.outputFormat
+	switch OutputFormat {
+	case "text", "json", "ndjson":
+	default:
+		l.Errorf("Unknown --output %q, expected text, json or ndjson", OutputFormat)
+		os.Exit(1)
+	}
+	Retries = *opts.retries
+	if !validHost(DefaultRegistry) {
+		l.Errorf("--default-registry %q is not a valid registry host", DefaultRegistry)
+		os.Exit(1)
+	}
+	switch *opts.spool {
+	case "all", "auto":
+	default:
+		l.Errorf("Unknown --spool %q, expected all or auto", *opts.spool)
+		os.Exit(1)
+	}
+	if err := validateRegistryConcurrency(); err != nil {
+		l.Error(err)
+		os.Exit(1)
+	}
+	if VerifyBlobs != "" && SkipBlobCheck {
+		l.Error("--verify-blobs checks the blobs --skip-blob-check skips, only one may be given")
 		os.Exit(1)
 	}
-	Username = *username
-	Password = *password
-	if *passwordStdin {
+	if *opts.stripAttestations && *opts.keepAttestations {
+		l.Error("Only one of --strip-attestations and --keep-attestations may be given")
+		os.Exit(1)
+	}
+	if ExcludeArtifacts && *opts.includeArtifacts {
+		l.Error("Only one of --include-artifacts and --exclude-artifacts may be given")
+		os.Exit(1)
+	}
+	if ExcludeArtifacts && *opts.artifactType != "" {
+		l.Error("--artifact-type requires an artifact source, which --exclude-artifacts skips")
+		os.Exit(1)
+	}
+	passwordSources := 0
+	for _, set := range []bool{*opts.password != "", *opts.passwordStdin, *opts.passwordFile != ""} {
+		if set {
+			passwordSources++
+		}
+	}
+	if passwordSources > 1 {
+		l.Error("Only one of -p, -P and --password-file may be given")
+		os.Exit(1)
+	}
+	if *opts.passwordFile != "" {
+		bd, err := ioutil.ReadFile(*opts.passwordFile)
+		if err != nil {
+			l.Error("Error reading password file: ", err)
+			os.Exit(1)
+		}
+		cred.Password = strings.TrimSpace(string(bd))
+	}
+	if *opts.passwordStdin {
 		// read password from stdin
 		bd, err := ioutil.ReadAll(os.Stdin)
 		if err != nil {
 			l.Error("Error reading password from stdin: ", err)
 		}
-		Password = strings.TrimSpace(string(bd))
+		cred.Password = strings.TrimSpace(string(bd))
 	}
-	l.Debug("Username: ", Username)
-	l.Debug("Password: ", Password)
-	image := args[0]
-	newImages := args[1:]
-	l = l.WithFields(log.Fields{
-		"image":      image,
-		"new_images": newImages,
-	})
-	l.Debug("Retagging image")
-	// get original manifest
-	manifest, err := getManifest(image)
+	if *opts.credsFD != 0 {
+		fdCredentials, err = readCredentialsFD(*opts.credsFD)
+		if err != nil {
+			l.Error("Error reading credentials: ", err)
+			os.Exit(1)
+		}
+		l.Debugf("Read credentials for %d registries from --creds-fd", len(fdCredentials))
+	}
+	if err := setupTracing(TraceID, OTel); err != nil {
+		l.Error(err)
+		os.Exit(1)
+	}
+	if err := applyDockerConfigNetwork(processEnv.dockerConfigPath()); err != nil {
+		l.Error("Error reading docker config: ", err)
+		os.Exit(1)
+	}
+	l.Debug("Username: ", cred.Username)
+	l.Debug("Password: ", cred.Password)
+	auth := newCredentialChain(cred)
+	defaultAuth = auth
+	if len(args) > 0 {
+		switch args[0] {
+		case "diff":
+			os.Exit(diffCmd(args[1:]))
+		case "exists":
+			os.Exit(existsCmd(args[1:]))
+		case "digest":
+			os.Exit(digestCmd(args[1:]))
+		case "index":
+			os.Exit(indexCmd(args[1:]))
+		case "prune":
+			os.Exit(pruneCmd(args[1:]))
+		case "alias":
+			os.Exit(aliasCmd(args[1:]))
+		case "check":
+			os.Exit(checkCmd(args[1:]))
+		}
+	}
+	groups := splitGroups(args)
+	if len(groups) == 0 {
+		usage()
+		os.Exit(1)
+	}
+	if *opts.expandEnv && *opts.destFile == "" {
+		l.Error("--expand-env expands the destinations of --dest-file, which is not given")
+		os.Exit(1)
+	}
+	if *opts.destFile != "" {
+		if len(groups) > 1 {
+			l.Error("--dest-file adds destinations to a single source and cannot be combined with -- groups")
+			os.Exit(1)
+		}
+		if *opts.destFile == "-" && *opts.passwordStdin {
+			l.Error("--dest-file - and -P both read from stdin, only one may be given")
+			os.Exit(1)
+		}
+		dests, err := readDestFile(*opts.destFile, *opts.expandEnv, os.LookupEnv)
+		if err != nil {
+			l.Error("Error reading destinations: ", err)
+			os.Exit(1)
+		}
+		for _, d := range dests {
+			groups[0].destinations = append(groups[0].destinations, d.ref)
+		}
+	}
+	for _, g := range groups {
+		if len(g.destinations) == 0 && len(DestTemplates) == 0 {
+			usage()
+			os.Exit(1)
+		}
+	}
+	if len(groups) > 1 && (promote || *opts.watch || *opts.expectDigest != "" || *opts.resume != "") {
+		l.Error("promote, --watch, --expect-digest and --resume take a single source and cannot be combined with -- groups")
+		os.Exit(1)
+	}
+	if (planning || applying) && *opts.watch {
+		l.Error("--watch cannot be combined with plan or apply")
+		os.Exit(1)
+	}
+	if planning && *opts.planOut == "" {
+		l.Error("plan needs --out, the file to write the plan to, or - for stdout")
+		os.Exit(1)
+	}
+	if *opts.resetHistoryCreated && !opts.resetCreated.isSet() {
+		l.Error("--reset-history-created needs --reset-created, the time to set")
+		os.Exit(1)
+	}
+	if planning && opts.resetCreated.isNow() {
+		l.Error("--reset-created now would push another digest at apply than planned, give a fixed time with plan")
+		os.Exit(1)
+	}
+	if applied != nil {
+		for i, g := range groups {
+			g.planned = applied.Groups[i]
+		}
+	}
+	if promote {
+		groups[0].source, *opts.expectDigest, err = promoteSource(groups[0].source, *opts.expectDigest)
+		if err != nil {
+			l.Error(err)
+			os.Exit(1)
+		}
+	}
+	switch *opts.format {
+	case "auto", "oci", "docker":
+	default:
+		l.Errorf("Unknown --format %q, expected oci, docker or auto", *opts.format)
+		os.Exit(1)
+	}
+	var resume *runReport
+	if *opts.resume != "" {
+		resume, err = loadResume(*opts.resume)
+		if err != nil {
+			l.Error("Error reading report to resume: ", err)
+			os.Exit(1)
+		}
+	}
+	if *opts.watch && (*opts.expectDigest != "" || *opts.resume != "") {
+		l.Error("--watch cannot be combined with --expect-digest, promote or --resume")
+		os.Exit(1)
+	}
+	if *opts.expectDigest != "" && (len(opts.annotations) > 0 || len(opts.indexAnnotations) > 0) {
+		l.Error("--annotation changes the pushed digest and cannot be combined with --expect-digest")
+		os.Exit(1)
+	}
+	if *opts.verifySignature {
+		verifier, err = newSignatureVerifier(*opts.cosignKey)
+		if err != nil {
+			l.Error(err)
+			os.Exit(1)
+		}
+	}
+	if len(groups) == 1 {
+		l = l.WithFields(log.Fields{
+			"image":      groups[0].source,
+			"new_images": groups[0].destinations,
+		})
+	}
+	progress, err = newProgressReporter(*opts.progress, *opts.quiet)
 	if err != nil {
-		l.Error("Error getting manifest: ", err)
+		l.Error(err)
 		os.Exit(1)
 	}
-	l.Debug("Got manifest")
-	// upload manifest to new images
-	workers := 10
-	if len(newImages) < workers {
-		workers = len(newImages)
+	report, err = newRunReport(*opts.report, *opts.reportFormat)
+	if err != nil {
+		l.Error(err)
+		os.Exit(1)
+	}
+	events, err = newEventWriter(*opts.eventsFD, *opts.eventsFile)
+	if err != nil {
+		l.Error("Error opening event stream: ", err)
+		os.Exit(1)
 	}
-	jobs := make(chan UploadJob, len(newImages))
-	results := make(chan error, len(newImages))
-	for i := 0; i < workers; i++ {
-		go manifestUploadWorker(jobs, results)
+	auditPath := *opts.auditLog
+	if auditPath == "" {
+		auditPath = os.Getenv("DOCKER_RETAG_AUDIT_LOG")
 	}
-	for _, newImage := range newImages {
-		jobs <- UploadJob{
-			Manifest: manifest,
-			Image:    newImage,
+	if auditPath != "" {
+		auditLog, err = openAuditLog(auditPath)
+		if err != nil {
+			l.Error("Error opening audit log: ", err)
+			os.Exit(1)
 		}
 	}
-	close(jobs)
-	for i := 0; i < len(newImages); i++ {
-		err := <-results
+	notifier, err = newWebhookNotifier(NotifyURLs, *opts.notifyOn, *opts.notifyTokenFile, *opts.notifyStrict)
+	if err != nil {
+		l.Error("Error configuring notifications: ", err)
+		os.Exit(1)
+	}
+	total := 0
+	var planErr error
+	for _, g := range groups {
+		if len(DestTemplates) > 0 {
+			rendered, err := renderDestTemplates(g.source, DestTemplates)
+			if err != nil {
+				l.Error(err)
+				if *opts.dryRun || planning {
+					os.Exit(1)
+				}
+				os.Exit(finishRun(err))
+			}
+			g.destinations = append(g.destinations, rendered...)
+		}
+		g.arguments = append([]string{}, g.destinations...)
+		events.emit(Event{Type: EventPlanStarted, Source: g.source, Destinations: len(g.destinations)})
+		g.plan, err = newPlan(g.source, g.destinations)
+		if err == nil {
+			g.destinations = g.plan.args()
+			resume.markOptional(g.plan)
+		} else if planErr == nil {
+			planErr = err
+		}
+		g.offset = total
+		total += len(g.destinations)
+	}
+	if *opts.workers < 1 {
+		*opts.workers = 1
+	}
+	if total < *opts.workers {
+		*opts.workers = total
+	}
+	report.begin(groups, *opts.workers)
+	if len(opts.requirePlatforms) > 0 && planErr == nil {
+		for _, g := range groups {
+			if err := checkGroupPlatforms(g, opts.requirePlatforms); err != nil {
+				planErr = err
+				break
+			}
+		}
+	}
+	if (opts.maxSize > 0 || *opts.maxLayers > 0) && planErr == nil {
+		for _, g := range groups {
+			if err := checkGroupSize(g, opts); err != nil {
+				planErr = err
+				break
+			}
+		}
+	}
+	if planErr != nil {
+		l.Error(planErr)
+		if *opts.dryRun || planning {
+			os.Exit(1)
+		}
+		os.Exit(finishRun(planErr))
+	}
+	if planning {
+		err := writePlanFile(groups, flagArgs(dockerRetagFlags, flags), opts, *opts.planOut)
+		removeDaemonExports()
+		var notFound *manifestNotFoundError
+		if errors.As(err, &notFound) {
+			os.Exit(exitSourceNotFound)
+		}
 		if err != nil {
-			l.Error("Error uploading manifest: ", err)
 			os.Exit(1)
 		}
+		os.Exit(0)
+	}
+	if *opts.dryRun {
+		if err := printPlans(groups); err != nil {
+			l.Error("Error printing plan: ", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if Preflight.enabled(total) {
+		// fail before the first push rather than part way through
+		if err := preflight(groups, *opts.workers); err != nil {
+			l.Error(err)
+			os.Exit(finishRun(err))
+		}
+	}
+	if *opts.watch {
+		os.Exit(watch(groups[0].source, groups[0].plan, opts))
+	}
+	l.Debug("Retagging image")
+	finishOnSignal()
+	finishAtDeadline(Deadline)
+	exitCode := runGroups(groups, total, opts, auth, promote, resume)
+	if c := finishRun(nil); exitCode == 0 {
+		exitCode = c
+	}
+	os.Exit(exitCode)
+}
+
+// runGroups pushes the destinations of every group with the workers and
+// returns the exit code of the run. Jobs are queued while the results are
+// read and counted as they arrive, so the memory it needs does not grow
+// with the number of destinations, except for --output json, which keeps
+// the results to print them all at the end.
+func runGroups(groups []*retagGroup, total int, opts *options, auth AuthProvider, promote bool, resume *runReport) int {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "runGroups",
+	})
+	// the queue only needs a destination of every registry up front,
+	// which the plans have parsed already
+	var destinations []string
+	registries := map[string]bool{}
+	for _, g := range groups {
+		for _, d := range g.plan.Destinations {
+			registry := d.Ref.Registry
+			if strings.HasPrefix(d.Arg, ociLayoutScheme) {
+				registry = ociLayoutScheme
+			}
+			if !registries[registry] {
+				registries[registry] = true
+				destinations = append(destinations, d.Arg)
+			}
+		}
+	}
+	jobs := newJobQueue(*opts.workers, destinations)
+	// results are read while the groups are queued, so neither the queue
+	// nor the results need room for every destination
+	results := make(chan UploadResult, *opts.workers)
+	progress.run()
+	for i := 0; i < *opts.workers; i++ {
+		go manifestUploadWorker(auth, jobs, results)
+	}
+	queued := make(chan int, 1)
+	go func() {
+		exitCode := 0
+		for _, g := range groups {
+			code, err := enqueueGroup(g, opts, promote, resume, jobs, results)
+			if err == nil {
+				continue
+			}
+			if len(groups) == 1 {
+				if c := finishRun(err); code == 0 {
+					code = c
+				}
+				os.Exit(code)
+			}
+			if code != 0 {
+				exitCode = code
+			}
+			failGroup(g, err, results)
+		}
+		jobs.close()
+		queued <- exitCode
+	}()
+	// the results are only kept for --output json, which prints them all
+	// in order at the end
+	var ordered []UploadResult
+	if OutputFormat == "json" {
+		ordered = make([]UploadResult, total)
+	}
+	totals := newRunTotals()
+	exitCode := 0
+	for i := 0; i < total; i++ {
+		r := <-results
+		if ordered != nil {
+			ordered[r.Index] = r
+		}
+		totals.add(r)
+		events.result(r)
+		var immutable *immutableTagError
+		if errors.As(r.Err, &immutable) && !r.Optional && exitCode == 0 {
+			exitCode = exitTagImmutable
+		}
+		if err := printResult(r); err != nil {
+			l.Error("Error printing result: ", err)
+		}
 	}
+	if code := <-queued; code != 0 {
+		exitCode = code
+	}
+	progress.finish()
+	if err := printResults(ordered); err != nil {
+		l.Error("Error printing results: ", err)
+		os.Exit(1)
+	}
+	progress.summary(totals)
+	return exitCode
+}
+
+// prepareManifest applies --format, --label, --reset-created and
+// --annotation to the source manifest, returning the source to copy from and the manifest to
+// push
+func prepareManifest(src imageSource, manifest Manifest, opts *options) (imageSource, Manifest, error) {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "prepareManifest",
+		"source":  src.String(),
+	})
+	var err error
+	if *opts.stripAttestations {
+		source := manifest.Digest()
+		var removed []Descriptor
+		manifest, removed, err = stripAttestations(manifest)
+		if err != nil {
+			l.Error("Error stripping attestations: ", err)
+			return src, manifest, err
+		}
+		if len(removed) > 0 {
+			logStrippedAttestations(src.String(), removed)
+			l.Infof("Stripped %d attestation manifests from %s, pushing %s", len(removed), source, manifest.Digest())
+			report.setDigest(manifest.Digest())
+			report.setStrippedAttestations(removed)
+		}
+	}
+	if *opts.format != "auto" {
+		source := manifest.Digest()
+		conv := newConvertingSource(src, *opts.format)
+		manifest, err = conv.convert(manifest)
+		if err != nil {
+			l.Error("Error converting manifest: ", err)
+			return src, manifest, err
+		}
+		if manifest.Digest() != source {
+			l.Infof("Converted manifest %s to %s format as %s", source, *opts.format, manifest.Digest())
+			report.setDigest(manifest.Digest())
+		}
+		src = conv
+	}
+	if len(opts.labels) > 0 {
+		source := manifest.Digest()
+		labeled := newLabelingSource(src, opts.labels)
+		manifest, err = labeled.rewrite(manifest)
+		if err != nil {
+			l.Error("Error labeling image: ", err)
+			return src, manifest, err
+		}
+		l.Infof("Labeled manifest %s as %s", source, manifest.Digest())
+		report.setDigest(manifest.Digest())
+		src = labeled
+	}
+	if opts.resetCreated.isSet() {
+		source := manifest.Digest()
+		created := newCreatedSource(src, opts.resetCreated.time, *opts.resetHistoryCreated)
+		manifest, err = created.rewrite(manifest)
+		if err != nil {
+			l.Error("Error setting created time: ", err)
+			return src, manifest, err
+		}
+		l.Infof("Set created time of manifest %s to %s, pushing %s", source, opts.resetCreated.time.Format(time.RFC3339), manifest.Digest())
+		report.setDigest(manifest.Digest())
+		src = created
+	}
+	if len(opts.annotations) > 0 || len(opts.indexAnnotations) > 0 {
+		source := manifest.Digest()
+		manifest, err = annotateManifest(manifest, opts.annotations, opts.indexAnnotations)
+		if err != nil {
+			l.Error("Error annotating manifest: ", err)
+			return src, manifest, err
+		}
+		l.Infof("Annotated manifest %s as %s", source, manifest.Digest())
+		report.setDigest(manifest.Digest())
+	}
+	if ResolveURLs {
+		src = &urlSource{imageSource: src}
+	}
+	return src, manifest, nil
+}
+
+// finishOnce guards finishRun, which the main path, --deadline and a
+// signal can all reach at once
+var (
+	finishOnce sync.Once
+	finishCode int
+)
+
+// finishRun ends the run with err as the run error: it rolls back a
+// failed run with --rollback-on-failure, writes the report, sends
+// notifications and returns the exit code. Only the first call finishes
+// the run; later ones wait for it and return the same exit code.
+func finishRun(err error) int {
+	finishOnce.Do(func() { finishCode = finish(err) })
+	return finishCode
+}
+
+// finish does the work of finishRun
+func finish(err error) int {
+	stopSpool()
+	removeDaemonExports()
+	failed := report.finish(err)
+	if failed && RollbackOnFailure {
+		report.setRollback(rollbacks.rollback())
+	}
+	report.write()
+	events.runFinished(report)
+	tracing.finish(report.Status, err)
+	if MetricsFile != "" {
+		writeMetricsFile(MetricsFile, report.End.Sub(report.Start).Seconds(), failed)
+	}
+	writeGitHubActions()
+	if nerr := notifier.send(failed); nerr != nil && notifier.strict {
+		return 1
+	}
+	if failed {
+		return 1
+	}
+	return 0
 }
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// IgnoreDockerConfigProxies ignores the proxies and HttpHeaders sections
+// of the docker config
+var IgnoreDockerConfigProxies bool
+
+// dockerConfigFile is the part of the docker CLI config docker-retag uses
+type dockerConfigFile struct {
+	Auths map[string]struct {
+		Auth          string `json:"auth"`
+		IdentityToken string `json:"identitytoken"`
+	} `json:"auths"`
+	// Proxies are keyed by the docker daemon host they apply to, or
+	// default for all others
+	Proxies map[string]dockerProxyConfig `json:"proxies"`
+	// HTTPHeaders are sent with every request the docker CLI makes
+	HTTPHeaders map[string]string `json:"HttpHeaders"`
+}
+
+// dockerProxyConfig is an entry of the proxies section of the docker config
+type dockerProxyConfig struct {
+	HTTPProxy  string `json:"httpProxy"`
+	HTTPSProxy string `json:"httpsProxy"`
+	NoProxy    string `json:"noProxy"`
+}
+
+// readDockerConfig reads and parses the docker config at path
+func readDockerConfig(path string) (*dockerConfigFile, error) {
+	bd, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dc := &dockerConfigFile{}
+	if err := json.Unmarshal(bd, dc); err != nil {
+		return nil, err
+	}
+	return dc, nil
+}
+
+// proxy returns the proxies for the docker daemon host, as the docker CLI
+// picks them: the entry for DOCKER_HOST, or else the default entry
+func (dc *dockerConfigFile) proxy(daemonHost string) (dockerProxyConfig, bool) {
+	if daemonHost != "" {
+		if p, ok := dc.Proxies[daemonHost]; ok {
+			return p, true
+		}
+	}
+	p, ok := dc.Proxies["default"]
+	return p, ok
+}
+
+// dockerConfigHeaders are the HttpHeaders of the docker config, sent with
+// every request before the --header headers of the host
+var dockerConfigHeaders map[string]string
+
+// redactedProxy returns the proxy url for logging, without its password
+func redactedProxy(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	return u.Redacted()
+}
+
+// applyDockerConfigNetwork applies the proxies and HttpHeaders of the
+// docker config at path. The proxies are set as the HTTP_PROXY,
+// HTTPS_PROXY and NO_PROXY environment of the process, which every
+// transport reads, unless the environment already sets them in either
+// case. HttpHeaders are replaced by --header headers of the same name.
+// --no-docker-config skips the docker config for these as for auths.
+func applyDockerConfigNetwork(path string) error {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "applyDockerConfigNetwork",
+		"path":    path,
+	})
+	if NoDockerConfig {
+		l.Debug("Ignoring docker config proxies and headers, --no-docker-config is set")
+		return nil
+	}
+	if IgnoreDockerConfigProxies {
+		l.Debug("Ignoring docker config proxies and headers, --ignore-docker-config-proxies is set")
+		return nil
+	}
+	if path == "" {
+		return nil
+	}
+	dc, err := readDockerConfig(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if p, ok := dc.proxy(os.Getenv("DOCKER_HOST")); ok {
+		for _, v := range []struct {
+			name  string
+			value string
+		}{
+			{"HTTP_PROXY", p.HTTPProxy},
+			{"HTTPS_PROXY", p.HTTPSProxy},
+			{"NO_PROXY", p.NoProxy},
+		} {
+			if v.value == "" {
+				continue
+			}
+			logged := v.value
+			if v.name != "NO_PROXY" {
+				logged = redactedProxy(v.value)
+			}
+			if set, ok := lookupEnvAnyCase(v.name); ok {
+				l.Debugf("Using %s from the environment over %s from the docker config", set, logged)
+				continue
+			}
+			l.Debugf("Using %s=%s from the docker config", v.name, logged)
+			if err := os.Setenv(v.name, v.value); err != nil {
+				return err
+			}
+		}
+	}
+	if len(dc.HTTPHeaders) > 0 {
+		dockerConfigHeaders = map[string]string{}
+		var names []string
+		for name, value := range dc.HTTPHeaders {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			dockerConfigHeaders[name] = value
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			value := dockerConfigHeaders[name]
+			if sensitiveHeader(name) {
+				value = "REDACTED"
+			}
+			l.Debugf("Sending header %s: %s from the docker config", name, value)
+		}
+	}
+	return nil
+}
+
+// lookupEnvAnyCase returns the variable name, or its lower case form as
+// net/http also reads, as name=value if either is set
+func lookupEnvAnyCase(name string) (string, bool) {
+	for _, n := range []string{name, strings.ToLower(name)} {
+		if v, ok := os.LookupEnv(n); ok {
+			if n != "NO_PROXY" && n != "no_proxy" {
+				v = redactedProxy(v)
+			}
+			return n + "=" + v, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeDockerConfig writes a docker config with a proxy and a header and
+// returns its path
+func writeDockerConfig(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	config := `{"proxies":{"default":{"httpsProxy":"http://proxy.example.com:3128"}},"HttpHeaders":{"X-Meta":"from-config"}}`
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// clearProxyEnv unsets the proxy variables for the test
+func clearProxyEnv(t *testing.T) {
+	t.Helper()
+	for _, name := range []string{"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "http_proxy", "https_proxy", "no_proxy"} {
+		if v, ok := os.LookupEnv(name); ok {
+			os.Unsetenv(name)
+			t.Cleanup(func() { os.Setenv(name, v) })
+		}
+	}
+	t.Cleanup(func() { os.Unsetenv("HTTPS_PROXY") })
+}
+
+func TestApplyDockerConfigNetwork(t *testing.T) {
+	clearProxyEnv(t)
+	t.Cleanup(func() { dockerConfigHeaders = nil })
+	if err := applyDockerConfigNetwork(writeDockerConfig(t)); err != nil {
+		t.Fatal(err)
+	}
+	if got := os.Getenv("HTTPS_PROXY"); got != "http://proxy.example.com:3128" {
+		t.Errorf("HTTPS_PROXY = %q, want the proxy of the docker config", got)
+	}
+	if got := dockerConfigHeaders["X-Meta"]; got != "from-config" {
+		t.Errorf("header X-Meta = %q, want the header of the docker config", got)
+	}
+}
+
+func TestApplyDockerConfigNetworkNoDockerConfig(t *testing.T) {
+	clearProxyEnv(t)
+	t.Cleanup(func() { dockerConfigHeaders = nil })
+	NoDockerConfig = true
+	defer func() { NoDockerConfig = false }()
+	if err := applyDockerConfigNetwork(writeDockerConfig(t)); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := os.LookupEnv("HTTPS_PROXY"); ok {
+		t.Errorf("HTTPS_PROXY = %q with --no-docker-config, want it unset", got)
+	}
+	if len(dockerConfigHeaders) > 0 {
+		t.Errorf("headers %v applied with --no-docker-config", dockerConfigHeaders)
+	}
+}
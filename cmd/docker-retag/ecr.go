@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CreateRepository creates missing ECR destination repositories before
+// pushing
+var CreateRepository bool
+
+var ecrHostPattern = regexp.MustCompile(`^([0-9]{12})\.dkr\.ecr(-fips)?\.([a-z0-9-]+)\.amazonaws\.com(\.cn)?$`)
+
+// ecrRegistry returns the account id and region of an ECR registry host
+func ecrRegistry(registry string) (account, region string, ok bool) {
+	m := ecrHostPattern.FindStringSubmatch(canonicalHost(registry))
+	if m == nil {
+		return "", "", false
+	}
+	return m[1], m[3], true
+}
+
+// ecrAPIEndpoint returns the ECR API endpoint for the registry host,
+// which AWS_ENDPOINT_URL_ECR or AWS_ENDPOINT_URL override
+func ecrAPIEndpoint(registry, region string) string {
+	for _, env := range []string{"AWS_ENDPOINT_URL_ECR", "AWS_ENDPOINT_URL"} {
+		if u := os.Getenv(env); u != "" {
+			return strings.TrimSuffix(u, "/") + "/"
+		}
+	}
+	host := "api.ecr." + region + ".amazonaws.com"
+	if strings.HasSuffix(canonicalHost(registry), ".cn") {
+		host += ".cn"
+	}
+	return "https://" + host + "/"
+}
+
+// createECRRepository creates the repository of ref on ECR with the
+// CreateRepository API. A repository that already exists is not an error.
+// The signed call is bounded by --auth-timeout like token requests.
+func createECRRepository(ref ImageRef) error {
+	l := log.WithFields(log.Fields{
+		"package":    "main",
+		"fn":         "createECRRepository",
+		"registry":   ref.Registry,
+		"repository": ref.Image,
+	})
+	account, region, ok := ecrRegistry(ref.Registry)
+	if !ok {
+		return fmt.Errorf("%s is not an ECR registry", ref.Registry)
+	}
+	creds, err := loadAWSCredentials()
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string]string{
+		"registryId":     account,
+		"repositoryName": ref.Image,
+	})
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if AuthTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, AuthTimeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", ecrAPIEndpoint(ref.Registry, region), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "AmazonEC2ContainerRegistry_V20150921.CreateRepository")
+	req.Header.Set("User-Agent", userAgent())
+	signAWSRequest(req, body, creds, region, "ecr", time.Now())
+	resp, err := http.DefaultClient.Do(req)
+	audit("repository_create", ref, ref.Repository(), "", resp, err)
+	if err != nil {
+		err = authTimedOut(ctx, ref.Registry, "the ECR API at "+req.URL.Host, err)
+		l.Error("Error creating repository: ", err)
+		return err
+	}
+	defer resp.Body.Close()
+	bd := readErrorBody(resp.Body)
+	if resp.StatusCode == http.StatusOK {
+		l.Info("Created repository ", ref.Repository())
+		return nil
+	}
+	var apiErr struct {
+		Type    string `json:"__type"`
+		Message string `json:"message"`
+	}
+	json.Unmarshal(bd, &apiErr)
+	if strings.HasSuffix(apiErr.Type, "RepositoryAlreadyExistsException") {
+		l.Debug("Repository already exists")
+		return nil
+	}
+	l.Error("Error creating repository: ", resp.Status, " ", logBody(bd))
+	return fmt.Errorf("creating repository %s: %s %s", ref.Repository(), resp.Status, apiErr.Message)
+}
+
+// createRepositories creates the ECR repositories of the destinations
+// that do not exist yet, once per repository
+func createRepositories(destinations []PlanRef) error {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "createRepositories",
+	})
+	seen := map[string]bool{}
+	for _, d := range destinations {
+		if d.Ref.Registry == "" || seen[d.Ref.Repository()] {
+			continue
+		}
+		seen[d.Ref.Repository()] = true
+		if _, _, ok := ecrRegistry(d.Ref.Registry); !ok {
+			l.Warnf("Not creating %s, --create-repository is only supported for ECR", d.Ref.Repository())
+			continue
+		}
+		if err := createECRRepository(d.Ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCreateECRRepositoryAuthTimeout(t *testing.T) {
+	hung := make(chan struct{})
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hung
+	}))
+	defer api.Close()
+	defer close(hung)
+	t.Setenv("AWS_ENDPOINT_URL_ECR", api.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	timeout := AuthTimeout
+	AuthTimeout = 50 * time.Millisecond
+	defer func() { AuthTimeout = timeout }()
+
+	ref, err := urlToImageTag("123456789012.dkr.ecr.us-east-1.amazonaws.com/app:1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	err = createECRRepository(ref)
+	if err == nil || !strings.Contains(err.Error(), "credential resolution timed out for 123456789012.dkr.ecr.us-east-1.amazonaws.com via the ECR API") {
+		t.Errorf("createECRRepository = %v, want an --auth-timeout error naming the ECR API", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("createECRRepository took %s, want it bounded by --auth-timeout", elapsed)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Event types written to --events-fd and --events-file
+const (
+	// EventPlanStarted is written for each source before its destinations
+	// are validated
+	EventPlanStarted = "plan_started"
+	// EventSourceResolved is written when the source manifest was read,
+	// with its digest
+	EventSourceResolved = "source_resolved"
+	// EventDestinationStarted is written when a worker starts pushing to a
+	// destination
+	EventDestinationStarted = "destination_started"
+	// EventBlobCopyProgress is written while a blob is copied to a
+	// destination, at most every eventProgressInterval, and when it ends
+	EventBlobCopyProgress = "blob_copy_progress"
+	// EventDestinationFinished is written for every destination with its
+	// status, also for destinations that were skipped or never started
+	EventDestinationFinished = "destination_finished"
+	// EventRunFinished is the last event, with the summary of the run
+	EventRunFinished = "run_finished"
+)
+
+// eventProgressInterval bounds how often blob_copy_progress is written for
+// a blob
+const eventProgressInterval = time.Second
+
+// Event is a line of the --events-fd and --events-file stream. The field
+// names are stable; fields that do not apply to the type of the event, or
+// are zero, are left out.
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// Source is the source of the destination or group the event is for
+	Source      string `json:"source,omitempty"`
+	Destination string `json:"destination,omitempty"`
+	// Destinations is the number of destinations of a plan_started source
+	Destinations int `json:"destinations,omitempty"`
+	// Digest is the source digest of source_resolved and the pushed digest
+	// of destination_finished
+	Digest string `json:"digest,omitempty"`
+	// Status is success, failed or the reason a destination was skipped
+	// for destination_finished, and success or failed for run_finished
+	Status string `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// Blob is the digest of the blob of blob_copy_progress
+	Blob string `json:"blob,omitempty"`
+	// Bytes are the bytes of the blob copied so far, or the bytes copied
+	// for a finished destination
+	Bytes int64 `json:"bytes,omitempty"`
+	// Total is the size of the blob, if known
+	Total   int64         `json:"total,omitempty"`
+	Summary *EventSummary `json:"summary,omitempty"`
+	// TraceID is the trace of the run, from --trace-id or TRACEPARENT
+	TraceID string `json:"trace_id,omitempty"`
+}
+
+// EventSummary is the summary of run_finished
+type EventSummary struct {
+	Succeeded      int     `json:"succeeded"`
+	Skipped        int     `json:"skipped"`
+	Failed         int     `json:"failed"`
+	FailedOptional int     `json:"failed_optional"`
+	Bytes          int64   `json:"bytes"`
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+}
+
+// events writes the event stream; it is a no-op until configured from
+// main with --events-fd or --events-file
+var events = &eventWriter{}
+
+// eventWriter writes events as JSON lines. Each line is written with a
+// single write under the lock, so lines from concurrent workers do not
+// interleave.
+type eventWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// newEventWriter opens the stream for --events-fd or --events-file. The
+// stream must not be stdout, where --output writes, or stderr, where logs
+// are written.
+func newEventWriter(fd int, path string) (*eventWriter, error) {
+	switch {
+	case fd != 0 && path != "":
+		return nil, fmt.Errorf("only one of --events-fd and --events-file may be given")
+	case fd == 1 || fd == 2:
+		return nil, fmt.Errorf("--events-fd %d would interleave events with output and logs, use another descriptor such as 3", fd)
+	case fd < 0:
+		return nil, fmt.Errorf("--events-fd %d is not a file descriptor", fd)
+	case fd > 0:
+		return &eventWriter{w: os.NewFile(uintptr(fd), "events")}, nil
+	case path != "":
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		return &eventWriter{w: f}, nil
+	}
+	return &eventWriter{}, nil
+}
+
+// emit writes the event, stamped with the current time
+func (e *eventWriter) emit(ev Event) {
+	if e.w == nil {
+		return
+	}
+	ev.Time = time.Now().UTC()
+	ev.TraceID = tracing.traceID
+	bd, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.w.Write(append(bd, '\n'))
+}
+
+// enabled reports whether events are written, so callers can skip
+// preparing them
+func (e *eventWriter) enabled() bool {
+	return e.w != nil
+}
+
+// result writes destination_finished for the result of a destination
+func (e *eventWriter) result(r UploadResult) {
+	e.emit(Event{
+		Type:        EventDestinationFinished,
+		Source:      r.Source,
+		Destination: r.Destination,
+		Digest:      r.Digest,
+		Status:      r.Status,
+		Error:       r.Error,
+		Bytes:       r.Bytes,
+	})
+}
+
+// blobProgress writes blob_copy_progress for the transfer, unless one was
+// written less than eventProgressInterval ago and the transfer is not done
+func (e *eventWriter) blobProgress(t *transfer, done bool) {
+	if !e.enabled() {
+		return
+	}
+	t.eventMu.Lock()
+	if !done && time.Since(t.lastEvent) < eventProgressInterval {
+		t.eventMu.Unlock()
+		return
+	}
+	t.lastEvent = time.Now()
+	t.eventMu.Unlock()
+	ev := Event{
+		Type:  EventBlobCopyProgress,
+		Blob:  t.desc.Digest,
+		Bytes: t.copied(),
+		Total: t.desc.Size,
+	}
+	if t.stats != nil {
+		ev.Source, ev.Destination = t.stats.source, t.stats.destination
+	}
+	e.emit(ev)
+}
+
+// runFinished writes run_finished with the summary of the finished report
+func (e *eventWriter) runFinished(r *runReport) {
+	if !e.enabled() {
+		return
+	}
+	r.mu.Lock()
+	s := r.summary()
+	s.ElapsedSeconds = r.End.Sub(r.Start).Seconds()
+	ev := Event{Type: EventRunFinished, Status: r.Status, Error: r.Error, Summary: s}
+	r.mu.Unlock()
+	e.emit(ev)
+}
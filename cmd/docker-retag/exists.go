@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// ExistsResult is the outcome of checking a single reference
+type ExistsResult struct {
+	Reference string `json:"reference"`
+	Exists    bool   `json:"exists"`
+	Digest    string `json:"digest,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// existsCmd checks whether each reference exists without pulling or
+// pushing anything. It exits 0 if all exist, 1 if any is missing and 2 if
+// any check failed.
+func existsCmd(args []string) int {
+	fs := flag.NewFlagSet("exists", flag.ContinueOnError)
+	jsonOut := fs.Bool("json", OutputFormat == "json", "Print the results as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s exists [--json] <image> ...\n", commandName())
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	code := 0
+	var results []ExistsResult
+	for _, arg := range fs.Args() {
+		r := ExistsResult{Reference: arg}
+		ref, err := urlToImageTag(arg)
+		if err == nil {
+			r.Digest, r.Exists, err = manifestDigest(ref, ref.Reference())
+		}
+		switch {
+		case err != nil:
+			r.Error = err.Error()
+			code = 2
+		case !r.Exists && code == 0:
+			code = 1
+		}
+		results = append(results, r)
+		if *jsonOut {
+			continue
+		}
+		switch {
+		case r.Error != "":
+			fmt.Fprintf(os.Stderr, "%s: %s\n", arg, r.Error)
+		case r.Exists:
+			fmt.Printf("%s %s\n", arg, r.Digest)
+		default:
+			fmt.Printf("%s not found\n", arg)
+		}
+	}
+	if *jsonOut {
+		jd, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			return 2
+		}
+		fmt.Println(string(jd))
+	}
+	return code
+}
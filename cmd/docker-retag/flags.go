@@ -0,0 +1,339 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// keyValueFlag is a repeatable flag of key=value pairs
+type keyValueFlag map[string]string
+
+func (f keyValueFlag) String() string {
+	var kv []string
+	for k, v := range f {
+		kv = append(kv, k+"="+v)
+	}
+	sort.Strings(kv)
+	return strings.Join(kv, ",")
+}
+
+func (f keyValueFlag) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("expected key=value, got %q", s)
+	}
+	f[k] = v
+	return nil
+}
+
+// stringListFlag is a repeatable flag that also accepts comma separated values
+type stringListFlag []string
+
+func (f *stringListFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringListFlag) Set(s string) error {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*f = append(*f, v)
+		}
+	}
+	return nil
+}
+
+// byteSizeFlag is a size in bytes that accepts K, M, G and T binary
+// suffixes
+type byteSizeFlag int64
+
+var byteSizeUnits = map[string]int64{
+	"":  1,
+	"B": 1,
+	"K": 1 << 10, "KB": 1 << 10, "KIB": 1 << 10,
+	"M": 1 << 20, "MB": 1 << 20, "MIB": 1 << 20,
+	"G": 1 << 30, "GB": 1 << 30, "GIB": 1 << 30,
+	"T": 1 << 40, "TB": 1 << 40, "TIB": 1 << 40,
+}
+
+func (f *byteSizeFlag) String() string {
+	return formatBytes(int64(*f))
+}
+
+func (f *byteSizeFlag) Set(s string) error {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	i := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	if i < 0 {
+		i = len(s)
+	}
+	n, err := strconv.ParseInt(s[:i], 10, 64)
+	unit, ok := byteSizeUnits[strings.TrimSpace(s[i:])]
+	if err != nil || !ok {
+		return fmt.Errorf("invalid size %q", s)
+	}
+	*f = byteSizeFlag(n * unit)
+	return nil
+}
+
+// blobVerifyFlag is --verify-blobs: off, fail, or warn with
+// --verify-blobs=warn. Given without a value it fails on mismatches.
+type blobVerifyFlag string
+
+func (f *blobVerifyFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return string(*f)
+}
+
+func (f *blobVerifyFlag) Set(s string) error {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "false":
+		*f = ""
+	case "true", "fail":
+		*f = "fail"
+	case "warn":
+		*f = "warn"
+	default:
+		return fmt.Errorf("expected fail or warn, got %q", s)
+	}
+	return nil
+}
+
+func (f *blobVerifyFlag) IsBoolFlag() bool {
+	return true
+}
+
+// preflightFlag is --preflight: on by default for runs with several
+// destinations, forced on with --preflight and off with --preflight=false
+type preflightFlag string
+
+func (f *preflightFlag) String() string {
+	if f == nil || *f == "" {
+		return "auto"
+	}
+	return string(*f)
+}
+
+func (f *preflightFlag) Set(s string) error {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "auto":
+		*f = ""
+	case "", "true":
+		*f = "true"
+	case "false":
+		*f = "false"
+	default:
+		return fmt.Errorf("expected true, false or auto, got %q", s)
+	}
+	return nil
+}
+
+func (f *preflightFlag) IsBoolFlag() bool {
+	return true
+}
+
+// platformsFlag is a repeatable os/architecture[/variant] flag
+type platformsFlag []Platform
+
+func (f *platformsFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	var ps []string
+	for i := range *f {
+		ps = append(ps, (*f)[i].String())
+	}
+	return strings.Join(ps, ",")
+}
+
+func (f *platformsFlag) Set(s string) error {
+	p, err := parsePlatform(s)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, p)
+	return nil
+}
+
+// options holds the values of the command line flags
+type options struct {
+	username                *string
+	password                *string
+	passwordStdin           *bool
+	passwordFile            *string
+	credsFD                 *int
+	versionFlag             *bool
+	acceptSchema1           *bool
+	skipBlobCheck           *bool
+	expectDigest            *string
+	includeNonDistributable *bool
+	outputFormat            *string
+	dryRun                  *bool
+	workers                 *int
+	progress                *string
+	retries                 *int
+	spoolDir                *string
+	spool                   *string
+	report                  *string
+	reportFormat            *string
+	eventsFD                *int
+	eventsFile              *string
+	resume                  *string
+	watch                   *bool
+	interval                *time.Duration
+	auditLog                *string
+	notifyOn                *string
+	notifyTokenFile         *string
+	notifyStrict            *bool
+	yes                     *bool
+	ifNotExists             *bool
+	quiet                   *bool
+	format                  *string
+	artifactType            *string
+	maxSourceAge            *time.Duration
+	strictAge               *bool
+	verifySignature         *bool
+	cosignKey               *string
+	stripAttestations       *bool
+	keepAttestations        *bool
+	includeArtifacts        *bool
+	planOut                 *string
+	destFile                *string
+	expandEnv               *bool
+	force                   *bool
+	requirePlatforms        platformsFlag
+	maxSize                 byteSizeFlag
+	maxLayers               *int
+	resetCreated            createdFlag
+	resetHistoryCreated     *bool
+	labels                  keyValueFlag
+	annotations             keyValueFlag
+	indexAnnotations        keyValueFlag
+}
+
+// defineFlags registers all flags on the flag set. Completion scripts are
+// generated from the flag set, so every flag must be defined here.
+func defineFlags(fs *flag.FlagSet) *options {
+	o := &options{
+		labels:           keyValueFlag{},
+		annotations:      keyValueFlag{},
+		indexAnnotations: keyValueFlag{},
+	}
+	o.username = fs.String("u", "", "Username for registry")
+	o.password = fs.String("p", "", "Password for registry")
+	o.passwordStdin = fs.Bool("P", false, "Read password from stdin")
+	o.passwordFile = fs.String("password-file", "", "Read password for registry from file")
+	o.credsFD = fs.Int("creds-fd", 0, "Read a JSON object of registry hosts with username and password or token from this inherited file descriptor, used after -u and -p")
+	fs.DurationVar(&AuthTimeout, "auth-timeout", defaultAuthTimeout, "Fail a registry token request, an SSO identity token exchange or an ECR CreateRepository call for --create-repository that has not finished within this duration, 0 for no limit")
+	fs.BoolVar(&NoCIAuth, "no-ci-auth", false, "Do not use CI_JOB_TOKEN or GITHUB_TOKEN for the GitLab and GitHub registries")
+	fs.BoolVar(&NoDockerConfig, "no-docker-config", false, "Do not read the docker config file for credentials, proxies or HttpHeaders")
+	fs.BoolVar(&IgnoreDockerConfigProxies, "ignore-docker-config-proxies", false, "Do not use the proxies and HttpHeaders of the docker config file")
+	o.versionFlag = fs.Bool("v", false, "Print version, commit, build date and Go version and exit; with --output json as an object")
+	fs.BoolVar(o.versionFlag, "version", false, "Same as -v")
+	o.acceptSchema1 = fs.Bool("accept-schema1", false, "Push legacy schema1 manifests unchanged instead of refusing them")
+	fs.Var(&ManifestAccept, "accept", "Manifest media type to request, replacing the default list (repeatable)")
+	o.skipBlobCheck = fs.Bool("skip-blob-check", false, "Skip verifying that referenced blobs exist at the destination before pushing")
+	fs.Var(&VerifyBlobs, "verify-blobs", "Check the size and digest the registry reports for blobs that are mounted or already at the destination, and name the repository of blobs whose content does not match; --verify-blobs=warn only warns about reported mismatches")
+	o.includeNonDistributable = fs.Bool("include-nondistributable", false, "Copy foreign and non-distributable layers, and other layers with urls, from the source to the destination instead of skipping them")
+	fs.BoolVar(&ResolveURLs, "resolve-urls", false, "Download layers whose descriptors list urls from those urls, verifying their digest, and push them to the destination as regular blobs")
+	o.yes = fs.Bool("yes", false, "Overwrite existing tags that point at a different manifest without asking")
+	o.ifNotExists = fs.Bool("if-not-exists", false, "Skip destinations whose tag already exists")
+	o.expectDigest = fs.String("expect-digest", "", "Fail before pushing unless the source manifest has this digest (sha256:...)")
+	o.artifactType = fs.String("artifact-type", "", "Fail unless the source is an artifact of this type, such as application/vnd.cncf.helm.config.v1+json")
+	o.maxSourceAge = fs.Duration("max-source-age", 0, "Fail unless the source image was created within this duration, such as 72h, from the created time of its config or the newest platform of an index")
+	fs.Var(&o.requirePlatforms, "require-platform", "Fail before pushing unless the source has this platform, as os/architecture[/variant] (repeatable)")
+	fs.Var(&o.maxSize, "max-size", "Fail before pushing if the compressed layers of the source, or of any platform of an index, add up to more than this, such as 2GB; with --require-platform only those platforms are checked")
+	o.maxLayers = fs.Int("max-layers", 0, "Fail before pushing if the source, or any platform of an index, has more layers than this")
+	o.strictAge = fs.Bool("strict-age", false, "Fail --max-source-age for images without a created time instead of warning")
+	o.verifySignature = fs.Bool("verify-signature", false, "Fail with exit code 4 before pushing unless the source has a cosign signature that verifies with --cosign-key")
+	o.cosignKey = fs.String("cosign-key", "", "Public key file to verify source signatures with, the only way to verify them: KMS keys and keyless verification are not supported")
+	o.format = fs.String("format", "auto", "Manifest format to push: oci, docker or auto to keep the format of the source")
+	o.stripAttestations = fs.Bool("strip-attestations", false, "Remove attestation manifests, such as the unknown/unknown entries of buildkit, from a pushed index")
+	o.keepAttestations = fs.Bool("keep-attestations", false, "Copy the attestation manifests of an index, the default")
+	o.includeArtifacts = fs.Bool("include-artifacts", false, "Copy sources that are attestations, signatures or other artifacts rather than images, the default")
+	fs.BoolVar(&ExcludeArtifacts, "exclude-artifacts", false, "Skip sources that are attestations, signatures or other artifacts rather than images, such as sha256-* fallback tags")
+	fs.Var(&o.resetCreated, "reset-created", "Set the created time of the image config, for every platform of a multi-arch image, to this RFC 3339 time or now")
+	o.resetHistoryCreated = fs.Bool("reset-history-created", false, "With --reset-created, also set the created time of every history entry of the config")
+	fs.Var(o.labels, "label", "Label to set in the image config, for every platform of a multi-arch image, as key=value (repeatable)")
+	fs.Var(o.annotations, "annotation", "Annotation to set on the pushed manifest, or on every entry of an index, as key=value (repeatable)")
+	fs.Var(o.indexAnnotations, "index-annotation", "Annotation to set on the pushed index itself, as key=value (repeatable)")
+	o.outputFormat = fs.String("output", "text", "Output format for results: text, json, or ndjson to print each result as a JSON line as soon as it is done")
+	o.dryRun = fs.Bool("dry-run", false, "Validate the references and print what would be retagged without contacting any registry")
+	fs.Var(&DestTemplates, "dest-template", "Go template for a further destination, rendered from the source reference and image config, which is read even with --dry-run, such as registry.example.com/app:{{label \"org.opencontainers.image.version\"}} (repeatable)")
+	o.destFile = fs.String("dest-file", "", "Read further destinations from this file, one per line, or from stdin with -")
+	o.expandEnv = fs.Bool("expand-env", false, "Expand ${VAR} and $VAR in --dest-file destinations, failing if a variable is unset; $$ is a literal $")
+	fs.Var(RegistryPrefixes, "registry-prefix", "API path prefix for a registry served below the host root, as host=prefix (repeatable)")
+	fs.StringVar(&DefaultRegistry, "default-registry", dockerHubRegistry, "Registry of references that do not name one (env DOCKER_RETAG_DEFAULT_REGISTRY)")
+	fs.Var(RepositoryMap, "repo-map", "Rewrite destinations starting with a repository prefix to another prefix, as from=to (repeatable)")
+	fs.Var(RegistryAPIBases, "registry-api-base", "API path for a registry, or for a path on it that is left out of repository names, as host[/path]=base (repeatable)")
+	fs.Var(RegistryMirrors, "registry-mirror", "Read source images from a mirror before the registry, as registry=mirror (repeatable)")
+	fs.Var(&AllowedRegistries, "allowed-registries", "Only push to these registries, which may use globs like *.example.com (env DOCKER_RETAG_ALLOWED_REGISTRIES)")
+	fs.Var(&OptionalRegistries, "optional-registry", "Registry whose destinations are optional: their failures are reported but do not fail the run, like destinations given as ?ref (repeatable)")
+	fs.Var(&DeniedRegistries, "denied-registries", "Never push to these registries, takes precedence over --allowed-registries (env DOCKER_RETAG_DENIED_REGISTRIES)")
+	fs.Var(&ProtectedTags, "protected-tags", "Tag patterns such as latest,stable,v* that destinations may only overwrite with --allow-protected")
+	fs.BoolVar(&AllowProtected, "allow-protected", false, "Allow overwriting tags matching --protected-tags")
+	fs.BoolVar(&RequireExplicitTags, "require-explicit-tags", false, "Reject references without a tag or digest instead of defaulting to latest")
+	fs.Var(&Preflight, "preflight", "Check that every destination repository can be pushed to before pushing anything, reporting all that cannot; auto runs it for runs with several destinations")
+	fs.BoolVar(&CreateRepository, "create-repository", false, "Create missing ECR destination repositories before pushing")
+	fs.BoolVar(&RollbackOnFailure, "rollback-on-failure", false, "When a destination fails, restore the destination tags the run moved to their previous digest and delete the tags it created")
+	fs.BoolVar(&PreHead, "pre-head", false, "Make a HEAD request for the destination manifest before pushing it, for registries that expect one")
+	fs.Var(&RegistryHeaders, "header", "HTTP header to send with every request to a registry host, as host=Name:Value (repeatable)")
+	fs.StringVar(&TraceID, "trace-id", "", "Trace id of 32 hex digits to add to every log line and JSON output, by default the trace of the TRACEPARENT environment variable")
+	fs.BoolVar(&OTel, "otel", false, "Export spans of the run, each destination and each blob copy to the OTLP/HTTP collector of the OTEL_EXPORTER_OTLP_* environment")
+	fs.BoolVar(&DebugHTTP, "debug-http", false, "Log every registry request and response with its headers, redacting credentials and token-like headers")
+	fs.BoolVar(&NoAPICheck, "no-api-check", false, "Do not check that registries implement the v2 API with GET /v2/ before the first manifest request")
+	fs.Var(&PlainHTTP, "plain-http", "Registry host to talk to over plain http (repeatable)")
+	fs.BoolVar(&TLSSkipVerify, "tls-skip-verify", false, "Do not verify the TLS certificates of registries, such as self-signed certificates of test registries")
+	o.workers = fs.Int("workers", 10, "Number of destinations to push concurrently")
+	fs.Var(RegistryConcurrency, "registry-concurrency", "Destinations to push to a registry at once, as host=N, by default all workers but one for each other destination registry (repeatable)")
+	fs.Var(&MaxManifestSize, "max-manifest-size", "Fail when a registry serves a manifest larger than this")
+	fs.Var(&ChunkSize, "chunk-size", "Upload blobs larger than this in resumable chunks of this size, 0 to always upload in one request")
+	o.spoolDir = fs.String("spool-dir", "", "Download blobs to a temporary directory under this path and upload them from disk instead of streaming them")
+	o.spool = fs.String("spool", "all", "Blobs to spool: all, or auto for blobs larger than --chunk-size")
+	o.retries = fs.Int("retries", 3, "Number of times to retry a rate limited request or resume an interrupted chunked blob upload")
+	fs.DurationVar(&Deadline, "deadline", 0, "Fail the run if it has not finished within this duration, 0 for no limit")
+	o.report = fs.String("report", "", "Write a report of the run to this file, also when the run fails")
+	o.reportFormat = fs.String("report-format", "json", "Format of the --report file: json or junit")
+	o.eventsFD = fs.Int("events-fd", 0, "Write progress events as JSON lines to this open file descriptor, such as 3")
+	o.eventsFile = fs.String("events-file", "", "Append progress events as JSON lines to this file")
+	o.watch = fs.Bool("watch", false, "Keep running and retag the destinations whenever the source changes")
+	o.interval = fs.Duration("interval", time.Minute, "How often --watch checks the source")
+	o.planOut = fs.String("out", "", "File docker-retag plan writes the plan to, - for stdout")
+	o.force = fs.Bool("force", false, "Let docker-retag apply push even if sources no longer resolve to the planned digests")
+	o.resume = fs.String("resume", "", "Skip destinations that the run which wrote this json --report already retagged from the same source digest")
+	fs.StringVar(&MetricsFile, "metrics-file", "", "Write timing and transfer metrics of the run to this file in the Prometheus textfile format")
+	o.auditLog = fs.String("audit-log", "", "Append a JSON line for every mutating registry operation to this file (env DOCKER_RETAG_AUDIT_LOG)")
+	fs.BoolVar(&GitHubOutput, "github-output", false, "Write GitHub Actions step outputs and annotations (default when GITHUB_ACTIONS=true)")
+	fs.Var(&NotifyURLs, "notify-url", "Webhook to POST the run summary to when the run ends (repeatable)")
+	o.notifyOn = fs.String("notify-on", "always", "When to send notifications: success, failure or always")
+	o.notifyTokenFile = fs.String("notify-token-file", "", "Read a bearer token for the notification webhooks from file")
+	o.notifyStrict = fs.Bool("notify-strict", false, "Exit with an error if a notification cannot be sent")
+	o.progress = fs.String("progress", "auto", "Blob transfer progress output: auto, plain or tty")
+	o.quiet = fs.Bool("quiet", false, "Suppress progress output")
+	fs.String("config", "", "Config file with flag defaults and registry settings (default ~/"+defaultConfigFile+")")
+	return o
+}
+
+// subcommands are accepted in place of the source image
+var subcommands = []struct {
+	Name        string
+	Args        string
+	Description string
+}{
+	{"promote", "<image>:<tag>@<digest> <new tag> ...", "Retag only if the source tag still points at the digest, exiting 3 on drift"},
+	{"plan", "--out plan.json <image> <new tag> ...", "Resolve sources and check destinations without pushing, and write a plan to apply later"},
+	{"apply", "[--force] plan.json", "Execute a plan, exiting 3 if a source no longer resolves to the planned digest"},
+	{"config", "show", "Print the effective configuration with secrets masked"},
+	{"completion", "bash|zsh|fish", "Print a shell completion script"},
+	{"diff", "[--json] <image> <image>", "Compare two images, exiting 1 if they differ"},
+	{"exists", "[--json] <image> ...", "Check whether images exist, exiting 1 if any is missing"},
+	{"digest", "[--platform os/arch] [--full-ref] <image> ...", "Print the manifest digest of images"},
+	{"index", "create|annotate|rm-platform <image> ...", "Create or edit multi-arch indexes"},
+	{"prune", "<repository> --filter <regexp> [--older-than 720h] [--keep n] [--dry-run]", "Delete tags matching a pattern"},
+	{"alias", "<repository> --target <tag> [--pattern <regexp>] [--semver-range <range>] [--dry-run]", "Point a tag at the tag of the highest semantic version"},
+	{"check", "[--json] [--repository <repository>] <registry>[/<repository>] ...", "Check credentials and connectivity for registries without pushing"},
+}
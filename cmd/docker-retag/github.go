@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// GitHubOutput enables GitHub Actions outputs and annotations outside of
+// GITHUB_ACTIONS
+var GitHubOutput bool
+
+// githubActions reports whether GitHub Actions integration is enabled
+func githubActions() bool {
+	return GitHubOutput || os.Getenv("GITHUB_ACTIONS") == "true"
+}
+
+// githubEscape escapes workflow command data
+func githubEscape(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// githubEscapeProperty escapes workflow command property values
+func githubEscapeProperty(s string) string {
+	return strings.NewReplacer(":", "%3A", ",", "%2C").Replace(githubEscape(s))
+}
+
+// writeGitHubActions writes the run results as step outputs to
+// $GITHUB_OUTPUT and as workflow command annotations on stderr, leaving
+// stdout to --output
+func writeGitHubActions() {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "writeGitHubActions",
+	})
+	if !githubActions() {
+		return
+	}
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	destinations := []string{}
+	statuses := map[string]string{}
+	for _, r := range report.Results {
+		destinations = append(destinations, r.Destination)
+		statuses[r.Destination] = r.Status
+		if r.Status == statusDuplicate {
+			fmt.Fprintf(os.Stderr, "::notice title=%s::Skipped %s, it duplicates an earlier destination\n", githubEscapeProperty(r.Destination), githubEscape(r.Destination))
+			continue
+		}
+		if r.Status == "skipped" {
+			fmt.Fprintf(os.Stderr, "::notice title=%s::Skipped %s, the tag already exists and was not overwritten\n", githubEscapeProperty(r.Destination), githubEscape(r.Destination))
+			continue
+		}
+		if r.Status == "success" {
+			fmt.Fprintf(os.Stderr, "::notice title=%s::Retagged %s as %s\n", githubEscapeProperty(r.Destination), githubEscape(r.Source), githubEscape(r.Destination+"@"+r.Digest))
+			continue
+		}
+		msg := r.Error
+		if msg == "" {
+			msg = report.Error
+		}
+		if msg == "" {
+			msg = r.Status
+		}
+		if r.optionalFailure() {
+			fmt.Fprintf(os.Stderr, "::warning title=%s::Retagging %s to an optional destination failed: %s\n", githubEscapeProperty(r.Destination), githubEscape(r.Source), githubEscape(msg))
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "::error title=%s::Retagging %s failed: %s\n", githubEscapeProperty(r.Destination), githubEscape(r.Source), githubEscape(msg))
+	}
+	if len(report.Results) == 0 && report.Error != "" {
+		fmt.Fprintf(os.Stderr, "::error::%s\n", githubEscape(report.Error))
+	}
+	path := os.Getenv("GITHUB_OUTPUT")
+	if path == "" {
+		return
+	}
+	dj, _ := json.Marshal(destinations)
+	sj, _ := json.Marshal(statuses)
+	out := fmt.Sprintf("digest=%s\ndestinations=%s\nstatus=%s\nresult=%s\n", report.Digest, dj, sj, report.Status)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		l.Error("Error opening GITHUB_OUTPUT: ", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.WriteString(out); err != nil {
+		l.Error("Error writing GITHUB_OUTPUT: ", err)
+	}
+}
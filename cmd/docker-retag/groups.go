@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// groupSeparator separates the groups of a run, each a source and its
+// destinations, as in "app:1.2.3 app:latest -- worker:1.2.3 worker:latest"
+const groupSeparator = "--"
+
+// retagGroup is a source and its destinations. A run has one group for
+// every --separated part of its arguments; they share the workers, the
+// credential and token caches and the report.
+type retagGroup struct {
+	index        int
+	source       string
+	destinations []string
+	plan         *Plan
+	// arguments are the destinations as given, before --repo-map
+	arguments []string
+	// planned is the group of the plan file apply executes, if any
+	planned *PlannedGroup
+	// offset is the index of the first destination of the group among all
+	// destinations of the run
+	offset int
+}
+
+// splitGroups splits the arguments into groups at each --. It returns
+// nil if a group is empty.
+func splitGroups(args []string) []*retagGroup {
+	var groups []*retagGroup
+	start := 0
+	for i := 0; i <= len(args); i++ {
+		if i < len(args) && args[i] != groupSeparator {
+			continue
+		}
+		if i == start {
+			return nil
+		}
+		groups = append(groups, &retagGroup{
+			index:        len(groups),
+			source:       args[start],
+			destinations: append([]string{}, args[start+1:i]...),
+		})
+		start = i + 1
+	}
+	return groups
+}
+
+// enqueueGroup reads the source of the group, prepares the manifest to
+// push and queues a job for every destination that is pushed. The results
+// of the other destinations, such as those resume already retagged, are
+// sent directly. If the group cannot be retagged the error is logged and
+// returned, with the exit code for it, or 0 for the exit code of a
+// failed run.
+func enqueueGroup(g *retagGroup, opts *options, promote bool, resume *runReport, jobs *jobQueue, results chan<- UploadResult) (int, error) {
+	l := log.WithFields(log.Fields{
+		"package":    "main",
+		"fn":         "enqueueGroup",
+		"image":      g.source,
+		"new_images": g.destinations,
+	})
+	// get original manifest
+	src, err := newImageSource(g.source)
+	if err != nil {
+		l.Error("Error opening source: ", err)
+		return 0, err
+	}
+	manifest, err := src.root()
+	if err != nil {
+		l.Error("Error getting manifest: ", err)
+		var notFound *manifestNotFoundError
+		if errors.As(err, &notFound) {
+			return exitSourceNotFound, err
+		}
+		return 0, err
+	}
+	l.Debug("Got manifest")
+	events.emit(Event{Type: EventSourceResolved, Source: g.source, Digest: manifest.Digest()})
+	report.setDigest(manifest.Digest())
+	if *opts.expectDigest != "" && manifest.Digest() != *opts.expectDigest {
+		err := fmt.Errorf("source manifest digest %s does not match expected digest %s", manifest.Digest(), *opts.expectDigest)
+		code := 0
+		if promote {
+			err = fmt.Errorf("tag drift detected: expected %s got %s", *opts.expectDigest, manifest.Digest())
+			code = exitTagDrift
+		}
+		l.Error(err)
+		return code, err
+	}
+	if ExcludeArtifacts && manifestKind(manifest) == kindArtifact {
+		l.Infof("Skipping %s, an artifact of type %q rather than an image", manifest.Digest(), manifest.artifactType())
+		for _, r := range artifactResults(g, manifest.Digest()) {
+			report.record(r)
+			results <- r
+		}
+		return 0, nil
+	}
+	if *opts.artifactType != "" && manifest.artifactType() != *opts.artifactType {
+		err := fmt.Errorf("source is an artifact of type %q, expected %q", manifest.artifactType(), *opts.artifactType)
+		l.Error(err)
+		return 0, err
+	}
+	if g.planned != nil {
+		if err := g.planned.checkDrift("source", g.planned.SourceDigest, manifest.Digest(), *opts.force); err != nil {
+			l.Error(err)
+			return exitTagDrift, err
+		}
+	}
+	if *opts.maxSourceAge > 0 {
+		age, err := checkSourceAge(src, manifest, *opts.maxSourceAge, *opts.strictAge)
+		report.setSourceAge(g.index, age)
+		if err != nil {
+			l.Error(err)
+			return 0, err
+		}
+	}
+	if g.plan.Size == nil && *opts.report != "" {
+		// the report has the size even without --max-size
+		if size, err := sourceSize(src, manifest, opts.requirePlatforms); err != nil {
+			l.Warn("Error getting the size of the source for the report: ", err)
+		} else {
+			report.setSourceSize(g.index, size)
+		}
+	}
+	var signature *SignatureCheck
+	if verifier != nil {
+		if signature, err = verifier.verify(src, manifest.Digest()); err != nil {
+			l.Error("Error verifying signature: ", err)
+			return exitSignature, err
+		}
+	}
+	sourceDigest := manifest.Digest()
+	src, manifest, err = prepareManifest(src, manifest, opts)
+	if err != nil {
+		return 0, err
+	}
+	if g.planned != nil && sourceDigest == g.planned.SourceDigest {
+		if err := g.planned.checkDrift("manifest to push", g.planned.Digest, manifest.Digest(), *opts.force); err != nil {
+			l.Error(err)
+			return exitTagDrift, err
+		}
+	}
+	report.setGroupDigest(g.index, manifest.Digest())
+	if src, err = startSpool(src, manifest, g.plan, opts); err != nil {
+		l.Error(err)
+		return 0, err
+	}
+	done, err := resume.resumed(g.source, manifest.Digest(), g.destinations)
+	if err != nil {
+		l.Error(err)
+		return 0, err
+	}
+	if CreateRepository {
+		if err := createRepositories(g.plan.Destinations); err != nil {
+			l.Error("Error creating repositories: ", err)
+			return 0, err
+		}
+	}
+	skipped := checkOverwrites(g.plan, manifest.Digest(), isTerminal(os.Stdin), *opts.yes, *opts.ifNotExists)
+	for i, r := range done {
+		skipped[i] = r
+	}
+	for i, r := range g.plan.plannedResults(manifest.Digest(), manifest.Digest() == sourceDigest) {
+		skipped[i] = r
+	}
+	kind := manifestKind(manifest)
+	for i, newImage := range g.destinations {
+		optional := g.plan.Destinations[i].Optional
+		if r, ok := skipped[i]; ok {
+			r.Index = g.offset + i
+			r.Kind = kind
+			if r.Optional = optional; r.Status == "failed" {
+				r.Status = r.failedStatus()
+			}
+			report.record(r)
+			results <- r
+			continue
+		}
+		jobs.push(UploadJob{
+			Index:     g.offset + i,
+			Manifest:  manifest,
+			Src:       src,
+			Source:    g.source,
+			Image:     newImage,
+			Signature: signature,
+			Optional:  optional,
+		})
+	}
+	return 0, nil
+}
+
+// failGroup fails every destination of a group that could not be
+// retagged with err, so the other groups of the run can go on
+func failGroup(g *retagGroup, err error, results chan<- UploadResult) {
+	report.setGroupError(g.index, err)
+	for i, d := range g.destinations {
+		r := UploadResult{
+			Index:       g.offset + i,
+			Source:      g.source,
+			Destination: d,
+			Status:      "failed",
+			Error:       err.Error(),
+			Err:         err,
+		}
+		report.record(r)
+		results <- r
+	}
+}
+
+// printPlans prints the plan of every group, as a single JSON array with
+// --output json
+func printPlans(groups []*retagGroup) error {
+	if OutputFormat == "json" && len(groups) > 1 {
+		plans := make([]*Plan, len(groups))
+		for i, g := range groups {
+			plans[i] = g.plan
+		}
+		jd, err := json.MarshalIndent(plans, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(jd))
+		return nil
+	}
+	for i, g := range groups {
+		if i > 0 && OutputFormat == "text" {
+			fmt.Println()
+		}
+		if err := g.plan.print(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
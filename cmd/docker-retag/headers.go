@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RegistryHeaders are extra HTTP headers sent to a registry host, given as
+// host=Name:Value with --header
+var RegistryHeaders headerFlag
+
+// DebugHTTP logs every registry request and response with its headers,
+// token-like headers redacted
+var DebugHTTP bool
+
+// registryHeader is a header sent with every request to host
+type registryHeader struct {
+	host  string
+	name  string
+	value string
+}
+
+// headerFlag is the repeatable --header flag. Its String leaves out the
+// values, which may be credentials.
+type headerFlag []registryHeader
+
+func (f *headerFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	var hs []string
+	for _, h := range *f {
+		hs = append(hs, h.host+"="+h.name)
+	}
+	return strings.Join(hs, ",")
+}
+
+func (f *headerFlag) Set(s string) error {
+	host, header, ok := strings.Cut(s, "=")
+	name, value, hasValue := strings.Cut(header, ":")
+	name = strings.TrimSpace(name)
+	if !ok || host == "" || !hasValue || name == "" || strings.ContainsAny(name, " \t") {
+		return fmt.Errorf("expected host=Name:Value, got %q", s)
+	}
+	*f = append(*f, registryHeader{host: host, name: http.CanonicalHeaderKey(name), value: strings.TrimSpace(value)})
+	return nil
+}
+
+// userAgent is the User-Agent of every request docker-retag sends
+func userAgent() string {
+	return build.userAgent()
+}
+
+// setRequestHeaders sets the User-Agent of req, the HttpHeaders of the
+// docker config and the --header headers for its host. Headers of other
+// hosts are never sent, also not to redirect targets or token services on
+// another host.
+func setRequestHeaders(req *http.Request) {
+	req.Header.Set("User-Agent", userAgent())
+	if tp := tracing.traceparent(); tp != "" {
+		req.Header.Set("traceparent", tp)
+	}
+	for name, value := range dockerConfigHeaders {
+		req.Header.Set(name, value)
+	}
+	host := canonicalHost(req.URL.Host)
+	for _, h := range RegistryHeaders {
+		if canonicalHost(h.host) == host {
+			req.Header.Set(h.name, h.value)
+		}
+	}
+}
+
+// removeRegistryHeaders removes the --header headers of host from h, when
+// a request is redirected away from it
+func removeRegistryHeaders(h http.Header, host string) {
+	host = canonicalHost(host)
+	for _, rh := range RegistryHeaders {
+		if canonicalHost(rh.host) == host {
+			h.Del(rh.name)
+		}
+	}
+}
+
+// sensitiveHeader reports whether the header may carry a credential, so
+// its value is redacted even with --debug-http
+func sensitiveHeader(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range []string{"authorization", "token", "secret", "password", "key", "cookie", "session", "signature", "credential"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// loggedHeaders formats h for --debug-http, with sensitive values redacted
+func loggedHeaders(h http.Header) string {
+	var names []string
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var hs []string
+	for _, name := range names {
+		v := strings.Join(h[name], ", ")
+		if sensitiveHeader(name) {
+			v = "REDACTED"
+		}
+		hs = append(hs, name+": "+v)
+	}
+	return strings.Join(hs, "; ")
+}
+
+// logHTTP logs the request and its response with --debug-http
+func logHTTP(req *http.Request, resp *http.Response, err error) {
+	if !DebugHTTP {
+		return
+	}
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "logHTTP",
+		"method":  req.Method,
+		"url":     req.URL.String(),
+		"request": loggedHeaders(req.Header),
+	})
+	if err != nil {
+		l.Info("HTTP request failed: ", err)
+		return
+	}
+	l.WithFields(log.Fields{
+		"status":   resp.Status,
+		"response": loggedHeaders(resp.Header),
+	}).Info("HTTP request")
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// exitTagImmutable is the exit code when a destination tag could not be
+// overwritten because the registry enforces tag immutability
+const exitTagImmutable = 6
+
+// immutableTagError is a manifest push rejected because the destination
+// tag is immutable, such as on ECR repositories with immutable tags or
+// Harbor projects with immutability rules. It is not retried.
+type immutableTagError struct {
+	ref    ImageRef
+	status string
+	// message is the registry's own message
+	message string
+}
+
+func (e *immutableTagError) Error() string {
+	return fmt.Sprintf("destination tag %s is immutable: %s %s", e.ref.String(), e.status, e.message)
+}
+
+// immutableTag returns the error for a manifest push to ref rejected with
+// body bd because the tag is immutable, or nil if it was rejected for
+// another reason. ECR answers TAG_INVALID saying the tag already exists,
+// Harbor DENIED or PRECONDITION saying the tag is immutable.
+func immutableTag(ref ImageRef, resp *http.Response, bd []byte) *immutableTagError {
+	var re registryErrors
+	json.Unmarshal(bd, &re)
+	for _, e := range re.Errors {
+		msg := strings.ToLower(e.Message)
+		switch {
+		case e.Code == "TAG_INVALID" && strings.Contains(msg, "already exists"),
+			strings.Contains(msg, "immutable"):
+			return &immutableTagError{ref: ref, status: resp.Status, message: e.Message}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// indexEntry is a source image added to an index, with an optional
+// platform override
+type indexEntry struct {
+	arg      string
+	platform *Platform
+}
+
+// indexEntriesFlag collects --add images. --platform applies to the
+// image added before it.
+type indexEntriesFlag []*indexEntry
+
+func (f *indexEntriesFlag) String() string {
+	return fmt.Sprint(len(*f), " images")
+}
+
+func (f *indexEntriesFlag) Set(s string) error {
+	*f = append(*f, &indexEntry{arg: s})
+	return nil
+}
+
+type indexPlatformFlag struct {
+	entries *indexEntriesFlag
+}
+
+func (f indexPlatformFlag) String() string {
+	return ""
+}
+
+func (f indexPlatformFlag) Set(s string) error {
+	if f.entries == nil || len(*f.entries) == 0 {
+		return errors.New("--platform must follow the --add it applies to")
+	}
+	p, err := parsePlatform(s)
+	if err != nil {
+		return err
+	}
+	(*f.entries)[len(*f.entries)-1].platform = &p
+	return nil
+}
+
+// indexDescriptor makes sure the image is in the target repository and
+// returns its descriptor for the index
+func indexDescriptor(target ImageRef, e *indexEntry) (Descriptor, error) {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "indexDescriptor",
+		"image":   e.arg,
+	})
+	src, err := newImageSource(e.arg)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	m, err := src.root()
+	if err != nil {
+		l.Error("Error getting manifest: ", err)
+		return Descriptor{}, err
+	}
+	if m.isIndex() {
+		return Descriptor{}, fmt.Errorf("%s is already a multi-arch index, add a single platform image instead", e.arg)
+	}
+	if m.MediaType == mediaTypeSchema1Signed {
+		return Descriptor{}, fmt.Errorf("%s is a schema1 manifest and cannot be added to an index", e.arg)
+	}
+	platform := e.platform
+	if platform == nil {
+		c, err := fetchConfig(src, m)
+		if err != nil {
+			l.Error("Error getting config: ", err)
+			return Descriptor{}, err
+		}
+		if c.OS == "" || c.Architecture == "" {
+			return Descriptor{}, fmt.Errorf("%s has no os and architecture in its config, pass --platform after --add", e.arg)
+		}
+		platform = &Platform{OS: c.OS, Architecture: c.Architecture, Variant: c.Variant, OSVersion: c.OSVersion}
+	}
+	rs, ok := src.(*registrySource)
+	if !ok || rs.ref.Repository() != target.Repository() {
+		l.Debug("Copying manifest to ", target.Repository())
+		if err := ensureContent(src, m, target, nil); err != nil {
+			return Descriptor{}, err
+		}
+		if _, _, err := putManifest(target, m.Digest(), m); err != nil {
+			return Descriptor{}, err
+		}
+	}
+	mediaType := m.ContentType
+	if mediaType == "" {
+		mediaType = m.MediaType
+	}
+	return Descriptor{
+		MediaType: mediaType,
+		Digest:    m.Digest(),
+		Size:      int64(len(m.Raw)),
+		Platform:  platform,
+	}, nil
+}
+
+// indexCreate assembles an index from single platform images and pushes
+// it to the target tag
+func indexCreate(args []string) int {
+	fs := flag.NewFlagSet("index create", flag.ContinueOnError)
+	var entries indexEntriesFlag
+	fs.Var(&entries, "add", "Image to add to the index (repeatable)")
+	fs.Var(indexPlatformFlag{&entries}, "platform", "Platform of the preceding --add image, instead of reading it from the image config")
+	format := fs.String("format", "oci", "Index format: oci or docker")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s index create <image> --add <image> [--platform os/arch] ...\n", commandName())
+		fs.PrintDefaults()
+	}
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return 1
+	}
+	if len(positional) != 1 || len(entries) == 0 {
+		fs.Usage()
+		return 1
+	}
+	target := positional[0]
+	idx := Manifest{SchemaVersion: 2}
+	switch *format {
+	case "oci":
+		idx.MediaType = mediaTypeOCIIndex
+	case "docker":
+		idx.MediaType = mediaTypeManifestList
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown index format %q, expected oci or docker\n", *format)
+		return 1
+	}
+	ref, err := urlToImageTag(target)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	if ref.Tag == "" || ref.Digest != "" {
+		fmt.Fprintln(os.Stderr, "Error: the index must be pushed to a tag")
+		return 1
+	}
+	seen := map[string]string{}
+	for _, e := range entries {
+		d, err := indexDescriptor(ref, e)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s: %s\n", e.arg, err)
+			return 1
+		}
+		if prev, ok := seen[d.Platform.String()]; ok {
+			fmt.Fprintf(os.Stderr, "Error: %s and %s are both %s\n", prev, e.arg, d.Platform)
+			return 1
+		}
+		seen[d.Platform.String()] = e.arg
+		idx.Manifests = append(idx.Manifests, d)
+	}
+	digest, _, err := putManifest(ref, ref.Reference(), idx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	fmt.Printf("%s@%s\n", ref.Repository(), digest)
+	return 0
+}
+
+// parseInterspersed parses args allowing flags before, between and
+// after the positional arguments, which it returns
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// editIndex fetches the index at arg, lets edit change its entries and
+// pushes the result back to the same tag, printing the old and new
+// digests. The index and its entries are edited as raw JSON so fields
+// docker-retag does not know about are kept as they are.
+func editIndex(arg string, edit func(entries []map[string]json.RawMessage) ([]map[string]json.RawMessage, error)) error {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "editIndex",
+		"image":   arg,
+	})
+	ref, err := urlToImageTag(arg)
+	if err != nil {
+		return err
+	}
+	if ref.Tag == "" || ref.Digest != "" {
+		return errors.New("the index must be referenced by tag")
+	}
+	m, err := fetchManifest(ref, ref.Tag)
+	if err != nil {
+		l.Error("Error getting manifest: ", err)
+		return err
+	}
+	if !m.isIndex() {
+		return fmt.Errorf("%s is a single platform image manifest (%s), not an index", arg, m.ContentType)
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(m.Raw, &doc); err != nil {
+		l.Error("Error decoding index: ", err)
+		return err
+	}
+	var entries []map[string]json.RawMessage
+	if err := json.Unmarshal(doc["manifests"], &entries); err != nil {
+		l.Error("Error decoding index entries: ", err)
+		return err
+	}
+	if entries, err = edit(entries); err != nil {
+		return err
+	}
+	if doc["manifests"], err = json.Marshal(entries); err != nil {
+		return err
+	}
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	updated, err := parseManifest(raw, m.ContentType)
+	if err != nil {
+		return err
+	}
+	digest, _, err := putManifest(ref, ref.Tag, updated)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s -> %s\n", m.Digest(), digest)
+	return nil
+}
+
+// entryPlatform decodes the platform of a raw index entry
+func entryPlatform(entry map[string]json.RawMessage) *Platform {
+	var p *Platform
+	if raw, ok := entry["platform"]; ok {
+		json.Unmarshal(raw, &p)
+	}
+	return p
+}
+
+// indexAnnotate sets annotations on the index entries for a platform
+func indexAnnotate(args []string) int {
+	fs := flag.NewFlagSet("index annotate", flag.ContinueOnError)
+	platform := fs.String("platform", "", "Platform of the entries to annotate, as os/arch[/variant]")
+	annotations := keyValueFlag{}
+	fs.Var(annotations, "annotation", "Annotation to set as key=value (repeatable)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s index annotate <image> --platform os/arch --annotation key=value ...\n", commandName())
+		fs.PrintDefaults()
+	}
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return 1
+	}
+	if len(positional) != 1 || *platform == "" || len(annotations) == 0 {
+		fs.Usage()
+		return 1
+	}
+	want, err := parsePlatform(*platform)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	err = editIndex(positional[0], func(entries []map[string]json.RawMessage) ([]map[string]json.RawMessage, error) {
+		matched := false
+		for _, e := range entries {
+			if !entryPlatform(e).matches(want) {
+				continue
+			}
+			matched = true
+			raw, err := mergeAnnotations(e["annotations"], annotations)
+			if err != nil {
+				return nil, err
+			}
+			e["annotations"] = raw
+		}
+		if !matched {
+			return nil, fmt.Errorf("no entry for platform %s in the index", (&want).String())
+		}
+		return entries, nil
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	return 0
+}
+
+// indexRemovePlatform removes the entries for platforms from the index
+func indexRemovePlatform(args []string) int {
+	fs := flag.NewFlagSet("index rm-platform", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s index rm-platform <image> <os/arch> ...\n", commandName())
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return 1
+	}
+	var platforms []Platform
+	for _, s := range fs.Args()[1:] {
+		p, err := parsePlatform(s)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			return 1
+		}
+		platforms = append(platforms, p)
+	}
+	err := editIndex(fs.Arg(0), func(entries []map[string]json.RawMessage) ([]map[string]json.RawMessage, error) {
+		var kept []map[string]json.RawMessage
+		for _, e := range entries {
+			p := entryPlatform(e)
+			remove := false
+			for _, want := range platforms {
+				remove = remove || p.matches(want)
+			}
+			if !remove {
+				kept = append(kept, e)
+			}
+		}
+		if len(kept) == len(entries) {
+			return nil, errors.New("none of the platforms are in the index")
+		}
+		if len(kept) == 0 {
+			return nil, errors.New("refusing to remove every entry from the index")
+		}
+		return kept, nil
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	return 0
+}
+
+// indexCmd dispatches the index subcommands
+func indexCmd(args []string) int {
+	if len(args) > 0 {
+		switch args[0] {
+		case "create":
+			return indexCreate(args[1:])
+		case "annotate":
+			return indexAnnotate(args[1:])
+		case "rm-platform":
+			return indexRemovePlatform(args[1:])
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Usage: %s index create|annotate|rm-platform <image> ...\n", commandName())
+	return 1
+}
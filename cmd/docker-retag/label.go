@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// configSource serves the images of another source with their config
+// changed by edit, such as with labels added. The modified configs are
+// kept in memory and served by their new digest, the layers are read from
+// the underlying source.
+type configSource struct {
+	imageSource
+	// edited describes the change for errors, such as labeled
+	edited string
+	edit   func(doc map[string]json.RawMessage) error
+
+	mu        sync.Mutex
+	manifests map[string]Manifest
+	configs   map[string][]byte
+}
+
+func newConfigSource(src imageSource, edited string, edit func(map[string]json.RawMessage) error) *configSource {
+	return &configSource{
+		imageSource: src,
+		edited:      edited,
+		edit:        edit,
+		manifests:   map[string]Manifest{},
+		configs:     map[string][]byte{},
+	}
+}
+
+// newLabelingSource adds labels to the image configs of src
+func newLabelingSource(src imageSource, labels map[string]string) *configSource {
+	return newConfigSource(src, "labeled", func(doc map[string]json.RawMessage) error {
+		return labelConfig(doc, labels)
+	})
+}
+
+func (s *configSource) unwrap() imageSource {
+	return s.imageSource
+}
+
+func (s *configSource) root() (Manifest, error) {
+	m, err := s.imageSource.root()
+	if err != nil {
+		return m, err
+	}
+	return s.rewrite(m)
+}
+
+func (s *configSource) manifest(reference string) (Manifest, error) {
+	s.mu.Lock()
+	m, ok := s.manifests[reference]
+	s.mu.Unlock()
+	if ok {
+		return m, nil
+	}
+	m, err := s.imageSource.manifest(reference)
+	if err != nil {
+		return m, err
+	}
+	return s.rewrite(m)
+}
+
+func (s *configSource) openBlob(desc Descriptor) (io.ReadCloser, error) {
+	s.mu.Lock()
+	config, ok := s.configs[desc.Digest]
+	s.mu.Unlock()
+	if ok {
+		return ioutil.NopCloser(bytes.NewReader(config)), nil
+	}
+	return s.imageSource.openBlob(desc)
+}
+
+// editConfig returns the config blob changed by edit
+func (s *configSource) editConfig(desc Descriptor) ([]byte, error) {
+	rc, err := s.imageSource.openBlob(desc)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	bd, err := ioutil.ReadAll(newVerifyingReader(rc, desc))
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(bd, &doc); err != nil {
+		return nil, fmt.Errorf("decoding config %s: %w", desc.Digest, err)
+	}
+	if err := s.edit(doc); err != nil {
+		return nil, fmt.Errorf("config %s: %w", desc.Digest, err)
+	}
+	return json.Marshal(doc)
+}
+
+// labelConfig adds the labels to the config document doc
+func labelConfig(doc map[string]json.RawMessage, labels map[string]string) error {
+	config := map[string]json.RawMessage{}
+	if raw, ok := doc["config"]; ok && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &config); err != nil {
+			return fmt.Errorf("decoding config: %w", err)
+		}
+	}
+	merged := map[string]string{}
+	if raw, ok := config["Labels"]; ok && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &merged); err != nil {
+			return fmt.Errorf("decoding labels: %w", err)
+		}
+	}
+	for k, v := range labels {
+		merged[k] = v
+	}
+	var err error
+	if config["Labels"], err = json.Marshal(merged); err != nil {
+		return err
+	}
+	doc["config"], err = json.Marshal(config)
+	return err
+}
+
+// rewrite returns m with its config changed, or the config of every image
+// in an index, which then refers to the new manifests. Only the config
+// descriptors change, the rest of the manifests is kept as it is.
+func (s *configSource) rewrite(m Manifest) (Manifest, error) {
+	if m.isSchema1(m.ContentType) {
+		return m, fmt.Errorf("schema1 manifests cannot be %s", s.edited)
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(m.Raw, &doc); err != nil {
+		return m, err
+	}
+	var err error
+	if m.isIndex() {
+		var descriptors []map[string]json.RawMessage
+		if err := json.Unmarshal(doc["manifests"], &descriptors); err != nil {
+			return m, err
+		}
+		for i, d := range descriptors {
+			digest := m.Manifests[i].Digest
+			child, err := s.imageSource.manifest(digest)
+			if err != nil {
+				return m, fmt.Errorf("getting manifest %s: %w", digest, err)
+			}
+			if child, err = s.rewrite(child); err != nil {
+				return m, fmt.Errorf("rewriting manifest %s: %w", digest, err)
+			}
+			d["digest"], _ = json.Marshal(child.Digest())
+			d["size"], _ = json.Marshal(len(child.Raw))
+		}
+		if doc["manifests"], err = json.Marshal(descriptors); err != nil {
+			return m, err
+		}
+	} else {
+		if m.Config == nil {
+			return m, fmt.Errorf("manifest %s has no config and cannot be %s", m.Digest(), s.edited)
+		}
+		switch m.Config.MediaType {
+		case mediaTypeDockerConfig, mediaTypeOCIConfig:
+		default:
+			return m, fmt.Errorf("manifest %s is an artifact of type %s, only image configs can be %s", m.Digest(), m.artifactType(), s.edited)
+		}
+		config, err := s.editConfig(*m.Config)
+		if err != nil {
+			return m, err
+		}
+		var desc map[string]json.RawMessage
+		if err := json.Unmarshal(doc["config"], &desc); err != nil {
+			return m, err
+		}
+		desc["digest"], _ = json.Marshal(digestOf(config))
+		desc["size"], _ = json.Marshal(len(config))
+		if doc["config"], err = json.Marshal(desc); err != nil {
+			return m, err
+		}
+		s.mu.Lock()
+		s.configs[digestOf(config)] = config
+		s.mu.Unlock()
+	}
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return m, err
+	}
+	out, err := parseManifest(raw, m.ContentType)
+	if err != nil {
+		return m, err
+	}
+	s.mu.Lock()
+	s.manifests[out.Digest()] = out
+	s.mu.Unlock()
+	return out, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TLSSkipVerify accepts any certificate a registry presents, such as the
+// self-signed certificate of a local test registry
+var TLSSkipVerify bool
+
+var (
+	loopbackProtocolsMu sync.Mutex
+	loopbackProtocols   = map[string]*loopbackProtocol{}
+)
+
+// loopbackProtocol is the protocol of one loopback registry, found once
+// per run
+type loopbackProtocol struct {
+	once     sync.Once
+	protocol string
+}
+
+// isLoopbackHost reports whether the registry host, with or without a
+// port, is localhost or a loopback address
+func isLoopbackHost(registry string) bool {
+	host := registry
+	if h, _, err := net.SplitHostPort(registry); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// loopbackRegistryProtocol returns the protocol of a registry on a
+// loopback address. Local registries usually serve plain http, so https
+// is tried first and, if it fails with a TLS or connection error, the
+// registry is talked to over http when it answers there. Other hosts are
+// never downgraded without --plain-http.
+func loopbackRegistryProtocol(registry string) string {
+	host := canonicalHost(registry)
+	loopbackProtocolsMu.Lock()
+	p, ok := loopbackProtocols[host]
+	if !ok {
+		p = &loopbackProtocol{}
+		loopbackProtocols[host] = p
+	}
+	loopbackProtocolsMu.Unlock()
+	p.once.Do(func() {
+		p.protocol = probeLoopbackProtocol(registry)
+	})
+	return p.protocol
+}
+
+// probeLoopbackProtocol sends GET /v2/ over https, and over http if that
+// fails. It stays with https unless http answers like a registry, so a
+// registry with a certificate problem fails with the TLS error rather
+// than a confusing plain http response.
+func probeLoopbackProtocol(registry string) string {
+	l := log.WithFields(log.Fields{
+		"package":  "main",
+		"fn":       "probeLoopbackProtocol",
+		"registry": registry,
+	})
+	err := probeProtocol("https", registry)
+	if err == nil {
+		return "https"
+	}
+	l.Debug("Loopback registry does not answer over https: ", err)
+	if probeProtocol("http", registry) != nil {
+		return "https"
+	}
+	l.Warn("Loopback registry does not answer over https, falling back to plain http: ", err)
+	return "http"
+}
+
+// probeProtocol sends GET /v2/ to the registry over protocol. Over http, it
+// fails unless the response is one a registry sends.
+func probeProtocol(protocol, registry string) error {
+	req, err := http.NewRequest("GET", protocol+"://"+registry+"/v2/", nil)
+	if err != nil {
+		return err
+	}
+	c, err := clientFor(registry)
+	if err != nil {
+		return err
+	}
+	setRequestHeaders(req)
+	resp, err := c.Do(req)
+	logHTTP(req, resp, err)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if protocol == "http" && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnauthorized &&
+		resp.Header.Get("Docker-Distribution-Api-Version") == "" {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// forgetLoopbackProtocols drops the protocols found for loopback
+// registries and the clients made for them, before and after the test
+func forgetLoopbackProtocols(t *testing.T) {
+	t.Helper()
+	forget := func() {
+		loopbackProtocolsMu.Lock()
+		loopbackProtocols = map[string]*loopbackProtocol{}
+		loopbackProtocolsMu.Unlock()
+		hostClientsMu.Lock()
+		hostClients = map[string]*http.Client{}
+		hostClientsMu.Unlock()
+		forgetAPIChecks()
+	}
+	forget()
+	t.Cleanup(forget)
+	t.Setenv("INSECURE_REGISTRY", "")
+}
+
+func TestIsLoopbackHost(t *testing.T) {
+	tests := map[string]bool{
+		"localhost":             true,
+		"localhost:5001":        true,
+		"LocalHost:5001":        true,
+		"127.0.0.1":             true,
+		"127.0.0.1:5000":        true,
+		"127.1.2.3:5000":        true,
+		"[::1]:5000":            true,
+		"::1":                   true,
+		"10.0.0.1:5000":         false,
+		"[fd00::1]:5000":        false,
+		"registry.example.com":  false,
+		"localhost.example.com": false,
+		"docker.io":             false,
+	}
+	for host, want := range tests {
+		if got := isLoopbackHost(host); got != want {
+			t.Errorf("isLoopbackHost(%q) = %v, want %v", host, got, want)
+		}
+	}
+}
+
+func TestLoopbackRegistryFallsBackToHTTP(t *testing.T) {
+	forgetLoopbackProtocols(t)
+	anonymousEnv(t)
+	r := startTestRegistry(t, httptest.NewServer)
+	r.putManifest("app", "1.0", mediaTypeOCIManifest, testImageManifest(1))
+	logs := new(test.Hook)
+	hooks := log.StandardLogger().ReplaceHooks(log.LevelHooks{})
+	defer log.StandardLogger().ReplaceHooks(hooks)
+	log.AddHook(logs)
+
+	port := r.host[strings.LastIndex(r.host, ":"):]
+	for _, host := range []string{r.host, "localhost" + port} {
+		if got := registryProtocol(host); got != "http" {
+			t.Errorf("registryProtocol(%s) = %s, want http for an http-only loopback registry", host, got)
+		}
+		ref, err := urlToImageTag(host + "/app:1.0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fetchManifest(ref, "1.0"); err != nil {
+			t.Errorf("fetchManifest from %s: %v", host, err)
+		}
+	}
+	downgrades := 0
+	for _, e := range logs.AllEntries() {
+		if e.Level == log.WarnLevel && strings.Contains(e.Message, "falling back to plain http") {
+			downgrades++
+		}
+	}
+	if downgrades != 2 {
+		t.Errorf("logged %d downgrades, want one warning for each host", downgrades)
+	}
+}
+
+func TestLoopbackRegistrySelfSigned(t *testing.T) {
+	forgetLoopbackProtocols(t)
+	anonymousEnv(t)
+	r := startTestRegistry(t, httptest.NewTLSServer)
+	r.putManifest("app", "1.0", mediaTypeOCIManifest, testImageManifest(1))
+	ref := r.ref(t, "app", "1.0")
+
+	// without --tls-skip-verify the certificate error is kept, not
+	// downgraded to http
+	if got := registryProtocol(r.host); got != "https" {
+		t.Errorf("registryProtocol = %s, want https for an https loopback registry", got)
+	}
+	err := checkRegistryAPI(ref)
+	if err == nil || !strings.Contains(err.Error(), "--tls-skip-verify") {
+		t.Errorf("checkRegistryAPI = %v, want the untrusted certificate pointing to --tls-skip-verify", err)
+	}
+
+	forgetLoopbackProtocols(t)
+	skip := TLSSkipVerify
+	TLSSkipVerify = true
+	defer func() { TLSSkipVerify = skip }()
+	if got := registryProtocol(r.host); got != "https" {
+		t.Errorf("registryProtocol with --tls-skip-verify = %s, want https", got)
+	}
+	if _, err := fetchManifest(ref, "1.0"); err != nil {
+		t.Errorf("fetchManifest with --tls-skip-verify: %v", err)
+	}
+}
+
+func TestNonLoopbackRegistryIsNotDowngraded(t *testing.T) {
+	forgetLoopbackProtocols(t)
+	if got := registryProtocol("registry.example.com:5000"); got != "https" {
+		t.Errorf("registryProtocol = %s, want https for a registry that is not on a loopback address", got)
+	}
+	loopbackProtocolsMu.Lock()
+	defer loopbackProtocolsMu.Unlock()
+	if len(loopbackProtocols) > 0 {
+		t.Error("the protocol of a registry that is not on a loopback address was probed")
+	}
+}
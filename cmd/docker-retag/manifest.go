@@ -0,0 +1,668 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	mediaTypeSchema1       = "application/vnd.docker.distribution.manifest.v1+json"
+	mediaTypeSchema1Signed = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+	mediaTypeSchema2       = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeManifestList  = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest   = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex      = "application/vnd.oci.image.index.v1+json"
+	mediaTypeOCIArtifact   = "application/vnd.oci.artifact.manifest.v1+json"
+	mediaTypeOCIEmpty      = "application/vnd.oci.empty.v1+json"
+)
+
+// manifestAccept is the Accept header sent when fetching manifests
+var manifestAccept = []string{
+	mediaTypeSchema2,
+	mediaTypeManifestList,
+	mediaTypeOCIManifest,
+	mediaTypeOCIIndex,
+	mediaTypeOCIArtifact,
+}
+
+// MaxManifestSize bounds the size of manifests read from registries, so a
+// misbehaving registry cannot make docker-retag read an unbounded response
+var MaxManifestSize = byteSizeFlag(4 << 20)
+
+// readManifest reads a manifest response body, decompressing it if a
+// proxy gzipped it, failing if it is larger than MaxManifestSize
+func readManifest(r io.Reader) ([]byte, error) {
+	limit := int64(MaxManifestSize)
+	bd, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if bd, err = gunzipBody(bd, limit+1); err != nil {
+		return nil, err
+	}
+	if int64(len(bd)) > limit {
+		return nil, fmt.Errorf("manifest exceeds size limit of %s, raise it with --max-manifest-size", formatBytes(limit))
+	}
+	return bd, nil
+}
+
+// ManifestAccept replaces manifestAccept when set with --accept
+var ManifestAccept stringListFlag
+
+// PreHead makes a HEAD request for the destination before every manifest
+// PUT, for registries that behave differently for manifests never HEADed
+var PreHead bool
+
+// errHeadNotSupported is returned by headManifest when the registry
+// answers HEAD with 405 or 501, which callers fall back from to a GET
+var errHeadNotSupported = errors.New("registry does not support HEAD for manifests")
+
+// acceptedTypes returns the manifest media types to request
+func acceptedTypes() []string {
+	if len(ManifestAccept) > 0 {
+		return ManifestAccept
+	}
+	return manifestAccept
+}
+
+// acceptHeader returns the Accept header for manifest requests
+func acceptHeader() string {
+	return strings.Join(acceptedTypes(), ", ")
+}
+
+// isAccepted reports whether contentType is one of the requested media
+// types, ignoring parameters such as q on either side
+func isAccepted(contentType string) bool {
+	for _, t := range acceptedTypes() {
+		if strings.TrimSpace(strings.Split(t, ";")[0]) == contentType {
+			return true
+		}
+	}
+	return false
+}
+
+// Platform describes the platform of an image in an index
+type Platform struct {
+	Architecture string   `json:"architecture"`
+	OS           string   `json:"os"`
+	OSVersion    string   `json:"os.version,omitempty"`
+	OSFeatures   []string `json:"os.features,omitempty"`
+	Variant      string   `json:"variant,omitempty"`
+}
+
+// parsePlatform parses a platform given as os/architecture[/variant]
+func parsePlatform(s string) (Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Platform{}, fmt.Errorf("invalid platform %q, expected os/architecture[/variant]", s)
+	}
+	p := Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// matches reports whether the platform satisfies want. The variant is
+// only compared when want has one.
+func (p *Platform) matches(want Platform) bool {
+	return p != nil && p.OS == want.OS && p.Architecture == want.Architecture && (want.Variant == "" || p.Variant == want.Variant)
+}
+
+// platformManifest returns the descriptor for the platform in the index
+func (m Manifest) platformManifest(want Platform) (Descriptor, error) {
+	for _, d := range m.Manifests {
+		if d.Platform.matches(want) {
+			return d, nil
+		}
+	}
+	var available []string
+	for _, d := range m.Manifests {
+		available = append(available, d.Platform.String())
+	}
+	return Descriptor{}, fmt.Errorf("no manifest for platform %s, available: %s", (&want).String(), strings.Join(available, ", "))
+}
+
+// String formats the platform as os/architecture[/variant]
+func (p *Platform) String() string {
+	if p == nil {
+		return "unknown"
+	}
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	if p.OSVersion != "" {
+		s += ":" + p.OSVersion
+	}
+	return s
+}
+
+// Descriptor references a blob or manifest by digest
+type Descriptor struct {
+	MediaType string   `json:"mediaType"`
+	Digest    string   `json:"digest"`
+	Size      int64    `json:"size"`
+	URLs      []string `json:"urls,omitempty"`
+	// ArtifactType is set on index entries of OCI artifacts, such as
+	// those of the referrers API and its fallback tags
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	Platform     *Platform         `json:"platform,omitempty"`
+}
+
+// nonDistributable reports whether the descriptor is a foreign or
+// non-distributable layer, such as a Windows base layer, which registries
+// serve from its urls and which must not be pushed unless permitted
+func (d Descriptor) nonDistributable() bool {
+	return strings.Contains(d.MediaType, ".foreign.") || strings.Contains(d.MediaType, ".nondistributable.")
+}
+
+type Manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Config        *Descriptor  `json:"config,omitempty"`
+	Layers        []Descriptor `json:"layers,omitempty"`
+	// Manifests is set for image indexes and manifest lists
+	Manifests []Descriptor `json:"manifests,omitempty"`
+	// ArtifactType, Blobs and Subject are set for OCI artifacts such as
+	// helm charts and signatures
+	ArtifactType string       `json:"artifactType,omitempty"`
+	Blobs        []Descriptor `json:"blobs,omitempty"`
+	Subject      *Descriptor  `json:"subject,omitempty"`
+	// Raw holds the manifest bytes as served by the registry
+	Raw []byte `json:"-"`
+	// ContentType is the media type the registry served the manifest as
+	ContentType string `json:"-"`
+}
+
+// Digest returns the sha256 digest of the raw manifest bytes. Registries
+// address signed schema1 manifests by the digest of their payload, the
+// manifest without its signatures, so that is used for those.
+func (m Manifest) Digest() string {
+	if m.isSchema1(m.ContentType) {
+		if payload, err := schema1Payload(m.Raw); err == nil {
+			return digestOf(payload)
+		}
+	}
+	return digestOf(m.Raw)
+}
+
+// schema1Payload returns the payload of a signed schema1 manifest: the
+// bytes before the signatures, up to the formatLength of the protected
+// header of a signature, followed by its formatTail, as libtrust signs it
+func schema1Payload(raw []byte) ([]byte, error) {
+	var jws struct {
+		Signatures []struct {
+			Protected string `json:"protected"`
+		} `json:"signatures"`
+	}
+	if err := json.Unmarshal(raw, &jws); err != nil {
+		return nil, err
+	}
+	if len(jws.Signatures) == 0 {
+		return nil, errors.New("schema1 manifest has no signatures")
+	}
+	protected, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(jws.Signatures[0].Protected, "="))
+	if err != nil {
+		return nil, fmt.Errorf("decoding schema1 protected header: %w", err)
+	}
+	var header struct {
+		FormatLength int    `json:"formatLength"`
+		FormatTail   string `json:"formatTail"`
+	}
+	if err := json.Unmarshal(protected, &header); err != nil {
+		return nil, fmt.Errorf("parsing schema1 protected header: %w", err)
+	}
+	tail, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(header.FormatTail, "="))
+	if err != nil {
+		return nil, fmt.Errorf("decoding schema1 format tail: %w", err)
+	}
+	if header.FormatLength <= 0 || header.FormatLength > len(raw) {
+		return nil, fmt.Errorf("schema1 format length %d is outside the manifest", header.FormatLength)
+	}
+	return append(append([]byte(nil), raw[:header.FormatLength]...), tail...), nil
+}
+
+// digestOf returns the sha256 digest of b
+func digestOf(b []byte) string {
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// isSchema1 returns true if the manifest is a legacy schema1 manifest,
+// which cannot be represented by the schema2 Manifest struct
+func (m Manifest) isSchema1(contentType string) bool {
+	if m.SchemaVersion == 1 {
+		return true
+	}
+	switch contentType {
+	case mediaTypeSchema1, mediaTypeSchema1Signed:
+		return true
+	}
+	return false
+}
+
+// isIndex returns true for OCI image indexes and docker manifest lists
+func (m Manifest) isIndex() bool {
+	switch m.ContentType {
+	case mediaTypeManifestList, mediaTypeOCIIndex:
+		return true
+	}
+	return m.Config == nil && len(m.Manifests) > 0
+}
+
+// blobs returns the config and layer descriptors of an image manifest,
+// or the blobs of an artifact manifest. Their media types are not
+// interpreted, so artifacts are copied as opaque blobs.
+func (m Manifest) blobs() []Descriptor {
+	var blobs []Descriptor
+	if m.Config != nil {
+		blobs = append(blobs, *m.Config)
+	}
+	blobs = append(blobs, m.Layers...)
+	return append(blobs, m.Blobs...)
+}
+
+// artifactType returns the type of artifact the manifest holds: its
+// artifactType, or the media type of its config
+func (m Manifest) artifactType() string {
+	if m.ArtifactType != "" {
+		return m.ArtifactType
+	}
+	if m.Config != nil && m.Config.MediaType != mediaTypeOCIEmpty {
+		return m.Config.MediaType
+	}
+	return ""
+}
+
+// parseManifest parses raw manifest bytes served with contentType
+func parseManifest(bd []byte, contentType string) (Manifest, error) {
+	var m Manifest
+	if err := json.Unmarshal(bd, &m); err != nil {
+		return m, err
+	}
+	m.Raw = bd
+	m.ContentType = strings.TrimSpace(strings.Split(contentType, ";")[0])
+	if m.ContentType == "" {
+		m.ContentType = m.MediaType
+	}
+	return m, nil
+}
+
+// getManifest gets the manifest at url with the credentials of auth
+func getManifest(url string, auth AuthProvider) (Manifest, error) {
+	ref, err := urlToImageTag(url)
+	if err != nil {
+		return Manifest{}, err
+	}
+	return fetchManifest(ref.withAuth(auth), ref.Reference())
+}
+
+// fetchManifest gets the manifest for the tag or digest in ref's repository
+func fetchManifest(ref ImageRef, reference string) (Manifest, error) {
+	l := log.WithFields(log.Fields{
+		"package":   "main",
+		"func":      "fetchManifest",
+		"url":       ref.String(),
+		"reference": reference,
+	})
+	l.Debug("Getting manifest from ", ref.String())
+	defer metrics.observe("manifest_get", ref.Registry, time.Now())
+	var m Manifest
+	if err := checkRegistryAPI(ref); err != nil {
+		l.Error(err)
+		return m, err
+	}
+	l.Debug("Registry: ", ref.Registry)
+	l.Debug("Image: ", ref.Image)
+	l.Debug("Reference: ", reference)
+	manifestUrl := ref.apiURL("manifests", reference)
+	l = l.WithFields(log.Fields{
+		"manifestUrl": manifestUrl,
+	})
+	l.Debug("Manifest url: ", manifestUrl)
+	req, err := http.NewRequest("GET", manifestUrl, nil)
+	if err != nil {
+		l.Error("Error creating request: ", err)
+		return m, err
+	}
+	req.Header.Add("Accept", acceptHeader())
+	if err := authorize(req, ref); err != nil {
+		l.Error("Error getting registry auth: ", err)
+		return m, err
+	}
+	l.Debug("Accept: ", req.Header.Get("Accept"))
+	resp, err := registryDo(req, ref.authProvider())
+	if err != nil {
+		l.Error("Error getting manifest: ", err)
+		return m, err
+	}
+	defer resp.Body.Close()
+	bd, err := readManifest(resp.Body)
+	if err != nil {
+		l.Error("Error reading response body: ", err)
+		return m, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		err := manifestNotFound(ref, reference, bd)
+		l.Error("Error getting manifest: ", err)
+		return m, err
+	}
+	if resp.StatusCode != 200 {
+		l.Error("Error getting manifest: ", resp.Status)
+		return m, errors.New(resp.Status)
+	}
+	l.Debug("Manifest: ", logBody(bd))
+	l.Debug("Content-Type: ", resp.Header.Get("Content-Type"))
+	m, err = parseManifest(bd, resp.Header.Get("Content-Type"))
+	if err != nil {
+		l.Error("Error unmarshalling manifest: ", err)
+		return m, err
+	}
+	if m.isSchema1(m.ContentType) {
+		if !AcceptSchema1 {
+			l.Error("Refusing schema1 manifest")
+			return m, fmt.Errorf("%s is a legacy schema1 manifest which cannot be retagged without losing data; pass --accept-schema1 to push the original signed manifest unchanged", ref.String())
+		}
+		l.Debug("Accepting schema1 manifest")
+		m.MediaType = mediaTypeSchema1Signed
+		m.ContentType = mediaTypeSchema1Signed
+	} else if !isAccepted(m.ContentType) {
+		l.Errorf("Registry served %q, which was not requested", m.ContentType)
+		return m, fmt.Errorf("%s was served as %q, which is not one of the accepted types %q", ref.String(), m.ContentType, acceptHeader())
+	}
+	return m, nil
+}
+
+// manifestExists checks whether the tag or digest exists in ref's repository
+func manifestExists(ref ImageRef, reference string) (bool, error) {
+	_, exists, err := headManifest(ref, reference)
+	if errors.Is(err, errHeadNotSupported) {
+		_, exists, err = getManifestDigest(ref, reference)
+	}
+	return exists, err
+}
+
+// headManifest checks whether the tag or digest exists in ref's
+// repository with a HEAD request, returning the Docker-Content-Digest the
+// registry sent, if any
+func headManifest(ref ImageRef, reference string) (string, bool, error) {
+	l := log.WithFields(log.Fields{
+		"package":   "main",
+		"fn":        "headManifest",
+		"url":       ref.String(),
+		"reference": reference,
+	})
+	l.Debug("Checking manifest existence")
+	if err := checkRegistryAPI(ref); err != nil {
+		l.Error(err)
+		return "", false, err
+	}
+	req, err := http.NewRequest("HEAD", ref.apiURL("manifests", reference), nil)
+	if err != nil {
+		l.Error("Error creating request: ", err)
+		return "", false, err
+	}
+	req.Header.Add("Accept", acceptHeader())
+	if err := authorize(req, ref); err != nil {
+		l.Error("Error getting registry auth: ", err)
+		return "", false, err
+	}
+	resp, err := registryDo(req, ref.authProvider())
+	if err != nil {
+		l.Error("Error checking manifest: ", err)
+		return "", false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Header.Get("Docker-Content-Digest"), true, nil
+	case http.StatusNotFound:
+		return "", false, nil
+	case http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		l.Debug("HEAD not supported: ", resp.Status)
+		return "", false, errHeadNotSupported
+	}
+	l.Error("Error checking manifest: ", resp.Status)
+	return "", false, errors.New(resp.Status)
+}
+
+// manifestDigest returns the digest of the manifest for the tag or digest
+// in ref's repository and whether it exists. The digest is taken from a
+// HEAD request, falling back to hashing the manifest when the registry
+// does not send Docker-Content-Digest or does not support HEAD.
+func manifestDigest(ref ImageRef, reference string) (string, bool, error) {
+	l := log.WithFields(log.Fields{
+		"package":   "main",
+		"fn":        "manifestDigest",
+		"url":       ref.String(),
+		"reference": reference,
+	})
+	digest, exists, err := headManifest(ref, reference)
+	switch {
+	case errors.Is(err, errHeadNotSupported):
+		l.Debug("HEAD not supported, getting manifest")
+	case err != nil || !exists || digest != "":
+		return digest, exists, err
+	default:
+		l.Debug("No digest in HEAD response, getting manifest")
+	}
+	return getManifestDigest(ref, reference)
+}
+
+// getManifestDigest returns the digest of the manifest for the tag or
+// digest in ref's repository and whether it exists, hashing the manifest
+// from a GET request
+func getManifestDigest(ref ImageRef, reference string) (string, bool, error) {
+	l := log.WithFields(log.Fields{
+		"package":   "main",
+		"fn":        "getManifestDigest",
+		"url":       ref.String(),
+		"reference": reference,
+	})
+	req, err := http.NewRequest("GET", ref.apiURL("manifests", reference), nil)
+	if err != nil {
+		l.Error("Error creating request: ", err)
+		return "", false, err
+	}
+	req.Header.Add("Accept", acceptHeader())
+	if err := authorize(req, ref); err != nil {
+		l.Error("Error getting registry auth: ", err)
+		return "", false, err
+	}
+	resp, err := registryDo(req, ref.authProvider())
+	if err != nil {
+		l.Error("Error getting manifest: ", err)
+		return "", false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		l.Error("Error getting manifest: ", resp.Status)
+		return "", false, errors.New(resp.Status)
+	}
+	bd, err := readManifest(resp.Body)
+	if err != nil {
+		l.Error("Error reading response body: ", err)
+		return "", false, err
+	}
+	// parsed like fetchManifest parses it, so signed schema1 manifests
+	// are digested over their payload in both
+	m, err := parseManifest(bd, resp.Header.Get("Content-Type"))
+	if err != nil {
+		l.Error("Error unmarshalling manifest: ", err)
+		return "", false, err
+	}
+	return m.Digest(), true, nil
+}
+
+// uploadManifest pushes the manifest to url with the credentials of auth
+// and returns the digest the registry stored it under and whether the
+// registry reported it created
+func uploadManifest(url string, auth AuthProvider, manifest Manifest) (string, bool, error) {
+	ref, err := urlToImageTag(url)
+	if err != nil {
+		return "", false, err
+	}
+	return putManifest(ref.withAuth(auth), ref.Reference(), manifest)
+}
+
+// putManifest pushes the manifest to the tag or digest in ref's repository
+// and returns the digest the registry stored it under. Child manifests of
+// an index are pushed by digest, so no intermediate tags are created; the
+// manifest must then have that digest.
+func putManifest(ref ImageRef, reference string, manifest Manifest) (string, bool, error) {
+	l := log.WithFields(log.Fields{
+		"package":   "main",
+		"func":      "putManifest",
+		"url":       ref.String(),
+		"reference": reference,
+	})
+	l.Debug("Uploading manifest to ", ref.String())
+	defer metrics.observe("manifest_put", ref.Registry, time.Now())
+	if err := checkRegistryAPI(ref); err != nil {
+		l.Error(err)
+		return "", false, err
+	}
+	l.Debug("Registry: ", ref.Registry)
+	l.Debug("Image: ", ref.Image)
+	l.Debug("Reference: ", reference)
+	manifestUrl := ref.apiURL("manifests", reference)
+	l = l.WithFields(log.Fields{
+		"manifestUrl": manifestUrl,
+	})
+	l.Debug("Manifest url: ", manifestUrl)
+	var err error
+	jd := manifest.Raw
+	if jd == nil {
+		jd, err = json.Marshal(manifest)
+		if err != nil {
+			l.Error("Error marshalling manifest: ", err)
+			return "", false, err
+		}
+		manifest.Raw = jd
+	}
+	l.Debug("Manifest: ", logBody(jd))
+	contentType := manifest.ContentType
+	if contentType == "" {
+		contentType = manifest.MediaType
+	}
+	expected := manifest.Digest()
+	byDigest := strings.Contains(reference, ":")
+	if byDigest && reference != expected {
+		l.Error("Manifest digest does not match the reference: ", expected)
+		return "", false, fmt.Errorf("cannot push manifest %s by digest %s", expected, reference)
+	}
+	if PreHead {
+		// the result does not matter, only that the registry saw the HEAD
+		if _, _, err := headManifest(ref, reference); err != nil && !errors.Is(err, errHeadNotSupported) {
+			l.Warn("Error in HEAD before PUT, pushing anyway: ", err)
+		}
+	}
+	req, err := http.NewRequest("PUT", manifestUrl, bytes.NewReader(jd))
+	if err != nil {
+		l.Error("Error creating request: ", err)
+		return "", false, err
+	}
+	// set explicitly, as some registries reject manifests sent without a
+	// Content-Length
+	req.ContentLength = int64(len(jd))
+	req.Header.Add("Content-Type", contentType)
+	if err := authorize(req, ref); err != nil {
+		l.Error("Error getting registry auth: ", err)
+		return "", false, err
+	}
+	resp, err := registryDo(req, ref.authProvider())
+	audit("manifest_put", ref, ref.withReference(reference).String(), expected, resp, err)
+	if err != nil {
+		l.Error("Error getting manifest: ", err)
+		return "", false, err
+	}
+	defer resp.Body.Close()
+	bd := readErrorBody(resp.Body)
+	l.Debug("Response: ", logBody(bd))
+	// some registries answer 200 instead of 201 when the manifest is
+	// already stored under the reference
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		if immutable := immutableTag(ref.withReference(reference), resp, bd); immutable != nil {
+			// an immutable tag that already has the digest needs no push
+			if current, exists, err := manifestDigest(ref, reference); err == nil && exists && current == expected {
+				l.Info("Tag is immutable and already points at ", expected)
+				return expected, false, nil
+			}
+			l.Error(immutable)
+			return "", false, immutable
+		}
+		if missing := blobsUnknown(resp, bd); missing != nil {
+			l.Error(missing)
+			return "", false, missing
+		}
+		l.Error("Error uploading manifest: ", resp.Status)
+		return "", false, pushError(ref, resp, bd)
+	}
+	created := resp.StatusCode != http.StatusOK
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		// a push by digest is verified by the registry itself
+		if !byDigest {
+			l.Warn("Registry did not return a Docker-Content-Digest header, unable to verify pushed manifest")
+		}
+		return expected, created, nil
+	}
+	if digest != expected {
+		l.Error("Pushed manifest digest mismatch: ", digest)
+		return digest, created, fmt.Errorf("registry stored manifest as %s, expected %s", digest, expected)
+	}
+	return digest, created, nil
+}
+
+// deleteManifest deletes the manifest with the digest from ref's
+// repository, which removes every tag pointing at it
+func deleteManifest(ref ImageRef, digest string) error {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"func":    "deleteManifest",
+		"url":     ref.String(),
+		"digest":  digest,
+	})
+	l.Debug("Deleting manifest from ", ref.Repository())
+	req, err := http.NewRequest("DELETE", ref.apiURL("manifests", digest), nil)
+	if err != nil {
+		l.Error("Error creating request: ", err)
+		return err
+	}
+	if err := authorize(req, ref); err != nil {
+		l.Error("Error getting registry auth: ", err)
+		return err
+	}
+	resp, err := registryDo(req, ref.authProvider())
+	audit("manifest_delete", ref, ref.withReference(digest).String(), digest, resp, err)
+	if err != nil {
+		l.Error("Error deleting manifest: ", err)
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusAccepted, http.StatusOK:
+		return nil
+	case http.StatusMethodNotAllowed:
+		return errors.New("the registry does not allow deleting manifests")
+	}
+	l.Error("Error deleting manifest: ", resp.Status)
+	return errors.New(resp.Status)
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// signedSchema1 returns a schema1 manifest signed the way libtrust does,
+// with the signatures spliced in before the closing brace of the payload,
+// and the payload registries digest it by
+func signedSchema1(t *testing.T) (signed, payload []byte) {
+	t.Helper()
+	payload = []byte("{\n   \"schemaVersion\": 1,\n   \"name\": \"app\",\n   \"tag\": \"1.0\",\n   \"architecture\": \"amd64\",\n   \"fsLayers\": [],\n   \"history\": []\n}")
+	formatLength := len(payload) - 2
+	tail := payload[formatLength:]
+	protected := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"formatLength":%d,"formatTail":%q,"time":"2016-01-01T00:00:00Z"}`, formatLength, base64.RawURLEncoding.EncodeToString(tail))))
+	signatures := fmt.Sprintf(",\n   \"signatures\": [{\"header\": {\"alg\": \"ES256\"}, \"signature\": \"c2lnbmF0dXJl\", \"protected\": %q}]", protected)
+	signed = append(append(append([]byte(nil), payload[:formatLength]...), signatures...), tail...)
+	return signed, payload
+}
+
+func TestSchema1Digest(t *testing.T) {
+	signed, payload := signedSchema1(t)
+	m := Manifest{SchemaVersion: 1, Raw: signed, ContentType: mediaTypeSchema1Signed}
+	if got, want := m.Digest(), digestOf(payload); got != want {
+		t.Errorf("Digest() = %s, want the payload digest %s", got, want)
+	}
+	unsigned := Manifest{SchemaVersion: 1, Raw: payload, ContentType: mediaTypeSchema1}
+	if got, want := unsigned.Digest(), digestOf(payload); got != want {
+		t.Errorf("Digest() of an unsigned manifest = %s, want %s", got, want)
+	}
+}
+
+func TestPutManifestSchema1Signed(t *testing.T) {
+	signed, payload := signedSchema1(t)
+	r := newTestRegistry(t)
+	r.digest = func(contentType string, body []byte) string {
+		if contentType == mediaTypeSchema1Signed {
+			return digestOf(payload)
+		}
+		return digestOf(body)
+	}
+	r.putManifest("app", "1.0", mediaTypeSchema1Signed, signed)
+	accept := AcceptSchema1
+	AcceptSchema1 = true
+	defer func() { AcceptSchema1 = accept }()
+
+	m, err := fetchManifest(r.ref(t, "app", "1.0"), "1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, created, err := putManifest(r.ref(t, "app", "1.1"), "1.1", m)
+	if err != nil {
+		t.Fatalf("pushing a signed schema1 manifest: %v", err)
+	}
+	if want := digestOf(payload); digest != want || !created {
+		t.Errorf("putManifest = %s, %v, want %s, true", digest, created, want)
+	}
+	if current, exists, err := manifestDigest(r.ref(t, "app", "1.1"), "1.1"); err != nil || !exists || current != digest {
+		t.Errorf("manifestDigest = %s, %v, %v, want %s", current, exists, err, digest)
+	}
+}
+
+func TestPutManifestStatus(t *testing.T) {
+	body := testImageManifest(1)
+	expected := digestOf(body)
+	tests := []struct {
+		status  int
+		digest  string
+		created bool
+		err     string
+	}{
+		{http.StatusCreated, expected, true, ""},
+		{http.StatusOK, expected, false, ""},
+		{http.StatusAccepted, expected, true, ""},
+		{http.StatusNoContent, expected, true, ""},
+		{http.StatusCreated, "", true, ""},
+		{http.StatusOK, "", false, ""},
+		{http.StatusCreated, digestOf([]byte("other")), true, "registry stored manifest as"},
+		{http.StatusBadRequest, "", false, "400"},
+	}
+	for _, tt := range tests {
+		r := newTestRegistry(t)
+		r.hook = func(w http.ResponseWriter, req *http.Request) bool {
+			if req.Method != "PUT" {
+				return false
+			}
+			ioutil.ReadAll(req.Body)
+			if tt.digest != "" {
+				w.Header().Set("Docker-Content-Digest", tt.digest)
+			}
+			w.WriteHeader(tt.status)
+			return true
+		}
+		m := Manifest{Raw: body, ContentType: mediaTypeOCIManifest, MediaType: mediaTypeOCIManifest, SchemaVersion: 2}
+		digest, created, err := putManifest(r.ref(t, "app", "1.0"), "1.0", m)
+		name := fmt.Sprintf("%d with digest %q", tt.status, tt.digest)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: putManifest = %v, want an error containing %q", name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: putManifest = %v", name, err)
+			continue
+		}
+		if digest != expected || created != tt.created {
+			t.Errorf("%s: putManifest = %s, created %v, want %s, created %v", name, digest, created, expected, tt.created)
+		}
+	}
+}
+
+func TestUploadWorkerRecordsManifestState(t *testing.T) {
+	r := newTestRegistry(t)
+	r.putManifest("app", "src", mediaTypeOCIManifest, testImageManifest(1))
+	r.hook = func(w http.ResponseWriter, req *http.Request) bool {
+		if req.Method != "PUT" || req.URL.Path != "/v2/app/manifests/same" {
+			return false
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Header().Set("Docker-Content-Digest", digestOf(body))
+		w.WriteHeader(http.StatusOK)
+		return true
+	}
+	skip := SkipBlobCheck
+	SkipBlobCheck = true
+	defer func() { SkipBlobCheck = skip }()
+	src, err := newImageSource(r.host + "/app:src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := src.root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	destinations := []string{r.host + "/app:new", r.host + "/app:same"}
+	jobs := newJobQueue(1, destinations)
+	for i, d := range destinations {
+		jobs.push(UploadJob{Index: i, Manifest: m, Src: src, Source: r.host + "/app:src", Image: d})
+	}
+	jobs.close()
+	results := make(chan UploadResult, len(destinations))
+	manifestUploadWorker(newCredentialChain(Credential{}), jobs, results)
+	close(results)
+	state := map[int]string{}
+	for res := range results {
+		if res.Err != nil {
+			t.Fatalf("%s: %v", res.Destination, res.Err)
+		}
+		state[res.Index] = res.Manifest
+	}
+	if state[0] != "created" || state[1] != "unchanged" {
+		t.Errorf("manifest states = %v, want created for 201 and unchanged for 200", state)
+	}
+}
+
+func TestFetchManifestSizeLimit(t *testing.T) {
+	limit := MaxManifestSize
+	MaxManifestSize = 1 << 10
+	defer func() { MaxManifestSize = limit }()
+	r := newTestRegistry(t)
+	small := testImageManifest(1)
+	large := []byte(strings.Replace(string(small), `"layers":[]`, `"layers":[],"annotations":{"pad":"`+strings.Repeat("x", 2<<10)+`"}`, 1))
+	r.putManifest("app", "small", mediaTypeOCIManifest, small)
+	r.putManifest("app", "large", mediaTypeOCIManifest, large)
+
+	if _, err := fetchManifest(r.ref(t, "app", "small"), "small"); err != nil {
+		t.Errorf("fetching a manifest below the limit: %v", err)
+	}
+	_, err := fetchManifest(r.ref(t, "app", "large"), "large")
+	if err == nil || !strings.Contains(err.Error(), "manifest exceeds size limit of 1.0 KiB") {
+		t.Errorf("fetching a manifest above the limit = %v, want a size limit error", err)
+	}
+	if _, _, err := manifestDigest(r.ref(t, "app", "large"), "large"); err != nil {
+		t.Errorf("manifestDigest reads the digest header, not the body: %v", err)
+	}
+}
+
+func TestPutSendsContentLength(t *testing.T) {
+	chunkSize := ChunkSize
+	ChunkSize = 0
+	defer func() { ChunkSize = chunkSize }()
+	r := newTestRegistry(t)
+	var puts int
+	r.hook = func(w http.ResponseWriter, req *http.Request) bool {
+		if req.Method != "PUT" {
+			return false
+		}
+		puts++
+		body, _ := ioutil.ReadAll(req.Body)
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if got := req.Header.Get("Content-Length"); got != fmt.Sprint(len(body)) || len(req.TransferEncoding) > 0 {
+			t.Errorf("PUT %s sent Content-Length %q and Transfer-Encoding %q for %d bytes", req.URL.Path, got, req.TransferEncoding, len(body))
+		}
+		return false
+	}
+	content := []byte("layer")
+	desc := Descriptor{MediaType: mediaTypeOCILayer, Digest: digestOf(content), Size: int64(len(content))}
+	if err := uploadBlob(r.ref(t, "app", "1.0"), desc, bytes.NewReader(content), nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range []string{"1.0", "1.1"} {
+		body := testImageManifest(len(tag))
+		m := Manifest{Raw: body, ContentType: mediaTypeOCIManifest, MediaType: mediaTypeOCIManifest, SchemaVersion: 2}
+		if _, _, err := putManifest(r.ref(t, "app", tag), tag, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if puts != 3 {
+		t.Errorf("registry received %d PUTs, want the blob and two manifests", puts)
+	}
+}
+
+func TestPutManifestPreHead(t *testing.T) {
+	pre := PreHead
+	PreHead = true
+	defer func() { PreHead = pre }()
+	body := testImageManifest(1)
+	m := Manifest{Raw: body, ContentType: mediaTypeOCIManifest, MediaType: mediaTypeOCIManifest, SchemaVersion: 2}
+	for _, status := range []int{0, http.StatusMethodNotAllowed, http.StatusNotImplemented, http.StatusInternalServerError} {
+		r := newTestRegistry(t)
+		r.hook = func(w http.ResponseWriter, req *http.Request) bool {
+			if status == 0 || req.Method != "HEAD" {
+				return false
+			}
+			w.WriteHeader(status)
+			return true
+		}
+		if _, _, err := putManifest(r.ref(t, "app", "1.0"), "1.0", m); err != nil {
+			t.Errorf("putManifest with HEAD answering %d = %v, want the push to go ahead", status, err)
+			continue
+		}
+		want := []string{"HEAD /v2/app/manifests/1.0", "PUT /v2/app/manifests/1.0"}
+		var got []string
+		for _, req := range r.requested() {
+			if strings.Contains(req, "/manifests/") {
+				got = append(got, req)
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("with HEAD answering %d, manifest requests = %q, want %q", status, got, want)
+		}
+	}
+}
+
+func TestManifestHeadNotSupported(t *testing.T) {
+	body := testImageManifest(1)
+	for _, status := range []int{http.StatusMethodNotAllowed, http.StatusNotImplemented} {
+		r := newTestRegistry(t)
+		digest := r.putManifest("app", "1.0", mediaTypeOCIManifest, body)
+		r.hook = func(w http.ResponseWriter, req *http.Request) bool {
+			if req.Method != "HEAD" {
+				return false
+			}
+			w.WriteHeader(status)
+			return true
+		}
+		if exists, err := manifestExists(r.ref(t, "app", "1.0"), "1.0"); err != nil || !exists {
+			t.Errorf("HEAD answering %d: manifestExists = %v, %v, want true", status, exists, err)
+		}
+		if exists, err := manifestExists(r.ref(t, "app", "2.0"), "2.0"); err != nil || exists {
+			t.Errorf("HEAD answering %d: manifestExists of a missing tag = %v, %v, want false", status, exists, err)
+		}
+		if got, exists, err := manifestDigest(r.ref(t, "app", "1.0"), "1.0"); err != nil || !exists || got != digest {
+			t.Errorf("HEAD answering %d: manifestDigest = %s, %v, %v, want %s", status, got, exists, err, digest)
+		}
+	}
+}
+
+func TestManifestDigestSchema1WithoutHead(t *testing.T) {
+	signed, payload := signedSchema1(t)
+	accept := AcceptSchema1
+	AcceptSchema1 = true
+	defer func() { AcceptSchema1 = accept }()
+	for _, contentType := range []string{mediaTypeSchema1Signed, mediaTypeSchema1Signed + "; charset=utf-8", "application/json"} {
+		r := newTestRegistry(t)
+		r.putManifest("app", "1.0", contentType, signed)
+		// no HEAD, so the digest is taken from a GET
+		r.hook = func(w http.ResponseWriter, req *http.Request) bool {
+			if req.Method != "HEAD" {
+				return false
+			}
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return true
+		}
+		m, err := fetchManifest(r.ref(t, "app", "1.0"), "1.0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest, exists, err := manifestDigest(r.ref(t, "app", "1.0"), "1.0")
+		if err != nil || !exists {
+			t.Fatalf("manifestDigest = %v, %v", exists, err)
+		}
+		if want := digestOf(payload); digest != want || m.Digest() != want {
+			t.Errorf("served as %q: manifestDigest = %s and fetchManifest digest %s, want both the payload digest %s", contentType, digest, m.Digest(), want)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// sourceManifests caches the manifests read from source registries for
+// the run, so a manifest needed by several destinations, templates or the
+// spool is fetched once
+var sourceManifests = &manifestCache{entries: map[string]*cachedManifest{}}
+
+// manifestCache holds manifests by canonical reference. Tags are cached
+// along with the digest they resolved to.
+type manifestCache struct {
+	mu      sync.Mutex
+	entries map[string]*cachedManifest
+}
+
+// cachedManifest is a manifest in the cache. It is fetched once, and
+// callers that need it meanwhile wait for that fetch.
+type cachedManifest struct {
+	once sync.Once
+	m    Manifest
+	err  error
+}
+
+// get returns the manifest with the tag or digest in ref's repository,
+// calling fetch only for the first caller. A failed fetch is not cached,
+// so a later caller tries again.
+func (c *manifestCache) get(ref ImageRef, reference string, fetch func(string) (Manifest, error)) (Manifest, error) {
+	key := ref.withReference(reference).canonical()
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if !ok {
+		e = &cachedManifest{}
+		c.entries[key] = e
+	}
+	c.mu.Unlock()
+	if ok {
+		log.WithFields(log.Fields{
+			"package": "main",
+			"fn":      "manifestCache.get",
+			"ref":     key,
+		}).Debug("Using cached manifest")
+	}
+	e.once.Do(func() {
+		e.m, e.err = fetch(reference)
+	})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e.err != nil {
+		if c.entries[key] == e {
+			delete(c.entries, key)
+		}
+		return e.m, e.err
+	}
+	if digest := e.m.Digest(); digest != reference {
+		if _, ok := c.entries[ref.withReference(digest).canonical()]; !ok {
+			d := &cachedManifest{}
+			d.once.Do(func() { d.m = e.m })
+			c.entries[ref.withReference(digest).canonical()] = d
+		}
+	}
+	return e.m, nil
+}
+
+// forgetTags drops the manifests cached by tag, so tags that may have
+// moved are read again. Manifests cached by digest cannot change.
+func (c *manifestCache) forgetTags() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.entries {
+		if !strings.Contains(key, "@") {
+			delete(c.entries, key)
+		}
+	}
+}
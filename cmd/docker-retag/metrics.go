@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MetricsFile is where the metrics of the run are written in the
+// Prometheus text format, if set
+var MetricsFile string
+
+// metrics collects timings and counters of the run per registry for the
+// summary and --metrics-file
+var metrics = &runMetrics{
+	phases:   map[metricKey]*phaseMetric{},
+	counters: map[metricKey]int64{},
+}
+
+// metricKey identifies a phase or counter on a registry
+type metricKey struct {
+	name     string
+	registry string
+}
+
+// phaseMetric is the number of operations of a phase and the time spent
+// in them
+type phaseMetric struct {
+	count   int64
+	seconds float64
+}
+
+// runMetrics is safe for use by concurrent workers
+type runMetrics struct {
+	mu       sync.Mutex
+	phases   map[metricKey]*phaseMetric
+	counters map[metricKey]int64
+}
+
+// observe records an operation of phase on registry that started at
+// start, for use with defer
+func (m *runMetrics) observe(phase, registry string, start time.Time) {
+	d := time.Since(start).Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := metricKey{phase, registry}
+	p, ok := m.phases[k]
+	if !ok {
+		p = &phaseMetric{}
+		m.phases[k] = p
+	}
+	p.count++
+	p.seconds += d
+}
+
+// add adds n to the counter name of registry
+func (m *runMetrics) add(name, registry string, n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[metricKey{name, registry}] += n
+}
+
+// sortedMetricKeys sorts metric keys by name and registry
+func sortedMetricKeys(keys []metricKey) []metricKey {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].name != keys[j].name {
+			return keys[i].name < keys[j].name
+		}
+		return keys[i].registry < keys[j].registry
+	})
+	return keys
+}
+
+// summary logs the time spent in each phase and the counters per registry
+func (m *runMetrics) summary() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var keys []metricKey
+	for k := range m.phases {
+		keys = append(keys, k)
+	}
+	for _, k := range sortedMetricKeys(keys) {
+		p := m.phases[k]
+		log.WithFields(log.Fields{
+			"phase":    k.name,
+			"registry": k.registry,
+			"count":    p.count,
+			"elapsed":  time.Duration(p.seconds * float64(time.Second)).Round(time.Millisecond).String(),
+		}).Info("Phase")
+	}
+	keys = nil
+	for k := range m.counters {
+		keys = append(keys, k)
+	}
+	for _, k := range sortedMetricKeys(keys) {
+		log.WithFields(log.Fields{
+			"registry": k.registry,
+			k.name:     m.counters[k],
+		}).Info("Transfer")
+	}
+}
+
+// prometheusLabel escapes a Prometheus label value
+func prometheusLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// textfile renders the metrics in the Prometheus text exposition format
+func (m *runMetrics) textfile(duration float64, failed bool) []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var b bytes.Buffer
+	var keys []metricKey
+	for k := range m.phases {
+		keys = append(keys, k)
+	}
+	keys = sortedMetricKeys(keys)
+	fmt.Fprintln(&b, "# HELP docker_retag_phase_seconds Time spent in each phase of the last run.")
+	fmt.Fprintln(&b, "# TYPE docker_retag_phase_seconds gauge")
+	for _, k := range keys {
+		fmt.Fprintf(&b, "docker_retag_phase_seconds{phase=\"%s\",registry=\"%s\"} %g\n", prometheusLabel(k.name), prometheusLabel(k.registry), m.phases[k].seconds)
+	}
+	fmt.Fprintln(&b, "# HELP docker_retag_phase_operations Number of operations in each phase of the last run.")
+	fmt.Fprintln(&b, "# TYPE docker_retag_phase_operations gauge")
+	for _, k := range keys {
+		fmt.Fprintf(&b, "docker_retag_phase_operations{phase=\"%s\",registry=\"%s\"} %d\n", prometheusLabel(k.name), prometheusLabel(k.registry), m.phases[k].count)
+	}
+	keys = nil
+	for k := range m.counters {
+		keys = append(keys, k)
+	}
+	keys = sortedMetricKeys(keys)
+	for i, k := range keys {
+		name := "docker_retag_" + k.name
+		if i == 0 || keys[i-1].name != k.name {
+			fmt.Fprintf(&b, "# HELP %s Number of %s in the last run.\n", name, strings.ReplaceAll(k.name, "_", " "))
+			fmt.Fprintf(&b, "# TYPE %s gauge\n", name)
+		}
+		fmt.Fprintf(&b, "%s{registry=\"%s\"} %d\n", name, prometheusLabel(k.registry), m.counters[k])
+	}
+	success := 1
+	if failed {
+		success = 0
+	}
+	fmt.Fprintln(&b, "# HELP docker_retag_run_duration_seconds Duration of the last run.")
+	fmt.Fprintln(&b, "# TYPE docker_retag_run_duration_seconds gauge")
+	fmt.Fprintf(&b, "docker_retag_run_duration_seconds %g\n", duration)
+	fmt.Fprintln(&b, "# HELP docker_retag_run_success Whether the last run succeeded.")
+	fmt.Fprintln(&b, "# TYPE docker_retag_run_success gauge")
+	fmt.Fprintf(&b, "docker_retag_run_success %d\n", success)
+	fmt.Fprintln(&b, "# HELP docker_retag_run_timestamp_seconds When the last run ended.")
+	fmt.Fprintln(&b, "# TYPE docker_retag_run_timestamp_seconds gauge")
+	fmt.Fprintf(&b, "docker_retag_run_timestamp_seconds %d\n", time.Now().Unix())
+	return b.Bytes()
+}
+
+// writeMetricsFile writes the metrics to path for the node_exporter
+// textfile collector. The file is replaced atomically so the collector
+// never reads a partial file.
+func writeMetricsFile(path string, duration float64, failed bool) error {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "writeMetricsFile",
+		"path":    path,
+	})
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		l.Error("Error creating metrics file: ", err)
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(metrics.textfile(duration, failed)); err != nil {
+		tmp.Close()
+		l.Error("Error writing metrics file: ", err)
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
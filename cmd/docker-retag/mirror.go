@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RegistryMirrors maps registries to mirrors that source images are read
+// from before the registry itself, as upstream=mirror. The mirror may
+// include a repository namespace, such as the project of a Harbor proxy
+// cache.
+var RegistryMirrors = keyValueFlag{}
+
+// mirrorOf returns the reference of ref on the mirror of its registry,
+// or nil if there is none
+func mirrorOf(ref ImageRef) *ImageRef {
+	for upstream, mirror := range RegistryMirrors {
+		if upstream != ref.Registry && canonicalHost(upstream) != canonicalHost(ref.Registry) && !(isDockerHub(upstream) && isDockerHub(ref.Registry)) {
+			continue
+		}
+		m := ref
+		host, namespace, _ := strings.Cut(strings.Trim(mirror, "/"), "/")
+		m.Registry = host
+		m.Prefix = registryPrefix(host)
+		m.APIBase = ""
+		if namespace != "" {
+			m.Image = namespace + "/" + ref.Image
+		}
+		m.routeAPIBase()
+		return &m
+	}
+	return nil
+}
+
+// fetch returns the manifest with the tag or digest, reading it from the
+// mirror if there is one. A manifest from the mirror is only used if its
+// digest matches the one the upstream registry has for the reference, so
+// a stale mirror is never promoted from. Otherwise, and when the mirror
+// fails, the manifest is read from the upstream registry.
+func (s *registrySource) fetch(reference string) (Manifest, error) {
+	if s.mirror == nil {
+		return fetchManifest(s.ref, reference)
+	}
+	l := log.WithFields(log.Fields{
+		"package":   "main",
+		"fn":        "registrySource.fetch",
+		"mirror":    s.mirror.Repository(),
+		"reference": reference,
+	})
+	expected := reference
+	if !strings.Contains(reference, ":") {
+		digest, exists, err := manifestDigest(s.ref, reference)
+		if err != nil || !exists || digest == "" {
+			return fetchManifest(s.ref, reference)
+		}
+		expected = digest
+	}
+	m, err := fetchManifest(*s.mirror, expected)
+	if err != nil {
+		l.Warn("Error getting manifest from mirror, using upstream: ", err)
+		return fetchManifest(s.ref, reference)
+	}
+	if digest := m.Digest(); digest != expected {
+		l.Warnf("Mirror served manifest %s, expected %s, using upstream", digest, expected)
+		return fetchManifest(s.ref, reference)
+	}
+	l.Debug("Using manifest from mirror")
+	return m, nil
+}
+
+// openMirrorBlob opens the blob on the mirror if there is one, falling
+// back to the upstream registry. Blob content is verified against its
+// digest as it is copied, wherever it was read from.
+func (s *registrySource) openMirrorBlob(desc Descriptor) (io.ReadCloser, error) {
+	if s.mirror != nil {
+		rc, err := openBlob(*s.mirror, desc.Digest)
+		if err == nil {
+			return rc, nil
+		}
+		log.WithFields(log.Fields{
+			"package": "main",
+			"fn":      "registrySource.openMirrorBlob",
+			"mirror":  s.mirror.Repository(),
+			"digest":  desc.Digest,
+		}).Warn("Error getting blob from mirror, using upstream: ", err)
+	}
+	return openBlob(s.ref, desc.Digest)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// digestPattern finds sha256 digests in registry error messages
+var digestPattern = regexp.MustCompile(`sha256:[a-f0-9]{64}`)
+
+// missingBlobsError is a manifest push rejected because the destination
+// repository does not have blobs or child manifests the manifest
+// references, with the digests the registry named. This happens when
+// registry garbage collection removes a blob between the content check
+// and the push.
+type missingBlobsError struct {
+	status  string
+	digests []string
+	// message is the registry's own message
+	message string
+}
+
+func (e *missingBlobsError) Error() string {
+	return fmt.Sprintf("%s: %s, missing %s", e.status, e.message, strings.Join(e.digests, ", "))
+}
+
+// blobsUnknown returns the error for a manifest push rejected with body
+// bd because of unknown blobs, or nil if it was rejected for another
+// reason or the registry did not say which blobs are missing. The
+// digests are taken from the detail of MANIFEST_BLOB_UNKNOWN and
+// BLOB_UNKNOWN errors, which registries send as a digest, an object with
+// a digest or a list of them, or else from the message.
+func blobsUnknown(resp *http.Response, bd []byte) *missingBlobsError {
+	var re registryErrors
+	json.Unmarshal(bd, &re)
+	var missing *missingBlobsError
+	seen := map[string]bool{}
+	for _, e := range re.Errors {
+		if e.Code != "MANIFEST_BLOB_UNKNOWN" && e.Code != "BLOB_UNKNOWN" {
+			continue
+		}
+		if missing == nil {
+			missing = &missingBlobsError{status: resp.Status, message: e.Message}
+		}
+		for _, d := range digestPattern.FindAllString(string(e.Detail)+" "+e.Message, -1) {
+			if !seen[d] {
+				seen[d] = true
+				missing.digests = append(missing.digests, d)
+			}
+		}
+	}
+	if missing == nil || len(missing.digests) == 0 {
+		return nil
+	}
+	return missing
+}
+
+// uploadManifestRepairing pushes the manifest like uploadManifest. If the
+// registry rejects it naming blobs or child manifests it is missing,
+// those are copied or mounted from the source and the manifest is pushed
+// once more. It also returns how many were repaired.
+func uploadManifestRepairing(src imageSource, url string, auth AuthProvider, m Manifest, stats *transferStats) (string, bool, int, error) {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "uploadManifestRepairing",
+		"url":     url,
+	})
+	digest, created, err := uploadManifest(url, auth, m)
+	var missing *missingBlobsError
+	if !errors.As(err, &missing) || src == nil {
+		return digest, created, 0, err
+	}
+	dst, perr := urlToImageTag(url)
+	if perr != nil {
+		return "", false, 0, perr
+	}
+	dst = dst.withAuth(auth)
+	l.Warnf("Registry reported %d missing blobs, copying them from %s", len(missing.digests), src)
+	if rerr := repairMissingBlobs(src, m, dst, missing.digests, stats); rerr != nil {
+		l.Error("Error repairing missing blobs: ", rerr)
+		return "", false, 0, fmt.Errorf("%w; repairing them failed: %v", err, rerr)
+	}
+	metrics.add("manifest_blob_repairs", dst.Registry, 1)
+	l.Warnf("Repaired %d missing blobs, retrying manifest push", len(missing.digests))
+	digest, created, err = uploadManifest(url, auth, m)
+	return digest, created, len(missing.digests), err
+}
+
+// repairMissingBlobs copies the blobs and child manifests of m with the
+// digests from src to dst. The blob checks of the run are bypassed, as
+// they found the blobs before the registry lost them.
+func repairMissingBlobs(src imageSource, m Manifest, dst ImageRef, digests []string, stats *transferStats) error {
+	blobs := map[string]Descriptor{}
+	for _, b := range m.blobs() {
+		blobs[b.Digest] = b
+	}
+	children := map[string]bool{}
+	for _, d := range m.Manifests {
+		children[d.Digest] = true
+	}
+	for _, d := range digests {
+		switch {
+		case blobs[d].Digest != "":
+			if err := copyBlob(src, dst, blobs[d], stats); err != nil {
+				return fmt.Errorf("copying blob %s: %w", d, err)
+			}
+		case children[d]:
+			child, err := src.manifest(d)
+			if err != nil {
+				return fmt.Errorf("getting manifest %s from %s: %w", d, src, err)
+			}
+			if err := ensureContent(src, child, dst, stats); err != nil {
+				return err
+			}
+			if _, _, err := putManifest(dst, d, child); err != nil {
+				return fmt.Errorf("pushing manifest %s: %w", d, err)
+			}
+		default:
+			return fmt.Errorf("the registry reported %s missing, which %s does not reference", d, m.Digest())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+)
+
+// netrcMachine is a machine entry of a netrc file
+type netrcMachine struct {
+	name     string
+	login    string
+	password string
+}
+
+// parseNetrc parses the machine entries of a netrc file. The default
+// entry is ignored so credentials are never sent to a registry that is
+// not listed, and macro definitions are skipped.
+func parseNetrc(bd []byte) []netrcMachine {
+	var machines []netrcMachine
+	var m *netrcMachine
+	lines := bufio.NewScanner(bytes.NewReader(bd))
+	inMacro := false
+	for lines.Scan() {
+		line := lines.Text()
+		if inMacro {
+			inMacro = strings.TrimSpace(line) != ""
+			continue
+		}
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		for i := 0; i < len(fields); i++ {
+			value := ""
+			if i+1 < len(fields) {
+				value = fields[i+1]
+			}
+			switch fields[i] {
+			case "machine":
+				machines = append(machines, netrcMachine{name: value})
+				m = &machines[len(machines)-1]
+				i++
+			case "default":
+				m = nil
+			case "login":
+				if m != nil {
+					m.login = value
+				}
+				i++
+			case "password":
+				if m != nil {
+					m.password = value
+				}
+				i++
+			case "account":
+				i++
+			case "macdef":
+				inMacro = true
+				i = len(fields)
+			}
+		}
+	}
+	return machines
+}
+
+// netrcHosts returns the machine names the registry may be listed under
+// in a netrc file
+func netrcHosts(registry string) []string {
+	if isDockerHub(registry) {
+		return []string{dockerHubRegistry, "index.docker.io", dockerHubAPIRegistry}
+	}
+	hosts := []string{registry}
+	if c := canonicalHost(registry); c != registry {
+		hosts = append(hosts, c)
+	}
+	if host, _, err := net.SplitHostPort(registry); err == nil {
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+// netrcCredentials returns the login and password of the registry from
+// the netrc file at path. A missing file has no credentials.
+func netrcCredentials(path, registry string) (string, string, error) {
+	if path == "" {
+		return "", "", nil
+	}
+	bd, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	machines := parseNetrc(bd)
+	for _, host := range netrcHosts(registry) {
+		for _, m := range machines {
+			if m.name == host && m.login != "" && m.password != "" {
+				return m.login, m.password, nil
+			}
+		}
+	}
+	return "", "", nil
+}
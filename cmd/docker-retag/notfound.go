@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// exitSourceNotFound is the exit code when the source tag, digest or
+	// repository does not exist
+	exitSourceNotFound = 5
+	// maxSuggestedTags bounds the existing tags a not found error lists
+	maxSuggestedTags = 5
+	// tagSuggestionTimeout bounds the tag list request made for a
+	// not found error, so a slow registry does not delay the failure
+	tagSuggestionTimeout = 10 * time.Second
+)
+
+// manifestNotFoundError is a 404 for a manifest. The registry error code
+// tells a missing repository (NAME_UNKNOWN) from a missing tag or digest
+// (MANIFEST_UNKNOWN). Registries such as GHCR also answer 404 for
+// repositories the credentials cannot pull from, so when the tag list
+// of the repository cannot be read either, the error says it may be
+// either.
+type manifestNotFoundError struct {
+	ref       ImageRef
+	reference string
+	// code is the registry error code, if the registry sent one
+	code string
+	// listed is set when the tags of the repository could be listed,
+	// which shows the repository exists and can be pulled from
+	listed bool
+	// tags are the existing tags closest to the reference
+	tags []string
+}
+
+func (e *manifestNotFoundError) Error() string {
+	isDigest := strings.Contains(e.reference, ":")
+	what := fmt.Sprintf("tag %q", e.reference)
+	if isDigest {
+		what = "manifest " + e.reference
+	}
+	repo := e.ref.Repository()
+	switch {
+	case e.listed && isDigest:
+		return fmt.Sprintf("%s not found in repository %s", what, repo)
+	case e.listed && len(e.tags) == 0:
+		return fmt.Sprintf("%s not found, repository %s has no tags", what, repo)
+	case e.listed:
+		return fmt.Sprintf("%s not found, repository %s has tags: %s", what, repo, strings.Join(e.tags, ", "))
+	case e.code == "NAME_UNKNOWN":
+		return fmt.Sprintf("repository %s does not exist, or cannot be read with the credentials used", repo)
+	case e.code == "MANIFEST_UNKNOWN":
+		return fmt.Sprintf("%s not found in repository %s", what, repo)
+	}
+	return fmt.Sprintf("%s not found: repository %s does not exist, has no such tag, or cannot be read with the credentials used", what, repo)
+}
+
+// manifestNotFound returns the error for a 404 with body bd for the
+// reference in ref's repository. Unless the registry said the repository
+// does not exist, the tags of the repository are listed: if that works
+// the repository exists and can be pulled from, and the tags closest to
+// a missing tag are included to catch typos.
+func manifestNotFound(ref ImageRef, reference string, bd []byte) *manifestNotFoundError {
+	e := &manifestNotFoundError{ref: ref, reference: reference}
+	var re registryErrors
+	json.Unmarshal(bd, &re)
+	for _, re := range re.Errors {
+		switch re.Code {
+		case "NAME_UNKNOWN", "MANIFEST_UNKNOWN":
+			e.code = re.Code
+		}
+	}
+	if e.code == "NAME_UNKNOWN" {
+		return e
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), tagSuggestionTimeout)
+	defer cancel()
+	tags, err := listTags(ctx, ref)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"package":    "main",
+			"fn":         "manifestNotFound",
+			"repository": ref.Repository(),
+		}).Debug("Cannot list tags to suggest: ", err)
+		return e
+	}
+	e.listed = true
+	e.tags = closestTags(reference, tags, maxSuggestedTags)
+	return e
+}
+
+// closestTags returns up to n of the tags, those with the smallest edit
+// distance to tag first
+func closestTags(tag string, tags []string, n int) []string {
+	distance := map[string]int{}
+	for _, t := range tags {
+		distance[t] = editDistance(tag, t)
+	}
+	sorted := append([]string{}, tags...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if distance[sorted[i]] != distance[sorted[j]] {
+			return distance[sorted[i]] < distance[sorted[j]]
+		}
+		return sorted[i] < sorted[j]
+	})
+	if len(sorted) > n {
+		sorted = sorted[:n]
+	}
+	return sorted
+}
+
+// editDistance returns the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	notifyTimeout  = 10 * time.Second
+	notifyAttempts = 3
+)
+
+// notifier posts the run report to the --notify-url webhooks; it sends
+// nothing until configured from main
+var notifier = &webhookNotifier{}
+
+// webhookNotifier sends the run summary to webhooks when the run ends
+type webhookNotifier struct {
+	urls   []string
+	on     string
+	token  string
+	strict bool
+}
+
+// newWebhookNotifier creates a notifier for urls. on is success, failure
+// or always, and the bearer token is read from tokenFile if set.
+func newWebhookNotifier(urls []string, on string, tokenFile string, strict bool) (*webhookNotifier, error) {
+	switch on {
+	case "success", "failure", "always":
+	default:
+		return nil, fmt.Errorf("unknown --notify-on value %q, expected success, failure or always", on)
+	}
+	n := &webhookNotifier{
+		urls:   urls,
+		on:     on,
+		strict: strict,
+	}
+	if tokenFile != "" {
+		bd, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		n.token = strings.TrimSpace(string(bd))
+	}
+	return n, nil
+}
+
+// send posts the report to every webhook if the outcome of the run
+// matches --notify-on. Each webhook is tried a bounded number of times so
+// a dead endpoint does not hang the run.
+func (n *webhookNotifier) send(failed bool) error {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "webhookNotifier.send",
+	})
+	if len(n.urls) == 0 || (n.on == "success" && failed) || (n.on == "failure" && !failed) {
+		return nil
+	}
+	bd, err := report.json()
+	if err != nil {
+		l.Error("Error encoding notification: ", err)
+		return err
+	}
+	var errs []string
+	for _, u := range n.urls {
+		if err := n.post(u, bd); err != nil {
+			l.WithField("url", u).Error("Error sending notification: ", err)
+			errs = append(errs, fmt.Sprintf("%s: %v", u, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New("notification failed: " + strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// post sends the payload to a single webhook, retrying failed requests
+func (n *webhookNotifier) post(u string, payload []byte) error {
+	var err error
+	for attempt := 0; attempt < notifyAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		err = func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+			defer cancel()
+			req, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(payload))
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("User-Agent", userAgent())
+			if n.token != "" {
+				req.Header.Set("Authorization", "Bearer "+n.token)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				return errors.New(resp.Status)
+			}
+			return nil
+		}()
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
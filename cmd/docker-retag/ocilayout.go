@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// ociLayoutScheme prefixes references to local OCI image layouts
+	ociLayoutScheme = "oci:"
+	// ociRefNameAnnotation names a manifest in an OCI layout index
+	ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+)
+
+// ociLayoutSource reads an image from an OCI image layout directory
+type ociLayoutSource struct {
+	arg  string
+	dir  string
+	tag  string
+	desc Descriptor
+}
+
+// splitOCILayoutArg splits oci:/path/to/layout[:tag] into the path and tag
+func splitOCILayoutArg(arg string) (string, string) {
+	rest := strings.TrimPrefix(arg, ociLayoutScheme)
+	if i := strings.LastIndex(rest, ":"); i > strings.LastIndex(rest, "/") && i > 1 {
+		return rest[:i], rest[i+1:]
+	}
+	return rest, ""
+}
+
+// readOCIIndex reads index.json of the layout in dir
+func readOCIIndex(dir string) (Manifest, error) {
+	if _, err := os.Stat(filepath.Join(dir, "oci-layout")); err != nil {
+		return Manifest{}, fmt.Errorf("%s is not an OCI image layout: %w", dir, err)
+	}
+	bd, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		return Manifest{}, err
+	}
+	idx, err := parseManifest(bd, mediaTypeOCIIndex)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("parsing %s: %w", filepath.Join(dir, "index.json"), err)
+	}
+	return idx, nil
+}
+
+// findOCIManifest finds the descriptor of the manifest tagged tag in the
+// layout index. Without a tag, the layout must contain a single manifest.
+func findOCIManifest(idx Manifest, tag string) (Descriptor, error) {
+	if tag == "" {
+		if len(idx.Manifests) == 1 {
+			return idx.Manifests[0], nil
+		}
+		tag = "latest"
+	}
+	for _, d := range idx.Manifests {
+		if d.Annotations[ociRefNameAnnotation] == tag {
+			return d, nil
+		}
+	}
+	return Descriptor{}, fmt.Errorf("tag %q not found in OCI layout index", tag)
+}
+
+func newOCILayoutSource(arg string) (*ociLayoutSource, error) {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "newOCILayoutSource",
+		"arg":     arg,
+	})
+	s := &ociLayoutSource{arg: arg}
+	s.dir, s.tag = splitOCILayoutArg(arg)
+	l.Debug("Reading OCI layout ", s.dir)
+	idx, err := readOCIIndex(s.dir)
+	if err != nil {
+		l.Error("Error reading OCI layout: ", err)
+		return nil, err
+	}
+	s.desc, err = findOCIManifest(idx, s.tag)
+	if err != nil {
+		l.Error("Error finding manifest: ", err)
+		return nil, fmt.Errorf("%s: %w", arg, err)
+	}
+	return s, nil
+}
+
+func (s *ociLayoutSource) blobPath(digest string) (string, error) {
+	alg, hex, ok := strings.Cut(digest, ":")
+	if !ok || alg == "" || hex == "" || strings.ContainsAny(digest, `/\`) {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+	return filepath.Join(s.dir, "blobs", alg, hex), nil
+}
+
+// readManifest reads and verifies the manifest blob with the digest
+func (s *ociLayoutSource) readManifest(desc Descriptor) (Manifest, error) {
+	p, err := s.blobPath(desc.Digest)
+	if err != nil {
+		return Manifest{}, err
+	}
+	bd, err := ioutil.ReadFile(p)
+	if err != nil {
+		return Manifest{}, err
+	}
+	if d := digestOf(bd); d != desc.Digest {
+		return Manifest{}, fmt.Errorf("manifest %s in %s has digest %s", desc.Digest, s.dir, d)
+	}
+	m, err := parseManifest(bd, desc.MediaType)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("parsing manifest %s: %w", desc.Digest, err)
+	}
+	return m, nil
+}
+
+func (s *ociLayoutSource) root() (Manifest, error) {
+	return s.readManifest(s.desc)
+}
+
+func (s *ociLayoutSource) manifest(reference string) (Manifest, error) {
+	if !strings.Contains(reference, ":") {
+		idx, err := readOCIIndex(s.dir)
+		if err != nil {
+			return Manifest{}, err
+		}
+		d, err := findOCIManifest(idx, reference)
+		if err != nil {
+			return Manifest{}, err
+		}
+		return s.readManifest(d)
+	}
+	return s.readManifest(Descriptor{Digest: reference})
+}
+
+func (s *ociLayoutSource) openBlob(desc Descriptor) (io.ReadCloser, error) {
+	p, err := s.blobPath(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("blob %s not found in %s", desc.Digest, s.dir)
+	}
+	return f, err
+}
+
+func (s *ociLayoutSource) String() string {
+	return s.arg
+}
+
+// ociLayoutLocks serializes index.json updates per layout directory
+var ociLayoutLocks sync.Map
+
+// ociLayoutWriter writes an image into an OCI image layout directory
+type ociLayoutWriter struct {
+	dir   string
+	src   imageSource
+	stats *transferStats
+}
+
+func (w *ociLayoutWriter) blobPath(digest string) (string, error) {
+	return (&ociLayoutSource{dir: w.dir}).blobPath(digest)
+}
+
+// writeBlob writes the content of r into the layout as desc, verifying its
+// digest. Blobs already present with the expected size are reused, and
+// partial downloads are removed when the copy fails.
+func (w *ociLayoutWriter) writeBlob(desc Descriptor, open func() (io.ReadCloser, error)) error {
+	p, err := w.blobPath(desc.Digest)
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Stat(p); err == nil && (desc.Size == 0 || fi.Size() == desc.Size) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	rc, err := open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	tmp, err := ioutil.TempFile(filepath.Dir(p), filepath.Base(p)+".*.partial")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	r, done := progress.track(desc, rc, w.stats)
+	defer done()
+	if _, err := io.Copy(tmp, newVerifyingReader(r, desc)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (w *ociLayoutWriter) writeManifest(m Manifest) error {
+	return w.writeBlob(Descriptor{Digest: m.Digest(), Size: int64(len(m.Raw))}, func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(m.Raw)), nil
+	})
+}
+
+// writeImage writes the manifest and everything it references
+func (w *ociLayoutWriter) writeImage(m Manifest) error {
+	if m.isIndex() {
+		for _, d := range m.Manifests {
+			child, err := w.src.manifest(d.Digest)
+			if err != nil {
+				return fmt.Errorf("getting manifest %s from %s: %w", d.Digest, w.src, err)
+			}
+			if err := w.writeImage(child); err != nil {
+				return err
+			}
+		}
+	}
+	for _, b := range m.blobs() {
+		b := b
+		if skipExternal(b) {
+			continue
+		}
+		if err := w.writeBlob(b, func() (io.ReadCloser, error) { return w.src.openBlob(b) }); err != nil {
+			return fmt.Errorf("writing blob %s: %w", b.Digest, err)
+		}
+	}
+	return w.writeManifest(m)
+}
+
+// tagImage records the manifest in index.json under tag, replacing any
+// manifest previously tagged with the same name
+func (w *ociLayoutWriter) tagImage(m Manifest, tag string) error {
+	lock, _ := ociLayoutLocks.LoadOrStore(w.dir, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+	idx := Manifest{
+		SchemaVersion: 2,
+		MediaType:     mediaTypeOCIIndex,
+	}
+	if existing, err := readOCIIndex(w.dir); err == nil {
+		idx.Manifests = existing.Manifests
+	}
+	var manifests []Descriptor
+	for _, d := range idx.Manifests {
+		if d.Annotations[ociRefNameAnnotation] != tag {
+			manifests = append(manifests, d)
+		}
+	}
+	mediaType := m.ContentType
+	if mediaType == "" {
+		mediaType = m.MediaType
+	}
+	idx.Manifests = append(manifests, Descriptor{
+		MediaType:   mediaType,
+		Digest:      m.Digest(),
+		Size:        int64(len(m.Raw)),
+		Annotations: map[string]string{ociRefNameAnnotation: tag},
+	})
+	jd, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(w.dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644); err != nil {
+		return err
+	}
+	tmp := filepath.Join(w.dir, "index.json.tmp")
+	if err := ioutil.WriteFile(tmp, jd, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(w.dir, "index.json"))
+}
+
+// exportOCILayout writes the image to the OCI layout given as
+// oci:/path[:tag], tagging it with defaultTag if no tag is given, and
+// returns the manifest digest
+func exportOCILayout(src imageSource, m Manifest, arg string, defaultTag string, stats *transferStats) (string, error) {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "exportOCILayout",
+		"arg":     arg,
+	})
+	if m.MediaType == mediaTypeSchema1Signed {
+		return "", errors.New("schema1 manifests cannot be written to an OCI layout")
+	}
+	dir, tag := splitOCILayoutArg(arg)
+	if tag == "" {
+		tag = defaultTag
+	}
+	l.Debug("Writing OCI layout ", dir, " tag ", tag)
+	if err := os.MkdirAll(filepath.Join(dir, "blobs"), 0755); err != nil {
+		l.Error("Error creating OCI layout: ", err)
+		return "", err
+	}
+	w := &ociLayoutWriter{dir: dir, src: src, stats: stats}
+	if err := w.writeImage(m); err != nil {
+		l.Error("Error writing image: ", err)
+		return "", err
+	}
+	if err := w.tagImage(m, tag); err != nil {
+		l.Error("Error writing index: ", err)
+		return "", err
+	}
+	return m.Digest(), nil
+}
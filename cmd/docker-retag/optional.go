@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strings"
+)
+
+// optionalPrefix marks a destination whose failure does not fail the
+// run, as in ?registry.eu-west.example.com/app:1.4
+const optionalPrefix = "?"
+
+// statusOptionalFailed is the status of an optional destination that
+// failed
+const statusOptionalFailed = "failed (optional)"
+
+// OptionalRegistries are registry hosts whose destinations are all
+// optional, given with --optional-registry
+var OptionalRegistries stringListFlag
+
+// splitOptional removes the optional prefix from a destination argument,
+// reporting whether it had one
+func splitOptional(arg string) (string, bool) {
+	if strings.HasPrefix(arg, optionalPrefix) {
+		return strings.TrimPrefix(arg, optionalPrefix), true
+	}
+	return arg, false
+}
+
+// isOptionalRegistry reports whether ref is on a registry given with
+// --optional-registry
+func isOptionalRegistry(ref ImageRef) bool {
+	return ref.Registry != "" && matchRegistry(OptionalRegistries, ref.Registry)
+}
+
+// failedStatus returns the status of the destination when it failed
+func (r UploadResult) failedStatus() string {
+	if r.Optional {
+		return statusOptionalFailed
+	}
+	return "failed"
+}
+
+// optionalFailure reports whether the destination is optional and
+// failed, which does not fail the run
+func (r UploadResult) optionalFailure() bool {
+	return r.Status == statusOptionalFailed
+}
+
+// markOptional marks the destinations of the plan that the previous run
+// had as optional, so a resumed run keeps treating them so
+func (prev *runReport) markOptional(p *Plan) {
+	if prev == nil {
+		return
+	}
+	optional := map[string]bool{}
+	for _, r := range prev.Results {
+		if r.Optional {
+			optional[r.Destination] = true
+		}
+	}
+	for i := range p.Destinations {
+		if optional[p.Destinations[i].Arg] {
+			p.Destinations[i].Optional = true
+		}
+	}
+}
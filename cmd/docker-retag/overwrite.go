@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// promptTimeout bounds how long a confirmation prompt waits for an answer,
+// in case stdin is not actually interactive
+const promptTimeout = 5 * time.Minute
+
+var stdinReader = bufio.NewReader(os.Stdin)
+
+// confirm asks question on stderr and reads a y/N answer from stdin.
+// Anything but yes, including no answer within timeout, declines.
+func confirm(question string, timeout time.Duration) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer := make(chan string, 1)
+	go func() {
+		line, _ := stdinReader.ReadString('\n')
+		answer <- line
+	}()
+	select {
+	case a := <-answer:
+		a = strings.ToLower(strings.TrimSpace(a))
+		return a == "y" || a == "yes"
+	case <-time.After(timeout):
+		fmt.Fprintln(os.Stderr)
+		return false
+	}
+}
+
+// checkOverwrites checks the destinations whose tag already points at a
+// different manifest before anything is pushed. Interactive runs ask
+// before overwriting them unless assumeYes is set, and with ifNotExists
+// existing tags are skipped. It returns the results for the destinations
+// that must not be pushed, by index.
+func checkOverwrites(plan *Plan, digest string, interactive, assumeYes, ifNotExists bool) map[int]UploadResult {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "checkOverwrites",
+	})
+	skipped := map[int]UploadResult{}
+	if !interactive && !assumeYes && !ifNotExists {
+		return skipped
+	}
+	for i, d := range plan.Destinations {
+		if d.Ref.Tag == "" || d.Ref.Digest != "" || d.Duplicate {
+			continue
+		}
+		r := UploadResult{
+			Index:       i,
+			Source:      plan.Source.Arg,
+			Destination: d.Arg,
+		}
+		current, exists, err := manifestDigest(d.Ref, d.Ref.Tag)
+		if err != nil {
+			r.Err = fmt.Errorf("checking existing tag: %w", err)
+			skipped[i] = r.complete(time.Now(), nil)
+			continue
+		}
+		if !exists {
+			continue
+		}
+		if ifNotExists {
+			l.Info("Skipping existing tag ", d.Reference)
+			r.Digest = current
+			skipped[i] = r.skip()
+			continue
+		}
+		if current == digest {
+			continue
+		}
+		if assumeYes || !interactive {
+			l.Infof("Overwriting %s, which currently points at %s", d.Reference, current)
+			continue
+		}
+		if !confirm(fmt.Sprintf("%s currently points at %s, overwrite with %s?", d.Reference, current, digest), promptTimeout) {
+			r.Digest = current
+			skipped[i] = r.skip()
+		}
+	}
+	return skipped
+}
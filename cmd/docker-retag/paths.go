@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// userEnv is the environment per-user files are looked up in. Lookups
+// take it rather than reading the process environment so the Windows and
+// Unix rules can be exercised with any environment.
+type userEnv struct {
+	goos   string
+	getenv func(string) string
+}
+
+// processEnv is the environment of the running process
+var processEnv = userEnv{goos: runtime.GOOS, getenv: os.Getenv}
+
+// home returns the home directory the way os.UserHomeDir does:
+// USERPROFILE on Windows and HOME elsewhere. On Windows HOMEDRIVE and
+// HOMEPATH, then HOME as set by Git Bash and Cygwin, are tried if
+// USERPROFILE is not set. It returns an empty string if none is set.
+func (e userEnv) home() string {
+	if e.goos != "windows" {
+		return e.getenv("HOME")
+	}
+	if h := e.getenv("USERPROFILE"); h != "" {
+		return h
+	}
+	if drive, path := e.getenv("HOMEDRIVE"), e.getenv("HOMEPATH"); drive != "" && path != "" {
+		return drive + path
+	}
+	return e.getenv("HOME")
+}
+
+// inHome returns the path of elem in the home directory, or an empty
+// string if there is no home directory
+func (e userEnv) inHome(elem ...string) string {
+	h := e.home()
+	if h == "" {
+		return ""
+	}
+	return filepath.Join(append([]string{h}, elem...)...)
+}
+
+// dockerConfigPath returns the docker CLI config file, honoring
+// DOCKER_CONFIG which the docker CLI also sets for plugins
+func (e userEnv) dockerConfigPath() string {
+	if dir := e.getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	return e.inHome(".docker", "config.json")
+}
+
+// configFilePath returns the default docker-retag config file
+func (e userEnv) configFilePath() string {
+	return e.inHome(defaultConfigFile)
+}
+
+// netrcPath returns the netrc file, honoring NETRC. Windows tools use
+// _netrc in the home directory.
+func (e userEnv) netrcPath() string {
+	if path := e.getenv("NETRC"); path != "" {
+		return path
+	}
+	if e.goos == "windows" {
+		return e.inHome("_netrc")
+	}
+	return e.inHome(".netrc")
+}
+
+// awsCredentialsPath returns the AWS shared credentials file, honoring
+// AWS_SHARED_CREDENTIALS_FILE
+func (e userEnv) awsCredentialsPath() string {
+	if path := e.getenv("AWS_SHARED_CREDENTIALS_FILE"); path != "" {
+		return path
+	}
+	return e.inHome(".aws", "credentials")
+}
+
+// dockerCertPath returns the directory with the TLS client certificates
+// for a DOCKER_HOST over TCP, honoring DOCKER_CERT_PATH like the docker CLI
+func (e userEnv) dockerCertPath() string {
+	if dir := e.getenv("DOCKER_CERT_PATH"); dir != "" {
+		return dir
+	}
+	return e.inHome(".docker")
+}
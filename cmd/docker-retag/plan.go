@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PlanRef is a reference given on the command line along with its parsed form
+type PlanRef struct {
+	Arg       string   `json:"arg"`
+	Reference string   `json:"reference"`
+	Ref       ImageRef `json:"-"`
+	// Duplicate is set when an earlier destination is the same image, so
+	// this one is not pushed
+	Duplicate bool `json:"duplicate,omitempty"`
+	// SameAsSource is set when the destination is the source image, which
+	// needs no push unless the manifest is changed on the way
+	SameAsSource bool `json:"same_as_source,omitempty"`
+	// MappedFrom is the destination as given when --repo-map rewrote it
+	MappedFrom string `json:"mapped_from,omitempty"`
+	// Optional is set for destinations given with the ? prefix or on a
+	// registry of --optional-registry, whose failure does not fail the run
+	Optional bool `json:"optional,omitempty"`
+}
+
+// key returns what identifies the image the reference points at
+func (r PlanRef) key() string {
+	if r.Ref.Registry == "" {
+		return r.Arg
+	}
+	return r.Ref.canonical()
+}
+
+// PlanRegistry is the group of destinations on one registry. They share
+// tokens and blob checks, and each blob is copied to the registry once
+// and mounted into its other repositories.
+type PlanRegistry struct {
+	Registry     string   `json:"registry"`
+	Destinations []string `json:"destinations"`
+}
+
+// Plan is the validated set of operations for a run. It is computed
+// before any registry is contacted so that bad input fails fast, and
+// is what --dry-run prints.
+type Plan struct {
+	Source       PlanRef        `json:"source"`
+	Destinations []PlanRef      `json:"destinations"`
+	Registries   []PlanRegistry `json:"registries"`
+	// DefaultRegistry is where references without a registry resolve to
+	DefaultRegistry string `json:"default_registry"`
+	// Platforms is the result of --require-platform for the source
+	Platforms *PlatformCheck `json:"platforms,omitempty"`
+	// Size is the size of the source checked by --max-size and
+	// --max-layers
+	Size *SourceSize `json:"size,omitempty"`
+}
+
+func newPlanRef(role string, arg string) (PlanRef, error) {
+	ref, err := urlToImageTag(arg)
+	if err != nil {
+		return PlanRef{}, fmt.Errorf("%s: %w", role, err)
+	}
+	if !hasExplicitTag(arg) {
+		if RequireExplicitTags {
+			return PlanRef{}, fmt.Errorf("%s %q has no tag or digest, --require-explicit-tags does not allow defaulting to latest", role, arg)
+		}
+		log.WithFields(log.Fields{
+			"package": "main",
+			"fn":      "newPlanRef",
+		}).Warnf("%s %s has no tag, using %s", role, arg, ref.String())
+	}
+	return PlanRef{
+		Arg:       arg,
+		Reference: ref.String(),
+		Ref:       ref,
+	}, nil
+}
+
+// newPlan parses and validates the source and destination references
+func newPlan(source string, destinations []string) (*Plan, error) {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "newPlan",
+		"source":  source,
+	})
+	l.Debug("Planning retag")
+	p := &Plan{DefaultRegistry: DefaultRegistry}
+	var err error
+	if isLocalSource(source) {
+		p.Source = PlanRef{Arg: source, Reference: source}
+	} else if p.Source, err = newPlanRef("source", source); err != nil {
+		return nil, err
+	}
+	for i, d := range destinations {
+		d, optional := splitOptional(d)
+		if strings.HasPrefix(d, dockerDaemonScheme) {
+			return nil, fmt.Errorf("destination %d: %s images can only be a source", i+1, dockerDaemonScheme)
+		}
+		if strings.HasPrefix(d, ociLayoutScheme) {
+			p.Destinations = append(p.Destinations, PlanRef{Arg: d, Reference: d, Optional: optional})
+			continue
+		}
+		role := fmt.Sprintf("destination %d", i+1)
+		pr, err := newPlanRef(role, d)
+		if err != nil {
+			return nil, err
+		}
+		if mapped, ok := mapRepository(pr.Ref); ok {
+			l.Infof("Mapped destination %s to %s", d, mapped)
+			if pr, err = newPlanRef(role, mapped); err != nil {
+				return nil, fmt.Errorf("%w, mapped from %s by --repo-map", err, d)
+			}
+			pr.MappedFrom = d
+		}
+		if err := pr.Ref.checkPushable(); err != nil {
+			return nil, fmt.Errorf("%s: %w", role, err)
+		}
+		pr.Optional = optional || isOptionalRegistry(pr.Ref)
+		p.Destinations = append(p.Destinations, pr)
+	}
+	p.dedupe()
+	p.groupRegistries()
+	if err := checkRegistryPolicy(p.Destinations); err != nil {
+		return nil, err
+	}
+	if !AllowProtected {
+		var protected []string
+		for _, d := range p.Destinations {
+			if d.Ref.Tag != "" && isProtectedTag(d.Ref) {
+				protected = append(protected, d.Reference)
+			}
+		}
+		if len(protected) > 0 {
+			return nil, fmt.Errorf("refusing to overwrite protected tags without --allow-protected: %s", strings.Join(protected, ", "))
+		}
+	}
+	return p, nil
+}
+
+// args returns the destinations as they are pushed, after --repo-map
+func (p *Plan) args() []string {
+	var args []string
+	for _, d := range p.Destinations {
+		args = append(args, d.Arg)
+	}
+	return args
+}
+
+// dedupe marks the destinations that repeat an earlier destination, which
+// would otherwise push the same tag concurrently, and the destinations
+// that are the source itself
+func (p *Plan) dedupe() {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "Plan.dedupe",
+	})
+	source := p.Source.key()
+	first := map[string]string{}
+	for i := range p.Destinations {
+		d := &p.Destinations[i]
+		key := d.key()
+		if arg, ok := first[key]; ok {
+			l.Infof("Dropping destination %s, a duplicate of %s", d.Arg, arg)
+			d.Duplicate = true
+			continue
+		}
+		first[key] = d.Arg
+		d.SameAsSource = key == source
+	}
+}
+
+// plannedResults returns the results of the destinations that need no
+// push, by index: duplicates are skipped, and destinations that are the
+// source succeed at once if the pushed manifest, with digest, is the
+// source manifest
+func (p *Plan) plannedResults(digest string, unchanged bool) map[int]UploadResult {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "Plan.plannedResults",
+	})
+	results := map[int]UploadResult{}
+	for i, d := range p.Destinations {
+		r := UploadResult{
+			Index:       i,
+			Source:      p.Source.Arg,
+			Destination: d.Arg,
+		}
+		switch {
+		case d.Duplicate:
+			r.Status = statusDuplicate
+			results[i] = r
+		case d.SameAsSource && unchanged:
+			l.Infof("%s is the source image, nothing to push", d.Reference)
+			r.Digest = digest
+			r.Manifest = "unchanged"
+			results[i] = r.complete(time.Now(), nil)
+		}
+	}
+	return results
+}
+
+// groupRegistries groups the destinations by registry, in the order the
+// registries first appear. OCI layout destinations form one group.
+// Duplicate destinations are left out.
+func (p *Plan) groupRegistries() {
+	groups := map[string]int{}
+	for _, d := range p.Destinations {
+		if d.Duplicate {
+			continue
+		}
+		registry := d.Ref.Registry
+		if strings.HasPrefix(d.Arg, ociLayoutScheme) {
+			registry = "oci-layout"
+		}
+		i, ok := groups[registry]
+		if !ok {
+			i = len(p.Registries)
+			groups[registry] = i
+			p.Registries = append(p.Registries, PlanRegistry{Registry: registry})
+		}
+		p.Registries[i].Destinations = append(p.Registries[i].Destinations, d.Reference)
+	}
+}
+
+// sharesSourceBlobs reports whether blobs have to be copied from the
+// source to more than one registry, so downloading each blob once and
+// uploading it from disk saves source traffic. Destinations on the source
+// registry mount blobs instead of copying them.
+func (p *Plan) sharesSourceBlobs() bool {
+	if isLocalSource(p.Source.Arg) {
+		return false
+	}
+	copied := 0
+	for _, g := range p.Registries {
+		if g.Registry == "oci-layout" {
+			copied += len(g.Destinations)
+		} else if g.Registry != p.Source.Ref.Registry {
+			copied++
+		}
+	}
+	return copied > 1
+}
+
+// matchRegistry reports whether the registry host matches one of the
+// patterns, which may use globs such as *.internal.example.com
+func matchRegistry(patterns []string, registry string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		for _, host := range []string{strings.ToLower(registry), canonicalHost(registry)} {
+			if ok, _ := path.Match(pattern, host); ok {
+				return true
+			}
+		}
+		if isDockerHub(pattern) && isDockerHub(registry) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRegistryPolicy rejects destinations on registries that are denied
+// by --denied-registries or missing from --allowed-registries. Deny takes
+// precedence over allow.
+func checkRegistryPolicy(destinations []PlanRef) error {
+	var violations []string
+	for _, d := range destinations {
+		if d.Ref.Registry == "" {
+			continue
+		}
+		switch {
+		case matchRegistry(DeniedRegistries, d.Ref.Registry):
+			violations = append(violations, fmt.Sprintf("%s (registry %s is denied)", d.Reference, d.Ref.Registry))
+		case len(AllowedRegistries) > 0 && !matchRegistry(AllowedRegistries, d.Ref.Registry):
+			violations = append(violations, fmt.Sprintf("%s (registry %s is not allowed)", d.Reference, d.Ref.Registry))
+		}
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("destinations violate the registry policy: %s", strings.Join(violations, ", "))
+	}
+	return nil
+}
+
+// isProtectedTag reports whether the tag of ref matches a pattern from
+// --protected-tags or the config file
+func isProtectedTag(ref ImageRef) bool {
+	for _, pattern := range append(FileConfig.protectedTags(ref), ProtectedTags...) {
+		if ok, _ := path.Match(pattern, ref.Tag); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// print writes the plan in the requested output format
+func (p *Plan) print() error {
+	if OutputFormat == "ndjson" {
+		jd, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(jd))
+		return nil
+	}
+	if OutputFormat == "json" {
+		jd, err := json.MarshalIndent(p, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(jd))
+		return nil
+	}
+	fmt.Println("Default registry:", p.DefaultRegistry)
+	fmt.Println("Source:", p.Source.Reference)
+	if p.Platforms != nil {
+		fmt.Printf("Platforms: %s (required %s)\n", strings.Join(p.Platforms.Available, ", "), strings.Join(p.Platforms.Required, ", "))
+	}
+	if p.Size != nil {
+		fmt.Println("Size:", p.Size)
+	}
+	mappedFrom := map[string]string{}
+	optional := map[string]bool{}
+	for _, d := range p.Destinations {
+		if d.MappedFrom != "" {
+			mappedFrom[d.Reference] = d.MappedFrom
+		}
+		optional[d.Reference] = optional[d.Reference] || d.Optional
+	}
+	for _, g := range p.Registries {
+		fmt.Printf("  %s:\n", g.Registry)
+		for _, d := range g.Destinations {
+			line := "    -> " + d
+			if from, ok := mappedFrom[d]; ok {
+				line += fmt.Sprintf(" (mapped from %s)", from)
+			}
+			if optional[d] {
+				line += " (optional)"
+			}
+			fmt.Println(line)
+		}
+	}
+	var duplicates []string
+	for _, d := range p.Destinations {
+		if d.Duplicate {
+			duplicates = append(duplicates, d.Arg)
+		}
+	}
+	if len(duplicates) > 0 {
+		fmt.Println("  skipped (duplicate):")
+		for _, d := range duplicates {
+			fmt.Println("    ->", d)
+		}
+	}
+	return nil
+}
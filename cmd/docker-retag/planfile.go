@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// planFileVersion is the version of the plan file format. apply refuses
+// plan files of any other version, whose fields may mean something else.
+const planFileVersion = 1
+
+// planExcludedFlags are not recorded in plan files: credentials and
+// --header, which may carry them, are given to apply itself, and some
+// flags only make sense for the plan run. --dest-template and --dest-file
+// are left out as their destinations are recorded rendered.
+var planExcludedFlags = map[string]bool{
+	"u":             true,
+	"p":             true,
+	"P":             true,
+	"password-file": true,
+	"creds-fd":      true,
+	"config":        true,
+	"header":        true,
+	"out":           true,
+	"force":         true,
+	"dry-run":       true,
+	"dest-template": true,
+	"dest-file":     true,
+	"expand-env":    true,
+}
+
+// PlanFile is the plan docker-retag plan writes and docker-retag apply
+// executes: the flags of the run and, for every group, the source digest
+// resolved and what is done to each destination
+type PlanFile struct {
+	Version            int       `json:"version"`
+	DockerRetagVersion string    `json:"docker_retag_version"`
+	Created            time.Time `json:"created"`
+	// Flags are the command line flags of the plan run, without
+	// credentials, which apply runs with
+	Flags  []string        `json:"flags"`
+	Groups []*PlannedGroup `json:"groups"`
+}
+
+// PlannedGroup is a source and its destinations in a plan file
+type PlannedGroup struct {
+	Source string `json:"source"`
+	// SourceDigest is the digest the source resolved to when planning.
+	// apply fails if it resolves to another digest, unless --force.
+	SourceDigest string `json:"source_digest"`
+	// Digest is the digest pushed, which differs from the source digest
+	// when flags such as --label change the manifest
+	Digest    string `json:"digest"`
+	MediaType string `json:"media_type"`
+	// SourceAge is when the source was created, checked when planning
+	// with --max-source-age
+	SourceAge *SourceAge `json:"source_age,omitempty"`
+	// Platforms is the result of --require-platform when planning
+	Platforms *PlatformCheck `json:"platforms,omitempty"`
+	// Size is the size of the source checked by --max-size and
+	// --max-layers when planning
+	Size *SourceSize `json:"size,omitempty"`
+	// Arguments are the destinations as given, with --dest-template
+	// destinations rendered
+	Arguments    []string             `json:"arguments"`
+	Destinations []PlannedDestination `json:"destinations"`
+}
+
+// PlannedDestination is what apply does to a destination: create the tag,
+// update it from its current digest, leave it unchanged, skip a duplicate
+// or export to an OCI layout. Blobs lists the blobs the destination
+// repository is missing, which are copied or mounted.
+type PlannedDestination struct {
+	Destination   string       `json:"destination"`
+	Action        string       `json:"action"`
+	CurrentDigest string       `json:"current_digest,omitempty"`
+	Blobs         []Descriptor `json:"blobs,omitempty"`
+	BlobBytes     int64        `json:"blob_bytes,omitempty"`
+	// ContentFrom is an earlier destination in the same repository with
+	// the same digest. Its content is copied once, and this destination
+	// only needs its manifest pushed.
+	ContentFrom string `json:"content_from,omitempty"`
+}
+
+// flagArgs returns the flags given on the command line, leaving out
+// planExcludedFlags and their values
+func flagArgs(fs *flag.FlagSet, args []string) []string {
+	flags := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			continue
+		}
+		name, _, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		takesValue := !hasValue
+		if f := fs.Lookup(name); f != nil {
+			if bf, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && bf.IsBoolFlag() {
+				takesValue = false
+			}
+		}
+		skip := planExcludedFlags[name]
+		if !skip {
+			flags = append(flags, arg)
+		}
+		if takesValue && i+1 < len(args) {
+			i++
+			if !skip {
+				flags = append(flags, args[i])
+			}
+		}
+	}
+	return flags
+}
+
+// writePlanFile resolves the sources of the groups and checks their
+// destinations without changing anything, and writes the plan to path,
+// or to stdout if path is -
+func writePlanFile(groups []*retagGroup, flags []string, opts *options, path string) error {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "writePlanFile",
+		"path":    path,
+	})
+	pf := &PlanFile{
+		Version:            planFileVersion,
+		DockerRetagVersion: Version,
+		Created:            time.Now().UTC(),
+		Flags:              flags,
+	}
+	// content is the first destination of each repository and digest
+	content := map[string]string{}
+	for _, g := range groups {
+		pg, err := planGroup(g, opts, content)
+		if err != nil {
+			l.Error("Error planning ", g.source, ": ", err)
+			return err
+		}
+		pf.Groups = append(pf.Groups, pg)
+	}
+	jd, err := json.MarshalIndent(pf, "", "  ")
+	if err != nil {
+		return err
+	}
+	if path == "-" {
+		fmt.Println(string(jd))
+		return nil
+	}
+	if err := ioutil.WriteFile(path, append(jd, '\n'), 0644); err != nil {
+		l.Error("Error writing plan: ", err)
+		return err
+	}
+	for _, pg := range pf.Groups {
+		counts := map[string]int{}
+		reused := 0
+		for _, d := range pg.Destinations {
+			counts[d.Action]++
+			if d.ContentFrom != "" {
+				reused++
+			}
+		}
+		l.WithFields(log.Fields{
+			"actions":        counts,
+			"reused_content": reused,
+		}).Infof("Planned %s at %s", pg.Source, pg.SourceDigest)
+	}
+	l.Info("Wrote plan, run docker-retag apply ", path, " to execute it")
+	return nil
+}
+
+// planGroup resolves the source of the group and prepares its manifest
+// as a run would, and records what would be done to every destination.
+// content holds the first destination planned for each repository and
+// digest, which the others with the same digest reuse the content of.
+func planGroup(g *retagGroup, opts *options, content map[string]string) (*PlannedGroup, error) {
+	src, err := newImageSource(g.source)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := src.root()
+	if err != nil {
+		return nil, err
+	}
+	pg := &PlannedGroup{
+		Source:       g.source,
+		SourceDigest: manifest.Digest(),
+		Arguments:    g.arguments,
+		Platforms:    g.plan.Platforms,
+		Size:         g.plan.Size,
+	}
+	if *opts.maxSourceAge > 0 {
+		if pg.SourceAge, err = checkSourceAge(src, manifest, *opts.maxSourceAge, *opts.strictAge); err != nil {
+			return nil, err
+		}
+	}
+	if src, manifest, err = prepareManifest(src, manifest, opts); err != nil {
+		return nil, err
+	}
+	pg.Digest = manifest.Digest()
+	pg.MediaType = manifest.ContentType
+	for _, d := range g.plan.Destinations {
+		pd := PlannedDestination{Destination: d.Reference}
+		switch {
+		case d.Duplicate:
+			pd.Action = statusDuplicate
+		case strings.HasPrefix(d.Arg, ociLayoutScheme):
+			pd.Action = "export"
+		default:
+			pd.Action = "create"
+			if d.Ref.Tag != "" && d.Ref.Digest == "" {
+				current, exists, err := manifestDigest(d.Ref, d.Ref.Tag)
+				if err != nil {
+					return nil, fmt.Errorf("checking existing tag %s: %w", d.Reference, err)
+				}
+				if exists {
+					pd.CurrentDigest = current
+					pd.Action = "update"
+					if current == pg.Digest {
+						pd.Action = "unchanged"
+					}
+				}
+			}
+			if pd.Action == "unchanged" || SkipBlobCheck {
+				break
+			}
+			key := d.Ref.Repository() + "@" + pg.Digest
+			if first, ok := content[key]; ok {
+				pd.ContentFrom = first
+				break
+			}
+			content[key] = d.Reference
+			if pd.Blobs, err = missingBlobs(src, manifest, d.Ref, map[string]bool{}); err != nil {
+				return nil, fmt.Errorf("checking blobs of %s: %w", d.Ref.Repository(), err)
+			}
+			for _, b := range pd.Blobs {
+				pd.BlobBytes += b.Size
+			}
+		}
+		pg.Destinations = append(pg.Destinations, pd)
+	}
+	return pg, nil
+}
+
+// missingBlobs returns the blobs referenced by m, and by the manifests of
+// an index that dst is missing, that are not in dst's repository. It
+// makes the same checks as ensureContent without copying anything.
+func missingBlobs(src imageSource, m Manifest, dst ImageRef, seen map[string]bool) ([]Descriptor, error) {
+	if m.MediaType == mediaTypeSchema1Signed {
+		return nil, nil
+	}
+	var missing []Descriptor
+	if m.isIndex() {
+		for _, d := range m.Manifests {
+			exists, err := manifestExists(dst, d.Digest)
+			if err != nil {
+				return nil, err
+			}
+			if exists {
+				continue
+			}
+			child, err := src.manifest(d.Digest)
+			if err != nil {
+				return nil, fmt.Errorf("getting manifest %s from %s: %w", d.Digest, src, err)
+			}
+			blobs, err := missingBlobs(src, child, dst, seen)
+			if err != nil {
+				return nil, err
+			}
+			missing = append(missing, blobs...)
+		}
+		return missing, nil
+	}
+	for _, b := range m.blobs() {
+		if b.Digest == "" || seen[b.Digest] || skipExternal(b) {
+			continue
+		}
+		seen[b.Digest] = true
+		exists, err := blobExists(dst, b.Digest)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			missing = append(missing, Descriptor{MediaType: b.MediaType, Digest: b.Digest, Size: b.Size})
+		}
+	}
+	return missing, nil
+}
+
+// loadPlanFile reads a plan file written by docker-retag plan, refusing
+// plans of another format version
+func loadPlanFile(path string) (*PlanFile, error) {
+	bd, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var pf PlanFile
+	if err := json.Unmarshal(bd, &pf); err != nil {
+		return nil, fmt.Errorf("parsing plan %s: %w", path, err)
+	}
+	if pf.Version != planFileVersion {
+		return nil, fmt.Errorf("plan %s has format version %d, written by docker-retag %s, this docker-retag applies version %d", path, pf.Version, pf.DockerRetagVersion, planFileVersion)
+	}
+	if len(pf.Groups) == 0 {
+		return nil, fmt.Errorf("plan %s has no sources", path)
+	}
+	return &pf, nil
+}
+
+// args returns the arguments of the run the plan was made for, a group
+// per source separated by --
+func (pf *PlanFile) args() []string {
+	var args []string
+	for i, g := range pf.Groups {
+		if i > 0 {
+			args = append(args, groupSeparator)
+		}
+		args = append(args, g.Source)
+		args = append(args, g.Arguments...)
+	}
+	return args
+}
+
+// checkDrift compares what a group resolves to when applied with what
+// was planned. A drifted source or pushed digest is an error, or only
+// logged with force.
+func (pg *PlannedGroup) checkDrift(what, planned, digest string, force bool) error {
+	if digest == planned {
+		return nil
+	}
+	err := fmt.Errorf("tag drift detected: %s of %s was %s when planned, now %s", what, pg.Source, planned, digest)
+	if !force {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "PlannedGroup.checkDrift",
+	}).Warn(err, ", applying anyway with --force")
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"testing"
+)
+
+func TestPlanGroupContentFrom(t *testing.T) {
+	anonymousEnv(t)
+	source := newTestRegistry(t)
+	pushIndexFixture(t, source, "src", "1.0")
+	dest := newTestRegistry(t)
+	opts := defineFlags(flag.NewFlagSet("docker-retag", flag.ContinueOnError))
+	group := func(destinations ...string) *retagGroup {
+		t.Helper()
+		var args []string
+		for _, d := range destinations {
+			args = append(args, dest.host+"/"+d)
+		}
+		plan, err := newPlan(source.host+"/src:1.0", args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &retagGroup{source: source.host + "/src:1.0", destinations: plan.args(), plan: plan}
+	}
+
+	content := map[string]string{}
+	var planned []PlannedDestination
+	for _, g := range []*retagGroup{group("app:a", "app:b", "other:c", "app:d"), group("app:e", "other:f")} {
+		pg, err := planGroup(g, opts, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		planned = append(planned, pg.Destinations...)
+	}
+	first, other := dest.host+"/app:a", dest.host+"/other:c"
+	want := map[string]string{
+		dest.host + "/app:a":   "",
+		dest.host + "/app:b":   first,
+		dest.host + "/other:c": "",
+		dest.host + "/app:d":   first,
+		dest.host + "/app:e":   first,
+		dest.host + "/other:f": other,
+	}
+	if len(planned) != len(want) {
+		t.Fatalf("planned %d destinations, want %d", len(planned), len(want))
+	}
+	for _, pd := range planned {
+		if pd.ContentFrom != want[pd.Destination] {
+			t.Errorf("%s has content_from %q, want %q", pd.Destination, pd.ContentFrom, want[pd.Destination])
+		}
+		if pd.ContentFrom != "" && len(pd.Blobs) > 0 {
+			t.Errorf("%s reuses the content of %s but lists %d blobs to copy", pd.Destination, pd.ContentFrom, len(pd.Blobs))
+		}
+		if pd.ContentFrom == "" && len(pd.Blobs) != 4 {
+			t.Errorf("%s lists %d missing blobs, want the 4 of the index", pd.Destination, len(pd.Blobs))
+		}
+	}
+}
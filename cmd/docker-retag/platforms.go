@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PlatformCheck is the result of --require-platform for a source: the
+// platforms required and those the source has
+type PlatformCheck struct {
+	Required  []string `json:"required"`
+	Available []string `json:"available"`
+}
+
+// sourcePlatforms returns the platforms of the source m: the platforms of
+// the manifests of an index, leaving out attestation manifests, or the
+// os and architecture of the image config. Index entries without a
+// platform are read from their config.
+func sourcePlatforms(src imageSource, m Manifest) ([]Platform, error) {
+	if !m.isIndex() {
+		c, err := fetchConfig(src, m)
+		if err != nil {
+			return nil, fmt.Errorf("reading image config from %s: %w", src, err)
+		}
+		if c.OS == "" || c.Architecture == "" {
+			return nil, nil
+		}
+		return []Platform{{OS: c.OS, Architecture: c.Architecture, Variant: c.Variant, OSVersion: c.OSVersion}}, nil
+	}
+	var platforms []Platform
+	for _, d := range m.Manifests {
+		if isAttestation(d) {
+			continue
+		}
+		if d.Platform != nil {
+			platforms = append(platforms, *d.Platform)
+			continue
+		}
+		child, err := src.manifest(d.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("getting manifest %s from %s: %w", d.Digest, src, err)
+		}
+		ps, err := sourcePlatforms(src, child)
+		if err != nil {
+			return nil, err
+		}
+		platforms = append(platforms, ps...)
+	}
+	return platforms, nil
+}
+
+// checkPlatforms fails unless the source m has every required platform,
+// listing the missing platforms and the ones the source has. A required
+// platform without a variant matches any variant.
+func checkPlatforms(src imageSource, m Manifest, required []Platform) (*PlatformCheck, error) {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "checkPlatforms",
+		"image":   src.String(),
+	})
+	platforms, err := sourcePlatforms(src, m)
+	if err != nil {
+		l.Error("Error getting platforms: ", err)
+		return nil, err
+	}
+	check := &PlatformCheck{Available: []string{}}
+	for i := range platforms {
+		check.Available = append(check.Available, platforms[i].String())
+	}
+	var missing []string
+	for _, want := range required {
+		check.Required = append(check.Required, want.String())
+		found := false
+		for i := range platforms {
+			if platforms[i].matches(want) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, want.String())
+		}
+	}
+	if len(missing) > 0 {
+		available := strings.Join(check.Available, ", ")
+		if available == "" {
+			available = "no platform in its config"
+		}
+		return check, fmt.Errorf("source %s is missing required platform %s, it has %s", src, strings.Join(missing, ", "), available)
+	}
+	l.Debug("Source has the required platforms: ", strings.Join(check.Required, ", "))
+	return check, nil
+}
+
+// checkGroupPlatforms runs --require-platform for the source of the group
+// and records the result in its plan and the report
+func checkGroupPlatforms(g *retagGroup, required []Platform) error {
+	src, err := newImageSource(g.source)
+	if err != nil {
+		return err
+	}
+	manifest, err := src.root()
+	if err != nil {
+		return err
+	}
+	check, err := checkPlatforms(src, manifest, required)
+	g.plan.Platforms = check
+	report.setPlatforms(g.index, check)
+	return err
+}
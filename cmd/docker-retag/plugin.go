@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+const (
+	// pluginName is the docker subcommand when installed as a CLI plugin
+	pluginName = "retag"
+	// pluginMetadataCmd is how the docker CLI discovers plugins
+	pluginMetadataCmd = "docker-cli-plugin-metadata"
+)
+
+// pluginMode is true when running as "docker retag"
+var pluginMode bool
+
+// pluginMetadata is the response to the docker CLI plugin metadata request
+type pluginMetadata struct {
+	SchemaVersion    string `json:"SchemaVersion"`
+	Vendor           string `json:"Vendor"`
+	Version          string `json:"Version"`
+	ShortDescription string `json:"ShortDescription"`
+	URL              string `json:"URL"`
+}
+
+// pluginDispatch detects invocation through the docker CLI plugin protocol.
+// It answers metadata requests and strips the leading plugin subcommand,
+// returning the remaining arguments. Standalone arguments are returned
+// unchanged.
+func pluginDispatch(args []string) []string {
+	if len(args) == 0 {
+		return args
+	}
+	switch args[0] {
+	case pluginMetadataCmd:
+		jd, _ := json.Marshal(pluginMetadata{
+			SchemaVersion:    "0.1.0",
+			Vendor:           "robertlestak",
+			Version:          Version,
+			ShortDescription: "Retag images in a remote registry without pulling them",
+			URL:              "https://github.com/robertlestak/docker-retag",
+		})
+		fmt.Println(string(jd))
+		os.Exit(0)
+	case pluginName:
+		pluginMode = true
+		return args[1:]
+	}
+	return args
+}
+
+// commandName is how the user invoked the tool
+func commandName() string {
+	if pluginMode {
+		return "docker " + pluginName
+	}
+	return "docker-retag"
+}
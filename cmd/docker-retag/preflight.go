@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Preflight checks that every destination repository can be pushed to
+// before anything is pushed. By default it is on for runs with several
+// destinations, where a permission problem found at the end leaves a
+// partial promotion.
+var Preflight preflightFlag
+
+// enabled reports whether the preflight runs for a run pushing to the
+// number of destinations
+func (f preflightFlag) enabled(destinations int) bool {
+	if f == "" {
+		return destinations > 1
+	}
+	return f == "true"
+}
+
+// preflightProblem is a destination repository the preflight could not
+// push to
+type preflightProblem struct {
+	repository string
+	err        error
+}
+
+// preflightError lists every destination repository that cannot be pushed
+// to, so they can all be fixed before the run is retried
+type preflightError struct {
+	problems []preflightProblem
+	checked  int
+}
+
+func (e *preflightError) Error() string {
+	var problems []string
+	for _, p := range e.problems {
+		problems = append(problems, p.repository+": "+p.err.Error())
+	}
+	return fmt.Sprintf("preflight found %d of %d destination repositories that cannot be pushed to, nothing was pushed: %s", len(e.problems), e.checked, strings.Join(problems, "; "))
+}
+
+// preflightRepositories returns the destination repositories of the groups
+// that are pushed to, once each, and which of them only optional
+// destinations push to. OCI layouts, duplicates and destinations that are
+// the source are left out.
+func preflightRepositories(groups []*retagGroup) ([]ImageRef, map[string]bool) {
+	var refs []ImageRef
+	optional := map[string]bool{}
+	for _, g := range groups {
+		for _, d := range g.plan.Destinations {
+			if d.Ref.Registry == "" || d.Duplicate || d.SameAsSource {
+				continue
+			}
+			repo := d.Ref.Repository()
+			only, seen := optional[repo]
+			optional[repo] = d.Optional && (!seen || only)
+			if !seen {
+				refs = append(refs, d.Ref)
+			}
+		}
+	}
+	return refs, optional
+}
+
+// preflight checks push access to every destination repository of the
+// groups, up to workers at once, by starting a blob upload and cancelling
+// it. Registries such as Docker Hub hand out tokens without the push scope
+// instead of refusing them, so only a push request shows the permission.
+// Repositories that do not exist are not a problem with --create-repository,
+// and repositories only optional destinations push to are only warned about.
+func preflight(groups []*retagGroup, workers int) error {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "preflight",
+	})
+	refs, optional := preflightRepositories(groups)
+	errs := make([]error, len(refs))
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for i, ref := range refs {
+		wg.Add(1)
+		go func(i int, ref ImageRef) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			errs[i] = checkPushAccess(ref)
+		}(i, ref)
+	}
+	wg.Wait()
+	e := &preflightError{checked: len(refs)}
+	for i, err := range errs {
+		var notFound *repositoryNotFoundError
+		if err == nil || (CreateRepository && errors.As(err, &notFound)) {
+			continue
+		}
+		if optional[refs[i].Repository()] {
+			l.WithField("repository", refs[i].Repository()).Warn("Cannot push to optional destinations: ", err)
+			continue
+		}
+		l.WithField("repository", refs[i].Repository()).Error("Cannot push: ", err)
+		e.problems = append(e.problems, preflightProblem{repository: refs[i].Repository(), err: err})
+	}
+	if len(e.problems) > 0 {
+		return e
+	}
+	l.Debugf("Can push to all %d destination repositories", len(refs))
+	return nil
+}
+
+// checkPushAccess starts a blob upload in ref's repository and cancels it
+func checkPushAccess(ref ImageRef) error {
+	l := log.WithFields(log.Fields{
+		"package":    "main",
+		"fn":         "checkPushAccess",
+		"repository": ref.Repository(),
+	})
+	if err := checkRegistryAPI(ref); err != nil {
+		return err
+	}
+	loc, _, err := startUpload(ref, nil)
+	if err != nil {
+		return err
+	}
+	if err := cancelUpload(ref, loc); err != nil {
+		// registries expire abandoned upload sessions
+		l.Debug("Error cancelling preflight upload: ", err)
+	}
+	return nil
+}
+
+// cancelUpload deletes the upload session at loc
+func cancelUpload(ref ImageRef, loc *url.URL) error {
+	req, err := http.NewRequest("DELETE", loc.String(), nil)
+	if err != nil {
+		return err
+	}
+	if err := authorize(req, ref); err != nil {
+		return err
+	}
+	resp, err := registryDo(req, ref.authProvider())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	progressPlainInterval = 5 * time.Second
+	progressTTYInterval   = 200 * time.Millisecond
+)
+
+// progress reports blob transfers; it stays quiet until started from main
+var progress = &progressReporter{quiet: true}
+
+// progressReporter tracks the running blob transfers and periodically
+// renders their progress, either as log lines or as live bars on a TTY
+type progressReporter struct {
+	mu        sync.Mutex
+	out       *os.File
+	tty       bool
+	quiet     bool
+	transfers []*transfer
+	lines     int
+	bytes     int64
+	start     time.Time
+	stop      chan struct{}
+	stopped   chan struct{}
+}
+
+// transfer is a single blob being copied
+type transfer struct {
+	p     *progressReporter
+	desc  Descriptor
+	stats *transferStats
+	n     int64
+	start time.Time
+	// lastEvent is when blob_copy_progress was last written for the blob,
+	// or the start of the transfer
+	eventMu   sync.Mutex
+	lastEvent time.Time
+}
+
+// transferStats counts the bytes copied and upload retries for a single
+// destination. A nil *transferStats discards the counts.
+type transferStats struct {
+	bytes   int64
+	retries int64
+	// source and destination name the transfers in events
+	source      string
+	destination string
+	// span is the --otel span of the destination, which blob copies are
+	// children of
+	span *span
+}
+
+// traceSpan returns the span of the destination, nil without one
+func (s *transferStats) traceSpan() *span {
+	if s == nil {
+		return nil
+	}
+	return s.span
+}
+
+func (s *transferStats) addBytes(n int64) {
+	if s != nil {
+		atomic.AddInt64(&s.bytes, n)
+	}
+}
+
+func (s *transferStats) addRetry() {
+	if s != nil {
+		atomic.AddInt64(&s.retries, 1)
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// newProgressReporter creates a reporter for the --progress mode, which is
+// auto, plain or tty. auto renders bars when stdout is a TTY.
+func newProgressReporter(mode string, quiet bool) (*progressReporter, error) {
+	p := &progressReporter{
+		out:   os.Stdout,
+		quiet: quiet,
+		start: time.Now(),
+	}
+	switch mode {
+	case "auto":
+		p.tty = isTerminal(os.Stdout)
+	case "plain":
+	case "tty":
+		p.tty = true
+	default:
+		return nil, fmt.Errorf("unknown progress mode %q, expected auto, plain or tty", mode)
+	}
+	return p, nil
+}
+
+// run renders progress until finish is called
+func (p *progressReporter) run() {
+	if p.quiet {
+		return
+	}
+	p.stop = make(chan struct{})
+	p.stopped = make(chan struct{})
+	interval := progressPlainInterval
+	if p.tty {
+		interval = progressTTYInterval
+		// log lines are written through the reporter so they do not
+		// tear the bars
+		log.SetOutput(&progressLogWriter{p: p, w: log.StandardLogger().Out})
+	}
+	go func() {
+		defer close(p.stopped)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-t.C:
+				p.render()
+			}
+		}
+	}()
+}
+
+// finish stops rendering and erases any bars
+func (p *progressReporter) finish() {
+	if p.quiet {
+		return
+	}
+	close(p.stop)
+	<-p.stopped
+	p.mu.Lock()
+	p.clear()
+	p.mu.Unlock()
+}
+
+// runTotals adds up the results of a run as they arrive, so the summary
+// does not need every result kept until the end
+type runTotals struct {
+	succeeded, skipped, failed int
+	// failedOptional are the optional destinations that failed, which
+	// failed does not count
+	failedOptional int
+	// images and artifacts count the destinations pushed by the kind of
+	// their source, indexes of images counting as images
+	images, artifacts int
+	registries        map[string]*registryTotals
+	// order is the order destination registries first had a result in
+	order []string
+}
+
+// registryTotals are the results and push times of a destination registry
+type registryTotals struct {
+	destinations, failed int
+	busy, slowest        float64
+}
+
+func newRunTotals() *runTotals {
+	return &runTotals{registries: map[string]*registryTotals{}}
+}
+
+// add counts the result
+func (t *runTotals) add(r UploadResult) {
+	failed := r.Status != "success" && !r.skipped()
+	switch {
+	case r.optionalFailure():
+		t.failedOptional++
+	case r.Status == "success":
+		t.succeeded++
+		if r.Kind == kindArtifact {
+			t.artifacts++
+		} else {
+			t.images++
+		}
+	case r.skipped():
+		t.skipped++
+	default:
+		t.failed++
+	}
+	registry := jobRegistry(r.Destination)
+	rt, ok := t.registries[registry]
+	if !ok {
+		rt = &registryTotals{}
+		t.registries[registry] = rt
+		t.order = append(t.order, registry)
+	}
+	rt.destinations++
+	if failed {
+		rt.failed++
+	}
+	rt.busy += r.Duration
+	if r.Duration > rt.slowest {
+		rt.slowest = r.Duration
+	}
+}
+
+// summary logs how many destinations succeeded, were skipped or failed,
+// with the total bytes transferred and wall time
+func (p *progressReporter) summary(totals *runTotals) {
+	if p.quiet {
+		return
+	}
+	log.WithFields(log.Fields{
+		"succeeded":       totals.succeeded,
+		"skipped":         totals.skipped,
+		"failed":          totals.failed,
+		"failed_optional": totals.failedOptional,
+		"images":          totals.images,
+		"artifacts":       totals.artifacts,
+		"transferred":     formatBytes(atomic.LoadInt64(&p.bytes)),
+		"elapsed":         time.Since(p.start).Round(time.Millisecond).String(),
+	}).Info("Done")
+	registrySummary(totals)
+	metrics.summary()
+}
+
+// registrySummary logs the results and push times of each destination
+// registry, so a slow registry stands out from the others
+func registrySummary(totals *runTotals) {
+	for _, registry := range totals.order {
+		t := totals.registries[registry]
+		log.WithFields(log.Fields{
+			"registry":     registry,
+			"destinations": t.destinations,
+			"failed":       t.failed,
+			"busy":         time.Duration(t.busy * float64(time.Second)).Round(time.Millisecond).String(),
+			"slowest":      time.Duration(t.slowest * float64(time.Second)).Round(time.Millisecond).String(),
+		}).Info("Registry")
+	}
+}
+
+// track registers a blob transfer and returns a reader that counts the
+// bytes read from r into the reporter and stats; done must be called when
+// the transfer ends
+func (p *progressReporter) track(desc Descriptor, r io.Reader, stats *transferStats) (io.Reader, func()) {
+	t := &transfer{p: p, desc: desc, stats: stats, start: time.Now()}
+	t.lastEvent = t.start
+	if p.quiet {
+		return &progressReader{r: r, t: t}, func() { events.blobProgress(t, true) }
+	}
+	p.mu.Lock()
+	p.transfers = append(p.transfers, t)
+	p.mu.Unlock()
+	return &progressReader{r: r, t: t}, func() {
+		p.remove(t)
+		events.blobProgress(t, true)
+	}
+}
+
+func (p *progressReporter) remove(t *transfer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, o := range p.transfers {
+		if o == t {
+			p.transfers = append(p.transfers[:i], p.transfers[i+1:]...)
+			break
+		}
+	}
+}
+
+// clear erases the bars drawn by the last render. p.mu must be held.
+func (p *progressReporter) clear() {
+	if p.lines > 0 {
+		fmt.Fprintf(p.out, "\033[%dA\033[J", p.lines)
+		p.lines = 0
+	}
+}
+
+func (p *progressReporter) render() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.tty {
+		for _, t := range p.transfers {
+			log.WithFields(log.Fields{
+				"digest":   t.desc.Digest,
+				"progress": t.progress(),
+				"rate":     t.rate(),
+			}).Info("Copying blob")
+		}
+		return
+	}
+	p.clear()
+	for _, t := range p.transfers {
+		fmt.Fprintf(p.out, "%s %s %s %s\n", shortDigest(t.desc.Digest), t.bar(30), t.progress(), t.rate())
+	}
+	p.lines = len(p.transfers)
+}
+
+// copied returns the bytes of the blob copied so far
+func (t *transfer) copied() int64 {
+	return atomic.LoadInt64(&t.n)
+}
+
+func (t *transfer) progress() string {
+	n := atomic.LoadInt64(&t.n)
+	if t.desc.Size <= 0 {
+		return formatBytes(n)
+	}
+	return formatBytes(n) + " / " + formatBytes(t.desc.Size)
+}
+
+func (t *transfer) rate() string {
+	secs := time.Since(t.start).Seconds()
+	if secs <= 0 {
+		return ""
+	}
+	return formatBytes(int64(float64(atomic.LoadInt64(&t.n))/secs)) + "/s"
+}
+
+func (t *transfer) bar(width int) string {
+	if t.desc.Size <= 0 {
+		return "[" + strings.Repeat(" ", width) + "]"
+	}
+	done := int(atomic.LoadInt64(&t.n) * int64(width) / t.desc.Size)
+	if done > width {
+		done = width
+	}
+	return "[" + strings.Repeat("=", done) + strings.Repeat(" ", width-done) + "]"
+}
+
+// progressReader counts the bytes read for a transfer
+type progressReader struct {
+	r io.Reader
+	t *transfer
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	atomic.AddInt64(&r.t.n, int64(n))
+	atomic.AddInt64(&r.t.p.bytes, int64(n))
+	r.t.stats.addBytes(int64(n))
+	events.blobProgress(r.t, false)
+	return n, err
+}
+
+// progressLogWriter clears the bars before a log line is written, the next
+// render redraws them below it
+type progressLogWriter struct {
+	p *progressReporter
+	w io.Writer
+}
+
+func (w *progressLogWriter) Write(b []byte) (int, error) {
+	w.p.mu.Lock()
+	defer w.p.mu.Unlock()
+	w.p.clear()
+	return w.w.Write(b)
+}
+
+// shortDigest abbreviates a digest for display
+func shortDigest(digest string) string {
+	if i := strings.Index(digest, ":"); i >= 0 && len(digest) > i+13 {
+		return digest[i+1 : i+13]
+	}
+	return digest
+}
+
+// formatBytes formats a byte count with binary units
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// exitTagDrift is the exit code of promote when the source tag no longer
+// points at the expected digest
+const exitTagDrift = 3
+
+// promoteSource splits the promote source into the tag to resolve and the
+// digest it is expected to point at, given either as <image>:<tag>@<digest>
+// or with --expect-digest. Resolving the tag rather than the digest is what
+// detects a tag that was force-pushed since the digest was recorded.
+func promoteSource(arg string, expectDigest string) (string, string, error) {
+	ref, err := urlToImageTag(arg)
+	if err != nil {
+		return "", "", err
+	}
+	expected := ref.Digest
+	if expectDigest != "" {
+		if expected != "" && expected != expectDigest {
+			return "", "", fmt.Errorf("source digest %s and --expect-digest %s differ", expected, expectDigest)
+		}
+		expected = expectDigest
+	}
+	if expected == "" {
+		return "", "", errors.New("promote needs the expected source digest, as <image>:<tag>@<digest> or with --expect-digest")
+	}
+	if ref.Tag == "" {
+		return ref.String(), expected, nil
+	}
+	return ref.withReference(ref.Tag).String(), expected, nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// pruneTag is a tag considered by prune and the decision made about it
+type pruneTag struct {
+	tag     string
+	digest  string
+	created time.Time
+	matched bool
+	delete  bool
+	reason  string
+}
+
+// imageCreated returns the creation time from the config of the image,
+// or of the first image of an index
+func imageCreated(ref ImageRef, m Manifest) (time.Time, error) {
+	src := &registrySource{arg: ref.String(), ref: ref}
+	if m.isIndex() {
+		if len(m.Manifests) == 0 {
+			return time.Time{}, nil
+		}
+		child, err := src.manifest(m.Manifests[0].Digest)
+		if err != nil {
+			return time.Time{}, err
+		}
+		m = child
+	}
+	c, err := fetchConfig(src, m)
+	if err != nil || c.Created == "" {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339Nano, c.Created)
+}
+
+// planPrune decides which tags of ref's repository to delete. Tags
+// matching the filter are candidates, sorted newest first: protected
+// tags, the keep newest and those created less than olderThan ago
+// survive. A manifest is only deleted if every
+// tag pointing at it is deleted, since deleting it removes them all.
+func planPrune(ref ImageRef, tags []*pruneTag, keep int, olderThan time.Duration) {
+	var candidates []*pruneTag
+	for _, t := range tags {
+		if t.matched {
+			candidates = append(candidates, t)
+		} else {
+			t.reason = "does not match the filter"
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if !candidates[i].created.Equal(candidates[j].created) {
+			return candidates[i].created.After(candidates[j].created)
+		}
+		return candidates[i].tag < candidates[j].tag
+	})
+	cutoff := time.Now().Add(-olderThan)
+	for i, t := range candidates {
+		switch {
+		case isProtectedTag(ref.withReference(t.tag)) && !AllowProtected:
+			t.reason = "protected"
+		case i < keep:
+			t.reason = fmt.Sprintf("among the newest %d, --keep", keep)
+		case olderThan > 0 && t.created.IsZero():
+			t.reason = "creation time unknown"
+		case olderThan > 0 && t.created.After(cutoff):
+			t.reason = fmt.Sprintf("created %s, less than %s ago", t.created.Format(time.RFC3339), olderThan)
+		default:
+			t.delete = true
+			t.reason = "matches the filter"
+			if olderThan > 0 {
+				t.reason = fmt.Sprintf("created %s, more than %s ago", t.created.Format(time.RFC3339), olderThan)
+			}
+		}
+	}
+	kept := map[string]string{}
+	for _, t := range tags {
+		if _, ok := kept[t.digest]; !ok && !t.delete {
+			kept[t.digest] = t.tag
+		}
+	}
+	for _, t := range tags {
+		if sibling, ok := kept[t.digest]; ok && t.delete {
+			t.delete = false
+			t.reason = fmt.Sprintf("shares its manifest with %s, which is kept", sibling)
+		}
+	}
+}
+
+// pruneCmd deletes tags of a repository matching a pattern
+func pruneCmd(args []string) int {
+	fs := flag.NewFlagSet("prune", flag.ContinueOnError)
+	filter := fs.String("filter", "", "Regular expression tags must fully match to be deleted, such as pr-.*")
+	olderThan := fs.Duration("older-than", 0, "Only delete tags of images created longer ago than this, such as 720h")
+	keep := fs.Int("keep", 0, "Keep this many of the newest matching tags")
+	dryRun := fs.Bool("dry-run", false, "Print what would be deleted and why other tags are kept, without deleting")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s prune <repository> --filter <regexp> [--older-than 720h] [--keep n] [--dry-run]\n", commandName())
+		fs.PrintDefaults()
+	}
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return 1
+	}
+	if len(positional) != 1 || *filter == "" {
+		fs.Usage()
+		return 1
+	}
+	l := log.WithFields(log.Fields{
+		"package":    "main",
+		"fn":         "pruneCmd",
+		"repository": positional[0],
+	})
+	re, err := regexp.Compile("^(?:" + *filter + ")$")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error: invalid --filter:", err)
+		return 1
+	}
+	pr, err := newPlanRef("repository", positional[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	if pr.Ref.Digest != "" {
+		fmt.Fprintln(os.Stderr, "Error: prune takes a repository, not a digest")
+		return 1
+	}
+	if err := checkRegistryPolicy([]PlanRef{pr}); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	ref := pr.Ref
+	names, err := listTags(context.Background(), ref)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error listing tags:", err)
+		return 1
+	}
+	sort.Strings(names)
+	var tags []*pruneTag
+	for _, name := range names {
+		t := &pruneTag{tag: name, matched: re.MatchString(name)}
+		// every tag is resolved, matching or not, to find the tags
+		// sharing a manifest with a tag to delete
+		if !t.matched || (*olderThan == 0 && *keep == 0) {
+			digest, exists, err := manifestDigest(ref, name)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %s: %s\n", name, err)
+				return 1
+			}
+			if !exists {
+				continue
+			}
+			t.digest = digest
+		} else {
+			m, err := fetchManifest(ref, name)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %s: %s\n", name, err)
+				return 1
+			}
+			t.digest = m.Digest()
+			if t.created, err = imageCreated(ref, m); err != nil {
+				l.Warnf("Unable to get the creation time of %s: %s", name, err)
+			}
+		}
+		tags = append(tags, t)
+	}
+	planPrune(ref, tags, *keep, *olderThan)
+	deletes := map[string][]string{}
+	var digests []string
+	for _, t := range tags {
+		if !t.delete {
+			if t.matched || *dryRun {
+				fmt.Printf("keep %s: %s\n", t.tag, t.reason)
+			}
+			continue
+		}
+		if *dryRun {
+			fmt.Printf("would delete %s (%s): %s\n", t.tag, t.digest, t.reason)
+		}
+		if _, ok := deletes[t.digest]; !ok {
+			digests = append(digests, t.digest)
+		}
+		deletes[t.digest] = append(deletes[t.digest], t.tag)
+	}
+	if *dryRun {
+		return 0
+	}
+	failed := false
+	for _, digest := range digests {
+		if err := deleteManifest(ref, digest); err != nil {
+			fmt.Fprintf(os.Stderr, "Error deleting %s (%s): %s\n", digest, strings.Join(deletes[digest], ", "), err)
+			failed = true
+			continue
+		}
+		fmt.Printf("deleted %s (%s)\n", digest, strings.Join(deletes[digest], ", "))
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlanPrune(t *testing.T) {
+	now := time.Now()
+	days := func(n int) time.Time { return now.Add(-time.Duration(n) * 24 * time.Hour) }
+	d := func(n int) string { return fmt.Sprintf("sha256:%064d", n) }
+	type tag struct {
+		tag     string
+		digest  string
+		created time.Time
+		matched bool
+	}
+	tests := []struct {
+		name      string
+		tags      []tag
+		keep      int
+		olderThan time.Duration
+		protected []string
+		deleted   []string
+		reasons   map[string]string
+	}{
+		{
+			name: "keep the newest by created time, not by name",
+			tags: []tag{
+				{"pr-1", d(1), days(1), true},
+				{"pr-2", d(2), days(30), true},
+				{"pr-3", d(3), days(10), true},
+				{"pr-4", d(4), days(20), true},
+			},
+			keep:    2,
+			deleted: []string{"pr-2", "pr-4"},
+			reasons: map[string]string{"pr-1": "among the newest 2, --keep", "pr-3": "among the newest 2, --keep"},
+		},
+		{
+			name: "only tags matching the filter",
+			tags: []tag{
+				{"pr-1", d(1), days(40), true},
+				{"main", d(2), days(40), false},
+			},
+			deleted: []string{"pr-1"},
+			reasons: map[string]string{"main": "does not match the filter"},
+		},
+		{
+			name: "older than",
+			tags: []tag{
+				{"pr-1", d(1), days(10), true},
+				{"pr-2", d(2), days(40), true},
+				{"pr-3", d(3), time.Time{}, true},
+			},
+			olderThan: 30 * 24 * time.Hour,
+			deleted:   []string{"pr-2"},
+			reasons:   map[string]string{"pr-3": "creation time unknown"},
+		},
+		{
+			name: "keep and older than together",
+			tags: []tag{
+				{"pr-1", d(1), days(50), true},
+				{"pr-2", d(2), days(40), true},
+				{"pr-3", d(3), days(5), true},
+			},
+			keep:      2,
+			olderThan: 30 * 24 * time.Hour,
+			deleted:   []string{"pr-1"},
+		},
+		{
+			name: "protected tags",
+			tags: []tag{
+				{"pr-1", d(1), days(40), true},
+				{"pr-stable", d(2), days(40), true},
+			},
+			protected: []string{"*-stable"},
+			deleted:   []string{"pr-1"},
+			reasons:   map[string]string{"pr-stable": "protected"},
+		},
+		{
+			name: "digest shared with a kept tag",
+			tags: []tag{
+				{"pr-1", d(1), days(1), true},
+				{"pr-2", d(1), days(40), true},
+				{"pr-3", d(3), days(40), true},
+			},
+			keep:    1,
+			deleted: []string{"pr-3"},
+			reasons: map[string]string{"pr-2": "shares its manifest with pr-1, which is kept"},
+		},
+		{
+			name: "digest shared with a protected tag",
+			tags: []tag{
+				{"pr-1", d(1), days(40), true},
+				{"release", d(1), days(40), true},
+			},
+			protected: []string{"release"},
+			reasons:   map[string]string{"pr-1": "shares its manifest with release, which is kept", "release": "protected"},
+		},
+		{
+			name: "digest shared with a tag outside the filter",
+			tags: []tag{
+				{"main", d(1), days(40), false},
+				{"pr-1", d(1), days(40), true},
+				{"pr-2", d(2), days(40), true},
+			},
+			deleted: []string{"pr-2"},
+			reasons: map[string]string{"pr-1": "shares its manifest with main, which is kept"},
+		},
+		{
+			name: "every tag of a digest deleted",
+			tags: []tag{
+				{"pr-1", d(1), days(40), true},
+				{"pr-2", d(1), days(40), true},
+			},
+			deleted: []string{"pr-1", "pr-2"},
+		},
+	}
+	ref, err := urlToImageTag("registry.example.com/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := ProtectedTags
+	defer func() { ProtectedTags = saved }()
+	for _, tt := range tests {
+		ProtectedTags = tt.protected
+		var tags []*pruneTag
+		for _, tg := range tt.tags {
+			tags = append(tags, &pruneTag{tag: tg.tag, digest: tg.digest, created: tg.created, matched: tg.matched})
+		}
+		planPrune(ref, tags, tt.keep, tt.olderThan)
+		var deleted []string
+		deletedDigests := map[string]bool{}
+		for _, tg := range tags {
+			if tg.delete {
+				deleted = append(deleted, tg.tag)
+				deletedDigests[tg.digest] = true
+			}
+			if want, ok := tt.reasons[tg.tag]; ok && tg.reason != want {
+				t.Errorf("%s: %s kept because %q, want %q", tt.name, tg.tag, tg.reason, want)
+			}
+		}
+		sort.Strings(deleted)
+		if !reflect.DeepEqual(deleted, tt.deleted) {
+			t.Errorf("%s: deleted %q, want %q", tt.name, deleted, tt.deleted)
+		}
+		// deleting a digest removes every tag pointing at it
+		for _, tg := range tags {
+			if !tg.delete && deletedDigests[tg.digest] {
+				t.Errorf("%s: %s is kept, but its digest %s is deleted", tt.name, tg.tag, tg.digest)
+			}
+			if tg.reason == "" || (tg.delete && strings.Contains(tg.reason, "kept")) {
+				t.Errorf("%s: %s has reason %q", tt.name, tg.tag, tg.reason)
+			}
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ImageRef is an image reference split into the parts needed
+// to address it on the registry API
+type ImageRef struct {
+	// Registry is the registry host, including the port if any
+	Registry string
+	// Prefix is the path the registry API is served under, if not the root
+	Prefix string
+	// APIBase is the path the registry API is served under, starting with
+	// a slash, when it is not Prefix, which then only routes to it
+	APIBase string
+	Image   string
+	Tag     string
+	Digest  string
+	// auth resolves the credentials for requests for the image, defaultAuth
+	// if nil
+	auth AuthProvider
+}
+
+// withAuth returns ref with requests for it authenticated by auth
+func (r ImageRef) withAuth(auth AuthProvider) ImageRef {
+	r.auth = auth
+	return r
+}
+
+// authProvider returns the provider of the credentials for ref
+func (r ImageRef) authProvider() AuthProvider {
+	if r.auth != nil {
+		return r.auth
+	}
+	return defaultAuth
+}
+
+// Reference returns the tag or digest used to address the manifest,
+// preferring the digest when both are set
+func (r ImageRef) Reference() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+// Repository returns the registry and repository path as the user wrote it
+func (r ImageRef) Repository() string {
+	parts := []string{r.Registry}
+	if r.Prefix != "" {
+		parts = append(parts, r.Prefix)
+	}
+	return strings.Join(append(parts, r.Image), "/")
+}
+
+// withReference returns the reference to the manifest tagged or with the
+// digest reference in the same repository
+func (r ImageRef) withReference(reference string) ImageRef {
+	r.Tag, r.Digest = "", ""
+	if strings.Contains(reference, ":") {
+		r.Digest = reference
+	} else {
+		r.Tag = reference
+	}
+	return r
+}
+
+func (r ImageRef) String() string {
+	s := r.Repository()
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// maxNameLength is the maximum length of registry and repository combined
+const maxNameLength = 255
+
+var (
+	hostRegexp          = regexp.MustCompile(`^(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])(?:\.(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9]))*(?::[0-9]+)?$`)
+	ipv6HostRegexp      = regexp.MustCompile(`^\[([0-9a-fA-F:.]+)\](?::[0-9]+)?$`)
+	pathComponentRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|[-]+)[a-z0-9]+)*$`)
+	tagRegexp           = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]{0,127}$`)
+	digestRegexp        = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*(?:[-_+.][A-Za-z][A-Za-z0-9]*)*:[0-9a-fA-F]{32,}$`)
+	sha256Regexp        = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+)
+
+// validate checks the reference against the distribution reference grammar
+func (r ImageRef) validate() error {
+	if !validHost(r.Registry) {
+		return fmt.Errorf("registry %q is not a valid host", r.Registry)
+	}
+	if r.Image == "" {
+		return fmt.Errorf("repository name is empty")
+	}
+	for _, c := range strings.Split(r.Image, "/") {
+		if !pathComponentRegexp.MatchString(c) {
+			if strings.ToLower(c) != c {
+				return fmt.Errorf("repository %q must be lowercase", r.Image)
+			}
+			return fmt.Errorf("repository component %q may only contain lowercase letters, digits and single separators (., _, __, -)", c)
+		}
+	}
+	if n := len(r.Registry) + 1 + len(r.Image); n > maxNameLength {
+		return fmt.Errorf("repository name is %d characters long, the maximum is %d", n, maxNameLength)
+	}
+	if r.Tag != "" && !tagRegexp.MatchString(r.Tag) {
+		return fmt.Errorf("tag %q must match [A-Za-z0-9_][A-Za-z0-9._-]{0,127}", r.Tag)
+	}
+	if r.Digest != "" {
+		if !digestRegexp.MatchString(r.Digest) {
+			return fmt.Errorf("digest %q is not of the form algorithm:hex", r.Digest)
+		}
+		if strings.HasPrefix(r.Digest, "sha256:") && !sha256Regexp.MatchString(r.Digest) {
+			return fmt.Errorf("digest %q must be sha256: followed by 64 lowercase hex characters", r.Digest)
+		}
+	}
+	return nil
+}
+
+const (
+	dockerHubRegistry    = "docker.io"
+	dockerHubAPIRegistry = "registry-1.docker.io"
+)
+
+// DefaultRegistry is the registry of references that do not name one,
+// Docker Hub unless set with --default-registry
+var DefaultRegistry = dockerHubRegistry
+
+// isDockerHub returns true if the registry is one of the names Docker Hub goes by
+func isDockerHub(registry string) bool {
+	switch registry {
+	case dockerHubRegistry, "index.docker.io", dockerHubAPIRegistry:
+		return true
+	}
+	return false
+}
+
+// apiHost returns the host the registry API is served from
+func (r ImageRef) apiHost() string {
+	if isDockerHub(r.Registry) {
+		return dockerHubAPIRegistry
+	}
+	return canonicalHost(r.Registry)
+}
+
+// canonicalHost rebuilds host[:port] so IPv6 literals are always bracketed
+func canonicalHost(registry string) string {
+	if host, port, err := net.SplitHostPort(registry); err == nil {
+		return net.JoinHostPort(host, port)
+	}
+	if ip := net.ParseIP(strings.Trim(registry, "[]")); ip != nil && strings.Contains(registry, ":") {
+		return "[" + ip.String() + "]"
+	}
+	return registry
+}
+
+// canonical returns the reference in a form that is equal for references
+// to the same manifest however the registry is written, such as the names
+// of Docker Hub or the case of the host
+func (r ImageRef) canonical() string {
+	r.Registry = strings.ToLower(r.apiHost())
+	return r.String()
+}
+
+// isRegistryHost returns true if the first path component of a reference
+// names a registry rather than a repository namespace
+func isRegistryHost(component string) bool {
+	return strings.ContainsAny(component, ".:[") || component == "localhost"
+}
+
+// validHost returns true if the registry is a hostname, IPv4 address or
+// bracketed IPv6 address, with an optional port
+func validHost(registry string) bool {
+	if !strings.HasPrefix(registry, "[") {
+		return hostRegexp.MatchString(registry)
+	}
+	m := ipv6HostRegexp.FindStringSubmatch(registry)
+	return m != nil && net.ParseIP(m[1]) != nil
+}
+
+// registryPrefix returns the configured API path prefix for the registry
+func registryPrefix(registry string) string {
+	return strings.Trim(RegistryPrefixes[registry], "/")
+}
+
+// RegistryAPIBases serves the registry API of a host, or of a path on
+// it, below another path, as host[/path]=base. The path is the part of
+// references that routes to the base and is not sent to the API, so
+// Artifactory and Nexus repositories can be used without subdomain
+// routing, such as a Nexus group for pulls and a hosted one for pushes.
+var RegistryAPIBases = keyValueFlag{}
+
+// routeAPIBase sets the API base of ref from the longest
+// --registry-api-base key matching its registry and the start of its
+// image, moving the path of the key from the image to the prefix. It
+// reports whether a key matched.
+func (r *ImageRef) routeAPIBase() bool {
+	var key, path, base string
+	for k, b := range RegistryAPIBases {
+		host, p, _ := strings.Cut(strings.Trim(k, "/"), "/")
+		if canonicalHost(host) != canonicalHost(r.Registry) || (p != "" && !strings.HasPrefix(r.Image, p+"/")) {
+			continue
+		}
+		if key == "" || len(k) > len(key) {
+			key, path, base = k, p, b
+		}
+	}
+	if key == "" {
+		return false
+	}
+	r.Prefix = path
+	r.Image = strings.TrimPrefix(r.Image, path+"/")
+	r.APIBase = "/" + strings.Trim(base, "/")
+	return true
+}
+
+// apiPath returns the path the registry API of ref is served under
+func (r ImageRef) apiPath() string {
+	if r.APIBase != "" {
+		return strings.TrimPrefix(r.APIBase, "/")
+	}
+	return r.Prefix
+}
+
+// checkPushable rejects destinations that name both a tag and a digest,
+// as Flux and Kubernetes write image references. Sources use the digest
+// and show the tag, but a manifest can only be pushed to one of them.
+func (r ImageRef) checkPushable() error {
+	if r.Tag != "" && r.Digest != "" {
+		return fmt.Errorf("%s names both tag %s and digest %s, a destination can only be pushed to a tag; drop @%s", r.String(), r.Tag, r.Digest, r.Digest)
+	}
+	return nil
+}
+
+// hasExplicitTag reports whether the reference names a tag or digest
+// instead of relying on the latest default
+func hasExplicitTag(url string) bool {
+	if strings.Contains(url, "@") {
+		return true
+	}
+	if i := strings.LastIndex(url, "/"); i >= 0 {
+		url = url[i+1:]
+	}
+	return strings.Contains(url, ":")
+}
+
+func urlToImageTag(url string) (ImageRef, error) {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "urlToImageTag",
+		"url":     url,
+	})
+	l.Debug("Getting image and tag from url")
+	// split the url into the registry, image, and tag
+	// url in format: hello.example.com:5000/myimage/path:latest
+	// it can also be in format: myimage/path:latest
+	// if no registry is specified, it will use the default registry
+	// (docker.io unless set with --default-registry)
+	// if no tag is specified, it will use the default tag (latest)
+	// IPv6 registries are bracketed: [fd00::10]:5000/myimage/path:latest
+	// registry: hello.example.com:5000
+	// image: myimage/path
+	// tag: latest
+	// a digest may be given instead of the tag: myimage/path@sha256:...
+	var ref ImageRef
+	name := url
+	if i := strings.Index(name, "@"); i >= 0 {
+		ref.Digest = name[i+1:]
+		name = name[:i]
+	}
+	if splitUrl := strings.SplitN(name, "/", 2); len(splitUrl) == 2 && isRegistryHost(splitUrl[0]) {
+		// url has a registry
+		// split the url into registry and image
+		ref.Registry = splitUrl[0]
+		ref.Image = splitUrl[1]
+	} else {
+		// url does not have a registry
+		// use the default registry
+		ref.Registry = DefaultRegistry
+		ref.Image = name
+	}
+	if isDockerHub(ref.Registry) {
+		// docker hub is displayed as docker.io, and official
+		// images live under the library namespace
+		ref.Registry = dockerHubRegistry
+		if !strings.Contains(ref.Image, "/") {
+			ref.Image = "library/" + ref.Image
+		}
+	}
+	// registries served below a path prefix carry the prefix
+	// in front of the repository
+	if ref.routeAPIBase() {
+		l.Debugf("Routing %s to API base %s", ref.Prefix, ref.APIBase)
+	} else if prefix := registryPrefix(ref.Registry); prefix != "" && strings.HasPrefix(ref.Image, prefix+"/") {
+		ref.Prefix = prefix
+		ref.Image = strings.TrimPrefix(ref.Image, prefix+"/")
+	}
+	if i := strings.LastIndex(ref.Image, ":"); i >= 0 {
+		// image has a tag
+		// split the image into image and tag
+		ref.Tag = ref.Image[i+1:]
+		ref.Image = ref.Image[:i]
+	} else if ref.Digest == "" {
+		// image does not have a tag
+		// use the default tag
+		ref.Tag = "latest"
+	}
+	l = l.WithFields(log.Fields{
+		"registry": ref.Registry,
+		"prefix":   ref.Prefix,
+		"image":    ref.Image,
+		"tag":      ref.Tag,
+		"digest":   ref.Digest,
+	})
+	if err := ref.validate(); err != nil {
+		l.Debug("Invalid reference: ", err)
+		return ref, fmt.Errorf("invalid reference %q: %w", url, err)
+	}
+	l.Debug("Got image and tag from url")
+	return ref, nil
+}
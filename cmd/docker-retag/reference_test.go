@@ -0,0 +1,140 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestURLToImageTagIPv6(t *testing.T) {
+	tests := []struct {
+		in                         string
+		registry, image, tag, host string
+	}{
+		{"[fd00::10]:5000/app:1.0", "[fd00::10]:5000", "app", "1.0", "[fd00::10]:5000"},
+		{"[fd00::10]/team/app", "[fd00::10]", "team/app", "latest", "[fd00::10]"},
+		{"[::1]:5000/app:1.0", "[::1]:5000", "app", "1.0", "[::1]:5000"},
+		{"[fd00:0:0::10]:5000/app:1.0", "[fd00:0:0::10]:5000", "app", "1.0", "[fd00:0:0::10]:5000"},
+	}
+	for _, tt := range tests {
+		ref, err := urlToImageTag(tt.in)
+		if err != nil {
+			t.Errorf("urlToImageTag(%q): %v", tt.in, err)
+			continue
+		}
+		if ref.Registry != tt.registry || ref.Image != tt.image || ref.Tag != tt.tag {
+			t.Errorf("urlToImageTag(%q) = %s %s %s, want %s %s %s", tt.in, ref.Registry, ref.Image, ref.Tag, tt.registry, tt.image, tt.tag)
+		}
+		if got := ref.apiHost(); got != tt.host {
+			t.Errorf("apiHost of %q = %s, want %s", tt.in, got, tt.host)
+		}
+		if got, want := ref.apiURL("manifests", "1.0"), "https://"+tt.host+"/v2/"+tt.image+"/manifests/1.0"; got != want {
+			t.Errorf("apiURL of %q = %s, want %s", tt.in, got, want)
+		}
+	}
+}
+
+func TestURLToImageTagInvalidIPv6(t *testing.T) {
+	for _, in := range []string{
+		"[fd00::zz]:5000/app:1.0",
+		"[fd00::10/app:1.0",
+		"fd00::10/app:1.0",
+		"[fd00::10]:port/app:1.0",
+		"[]/app:1.0",
+	} {
+		if ref, err := urlToImageTag(in); err == nil {
+			t.Errorf("urlToImageTag(%q) = %s, want an invalid host", in, ref.String())
+		}
+	}
+}
+
+func TestCanonicalHost(t *testing.T) {
+	tests := map[string]string{
+		"fd00::10":            "[fd00::10]",
+		"[fd00::10]":          "[fd00::10]",
+		"[fd00::10]:5000":     "[fd00::10]:5000",
+		"registry.local:5000": "registry.local:5000",
+		"127.0.0.1:5000":      "127.0.0.1:5000",
+		"registry.local":      "registry.local",
+	}
+	for in, want := range tests {
+		if got := canonicalHost(in); got != want {
+			t.Errorf("canonicalHost(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestDockerConfigKeysIPv6(t *testing.T) {
+	want := []string{"fd00::10", "https://fd00::10", "http://fd00::10", "[fd00::10]", "https://[fd00::10]", "http://[fd00::10]"}
+	if got := dockerConfigKeys("fd00::10"); !reflect.DeepEqual(got, want) {
+		t.Errorf("dockerConfigKeys = %q, want %q", got, want)
+	}
+	want = []string{"[fd00::10]:5000", "https://[fd00::10]:5000", "http://[fd00::10]:5000"}
+	if got := dockerConfigKeys("[fd00::10]:5000"); !reflect.DeepEqual(got, want) {
+		t.Errorf("dockerConfigKeys = %q, want %q", got, want)
+	}
+}
+
+func TestURLToImageTagRoundTrip(t *testing.T) {
+	const digest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		in, want                        string
+		registry, image, tag, reference string
+	}{
+		{"registry.example.com:5000/app:1.4.0", "registry.example.com:5000/app:1.4.0", "registry.example.com:5000", "app", "1.4.0", "1.4.0"},
+		{"registry.example.com:5000/app@" + digest, "registry.example.com:5000/app@" + digest, "registry.example.com:5000", "app", "", digest},
+		{"registry.example.com:5000/app:1.4.0@" + digest, "registry.example.com:5000/app:1.4.0@" + digest, "registry.example.com:5000", "app", "1.4.0", digest},
+		{"registry.example.com/team/sub/app:1.4.0", "registry.example.com/team/sub/app:1.4.0", "registry.example.com", "team/sub/app", "1.4.0", "1.4.0"},
+		{"registry.example.com/team/sub/app@" + digest, "registry.example.com/team/sub/app@" + digest, "registry.example.com", "team/sub/app", "", digest},
+		{"localhost:5001/team/app:1.4.0@" + digest, "localhost:5001/team/app:1.4.0@" + digest, "localhost:5001", "team/app", "1.4.0", digest},
+		{"app:1.4.0", "docker.io/library/app:1.4.0", "docker.io", "library/app", "1.4.0", "1.4.0"},
+		{"app@" + digest, "docker.io/library/app@" + digest, "docker.io", "library/app", "", digest},
+		{"team/app:1.4.0@" + digest, "docker.io/team/app:1.4.0@" + digest, "docker.io", "team/app", "1.4.0", digest},
+		{"app", "docker.io/library/app:latest", "docker.io", "library/app", "latest", "latest"},
+	}
+	for _, tt := range tests {
+		ref, err := urlToImageTag(tt.in)
+		if err != nil {
+			t.Errorf("urlToImageTag(%q): %v", tt.in, err)
+			continue
+		}
+		if ref.Registry != tt.registry || ref.Image != tt.image || ref.Tag != tt.tag || ref.Reference() != tt.reference {
+			t.Errorf("urlToImageTag(%q) = %s %s %s %s, want %s %s %s %s", tt.in, ref.Registry, ref.Image, ref.Tag, ref.Reference(), tt.registry, tt.image, tt.tag, tt.reference)
+		}
+		if got := ref.String(); got != tt.want {
+			t.Errorf("urlToImageTag(%q).String() = %s, want %s", tt.in, got, tt.want)
+		}
+		again, err := urlToImageTag(ref.String())
+		if err != nil || !reflect.DeepEqual(again, ref) {
+			t.Errorf("urlToImageTag(%q) = %+v, %v, want it to parse back to %+v", ref.String(), again, err, ref)
+		}
+	}
+}
+
+func TestCheckPushable(t *testing.T) {
+	const digest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	for _, in := range []string{
+		"registry.example.com:5000/app:1.4.0",
+		"registry.example.com:5000/app@" + digest,
+		"team/sub/app",
+	} {
+		if err := validateDestination(in); err != nil {
+			t.Errorf("validateDestination(%q) = %v, want it pushable", in, err)
+		}
+	}
+	for _, in := range []string{
+		"registry.example.com:5000/app:1.4.0@" + digest,
+		"team/sub/app:1.4.0@" + digest,
+	} {
+		err := validateDestination(in)
+		if err == nil || !strings.Contains(err.Error(), "drop @"+digest) {
+			t.Errorf("validateDestination(%q) = %v, want it rejected with the digest to drop", in, err)
+		}
+		if _, err := newPlan("registry.example.com/app:src", []string{in}); err == nil || !strings.Contains(err.Error(), "a destination can only be pushed to a tag") {
+			t.Errorf("newPlan with destination %q = %v, want it rejected", in, err)
+		}
+	}
+	if _, err := newPlan("registry.example.com/app:1.4.0@"+digest, []string{"registry.example.com/app:1.5.0"}); err != nil {
+		t.Errorf("newPlan with a tag and digest source = %v, want it accepted", err)
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const maxRedirects = 10
+
+// httpClient is shared by all registry requests without host specific
+// settings. Redirects are followed by registryDo so that the method,
+// body and credentials can be handled explicitly
+var httpClient = &http.Client{
+	CheckRedirect: noRedirect,
+}
+
+var (
+	hostClientsMu sync.Mutex
+	hostClients   = map[string]*http.Client{}
+	limitersMu    sync.Mutex
+	limiters      = map[string]*rateLimiter{}
+)
+
+// registryErrors is the error body of registry API responses
+type registryErrors struct {
+	Errors []struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+		// Detail is free-form, such as the digest of an unknown blob
+		Detail json.RawMessage `json:"detail,omitempty"`
+	} `json:"errors"`
+}
+
+// repositoryNotFoundError is returned when pushing to a repository that
+// does not exist on a registry which does not create repositories on push
+type repositoryNotFoundError struct {
+	ref ImageRef
+}
+
+func (e *repositoryNotFoundError) Error() string {
+	msg := fmt.Sprintf("destination repository %s does not exist on %s; create it", e.ref.Image, e.ref.Registry)
+	if _, _, ok := ecrRegistry(e.ref.Registry); ok {
+		msg += " or pass --create-repository"
+	}
+	return msg
+}
+
+// pushError returns the error for an unexpected response with body bd to
+// a push to ref's repository, using the error code and message from the
+// body if there is one
+func pushError(ref ImageRef, resp *http.Response, bd []byte) error {
+	var re registryErrors
+	json.Unmarshal(bd, &re)
+	for _, e := range re.Errors {
+		switch e.Code {
+		case "NAME_UNKNOWN", "REPOSITORY_NOT_FOUND":
+			return &repositoryNotFoundError{ref: ref}
+		}
+	}
+	if len(re.Errors) > 0 && re.Errors[0].Message != "" {
+		return fmt.Errorf("%s: %s", resp.Status, re.Errors[0].Message)
+	}
+	return errors.New(resp.Status)
+}
+
+const (
+	// maxErrorBody bounds how much of an error response is read, as some
+	// proxies answer with large HTML pages
+	maxErrorBody = 64 << 10
+	// maxLoggedBody bounds the request and response bodies written to
+	// debug logs, such as manifest lists with many platforms
+	maxLoggedBody = 4 << 10
+)
+
+// readErrorBody reads the start of an error response body
+func readErrorBody(r io.Reader) []byte {
+	bd, _ := ioutil.ReadAll(io.LimitReader(r, maxErrorBody))
+	return bd
+}
+
+// gzipMagic starts every gzip stream
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// gunzipBody returns the JSON response body bd decompressed if it is
+// gzip. Some proxies gzip JSON responses whether or not the client asked
+// for it, with a Content-Encoding that Go's transport does not decode or
+// none at all; JSON never starts with the gzip magic bytes, so the body
+// itself tells. At most limit bytes are decompressed, or all with a limit
+// of 0. Callers compute digests over the decompressed bytes, which are
+// the bytes the registry serves without the proxy.
+func gunzipBody(bd []byte, limit int64) ([]byte, error) {
+	if !bytes.HasPrefix(bd, gzipMagic) {
+		return bd, nil
+	}
+	log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "gunzipBody",
+	}).Debug("Decompressing gzip response body")
+	zr, err := gzip.NewReader(bytes.NewReader(bd))
+	if err != nil {
+		return nil, fmt.Errorf("decompressing gzip response: %w", err)
+	}
+	defer zr.Close()
+	var r io.Reader = zr
+	if limit > 0 {
+		r = io.LimitReader(zr, limit)
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing gzip response: %w", err)
+	}
+	return out, nil
+}
+
+// logBody returns a body for logging, truncated to maxLoggedBody bytes
+func logBody(bd []byte) string {
+	if len(bd) <= maxLoggedBody {
+		return string(bd)
+	}
+	return fmt.Sprintf("%s... (%d bytes truncated)", bd[:maxLoggedBody], len(bd)-maxLoggedBody)
+}
+
+func noRedirect(req *http.Request, via []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+// clientFor returns the http client for the registry host, using a
+// dedicated transport when the config file sets a CA for it or with
+// --tls-skip-verify
+func clientFor(host string) (*http.Client, error) {
+	rc := FileConfig.registry(host)
+	hasCA := rc != nil && rc.CAFile != ""
+	if !hasCA && !TLSSkipVerify {
+		return httpClient, nil
+	}
+	hostClientsMu.Lock()
+	defer hostClientsMu.Unlock()
+	if c, ok := hostClients[host]; ok {
+		return c, nil
+	}
+	cfg := &tls.Config{InsecureSkipVerify: TLSSkipVerify}
+	if hasCA {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := ioutil.ReadFile(rc.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA file for %s: %w", host, err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s for %s", rc.CAFile, host)
+		}
+		cfg.RootCAs = pool
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = cfg
+	c := &http.Client{
+		Transport:     t,
+		CheckRedirect: noRedirect,
+	}
+	hostClients[host] = c
+	return c, nil
+}
+
+// rateLimiter spaces requests to a registry evenly
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func (r *rateLimiter) wait() {
+	r.mu.Lock()
+	now := time.Now()
+	if r.next.Before(now) {
+		r.next = now
+	}
+	delay := r.next.Sub(now)
+	r.next = r.next.Add(r.interval)
+	r.mu.Unlock()
+	time.Sleep(delay)
+}
+
+// waitForRateLimit blocks until a request to the host is allowed by
+// the rate limit in the config file and any backoff after throttling
+func waitForRateLimit(host string) {
+	waitForBackoff(host)
+	rc := FileConfig.registry(host)
+	if rc == nil || rc.RateLimit <= 0 {
+		return
+	}
+	limitersMu.Lock()
+	rl, ok := limiters[host]
+	if !ok {
+		rl = &rateLimiter{interval: time.Duration(float64(time.Second) / rc.RateLimit)}
+		limiters[host] = rl
+	}
+	limitersMu.Unlock()
+	rl.wait()
+}
+
+func registryProtocol(registry string) string {
+	l := log.WithFields(log.Fields{
+		"package":  "main",
+		"fn":       "registryProtocol",
+		"registry": registry,
+	})
+	l.Debug("Getting registry protocol")
+	if os.Getenv("INSECURE_REGISTRY") == "true" {
+		return "http"
+	}
+	for _, h := range PlainHTTP {
+		if canonicalHost(h) == canonicalHost(registry) {
+			return "http"
+		}
+	}
+	if rc := FileConfig.registry(registry); rc != nil && rc.Insecure {
+		return "http"
+	}
+	if isLoopbackHost(registry) {
+		return loopbackRegistryProtocol(registry)
+	}
+	return "https"
+}
+
+// apiRoot returns the /v2/ url of the registry API
+func (r ImageRef) apiRoot() string {
+	host := r.apiHost()
+	base := fmt.Sprintf("%s://%s", registryProtocol(host), host)
+	if path := r.apiPath(); path != "" {
+		base += "/" + path
+	}
+	return base + "/v2/"
+}
+
+// apiURL builds a registry API url for the image, e.g.
+// apiURL("manifests", "latest") for the manifest of the latest tag
+func (r ImageRef) apiURL(elem ...string) string {
+	return r.apiRoot() + r.Image + "/" + strings.Join(elem, "/")
+}
+
+func isRedirect(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// registryDo sends the request like authorizedDo. Requests answered with
+// 429 Too Many Requests are sent again after the wait the registry asks
+// for, up to Retries times.
+func registryDo(req *http.Request, auth AuthProvider) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := authorizedDo(req, auth)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+			return resp, err
+		}
+		wait, err := throttled(req, resp, attempt)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		time.Sleep(wait)
+		if req, err = replayRequest(req); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// replayable reports whether the body of req can be sent again
+func replayable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// replayRequest returns a copy of req with a fresh body, for sending it
+// again
+func replayRequest(req *http.Request) (*http.Request, error) {
+	next := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		next.Body = body
+	}
+	return next, nil
+}
+
+// authorizedDo sends the request like followRedirects. If the registry
+// rejects it with a bearer challenge, the token for the request scope is
+// fetched with the credentials of auth, or refreshed if the rejected one
+// was already cached, and the request is retried once. Requests whose
+// body cannot be replayed are not retried.
+func authorizedDo(req *http.Request, auth AuthProvider) (*http.Response, error) {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "authorizedDo",
+		"method":  req.Method,
+		"url":     req.URL.String(),
+	})
+	resp, err := followRedirects(req)
+	if err != nil {
+		return nil, err
+	}
+	logRateLimit(resp)
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+	ch, ok := parseBearerChallenge(resp.Header.Get("WWW-Authenticate"))
+	if !ok {
+		return resp, nil
+	}
+	if !replayable(req) {
+		l.Debug("Not retrying unauthorized request, the body cannot be replayed")
+		return resp, nil
+	}
+	resp.Body.Close()
+	host := req.URL.Host
+	scope := requestScope(req)
+	tokens.setChallenge(host, ch)
+	tokens.invalidate(host, scope, auth, strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "))
+	token, err := tokens.token(host, scope, auth)
+	if err != nil {
+		l.Error("Error refreshing registry token: ", err)
+		return nil, err
+	}
+	l.Debug("Retrying with a new registry token")
+	metrics.add("auth_retries", host, 1)
+	next, err := replayRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	next.Header.Set("Authorization", "Bearer "+token)
+	resp, err = followRedirects(next)
+	if err != nil {
+		return nil, err
+	}
+	logRateLimit(resp)
+	return resp, nil
+}
+
+// logRateLimit logs the pull rate limit Docker Hub reports on manifest
+// responses, so users can see when they get close to it
+func logRateLimit(resp *http.Response) {
+	remaining := resp.Header.Get("RateLimit-Remaining")
+	if remaining == "" {
+		return
+	}
+	log.WithFields(log.Fields{
+		"package":   "main",
+		"fn":        "logRateLimit",
+		"registry":  resp.Request.URL.Host,
+		"limit":     resp.Header.Get("RateLimit-Limit"),
+		"remaining": remaining,
+		"source":    resp.Header.Get("Docker-RateLimit-Source"),
+	}).Debug("Registry rate limit")
+}
+
+// followRedirects sends the request, following redirects while keeping
+// the request method and body. The Authorization header is only forwarded
+// to redirect targets on the same host.
+func followRedirects(req *http.Request) (*http.Response, error) {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "followRedirects",
+		"method":  req.Method,
+		"url":     req.URL.String(),
+	})
+	for i := 0; ; i++ {
+		c, err := clientFor(req.URL.Host)
+		if err != nil {
+			return nil, err
+		}
+		waitForRateLimit(req.URL.Host)
+		setRequestHeaders(req)
+		resp, err := c.Do(req)
+		logHTTP(req, resp, err)
+		if err != nil {
+			return nil, err
+		}
+		if !isRedirect(resp.StatusCode) || resp.Header.Get("Location") == "" {
+			return resp, nil
+		}
+		resp.Body.Close()
+		if i >= maxRedirects {
+			return nil, fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+		loc, err := req.URL.Parse(resp.Header.Get("Location"))
+		if err != nil {
+			l.Error("Error parsing redirect location: ", err)
+			return nil, err
+		}
+		l.Debug("Following redirect to ", loc.String())
+		method := req.Method
+		if resp.StatusCode == http.StatusSeeOther {
+			method = "GET"
+		}
+		next, err := http.NewRequestWithContext(req.Context(), method, loc.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		if method == req.Method && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			next.Body = body
+			next.GetBody = req.GetBody
+			next.ContentLength = req.ContentLength
+		}
+		next.Header = req.Header.Clone()
+		if loc.Host != req.URL.Host {
+			next.Header.Del("Authorization")
+			removeRegistryHeaders(next.Header, req.URL.Host)
+		}
+		req = next
+	}
+}
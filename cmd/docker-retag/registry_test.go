@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testRegistry is an in-memory registry serving the parts of the v2 API
+// docker-retag uses, over plain http
+type testRegistry struct {
+	*httptest.Server
+	// host is the registry host, such as 127.0.0.1:41234
+	host string
+	// hook, if set, handles requests before the registry and returns
+	// true if it answered them
+	hook func(w http.ResponseWriter, r *http.Request) bool
+	// digest computes the digest the registry stores a pushed manifest
+	// under, by default the sha256 of its bytes
+	digest func(contentType string, body []byte) string
+
+	mu        sync.Mutex
+	manifests map[string]testManifest
+	blobs     map[string][]byte
+	uploads   map[string][]byte
+	requests  []string
+}
+
+type testManifest struct {
+	contentType string
+	body        []byte
+}
+
+// newTestRegistry starts a registry and configures docker-retag to talk
+// to it over plain http until the test ends
+func newTestRegistry(t testing.TB) *testRegistry {
+	t.Helper()
+	r := startTestRegistry(t, httptest.NewServer)
+	plain := PlainHTTP
+	PlainHTTP = append(append(stringListFlag{}, plain...), r.host)
+	t.Cleanup(func() { PlainHTTP = plain })
+	return r
+}
+
+// startTestRegistry starts a registry with start, such as
+// httptest.NewTLSServer, leaving docker-retag to find its protocol
+func startTestRegistry(t testing.TB, start func(http.Handler) *httptest.Server) *testRegistry {
+	t.Helper()
+	r := &testRegistry{
+		manifests: map[string]testManifest{},
+		blobs:     map[string][]byte{},
+		uploads:   map[string][]byte{},
+		digest: func(_ string, body []byte) string {
+			return digestOf(body)
+		},
+	}
+	r.Server = start(http.HandlerFunc(r.serve))
+	r.host = r.Listener.Addr().String()
+	t.Cleanup(r.Close)
+	return r
+}
+
+// ref returns the reference to reference in repo on the registry
+func (r *testRegistry) ref(t testing.TB, repo, reference string) ImageRef {
+	t.Helper()
+	sep := ":"
+	if strings.Contains(reference, ":") {
+		sep = "@"
+	}
+	ref, err := urlToImageTag(r.host + "/" + repo + sep + reference)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ref
+}
+
+// putManifest stores a manifest under reference and its digest
+func (r *testRegistry) putManifest(repo, reference, contentType string, body []byte) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d := r.digest(contentType, body)
+	r.manifests[repo+"@"+reference] = testManifest{contentType, body}
+	r.manifests[repo+"@"+d] = testManifest{contentType, body}
+	return d
+}
+
+// putBlob stores a blob and returns its digest
+func (r *testRegistry) putBlob(body []byte) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d := digestOf(body)
+	r.blobs[d] = body
+	return d
+}
+
+// requested returns the requests the registry received, as "METHOD path"
+func (r *testRegistry) requested() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.requests...)
+}
+
+func (r *testRegistry) serve(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	r.requests = append(r.requests, req.Method+" "+req.URL.RequestURI())
+	r.mu.Unlock()
+	if r.hook != nil && r.hook(w, req) {
+		return
+	}
+	w.Header().Set("Docker-Distribution-Api-Version", registryAPIVersion)
+	path := req.URL.Path
+	if path == "/v2/" {
+		w.Write([]byte("{}"))
+		return
+	}
+	path = strings.TrimPrefix(path, "/v2/")
+	switch {
+	case strings.Contains(path, "/manifests/"):
+		repo, reference, _ := strings.Cut(path, "/manifests/")
+		r.serveManifest(w, req, repo, reference)
+	case strings.Contains(path, "/blobs/uploads/"):
+		r.serveUpload(w, req, path)
+	case strings.Contains(path, "/blobs/"):
+		_, d, _ := strings.Cut(path, "/blobs/")
+		r.mu.Lock()
+		b, ok := r.blobs[d]
+		r.mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(b)))
+		w.Header().Set("Docker-Content-Digest", d)
+		if req.Method == "GET" {
+			w.Write(b)
+		}
+	case strings.HasSuffix(path, "/tags/list"):
+		repo := strings.TrimSuffix(path, "/tags/list")
+		r.mu.Lock()
+		tags := []string{}
+		for k := range r.manifests {
+			if p, reference, _ := strings.Cut(k, "@"); p == repo && !strings.Contains(reference, ":") {
+				tags = append(tags, reference)
+			}
+		}
+		r.mu.Unlock()
+		sort.Strings(tags)
+		json.NewEncoder(w).Encode(map[string]interface{}{"name": repo, "tags": tags})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (r *testRegistry) serveManifest(w http.ResponseWriter, req *http.Request, repo, reference string) {
+	switch req.Method {
+	case "GET", "HEAD":
+		r.mu.Lock()
+		m, ok := r.manifests[repo+"@"+reference]
+		r.mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[{"code":"MANIFEST_UNKNOWN"}]}`))
+			return
+		}
+		w.Header().Set("Content-Type", m.contentType)
+		w.Header().Set("Content-Length", fmt.Sprint(len(m.body)))
+		w.Header().Set("Docker-Content-Digest", r.digest(m.contentType, m.body))
+		if req.Method == "GET" {
+			w.Write(m.body)
+		}
+	case "PUT":
+		body, _ := ioutil.ReadAll(req.Body)
+		d := r.putManifest(repo, reference, req.Header.Get("Content-Type"), body)
+		w.Header().Set("Docker-Content-Digest", d)
+		w.WriteHeader(http.StatusCreated)
+	case "DELETE":
+		r.mu.Lock()
+		if !strings.Contains(reference, ":") {
+			delete(r.manifests, repo+"@"+reference)
+		}
+		for k, m := range r.manifests {
+			if p, _, _ := strings.Cut(k, "@"); p == repo && r.digest(m.contentType, m.body) == reference {
+				delete(r.manifests, k)
+			}
+		}
+		r.mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *testRegistry) serveUpload(w http.ResponseWriter, req *http.Request, path string) {
+	repo, id, _ := strings.Cut(path, "/blobs/uploads/")
+	body, _ := ioutil.ReadAll(req.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch req.Method {
+	case "POST":
+		if mount := req.URL.Query().Get("mount"); mount != "" {
+			if _, ok := r.blobs[mount]; ok {
+				w.Header().Set("Docker-Content-Digest", mount)
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+		}
+		id = fmt.Sprint(len(r.uploads) + 1)
+		r.uploads[id] = body
+		if d := req.URL.Query().Get("digest"); d != "" {
+			r.blobs[d] = body
+			delete(r.uploads, id)
+			w.Header().Set("Docker-Content-Digest", d)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		w.Header().Set("Location", "/v2/"+repo+"/blobs/uploads/"+id)
+		w.Header().Set("Range", "0-0")
+		w.WriteHeader(http.StatusAccepted)
+	case "PATCH":
+		r.uploads[id] = append(r.uploads[id], body...)
+		w.Header().Set("Location", "/v2/"+repo+"/blobs/uploads/"+id)
+		w.Header().Set("Range", fmt.Sprintf("0-%d", len(r.uploads[id])-1))
+		w.WriteHeader(http.StatusAccepted)
+	case "PUT":
+		d := req.URL.Query().Get("digest")
+		r.blobs[d] = append(r.uploads[id], body...)
+		delete(r.uploads, id)
+		w.Header().Set("Docker-Content-Digest", d)
+		w.WriteHeader(http.StatusCreated)
+	case "GET":
+		upload, ok := r.uploads[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Location", "/v2/"+repo+"/blobs/uploads/"+id)
+		if len(upload) > 0 {
+			w.Header().Set("Range", fmt.Sprintf("0-%d", len(upload)-1))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "DELETE":
+		delete(r.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// gzipEverything wraps h like a proxy that gzips every response body,
+// whatever the client asked for, with the Content-Encoding encoding
+func gzipEverything(h http.Handler, encoding string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		if rec.Body.Len() == 0 {
+			w.WriteHeader(rec.Code)
+			return
+		}
+		w.Header().Del("Content-Length")
+		if encoding != "" {
+			w.Header().Set("Content-Encoding", encoding)
+		}
+		w.WriteHeader(rec.Code)
+		zw := gzip.NewWriter(w)
+		zw.Write(rec.Body.Bytes())
+		zw.Close()
+	})
+}
+
+func TestGzippedResponses(t *testing.T) {
+	anonymousEnv(t)
+	for _, encoding := range []string{"gzip", "x-gzip", ""} {
+		realm := httptest.NewServer(gzipEverything(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"token":"gzipped-token"}`))
+		}), encoding))
+		defer realm.Close()
+		r := startTestRegistry(t, func(h http.Handler) *httptest.Server {
+			return httptest.NewServer(gzipEverything(h, encoding))
+		})
+		r.hook = func(w http.ResponseWriter, req *http.Request) bool {
+			if req.Header.Get("Authorization") == "Bearer gzipped-token" {
+				return false
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+realm.URL+`/token",service="registry.example.com"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return true
+		}
+		plain := PlainHTTP
+		PlainHTTP = append(append(stringListFlag{}, plain...), r.host)
+		defer func() { PlainHTTP = plain }()
+		body := testImageManifest(1)
+		digest := r.putManifest("app", "1.0", mediaTypeOCIManifest, body)
+
+		name := fmt.Sprintf("Content-Encoding %q", encoding)
+		for _, reference := range []string{"1.0", digest} {
+			m, err := fetchManifest(r.ref(t, "app", reference), reference)
+			if err != nil {
+				t.Errorf("%s: fetchManifest(%s) = %v", name, reference, err)
+				continue
+			}
+			if m.Digest() != digest || string(m.Raw) != string(body) {
+				t.Errorf("%s: fetchManifest(%s) = %s, want the decompressed manifest %s", name, reference, m.Digest(), digest)
+			}
+		}
+		tags, err := listTags(context.Background(), r.ref(t, "app", "1.0"))
+		if err != nil || fmt.Sprint(tags) != "[1.0]" {
+			t.Errorf("%s: listTags = %q, %v, want [1.0]", name, tags, err)
+		}
+	}
+}
+
+func TestGunzipBodyLimit(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(bytes.Repeat([]byte("x"), 1<<20))
+	zw.Close()
+	bd, err := gunzipBody(buf.Bytes(), 1024)
+	if err != nil || len(bd) != 1024 {
+		t.Errorf("gunzipBody = %d bytes, %v, want it to stop at the limit of 1024", len(bd), err)
+	}
+	if bd, err := gunzipBody([]byte(`{"tags":[]}`), 0); err != nil || string(bd) != `{"tags":[]}` {
+		t.Errorf("gunzipBody of plain JSON = %q, %v, want it unchanged", bd, err)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+)
+
+// RepositoryMap rewrites destination repositories that start with a
+// prefix to another prefix, as source prefix=destination prefix, so whole
+// namespaces can be promoted into a Harbor or GitLab project
+var RepositoryMap = keyValueFlag{}
+
+// normalizeRepoPrefix returns a repository prefix with its registry
+// written the way references are parsed: Docker Hub as docker.io and the
+// host in lower case
+func normalizeRepoPrefix(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	host, rest, _ := strings.Cut(prefix, "/")
+	if isDockerHub(strings.ToLower(host)) {
+		host = dockerHubRegistry
+	}
+	if rest == "" {
+		return strings.ToLower(host)
+	}
+	return strings.ToLower(host) + "/" + rest
+}
+
+// mapRepository rewrites ref with the longest --repo-map prefix that its
+// repository starts with, matching whole path components. It returns the
+// rewritten reference and whether a prefix matched.
+func mapRepository(ref ImageRef) (string, bool) {
+	repo := normalizeRepoPrefix(ref.Repository())
+	var from, to string
+	for src, dst := range RepositoryMap {
+		src = normalizeRepoPrefix(src)
+		if repo != src && !strings.HasPrefix(repo, src+"/") {
+			continue
+		}
+		if len(src) > len(from) {
+			from, to = src, dst
+		}
+	}
+	if from == "" {
+		return "", false
+	}
+	mapped := strings.Trim(to, "/") + repo[len(from):]
+	if ref.Tag != "" {
+		mapped += ":" + ref.Tag
+	}
+	if ref.Digest != "" {
+		mapped += "@" + ref.Digest
+	}
+	return mapped, true
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// report collects the results of the run for --report; it is a no-op
+// until configured from main
+var report = &runReport{}
+
+// runReport is the document written by --report. Workers record each
+// destination as it starts and finishes, so the report can be written
+// with everything attempted so far when the run fails or is interrupted.
+// The results of the destinations are only kept when the report is
+// written, posted to webhooks or read for GitHub Actions; otherwise they
+// are only counted, so a run with many destinations does not hold them
+// all.
+type runReport struct {
+	mu     sync.Mutex
+	path   string
+	format string
+	// keep is whether Results holds every destination
+	keep bool
+	// planned is the number of destinations of the run
+	planned int
+	// counted sums up the destinations that finished
+	counted EventSummary
+
+	Version string         `json:"version"`
+	TraceID string         `json:"trace_id,omitempty"`
+	Start   time.Time      `json:"start"`
+	End     time.Time      `json:"end"`
+	Workers int            `json:"workers"`
+	Source  string         `json:"source"`
+	Digest  string         `json:"digest,omitempty"`
+	Status  string         `json:"status"`
+	Error   string         `json:"error,omitempty"`
+	Results []UploadResult `json:"results"`
+	// StrippedAttestations are the entries --strip-attestations removed
+	// from the source index
+	StrippedAttestations []Descriptor `json:"stripped_attestations,omitempty"`
+	// SourceAge is when the source was created, checked by
+	// --max-source-age
+	SourceAge *SourceAge `json:"source_age,omitempty"`
+	// Platforms is the result of --require-platform for the source
+	Platforms *PlatformCheck `json:"platforms,omitempty"`
+	// Size is the compressed size and layer count of the source
+	Size *SourceSize `json:"size,omitempty"`
+	// Rollback is what --rollback-on-failure undid after the run failed
+	Rollback []RollbackAction `json:"rollback,omitempty"`
+	// Groups nests the results by source when several -- separated groups
+	// are retagged in one run
+	Groups []*reportGroup `json:"groups,omitempty"`
+}
+
+// reportGroup is the part of the report for one source of a run with
+// several groups
+type reportGroup struct {
+	Source  string         `json:"source"`
+	Digest  string         `json:"digest,omitempty"`
+	Status  string         `json:"status"`
+	Error   string         `json:"error,omitempty"`
+	Results []UploadResult `json:"results"`
+	// SourceAge is when the source was created, checked by
+	// --max-source-age
+	SourceAge *SourceAge `json:"source_age,omitempty"`
+	// Size is the compressed size and layer count of the source
+	Size *SourceSize `json:"size,omitempty"`
+	// Platforms is the result of --require-platform for the source
+	Platforms *PlatformCheck `json:"platforms,omitempty"`
+	offset    int
+	count     int
+}
+
+// newRunReport creates a report written to path in format, json or junit
+func newRunReport(path, format string) (*runReport, error) {
+	switch format {
+	case "json", "junit":
+	default:
+		return nil, fmt.Errorf("unknown report format %q, expected json or junit", format)
+	}
+	return &runReport{
+		path:    path,
+		format:  format,
+		Version: Version,
+		TraceID: tracing.traceID,
+		Start:   time.Now(),
+	}, nil
+}
+
+// begin records the planned destinations of every group as pending
+func (r *runReport) begin(groups []*retagGroup, workers int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Workers = workers
+	r.Results = nil
+	r.keep = r.path != "" || len(notifier.urls) > 0 || githubActions()
+	r.planned = 0
+	r.counted = EventSummary{}
+	for _, g := range groups {
+		r.planned += len(g.destinations)
+		if !r.keep {
+			continue
+		}
+		for i, d := range g.destinations {
+			r.Results = append(r.Results, UploadResult{
+				Index:       g.offset + i,
+				Source:      g.source,
+				Destination: d,
+				Status:      "pending",
+			})
+		}
+	}
+	if len(groups) == 1 {
+		r.Source = groups[0].source
+		return
+	}
+	for _, g := range groups {
+		r.Groups = append(r.Groups, &reportGroup{Source: g.source, offset: g.offset, count: len(g.destinations)})
+	}
+}
+
+// record stores the current state of a destination, and counts it once
+// it has finished
+func (r *runReport) record(res UploadResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if res.Index < len(r.Results) {
+		r.Results[res.Index] = res
+	}
+	switch {
+	case res.Status == "pending" || res.Status == "running":
+	case res.Status == "success":
+		r.counted.Succeeded++
+	case res.skipped():
+		r.counted.Skipped++
+	case res.optionalFailure():
+		r.counted.FailedOptional++
+	default:
+		r.counted.Failed++
+	}
+	r.counted.Bytes += res.Bytes
+}
+
+// summary sums up the destinations, counting those that did not finish
+// as failed. It is called with the lock held.
+func (r *runReport) summary() *EventSummary {
+	s := r.counted
+	finished := s.Succeeded + s.Skipped + s.FailedOptional + s.Failed
+	if finished < r.planned {
+		s.Failed += r.planned - finished
+	}
+	return &s
+}
+
+// setDigest records the digest of the source manifest. With several
+// groups the digest of each is recorded by setGroupDigest instead.
+func (r *runReport) setDigest(digest string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.Groups) == 0 {
+		r.Digest = digest
+	}
+}
+
+// setGroupDigest records the digest pushed for a group of a run with
+// several groups
+func (r *runReport) setGroupDigest(group int, digest string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if group < len(r.Groups) {
+		r.Groups[group].Digest = digest
+	}
+}
+
+// setGroupError records why a group of a run with several groups could
+// not be retagged
+func (r *runReport) setGroupError(group int, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if group < len(r.Groups) {
+		r.Groups[group].Error = err.Error()
+	}
+}
+
+// setSourceAge records when the source of the group was created
+func (r *runReport) setSourceAge(group int, age *SourceAge) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.Groups) == 0 {
+		r.SourceAge = age
+	} else if group < len(r.Groups) {
+		r.Groups[group].SourceAge = age
+	}
+}
+
+// setPlatforms records the --require-platform check of the source of the
+// group
+func (r *runReport) setPlatforms(group int, check *PlatformCheck) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.Groups) == 0 {
+		r.Platforms = check
+	} else if group < len(r.Groups) {
+		r.Groups[group].Platforms = check
+	}
+}
+
+// setSourceSize records the size of the source of the group
+func (r *runReport) setSourceSize(group int, size *SourceSize) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.Groups) == 0 {
+		r.Size = size
+	} else if group < len(r.Groups) {
+		r.Groups[group].Size = size
+	}
+}
+
+// setRollback records what --rollback-on-failure undid
+func (r *runReport) setRollback(actions []RollbackAction) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Rollback = actions
+}
+
+// setStrippedAttestations records the attestation manifests removed from
+// the source index
+func (r *runReport) setStrippedAttestations(removed []Descriptor) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.StrippedAttestations = removed
+}
+
+// finish ends the run with err as the run error, returning whether the
+// run failed
+func (r *runReport) finish(err error) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.End = time.Now()
+	r.Status = "success"
+	if err != nil {
+		r.Status = "failed"
+		r.Error = err.Error()
+	}
+	if r.summary().Failed > 0 {
+		r.Status = "failed"
+	}
+	if !r.keep {
+		return r.Status != "success"
+	}
+	for _, g := range r.Groups {
+		g.Results = r.Results[g.offset : g.offset+g.count]
+		g.Status = "success"
+		for _, res := range g.Results {
+			if res.Status != "success" && !res.skipped() && !res.optionalFailure() {
+				g.Status = "failed"
+			}
+		}
+	}
+	return r.Status != "success"
+}
+
+// json returns the report as a JSON document
+func (r *runReport) json() ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return json.MarshalIndent(r, "", "  ")
+}
+
+// write writes the finished report to the report path, if one is set
+func (r *runReport) write() {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "runReport.write",
+		"path":    r.path,
+	})
+	if r.path == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var bd []byte
+	var merr error
+	if r.format == "junit" {
+		bd, merr = r.junit()
+	} else {
+		bd, merr = json.MarshalIndent(r, "", "  ")
+	}
+	if merr != nil {
+		l.Error("Error encoding report: ", merr)
+		return
+	}
+	if werr := ioutil.WriteFile(r.path, bd, 0644); werr != nil {
+		l.Error("Error writing report: ", werr)
+	}
+}
+
+// runDeadline is when --deadline ends the run, zero if there is none
+var runDeadline time.Time
+
+// finishAtDeadline fails the run if it has not finished within d, rolling
+// it back with --rollback-on-failure
+func finishAtDeadline(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	runDeadline = time.Now().Add(d)
+	time.AfterFunc(d, func() {
+		os.Exit(finishRun(fmt.Errorf("deadline of %s exceeded", d)))
+	})
+}
+
+// finishOnSignal finishes the run, rolling it back with
+// --rollback-on-failure, before exiting when it is interrupted
+func finishOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		s := <-c
+		finishRun(fmt.Errorf("interrupted by %s", s))
+		os.Exit(130)
+	}()
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Time      float64         `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Props     []junitProperty `xml:"properties>property"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *struct{}     `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// junit renders the report as a JUnit XML document with one test case
+// per destination. r.mu must be held.
+func (r *runReport) junit() ([]byte, error) {
+	suite := junitTestSuite{
+		Name:      "docker-retag",
+		Tests:     len(r.Results),
+		Time:      r.End.Sub(r.Start).Seconds(),
+		Timestamp: r.Start.Format(time.RFC3339),
+		Props: []junitProperty{
+			{Name: "version", Value: r.Version},
+			{Name: "source", Value: r.Source},
+			{Name: "workers", Value: fmt.Sprint(r.Workers)},
+		},
+	}
+	for _, res := range r.Results {
+		tc := junitTestCase{
+			Name:      res.Destination,
+			ClassName: res.Source,
+			Time:      res.Duration,
+			SystemOut: fmt.Sprintf("digest=%s bytes=%d attempts=%d", res.Digest, res.Bytes, res.Attempts),
+		}
+		if res.skipped() {
+			tc.Skipped = &struct{}{}
+		} else if res.optionalFailure() {
+			tc.Skipped = &struct{}{}
+			tc.SystemOut += " " + res.Status + ": " + res.Error
+		} else if res.Status != "success" {
+			msg := res.Error
+			if msg == "" {
+				msg = r.Error
+			}
+			if msg == "" {
+				msg = res.Status
+			}
+			tc.Failure = &junitFailure{Message: msg, Text: msg}
+			suite.Failures++
+		}
+		suite.Cases = append(suite.Cases, tc)
+	}
+	bd, err := xml.MarshalIndent(junitTestSuites{Suites: []junitTestSuite{suite}}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), bd...), nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// loadResume reads the JSON report of a previous run for --resume
+func loadResume(path string) (*runReport, error) {
+	bd, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	prev := &runReport{}
+	if err := json.Unmarshal(bd, prev); err != nil {
+		return nil, fmt.Errorf("reading report %s, --resume needs a json report: %w", path, err)
+	}
+	return prev, nil
+}
+
+// resumed returns the results of the destinations that the previous run
+// already retagged, by index, so they are not pushed again. The previous
+// run must have retagged the same source with the same digest, so a
+// source tag that moved since invalidates the resume.
+func (prev *runReport) resumed(source, digest string, destinations []string) (map[int]UploadResult, error) {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "runReport.resumed",
+	})
+	done := map[int]UploadResult{}
+	if prev == nil {
+		return done, nil
+	}
+	if prev.Source != source {
+		return nil, fmt.Errorf("cannot resume, the report is for source %s, not %s", prev.Source, source)
+	}
+	if prev.Digest == "" {
+		return done, nil
+	}
+	if prev.Digest != digest {
+		return nil, fmt.Errorf("cannot resume, %s is now %s but the previous run retagged %s", source, digest, prev.Digest)
+	}
+	succeeded := map[string]UploadResult{}
+	for _, r := range prev.Results {
+		if r.Status == "success" && r.Digest == digest {
+			succeeded[r.Destination] = r
+		}
+	}
+	for i, d := range destinations {
+		r, ok := succeeded[d]
+		if !ok {
+			continue
+		}
+		l.Info("Already retagged by the previous run: ", d)
+		r.Index = i
+		done[i] = r
+	}
+	return done, nil
+}
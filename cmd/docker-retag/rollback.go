@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RollbackOnFailure restores the destination tags a failed run already
+// moved to what they pointed at before, and deletes the tags it created
+var RollbackOnFailure bool
+
+// RollbackAction is what was done to undo the push to a destination, as
+// recorded in the report
+type RollbackAction struct {
+	Destination string `json:"destination"`
+	// Action is restore for a tag moved back to its previous digest, or
+	// delete for a tag that did not exist before the run
+	Action string `json:"action"`
+	// Digest is the digest the run pushed to the tag
+	Digest string `json:"digest"`
+	// PreviousDigest is the digest the tag is restored to
+	PreviousDigest string `json:"previous_digest,omitempty"`
+	Status         string `json:"status"`
+	Error          string `json:"error,omitempty"`
+}
+
+// rollbackEntry is the state of a destination tag before it was pushed
+type rollbackEntry struct {
+	index    int
+	ref      ImageRef
+	existed  bool
+	previous string
+	// pushed is the digest pushed, empty until the push succeeded
+	pushed string
+	// settled is set once the push finished, whether it succeeded or not
+	settled bool
+}
+
+// rollbackJournal records the destination tags as they are pushed, so a
+// failed run can undo them
+type rollbackJournal struct {
+	mu      sync.Mutex
+	entries map[int]*rollbackEntry
+	// closed is set when the rollback starts, after which no push begins
+	closed bool
+	// pending counts the recorded pushes that have not settled
+	pending sync.WaitGroup
+}
+
+// rollbackSettleTimeout is how long the rollback waits for the pushes
+// still in flight when the run is cut short by --deadline or a signal
+var rollbackSettleTimeout = 30 * time.Second
+
+// rollbacks is the journal of the run, used with --rollback-on-failure
+var rollbacks = &rollbackJournal{entries: map[int]*rollbackEntry{}}
+
+// before records what the tag of destination index points at before it
+// is pushed. A destination without a tag, pushed by digest, moves no tag
+// and is not recorded. Once the rollback has started no push may begin.
+func (j *rollbackJournal) before(index int, ref ImageRef) error {
+	if ref.Tag == "" || ref.Digest != "" {
+		return nil
+	}
+	previous, existed, err := manifestDigest(ref, ref.Tag)
+	if err != nil {
+		return fmt.Errorf("recording the current digest of %s for --rollback-on-failure: %w", ref.String(), err)
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.closed {
+		return fmt.Errorf("not pushing %s, the run is being rolled back", ref.String())
+	}
+	j.pending.Add(1)
+	j.entries[index] = &rollbackEntry{index: index, ref: ref, existed: existed, previous: previous}
+	return nil
+}
+
+// pushed records that the push of destination index finished, pointing
+// its tag at digest unless err is set
+func (j *rollbackJournal) pushed(index int, digest string, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	e, ok := j.entries[index]
+	if !ok || e.settled {
+		return
+	}
+	if err == nil {
+		e.pushed = digest
+	}
+	e.settled = true
+	j.pending.Done()
+}
+
+// settle stops new pushes and waits up to timeout for the pushes in
+// flight to finish
+func (j *rollbackJournal) settle(timeout time.Duration) {
+	j.mu.Lock()
+	j.closed = true
+	j.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		j.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+}
+
+// rollback undoes every recorded push that changed its tag, the latest
+// first, and returns what it did. It first waits for the pushes in flight,
+// and a push still running after rollbackSettleTimeout is recorded as
+// failed to roll back. A failure to undo one destination is logged and
+// recorded, and the others are still rolled back.
+func (j *rollbackJournal) rollback() []RollbackAction {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "rollback",
+	})
+	j.settle(rollbackSettleTimeout)
+	j.mu.Lock()
+	var entries []*rollbackEntry
+	for _, e := range j.entries {
+		if !e.settled || (e.pushed != "" && e.pushed != e.previous) {
+			entries = append(entries, e)
+		}
+	}
+	j.mu.Unlock()
+	sort.Slice(entries, func(a, b int) bool { return entries[a].index > entries[b].index })
+	actions := []RollbackAction{}
+	failed := 0
+	for _, e := range entries {
+		a := RollbackAction{Destination: e.ref.String(), Digest: e.pushed, Status: "success"}
+		ll := l.WithField("destination", a.Destination)
+		var err error
+		if !e.settled {
+			a.Action, a.PreviousDigest = "delete", ""
+			if e.existed {
+				a.Action, a.PreviousDigest = "restore", e.previous
+			}
+			err = fmt.Errorf("still pushing after %s, the push may yet move the tag", rollbackSettleTimeout)
+		} else if e.existed {
+			a.Action, a.PreviousDigest = "restore", e.previous
+			ll.Warnf("Rolling back: restoring %s to %s", a.Destination, e.previous)
+			err = restoreTag(e.ref, e.previous)
+		} else {
+			a.Action = "delete"
+			ll.Warnf("Rolling back: deleting %s, which did not exist before the run", a.Destination)
+			err = deleteTag(e.ref)
+		}
+		if err != nil {
+			failed++
+			a.Status, a.Error = "failed", err.Error()
+			ll.Errorf("ROLLBACK FAILED, %s is left at %s: %s", a.Destination, e.pushed, err)
+		}
+		actions = append(actions, a)
+	}
+	if failed > 0 {
+		l.Errorf("ROLLBACK FAILED for %d of %d destinations, fix them by hand", failed, len(entries))
+	} else if len(entries) > 0 {
+		l.Warnf("Rolled back %d destinations", len(entries))
+	}
+	return actions
+}
+
+// restoreTag points the tag of ref back at the manifest with the digest,
+// which the registry still has by digest after the tag moved
+func restoreTag(ref ImageRef, digest string) error {
+	m, err := fetchManifest(ref, digest)
+	if err != nil {
+		return fmt.Errorf("getting previous manifest %s: %w", digest, err)
+	}
+	_, _, err = putManifest(ref, ref.Tag, m)
+	return err
+}
+
+// deleteTag deletes the tag of ref. Only the tag is deleted: deleting the
+// manifest by digest would also remove other tags pointing at it, such as
+// the source, so registries that cannot delete tags fail instead.
+func deleteTag(ref ImageRef) error {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "deleteTag",
+		"url":     ref.String(),
+	})
+	req, err := http.NewRequest("DELETE", ref.apiURL("manifests", ref.Tag), nil)
+	if err != nil {
+		return err
+	}
+	if err := authorize(req, ref); err != nil {
+		return err
+	}
+	resp, err := registryDo(req, ref.authProvider())
+	audit("tag_delete", ref, ref.String(), "", resp, err)
+	if err != nil {
+		l.Error("Error deleting tag: ", err)
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusAccepted, http.StatusOK:
+		return nil
+	case http.StatusMethodNotAllowed:
+		return errors.New("the registry does not allow deleting tags")
+	}
+	bd := readErrorBody(resp.Body)
+	var re registryErrors
+	json.Unmarshal(bd, &re)
+	for _, e := range re.Errors {
+		if e.Code == "UNSUPPORTED" || e.Code == "DIGEST_INVALID" {
+			return errors.New("the registry only deletes manifests by digest, which would remove other tags")
+		}
+	}
+	return pushError(ref, resp, bd)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testImageManifest returns an image manifest that differs by n
+func testImageManifest(n int) []byte {
+	return []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"config":{"mediaType":%q,"digest":"sha256:%064d","size":2},"layers":[]}`, mediaTypeOCIManifest, mediaTypeOCIConfig, n))
+}
+
+func TestRollbackWaitsForPushInFlight(t *testing.T) {
+	r := newTestRegistry(t)
+	previous := r.putManifest("app", "1.0", mediaTypeOCIManifest, testImageManifest(1))
+	ref := r.ref(t, "app", "1.0")
+	j := &rollbackJournal{entries: map[int]*rollbackEntry{}}
+	if err := j.before(0, ref); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		j.pushed(0, r.putManifest("app", "1.0", mediaTypeOCIManifest, testImageManifest(2)), nil)
+	}()
+	actions := j.rollback()
+	if len(actions) != 1 || actions[0].Action != "restore" || actions[0].Status != "success" {
+		t.Fatalf("rollback = %+v, want the push that finished during it restored", actions)
+	}
+	if current, _, err := manifestDigest(ref, "1.0"); err != nil || current != previous {
+		t.Errorf("app:1.0 = %s, %v after the rollback, want %s", current, err, previous)
+	}
+	if err := j.before(1, r.ref(t, "app", "1.1")); err == nil {
+		t.Error("a push began after the rollback started")
+	}
+}
+
+func TestRollbackReportsUnsettledPush(t *testing.T) {
+	r := newTestRegistry(t)
+	timeout := rollbackSettleTimeout
+	rollbackSettleTimeout = 10 * time.Millisecond
+	defer func() { rollbackSettleTimeout = timeout }()
+	j := &rollbackJournal{entries: map[int]*rollbackEntry{}}
+	if err := j.before(0, r.ref(t, "app", "1.0")); err != nil {
+		t.Fatal(err)
+	}
+	actions := j.rollback()
+	if len(actions) != 1 || actions[0].Action != "delete" || actions[0].Status != "failed" {
+		t.Errorf("rollback = %+v, want the push still in flight reported as not rolled back", actions)
+	}
+}
+
+func TestFinishRunRollsBackOnce(t *testing.T) {
+	r := newTestRegistry(t)
+	t.Setenv("GITHUB_OUTPUT", "")
+	t.Setenv("GITHUB_STEP_SUMMARY", "")
+	RollbackOnFailure = true
+	journal, saved := &rollbackJournal{entries: map[int]*rollbackEntry{}}, rollbacks
+	rollbacks, report, finishOnce = journal, &runReport{}, sync.Once{}
+	defer func() {
+		RollbackOnFailure, rollbacks, report, finishOnce = false, saved, &runReport{}, sync.Once{}
+	}()
+	ref := r.ref(t, "app", "1.0")
+	if err := rollbacks.before(0, ref); err != nil {
+		t.Fatal(err)
+	}
+	rollbacks.pushed(0, r.putManifest("app", "1.0", mediaTypeOCIManifest, testImageManifest(1)), nil)
+
+	// the deadline and the main path finishing at the same time
+	codes := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() { codes <- finishRun(errors.New("deadline of 1s exceeded")) }()
+	}
+	for i := 0; i < 2; i++ {
+		if code := <-codes; code != 1 {
+			t.Errorf("finishRun = %d, want 1", code)
+		}
+	}
+	if _, exists, err := manifestDigest(ref, "1.0"); err != nil || exists {
+		t.Errorf("app:1.0 exists = %v, %v after a failed run, want the tag it created deleted", exists, err)
+	}
+	deletes := 0
+	for _, req := range r.requested() {
+		if req == "DELETE /v2/app/manifests/1.0" {
+			deletes++
+		}
+	}
+	if deletes != 1 || len(report.Rollback) != 1 {
+		t.Errorf("rolled back %d times, report records %+v, want one rollback", deletes, report.Rollback)
+	}
+}
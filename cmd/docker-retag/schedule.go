@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// RegistryConcurrency caps the destinations pushed to a registry at once,
+// as host=N
+var RegistryConcurrency = keyValueFlag{}
+
+// maxQueuedJobs is how many jobs may wait in the queue. Pushing more blocks
+// until workers take jobs, so the memory of a run with many destinations
+// does not grow with their number. It is large enough that the jobs of
+// usual runs are all queued at once, and every registry's queue is served
+// even while another registry is slow.
+const maxQueuedJobs = 1024
+
+// jobQueue hands upload jobs to the workers from a queue per destination
+// registry. A registry only gets as many workers as its concurrency cap
+// allows, so a slow or throttled registry cannot hold every worker while
+// the destinations on other registries wait behind it.
+type jobQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	workers int
+	queues  map[string][]UploadJob
+	running map[string]int
+	// queued is the number of jobs waiting in all queues
+	queued int
+	// order is the order registries are served in, round robin from next
+	order  []string
+	next   int
+	closed bool
+}
+
+// newJobQueue returns a queue for workers pushing to destinations. The
+// registries of all destinations are known up front, so the default caps
+// already account for registries whose jobs are queued later.
+func newJobQueue(workers int, destinations []string) *jobQueue {
+	q := &jobQueue{
+		workers: workers,
+		queues:  map[string][]UploadJob{},
+		running: map[string]int{},
+	}
+	q.cond = sync.NewCond(&q.mu)
+	for _, d := range destinations {
+		registry := jobRegistry(d)
+		if _, ok := q.queues[registry]; !ok {
+			q.queues[registry] = nil
+			q.order = append(q.order, registry)
+		}
+	}
+	return q
+}
+
+// validateRegistryConcurrency checks the --registry-concurrency values
+func validateRegistryConcurrency() error {
+	for host, v := range RegistryConcurrency {
+		if n, err := strconv.Atoi(v); err != nil || n < 1 {
+			return fmt.Errorf("--registry-concurrency %s=%s is not a positive number", host, v)
+		}
+	}
+	return nil
+}
+
+// jobRegistry returns the registry a destination is pushed to, which
+// its job is queued by
+func jobRegistry(image string) string {
+	if strings.HasPrefix(image, ociLayoutScheme) {
+		return "oci-layout"
+	}
+	ref, err := urlToImageTag(image)
+	if err != nil {
+		return ""
+	}
+	return canonicalHost(ref.Registry)
+}
+
+// limit returns how many jobs of the registry may run at once: the
+// --registry-concurrency for it, or by default all workers but one for
+// each other registry with destinations, so every registry keeps a
+// worker. It is called with the lock held.
+func (q *jobQueue) limit(registry string) int {
+	for host, v := range RegistryConcurrency {
+		if canonicalHost(host) == registry {
+			n, _ := strconv.Atoi(v)
+			return n
+		}
+	}
+	n := q.workers - (len(q.order) - 1)
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// push queues the job behind the others for its registry, waiting while
+// the queue is full
+func (q *jobQueue) push(j UploadJob) {
+	j.registry = jobRegistry(j.Image)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.queued >= maxQueuedJobs {
+		q.cond.Wait()
+	}
+	if _, ok := q.queues[j.registry]; !ok {
+		q.order = append(q.order, j.registry)
+	}
+	q.queues[j.registry] = append(q.queues[j.registry], j)
+	q.queued++
+	q.cond.Broadcast()
+}
+
+// close ends the queue once every job has been pushed
+func (q *jobQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// pop waits for a job whose registry is below its cap, taking registries
+// in turn. It returns false when the queue is closed and empty.
+func (q *jobQueue) pop() (UploadJob, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		queued := false
+		for i := range q.order {
+			registry := q.order[(q.next+i)%len(q.order)]
+			jobs := q.queues[registry]
+			if len(jobs) == 0 {
+				continue
+			}
+			queued = true
+			if q.running[registry] >= q.limit(registry) {
+				continue
+			}
+			j := jobs[0]
+			if len(jobs) == 1 {
+				// let the backing array go once the queue drains
+				jobs = nil
+			} else {
+				jobs = jobs[1:]
+			}
+			q.queues[registry] = jobs
+			q.queued--
+			q.running[registry]++
+			q.next = (q.next + i + 1) % len(q.order)
+			return j, true
+		}
+		if q.closed && !queued {
+			return UploadJob{}, false
+		}
+		q.cond.Wait()
+	}
+}
+
+// done frees the slot of the job's registry for its next job
+func (q *jobQueue) done(j UploadJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.running[j.registry]--
+	q.cond.Broadcast()
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// newStubRegistry starts a registry serving a source manifest, app:src,
+// and accepting any manifest pushed to app without keeping it, so its own
+// memory does not grow with the destinations. onPut is called with the
+// tag of every manifest pushed before it is answered.
+func newStubRegistry(tb testing.TB, onPut func(tag string)) string {
+	tb.Helper()
+	config := []byte("{}")
+	configDigest := digestOf(config)
+	source := []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"config":{"mediaType":%q,"digest":%q,"size":%d},"layers":[]}`, mediaTypeOCIManifest, mediaTypeOCIConfig, configDigest, len(config)))
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Docker-Distribution-Api-Version", registryAPIVersion)
+		switch {
+		case r.URL.Path == "/v2/":
+			w.Write([]byte("{}"))
+		case r.URL.Path == "/v2/app/manifests/src" || r.URL.Path == "/v2/app/manifests/"+digestOf(source):
+			w.Header().Set("Content-Type", mediaTypeOCIManifest)
+			w.Header().Set("Content-Length", fmt.Sprint(len(source)))
+			w.Header().Set("Docker-Content-Digest", digestOf(source))
+			if r.Method == "GET" {
+				w.Write(source)
+			}
+		case r.URL.Path == "/v2/app/blobs/"+configDigest:
+			w.Header().Set("Content-Length", fmt.Sprint(len(config)))
+			w.Header().Set("Docker-Content-Digest", configDigest)
+			if r.Method == "GET" {
+				w.Write(config)
+			}
+		case r.Method == "PUT" && strings.HasPrefix(r.URL.Path, "/v2/app/manifests/"):
+			body, _ := ioutil.ReadAll(r.Body)
+			onPut(strings.TrimPrefix(r.URL.Path, "/v2/app/manifests/"))
+			w.Header().Set("Docker-Content-Digest", digestOf(body))
+			w.WriteHeader(http.StatusCreated)
+		default:
+			io.Copy(ioutil.Discard, r.Body)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	host := strings.TrimPrefix(s.URL, "http://")
+	plain := PlainHTTP
+	PlainHTTP = append(append(stringListFlag{}, plain...), host)
+	tb.Cleanup(func() {
+		s.Close()
+		PlainHTTP = plain
+	})
+	return host
+}
+
+// BenchmarkRunGroups plans and pushes the source to n destinations. It
+// reports the live heap held by the destination list and plan, which
+// grows with n as both are built before the run starts, and the live
+// heap the run adds on top of them, measured while the push of the last
+// destination is held, once the workers are idle. Only the latter stays
+// flat as n grows.
+func BenchmarkRunGroups(b *testing.B) {
+	for _, n := range []int{1000, 100000} {
+		b.Run(fmt.Sprintf("destinations=%d", n), func(b *testing.B) {
+			benchmarkRunGroups(b, n)
+		})
+	}
+}
+
+func benchmarkRunGroups(b *testing.B, n int) {
+	b.Setenv("GITHUB_ACTIONS", "")
+	level := log.GetLevel()
+	log.SetLevel(log.WarnLevel)
+	defer log.SetLevel(level)
+	// stdin is no terminal, so existing tags are not checked one by one
+	stdin := os.Stdin
+	r, w, err := os.Pipe()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer w.Close()
+	os.Stdin = r
+	defer func() { os.Stdin = stdin }()
+
+	last := fmt.Sprintf("t%d", n-1)
+	held, release := make(chan struct{}), make(chan struct{})
+	host := newStubRegistry(b, func(tag string) {
+		if tag == last {
+			held <- struct{}{}
+			<-release
+		}
+	})
+	opts := defineFlags(flag.NewFlagSet("docker-retag", flag.ContinueOnError))
+	*opts.workers = 10
+	source := host + "/app:src"
+	saved := report
+	defer func() { report = saved }()
+
+	var planned, run int64
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		base := heapAfterGC()
+		destinations := make([]string, n)
+		for j := range destinations {
+			destinations[j] = fmt.Sprintf("%s/app:t%d", host, j)
+		}
+		plan, err := newPlan(source, destinations)
+		if err != nil {
+			b.Fatal(err)
+		}
+		groups := []*retagGroup{{source: source, destinations: plan.args(), plan: plan}}
+		report = &runReport{}
+		report.begin(groups, *opts.workers)
+		withPlan := heapAfterGC()
+		measured := make(chan int64)
+		go func() {
+			<-held
+			// let the other workers finish their last pushes
+			time.Sleep(100 * time.Millisecond)
+			heap := heapAfterGC()
+			close(release)
+			measured <- int64(heap) - int64(withPlan)
+		}()
+		if code := runGroups(groups, n, opts, newCredentialChain(Credential{}), false, nil); code != 0 {
+			b.Fatalf("runGroups = %d, want 0", code)
+		}
+		if heap := <-measured; heap > run {
+			run = heap
+		}
+		if heap := int64(withPlan) - int64(base); heap > planned {
+			planned = heap
+		}
+		release = make(chan struct{})
+		if s := report.summary(); s.Succeeded != n {
+			b.Fatalf("%d of %d destinations succeeded", s.Succeeded, n)
+		}
+		runtime.KeepAlive(groups)
+	}
+	b.ReportMetric(float64(planned)/(1<<20), "plan-heap-MB")
+	b.ReportMetric(float64(run)/(1<<20), "run-heap-MB")
+}
+
+// heapAfterGC returns the bytes of live heap objects
+func heapAfterGC() uint64 {
+	runtime.GC()
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
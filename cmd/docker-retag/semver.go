@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// semverPattern matches a semantic version with an optional v prefix.
+// Minor and patch may be left out, as in v1 or 1.2, and count as zero.
+var semverPattern = regexp.MustCompile(`^[vV]?(0|[1-9][0-9]*)(?:\.(0|[1-9][0-9]*))?(?:\.(0|[1-9][0-9]*))?(?:-([0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*))?(?:\+([0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*))?$`)
+
+// semver is a parsed semantic version. Build metadata is kept but does
+// not take part in the ordering.
+type semver struct {
+	major, minor, patch uint64
+	// parts is how many of major, minor and patch were given, which
+	// ranges use to widen partial versions
+	parts      int
+	prerelease []string
+	build      string
+}
+
+// parseSemver parses s as a semantic version
+func parseSemver(s string) (semver, error) {
+	m := semverPattern.FindStringSubmatch(s)
+	if m == nil {
+		return semver{}, fmt.Errorf("%q is not a semantic version", s)
+	}
+	v := semver{parts: 1, build: m[5]}
+	for i, p := range []*uint64{&v.major, &v.minor, &v.patch} {
+		if m[i+1] == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(m[i+1], 10, 64)
+		if err != nil {
+			return semver{}, fmt.Errorf("%q is not a semantic version: %w", s, err)
+		}
+		*p = n
+		v.parts = i + 1
+	}
+	if m[4] != "" {
+		v.prerelease = strings.Split(m[4], ".")
+	}
+	return v, nil
+}
+
+func (v semver) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.major, v.minor, v.patch)
+	if len(v.prerelease) > 0 {
+		s += "-" + strings.Join(v.prerelease, ".")
+	}
+	return s
+}
+
+// compare orders versions by semver precedence, returning -1, 0 or 1. A
+// prerelease is lower than its release; its identifiers compare
+// numerically when numeric and lexically otherwise.
+func (v semver) compare(o semver) int {
+	for _, c := range [][2]uint64{{v.major, o.major}, {v.minor, o.minor}, {v.patch, o.patch}} {
+		switch {
+		case c[0] < c[1]:
+			return -1
+		case c[0] > c[1]:
+			return 1
+		}
+	}
+	switch {
+	case len(v.prerelease) == 0 && len(o.prerelease) == 0:
+		return 0
+	case len(v.prerelease) == 0:
+		return 1
+	case len(o.prerelease) == 0:
+		return -1
+	}
+	for i := 0; i < len(v.prerelease) && i < len(o.prerelease); i++ {
+		a, b := v.prerelease[i], o.prerelease[i]
+		an, aerr := strconv.ParseUint(a, 10, 64)
+		bn, berr := strconv.ParseUint(b, 10, 64)
+		switch {
+		case aerr == nil && berr == nil:
+			if an != bn {
+				if an < bn {
+					return -1
+				}
+				return 1
+			}
+		case aerr == nil:
+			// numeric identifiers are lower than alphanumeric ones
+			return -1
+		case berr == nil:
+			return 1
+		case a != b:
+			if a < b {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(v.prerelease) < len(o.prerelease):
+		return -1
+	case len(v.prerelease) > len(o.prerelease):
+		return 1
+	}
+	return 0
+}
+
+// next returns the lowest version above every version starting with the
+// given parts of v, so 1.2 has 1.3.0 and 1 has 2.0.0
+func (v semver) next() semver {
+	switch v.parts {
+	case 1:
+		return semver{major: v.major + 1, parts: 3}
+	case 2:
+		return semver{major: v.major, minor: v.minor + 1, parts: 3}
+	}
+	return semver{major: v.major, minor: v.minor, patch: v.patch + 1, parts: 3}
+}
+
+// semverConstraint is a single comparison of a range
+type semverConstraint struct {
+	op string
+	v  semver
+}
+
+func (c semverConstraint) allows(v semver) bool {
+	switch c.op {
+	case "=":
+		return v.compare(c.v) == 0
+	case "!=":
+		return v.compare(c.v) != 0
+	case ">":
+		return v.compare(c.v) > 0
+	case ">=":
+		return v.compare(c.v) >= 0
+	case "<":
+		return v.compare(c.v) < 0
+	}
+	return v.compare(c.v) <= 0
+}
+
+// semverRange is a version range such as ">=1.2 <2": constraints
+// separated by spaces or commas must all hold, and || separates
+// alternatives
+type semverRange struct {
+	text string
+	any  [][]semverConstraint
+}
+
+var semverConstraintPattern = regexp.MustCompile(`^(>=|<=|!=|=|>|<|~|\^)?\s*(\S+)$`)
+
+// parseSemverRange parses a range of comparisons with =, !=, >, >=, <
+// and <=. A partial version stands for all versions it starts with: =1.2
+// and 1.2 allow 1.2.x, <=1.2 allows up to 1.2.x and >1.2 starts at 1.3.0.
+// ~1.2 allows 1.2.x and ^1.2 allows 1.x from 1.2.0, or 0.2.x for 0.2.
+func parseSemverRange(s string) (*semverRange, error) {
+	r := &semverRange{text: s}
+	for _, alt := range strings.Split(s, "||") {
+		// join operators written apart from their version, as in >= 1.2
+		fields := strings.Fields(strings.ReplaceAll(alt, ",", " "))
+		var tokens []string
+		for i := 0; i < len(fields); i++ {
+			if strings.Trim(fields[i], "<>=!~^") == "" && i+1 < len(fields) {
+				tokens = append(tokens, fields[i]+fields[i+1])
+				i++
+				continue
+			}
+			tokens = append(tokens, fields[i])
+		}
+		if len(tokens) == 0 {
+			return nil, fmt.Errorf("invalid semver range %q: empty alternative", s)
+		}
+		var all []semverConstraint
+		for _, t := range tokens {
+			m := semverConstraintPattern.FindStringSubmatch(t)
+			if m == nil {
+				return nil, fmt.Errorf("invalid semver range %q: %q is not a comparison", s, t)
+			}
+			v, err := parseSemver(m[2])
+			if err != nil {
+				return nil, fmt.Errorf("invalid semver range %q: %w", s, err)
+			}
+			all = append(all, expandConstraint(m[1], v)...)
+		}
+		r.any = append(r.any, all)
+	}
+	return r, nil
+}
+
+// expandConstraint turns a comparison with a partial version, ~ or ^ into
+// plain comparisons with full versions
+func expandConstraint(op string, v semver) []semverConstraint {
+	partial := v.parts < 3 && len(v.prerelease) == 0
+	switch op {
+	case "", "=":
+		if partial {
+			return []semverConstraint{{">=", v}, {"<", v.next()}}
+		}
+		return []semverConstraint{{"=", v}}
+	case "!=":
+		return []semverConstraint{{"!=", v}}
+	case ">":
+		if partial {
+			return []semverConstraint{{">=", v.next()}}
+		}
+	case "<=":
+		if partial {
+			return []semverConstraint{{"<", v.next()}}
+		}
+	case "~":
+		if v.parts == 3 {
+			v.parts = 2
+		}
+		return []semverConstraint{{">=", v}, {"<", v.next()}}
+	case "^":
+		switch {
+		case v.major > 0 || v.parts == 1:
+			v.parts = 1
+		case v.minor > 0 || v.parts == 2:
+			v.parts = 2
+		}
+		return []semverConstraint{{">=", v}, {"<", v.next()}}
+	}
+	return []semverConstraint{{op, v}}
+}
+
+// allows reports whether v is in the range
+func (r *semverRange) allows(v semver) bool {
+	for _, all := range r.any {
+		ok := true
+		for _, c := range all {
+			if !c.allows(v) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *semverRange) String() string {
+	return r.text
+}
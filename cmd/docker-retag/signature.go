@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// exitSignature is the exit code when --verify-signature finds no
+	// valid signature for the source
+	exitSignature = 4
+	// cosignSignatureAnnotation holds the base64 signature of the payload
+	// in a layer of a cosign signature manifest
+	cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+	// cosignSignatureType is the critical type of a cosign payload
+	cosignSignatureType = "cosign container image signature"
+	// maxSignaturePayload bounds the signature payloads that are read
+	maxSignaturePayload = 1 << 20
+)
+
+// SignatureCheck is the result of --verify-signature, included in the
+// results of every destination
+type SignatureCheck struct {
+	Verified bool `json:"verified"`
+	// Signature is the digest of the signature manifest that verified
+	Signature string `json:"signature,omitempty"`
+	Key       string `json:"key"`
+}
+
+// verifier checks the signature of the source before anything is pushed
+// with --verify-signature; it is nil otherwise
+var verifier *signatureVerifier
+
+// signatureVerifier checks cosign signatures of the source with a public
+// key
+type signatureVerifier struct {
+	keyPath string
+	key     crypto.PublicKey
+}
+
+// cosignPayload is the part of a cosign simple signing payload that
+// binds the signature to a manifest
+type cosignPayload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+// newSignatureVerifier loads the key for --verify-signature, so a bad
+// key fails before any registry is contacted. Only public key files given
+// with --cosign-key are supported: KMS keys and keyless verification need
+// the sigstore services and trust roots, which docker-retag does not talk
+// to.
+func newSignatureVerifier(keyPath string) (*signatureVerifier, error) {
+	if keyPath == "" {
+		return nil, errors.New("--verify-signature needs --cosign-key")
+	}
+	if i := strings.Index(keyPath, "://"); i > 0 {
+		return nil, fmt.Errorf("--cosign-key %s: %s keys are not supported, export the public key to a file", keyPath, keyPath[:i])
+	}
+	bd, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading --cosign-key: %w", err)
+	}
+	block, _ := pem.Decode(bd)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("--cosign-key %s is not a PEM public key", keyPath)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing --cosign-key %s: %w", keyPath, err)
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+	default:
+		return nil, fmt.Errorf("--cosign-key %s has an unsupported key type %T", keyPath, key)
+	}
+	return &signatureVerifier{keyPath: keyPath, key: key}, nil
+}
+
+// signatureTag returns the tag cosign stores the signatures of the
+// manifest with digest under
+func signatureTag(digest string) string {
+	return strings.Replace(digest, ":", "-", 1) + ".sig"
+}
+
+// verify checks that the source manifest with digest has a cosign
+// signature made with the key. It fails if there is no signature, or
+// none of the signatures verifies and is for the digest.
+func (v *signatureVerifier) verify(src imageSource, digest string) (*SignatureCheck, error) {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "signatureVerifier.verify",
+		"source":  src.String(),
+		"digest":  digest,
+	})
+	rs, ok := baseRegistrySource(src)
+	if !ok {
+		return nil, fmt.Errorf("signatures can only be verified for sources in a registry, not %s", src)
+	}
+	sigRef := rs.ref.withReference(signatureTag(digest))
+	exists, err := manifestExists(sigRef, sigRef.Tag)
+	if err != nil {
+		return nil, fmt.Errorf("looking up signature %s: %w", sigRef, err)
+	}
+	if !exists {
+		return nil, fmt.Errorf("%s has no signature, %s does not exist", src, sigRef)
+	}
+	m, err := fetchManifest(sigRef, sigRef.Tag)
+	if err != nil {
+		return nil, fmt.Errorf("getting signature %s: %w", sigRef, err)
+	}
+	var failures []string
+	for _, layer := range m.Layers {
+		sig, ok := layer.Annotations[cosignSignatureAnnotation]
+		if !ok {
+			continue
+		}
+		if err := v.verifyLayer(rs.ref, layer, sig, digest); err != nil {
+			l.Debugf("Signature layer %s does not verify: %s", layer.Digest, err)
+			failures = append(failures, err.Error())
+			continue
+		}
+		l.Infof("Verified signature %s with %s", m.Digest(), v.keyPath)
+		return &SignatureCheck{Verified: true, Signature: m.Digest(), Key: v.keyPath}, nil
+	}
+	if len(failures) == 0 {
+		return nil, fmt.Errorf("%s has no cosign signatures", sigRef)
+	}
+	return nil, fmt.Errorf("no signature in %s verifies with %s: %s", sigRef, v.keyPath, strings.Join(failures, "; "))
+}
+
+// verifyLayer checks the base64 signature sig of the payload in layer and
+// that the payload is for digest
+func (v *signatureVerifier) verifyLayer(ref ImageRef, layer Descriptor, sig string, digest string) error {
+	if layer.Size > maxSignaturePayload {
+		return fmt.Errorf("payload %s is %s, larger than a signature payload", layer.Digest, formatBytes(layer.Size))
+	}
+	raw, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return fmt.Errorf("decoding signature: %w", err)
+	}
+	rc, err := openBlob(ref, layer.Digest)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	payload, err := ioutil.ReadAll(newVerifyingReader(io.LimitReader(rc, maxSignaturePayload+1), layer))
+	if err != nil {
+		return err
+	}
+	if err := verifySignatureBytes(v.key, payload, raw); err != nil {
+		return err
+	}
+	var p cosignPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return fmt.Errorf("decoding payload: %w", err)
+	}
+	if p.Critical.Type != cosignSignatureType {
+		return fmt.Errorf("payload has type %q, expected %q", p.Critical.Type, cosignSignatureType)
+	}
+	if p.Critical.Image.DockerManifestDigest != digest {
+		return fmt.Errorf("payload signs %s, not %s", p.Critical.Image.DockerManifestDigest, digest)
+	}
+	return nil
+}
+
+// verifySignatureBytes checks sig over payload the way cosign signs:
+// ECDSA and RSA PKCS#1 v1.5 over the SHA-256 of the payload, and Ed25519
+// over the payload itself
+func verifySignatureBytes(key crypto.PublicKey, payload, sig []byte) error {
+	sum := sha256.Sum256(payload)
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(k, sum[:], sig) {
+			return errors.New("invalid ECDSA signature")
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, sum[:], sig); err != nil {
+			return fmt.Errorf("invalid RSA signature: %w", err)
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, payload, sig) {
+			return errors.New("invalid Ed25519 signature")
+		}
+	default:
+		return fmt.Errorf("unsupported key type %T", key)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writePublicKey writes the public key as a PEM file and returns its path
+func writePublicKey(t *testing.T, pub crypto.PublicKey) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "cosign.pub")
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// cosignSign signs payload the way cosign does with the private key
+func cosignSign(t *testing.T, key crypto.Signer, payload []byte) string {
+	t.Helper()
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, payload)
+	case *ecdsa.PrivateKey:
+		sum := sha256.Sum256(payload)
+		sig, err = ecdsa.SignASN1(rand.Reader, k, sum[:])
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
+// cosignPayloadFor returns a simple signing payload of the type for digest
+func cosignPayloadFor(digest, typ string) []byte {
+	return []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":"registry.example.com/app"},"image":{"docker-manifest-digest":%q},"type":%q},"optional":null}`, digest, typ))
+}
+
+// signatureLayer is a layer of a signature manifest, with no signature
+// annotation if sig is empty
+type signatureLayer struct {
+	payload []byte
+	sig     string
+}
+
+// pushSignature pushes a cosign signature manifest of the layers for
+// digest to the repository app of the registry
+func pushSignature(t *testing.T, r *testRegistry, digest string, layers ...signatureLayer) {
+	t.Helper()
+	config := []byte("{}")
+	m := struct {
+		SchemaVersion int          `json:"schemaVersion"`
+		MediaType     string       `json:"mediaType"`
+		Config        Descriptor   `json:"config"`
+		Layers        []Descriptor `json:"layers"`
+	}{2, mediaTypeOCIManifest, Descriptor{MediaType: mediaTypeOCIConfig, Digest: r.putBlob(config), Size: int64(len(config))}, nil}
+	for _, l := range layers {
+		d := Descriptor{MediaType: "application/vnd.dev.cosign.simplesigning.v1+json", Digest: r.putBlob(l.payload), Size: int64(len(l.payload))}
+		if l.sig != "" {
+			d.Annotations = map[string]string{cosignSignatureAnnotation: l.sig}
+		}
+		m.Layers = append(m.Layers, d)
+	}
+	bd, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.putManifest("app", signatureTag(digest), mediaTypeOCIManifest, bd)
+}
+
+func TestVerifySignature(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := fmt.Sprintf("sha256:%064d", 9)
+	tests := []struct {
+		name string
+		key  crypto.Signer
+		// layers returns the layers of the signature of digest, or none
+		// for no signature
+		layers func(digest string) []signatureLayer
+		err    string
+	}{
+		{"valid ECDSA", ecKey, func(digest string) []signatureLayer {
+			p := cosignPayloadFor(digest, cosignSignatureType)
+			return []signatureLayer{{p, cosignSign(t, ecKey, p)}}
+		}, ""},
+		{"valid Ed25519", edKey, func(digest string) []signatureLayer {
+			p := cosignPayloadFor(digest, cosignSignatureType)
+			return []signatureLayer{{p, cosignSign(t, edKey, p)}}
+		}, ""},
+		{"payload for another digest", ecKey, func(digest string) []signatureLayer {
+			p := cosignPayloadFor(other, cosignSignatureType)
+			return []signatureLayer{{p, cosignSign(t, ecKey, p)}}
+		}, "payload signs " + other},
+		{"wrong key", ecKey, func(digest string) []signatureLayer {
+			p := cosignPayloadFor(digest, cosignSignatureType)
+			return []signatureLayer{{p, cosignSign(t, otherKey, p)}}
+		}, "invalid ECDSA signature"},
+		{"wrong Ed25519 key", edKey, func(digest string) []signatureLayer {
+			p := cosignPayloadFor(digest, cosignSignatureType)
+			return []signatureLayer{{p, cosignSign(t, ecKey, p)}}
+		}, "invalid Ed25519 signature"},
+		{"wrong type", ecKey, func(digest string) []signatureLayer {
+			p := cosignPayloadFor(digest, "cosign attestation")
+			return []signatureLayer{{p, cosignSign(t, ecKey, p)}}
+		}, `payload has type "cosign attestation"`},
+		{"no signature tag", ecKey, func(digest string) []signatureLayer {
+			return nil
+		}, "has no signature"},
+		{"layers without the annotation are skipped", ecKey, func(digest string) []signatureLayer {
+			p := cosignPayloadFor(digest, cosignSignatureType)
+			return []signatureLayer{{[]byte("not a signature"), ""}, {p, cosignSign(t, ecKey, p)}}
+		}, ""},
+		{"only layers without the annotation", ecKey, func(digest string) []signatureLayer {
+			return []signatureLayer{{cosignPayloadFor(digest, cosignSignatureType), ""}}
+		}, "has no cosign signatures"},
+	}
+	for _, tt := range tests {
+		r := newTestRegistry(t)
+		digest := r.putManifest("app", "1.0", mediaTypeOCIManifest, testImageManifest(1))
+		if layers := tt.layers(digest); layers != nil {
+			pushSignature(t, r, digest, layers...)
+		}
+		v, err := newSignatureVerifier(writePublicKey(t, tt.key.Public()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		src, err := newImageSource(r.host + "/app:1.0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		check, err := v.verify(src, digest)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: verify = %v, want an error containing %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: verify = %v", tt.name, err)
+			continue
+		}
+		if !check.Verified || check.Signature == "" {
+			t.Errorf("%s: verify = %+v, want it verified by the signature manifest", tt.name, check)
+		}
+	}
+}
+
+func TestNewSignatureVerifierRejectsKeys(t *testing.T) {
+	for _, key := range []string{"", "awskms:///alias/cosign", filepath.Join(t.TempDir(), "missing.pub")} {
+		if _, err := newSignatureVerifier(key); err == nil {
+			t.Errorf("newSignatureVerifier(%q) passed, want an error", key)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SourceSize is the size of the source image: the compressed size and
+// number of its layers, which --max-size and --max-layers check. For an
+// index they are the largest of its platforms.
+type SourceSize struct {
+	Bytes  int64 `json:"bytes"`
+	Layers int   `json:"layers"`
+	// Platforms are the sizes of the platforms of an index, leaving out
+	// attestation manifests and, with --require-platform, the platforms
+	// not required
+	Platforms []PlatformSize `json:"platforms,omitempty"`
+}
+
+// PlatformSize is the size of one platform of an index
+type PlatformSize struct {
+	Platform string `json:"platform,omitempty"`
+	Digest   string `json:"digest"`
+	Bytes    int64  `json:"bytes"`
+	Layers   int    `json:"layers"`
+}
+
+// String returns the size as 1.2 GiB in 14 layers
+func (s *SourceSize) String() string {
+	if s.Layers == 1 {
+		return formatBytes(s.Bytes) + " in 1 layer"
+	}
+	return fmt.Sprintf("%s in %d layers", formatBytes(s.Bytes), s.Layers)
+}
+
+// sourceSize sums the layer sizes of the source m. The platforms of an
+// index are sized separately, only those matching platforms if any are
+// given.
+func sourceSize(src imageSource, m Manifest, platforms []Platform) (*SourceSize, error) {
+	if !m.isIndex() {
+		size := &SourceSize{Layers: len(m.Layers)}
+		for _, l := range m.Layers {
+			size.Bytes += l.Size
+		}
+		return size, nil
+	}
+	size := &SourceSize{}
+	for _, d := range m.Manifests {
+		if isAttestation(d) || !platformWanted(d, platforms) {
+			continue
+		}
+		child, err := src.manifest(d.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("getting manifest %s from %s: %w", d.Digest, src, err)
+		}
+		cs, err := sourceSize(src, child, platforms)
+		if err != nil {
+			return nil, err
+		}
+		ps := PlatformSize{Digest: d.Digest, Bytes: cs.Bytes, Layers: cs.Layers}
+		if d.Platform != nil {
+			ps.Platform = d.Platform.String()
+		}
+		size.Platforms = append(size.Platforms, ps)
+		if cs.Bytes > size.Bytes {
+			size.Bytes = cs.Bytes
+		}
+		if cs.Layers > size.Layers {
+			size.Layers = cs.Layers
+		}
+	}
+	return size, nil
+}
+
+// platformWanted reports whether the index entry d matches one of the
+// platforms, or any platform if none are given. Entries without a
+// platform are always sized.
+func platformWanted(d Descriptor, platforms []Platform) bool {
+	if len(platforms) == 0 || d.Platform == nil {
+		return true
+	}
+	for _, want := range platforms {
+		if d.Platform.matches(want) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSourceSize fails if the source m, or any platform of an index, is
+// larger than maxSize or has more layers than maxLayers, naming the
+// totals found. Zero limits are not checked. The size is returned for
+// the plan and report also when the check fails.
+func checkSourceSize(src imageSource, m Manifest, maxSize int64, maxLayers int, platforms []Platform) (*SourceSize, error) {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "checkSourceSize",
+		"image":   src.String(),
+	})
+	size, err := sourceSize(src, m, platforms)
+	if err != nil {
+		l.Error("Error getting size: ", err)
+		return nil, err
+	}
+	sizes := size.Platforms
+	if !m.isIndex() {
+		sizes = []PlatformSize{{Digest: m.Digest(), Bytes: size.Bytes, Layers: size.Layers}}
+	}
+	var over []string
+	for _, ps := range sizes {
+		var reasons []string
+		if maxSize > 0 && ps.Bytes > maxSize {
+			reasons = append(reasons, fmt.Sprintf("%s, larger than --max-size %s", formatBytes(ps.Bytes), formatBytes(maxSize)))
+		}
+		if maxLayers > 0 && ps.Layers > maxLayers {
+			reasons = append(reasons, fmt.Sprintf("%d layers, more than --max-layers %d", ps.Layers, maxLayers))
+		}
+		if len(reasons) == 0 {
+			continue
+		}
+		reason := strings.Join(reasons, " and ")
+		switch {
+		case !m.isIndex():
+		case ps.Platform != "":
+			reason = "platform " + ps.Platform + " is " + reason
+		default:
+			reason = "manifest " + ps.Digest + " is " + reason
+		}
+		over = append(over, reason)
+	}
+	if len(over) == 0 {
+		l.Debug("Source is ", size)
+		return size, nil
+	}
+	if !m.isIndex() {
+		return size, fmt.Errorf("source %s is %s", src, over[0])
+	}
+	return size, fmt.Errorf("source %s is too large: %s", src, strings.Join(over, "; "))
+}
+
+// checkGroupSize runs --max-size and --max-layers for the source of the
+// group and records the size in its plan and the report
+func checkGroupSize(g *retagGroup, opts *options) error {
+	src, err := newImageSource(g.source)
+	if err != nil {
+		return err
+	}
+	manifest, err := src.root()
+	if err != nil {
+		return err
+	}
+	size, err := checkSourceSize(src, manifest, int64(opts.maxSize), *opts.maxLayers, opts.requirePlatforms)
+	g.plan.Size = size
+	report.setSourceSize(g.index, size)
+	return err
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io"
+	"strings"
+)
+
+// imageSource is where the image being retagged is read from
+type imageSource interface {
+	// root returns the manifest being retagged
+	root() (Manifest, error)
+	// manifest returns the manifest with the given tag or digest
+	manifest(reference string) (Manifest, error)
+	// openBlob opens the blob described by desc for reading
+	openBlob(desc Descriptor) (io.ReadCloser, error)
+	String() string
+}
+
+// wrappedSource is implemented by sources that serve another source with
+// changes, so unchanged blobs can still be mounted from its registry
+type wrappedSource interface {
+	unwrap() imageSource
+}
+
+// baseRegistrySource returns the registry source underneath src, if any
+func baseRegistrySource(src imageSource) (*registrySource, bool) {
+	for {
+		switch s := src.(type) {
+		case *registrySource:
+			return s, true
+		case wrappedSource:
+			src = s.unwrap()
+		default:
+			return nil, false
+		}
+	}
+}
+
+// registrySource reads images from a registry, or from its mirror
+type registrySource struct {
+	arg    string
+	ref    ImageRef
+	mirror *ImageRef
+}
+
+func (s *registrySource) root() (Manifest, error) {
+	return sourceManifests.get(s.ref, s.ref.Reference(), s.fetch)
+}
+
+func (s *registrySource) manifest(reference string) (Manifest, error) {
+	return sourceManifests.get(s.ref, reference, s.fetch)
+}
+
+func (s *registrySource) openBlob(desc Descriptor) (io.ReadCloser, error) {
+	return s.openMirrorBlob(desc)
+}
+
+func (s *registrySource) String() string {
+	return s.arg
+}
+
+// newImageSource returns the source for the image reference given on
+// the command line
+func newImageSource(arg string) (imageSource, error) {
+	if strings.HasPrefix(arg, ociLayoutScheme) {
+		return newOCILayoutSource(arg)
+	}
+	if strings.HasPrefix(arg, dockerDaemonScheme) {
+		return newDockerDaemonSource(arg)
+	}
+	ref, err := urlToImageTag(arg)
+	if err != nil {
+		return nil, err
+	}
+	return &registrySource{arg: arg, ref: ref, mirror: mirrorOf(ref)}, nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// spools hold the source blobs on disk while they are copied, one for
+// each source of the run whose blobs are spooled
+var spools []*blobSpool
+
+// blobSpool downloads each source blob once into a directory so every
+// destination that needs it uploads from disk instead of downloading it
+// again. Blobs up to threshold bytes are streamed instead.
+type blobSpool struct {
+	dir       string
+	threshold int64
+	mu        sync.Mutex
+	blobs     map[string]*spooledBlob
+}
+
+// spooledBlob is a blob in the spool. The download happens once, and
+// readers that need the blob meanwhile wait for it.
+type spooledBlob struct {
+	once sync.Once
+	path string
+	err  error
+}
+
+// newBlobSpool creates a spool in a new temporary directory under parent,
+// or under the system temporary directory if parent is empty
+func newBlobSpool(parent string, threshold int64) (*blobSpool, error) {
+	dir, err := ioutil.TempDir(parent, "docker-retag-spool-")
+	if err != nil {
+		return nil, err
+	}
+	return &blobSpool{dir: dir, threshold: threshold, blobs: map[string]*spooledBlob{}}, nil
+}
+
+// startSpool sets up the spool for copying the manifest from src and
+// returns the source to copy from. Blobs are spooled with --spool-dir,
+// or in a temporary directory when they are copied to several
+// registries, after checking that the spool has room for them. Otherwise
+// blobs are streamed and src is returned unchanged.
+func startSpool(src imageSource, manifest Manifest, plan *Plan, opts *options) (imageSource, error) {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "startSpool",
+	})
+	if *opts.spoolDir == "" && !plan.sharesSourceBlobs() {
+		return src, nil
+	}
+	var threshold int64
+	if *opts.spool == "auto" {
+		threshold = int64(ChunkSize)
+	}
+	size, err := spoolSize(src, manifest, threshold, map[string]bool{})
+	if err != nil {
+		l.Error("Error sizing spool: ", err)
+		return src, err
+	}
+	s, err := newBlobSpool(*opts.spoolDir, threshold)
+	if err != nil {
+		l.Error("Error creating spool: ", err)
+		return src, err
+	}
+	free, err := diskFree(s.dir)
+	if err != nil {
+		l.Warn("Unable to check free space for the spool: ", err)
+	} else if free < uint64(size) {
+		s.remove()
+		return src, fmt.Errorf("spool directory %s has %s free, but the image needs up to %s", s.dir, formatBytes(int64(free)), formatBytes(size))
+	}
+	l.Debugf("Spooling up to %s in %s", formatBytes(size), s.dir)
+	spools = append(spools, s)
+	return &spoolingSource{imageSource: src, spool: s}, nil
+}
+
+// stopSpool removes the spools of the run, if any
+func stopSpool() {
+	for _, s := range spools {
+		s.remove()
+	}
+	spools = nil
+}
+
+// spoolSize returns the total size of the distinct blobs larger than
+// threshold that the manifest, and the manifests of an index, reference
+func spoolSize(src imageSource, m Manifest, threshold int64, seen map[string]bool) (int64, error) {
+	var size int64
+	for _, d := range m.Manifests {
+		child, err := src.manifest(d.Digest)
+		if err != nil {
+			return 0, err
+		}
+		n, err := spoolSize(src, child, threshold, seen)
+		if err != nil {
+			return 0, err
+		}
+		size += n
+	}
+	for _, b := range m.blobs() {
+		if b.Digest == "" || seen[b.Digest] || b.Size <= threshold || skipExternal(b) {
+			continue
+		}
+		seen[b.Digest] = true
+		size += b.Size
+	}
+	return size, nil
+}
+
+// open returns the content of the blob, downloading it from src into the
+// spool the first time it is needed
+func (s *blobSpool) open(src imageSource, desc Descriptor) (io.ReadCloser, error) {
+	if desc.Size <= s.threshold {
+		return src.openBlob(desc)
+	}
+	s.mu.Lock()
+	b, ok := s.blobs[desc.Digest]
+	if !ok {
+		b = &spooledBlob{path: filepath.Join(s.dir, strings.Replace(desc.Digest, ":", "-", 1))}
+		s.blobs[desc.Digest] = b
+	}
+	s.mu.Unlock()
+	b.once.Do(func() {
+		b.err = s.download(src, desc, b.path)
+	})
+	if b.err != nil {
+		return nil, b.err
+	}
+	return os.Open(b.path)
+}
+
+// download writes the verified content of the blob to path
+func (s *blobSpool) download(src imageSource, desc Descriptor, path string) error {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "blobSpool.download",
+		"digest":  desc.Digest,
+	})
+	l.Debug("Spooling blob")
+	rc, err := src.openBlob(desc)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	f, err := os.Create(path)
+	if err != nil {
+		l.Error("Error creating spool file: ", err)
+		return err
+	}
+	if _, err := io.Copy(f, newVerifyingReader(rc, desc)); err != nil {
+		f.Close()
+		os.Remove(path)
+		l.Error("Error spooling blob: ", err)
+		return err
+	}
+	return f.Close()
+}
+
+// remove deletes the spool directory and everything in it
+func (s *blobSpool) remove() {
+	if err := os.RemoveAll(s.dir); err != nil {
+		log.WithFields(log.Fields{
+			"package": "main",
+			"fn":      "blobSpool.remove",
+			"dir":     s.dir,
+		}).Error("Error removing spool: ", err)
+	}
+}
+
+// spoolingSource serves the blobs of an image source through the spool
+type spoolingSource struct {
+	imageSource
+	spool *blobSpool
+}
+
+func (s *spoolingSource) openBlob(desc Descriptor) (io.ReadCloser, error) {
+	return s.spool.open(s.imageSource, desc)
+}
+
+func (s *spoolingSource) unwrap() imageSource {
+	return s.imageSource
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// tagsPageSize is the number of tags asked for per page. Registries
+	// may return fewer, and ECR returns at most 1000.
+	tagsPageSize = 1000
+	// maxTagPages stops listing a repository whose registry keeps
+	// returning pages, so a registry that loops cannot hang the run
+	maxTagPages = 1000
+)
+
+// listTags returns the tags of the repository referenced by ref. Pages
+// are followed through the Link header with rel="next", as the
+// distribution spec describes. A page of exactly the page size without
+// a Link header is followed by asking for the tags after its last one
+// with last, for registries that paginate but do not send Link. Pages
+// repeating a url or only tags already listed end the listing.
+func listTags(ctx context.Context, ref ImageRef) ([]string, error) {
+	l := log.WithFields(log.Fields{
+		"package":  "main",
+		"fn":       "listTags",
+		"registry": ref.Registry,
+		"image":    ref.Image,
+	})
+	l.Debug("Listing tags")
+	first := ref.apiURL("tags", "list") + "?n=" + strconv.Itoa(tagsPageSize)
+	visited := map[string]bool{}
+	seen := map[string]bool{}
+	var tags []string
+	for page, next := 0, first; next != ""; page++ {
+		if page == maxTagPages {
+			return nil, fmt.Errorf("listing the tags of %s: stopped after %d pages", ref.Repository(), maxTagPages)
+		}
+		if visited[next] {
+			l.Warn("Registry links to a tags page already listed, stopping: ", next)
+			break
+		}
+		visited[next] = true
+		pageTags, link, err := listTagsPage(ctx, ref, next)
+		if err != nil {
+			return nil, err
+		}
+		added := 0
+		for _, t := range pageTags {
+			if !seen[t] {
+				seen[t] = true
+				tags = append(tags, t)
+				added++
+			}
+		}
+		switch {
+		case added == 0 && len(pageTags) > 0:
+			l.Warn("Registry returned a tags page of tags already listed, stopping")
+			next = ""
+		case link != "":
+			next = link
+		case len(pageTags) == tagsPageSize:
+			next = first + "&last=" + url.QueryEscape(pageTags[len(pageTags)-1])
+		default:
+			next = ""
+		}
+	}
+	l.Debugf("Listed %d tags", len(tags))
+	return tags, nil
+}
+
+// listTagsPage gets a page of the tag list at u, returning its tags and
+// the url of the next page from the Link header, if any
+func listTagsPage(ctx context.Context, ref ImageRef, u string) ([]string, string, error) {
+	l := log.WithFields(log.Fields{
+		"package":  "main",
+		"fn":       "listTagsPage",
+		"registry": ref.Registry,
+		"url":      u,
+	})
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		l.Error("Error creating request: ", err)
+		return nil, "", err
+	}
+	if err := authorize(req, ref); err != nil {
+		l.Error("Error getting registry auth: ", err)
+		return nil, "", err
+	}
+	resp, err := registryDo(req, ref.authProvider())
+	if err != nil {
+		l.Error("Error listing tags: ", err)
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	bd, err := ioutil.ReadAll(resp.Body)
+	if err == nil {
+		bd, err = gunzipBody(bd, 0)
+	}
+	if err != nil {
+		l.Error("Error reading response body: ", err)
+		return nil, "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		l.Error("Error listing tags: ", resp.Status)
+		return nil, "", errors.New(resp.Status)
+	}
+	var tl struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.Unmarshal(bd, &tl); err != nil {
+		l.Error("Error unmarshalling tag list: ", err)
+		return nil, "", err
+	}
+	next, err := nextLink(resp.Header.Values("Link"), resp.Request.URL)
+	if err != nil {
+		l.Error("Error parsing Link header: ", err)
+		return nil, "", err
+	}
+	return tl.Tags, next, nil
+}
+
+// nextLink returns the url of the link with rel="next" in RFC 5988 Link
+// header values, such as </v2/app/tags/list?n=100&last=b>; rel="next",
+// resolved against base, or an empty string if there is none
+func nextLink(values []string, base *url.URL) (string, error) {
+	for _, v := range values {
+		for _, link := range strings.Split(v, ",") {
+			target, params, ok := strings.Cut(strings.TrimSpace(link), ";")
+			target = strings.TrimSpace(target)
+			if !ok || !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			for _, p := range strings.Split(params, ";") {
+				k, val, _ := strings.Cut(strings.TrimSpace(p), "=")
+				if !strings.EqualFold(strings.TrimSpace(k), "rel") {
+					continue
+				}
+				for _, rel := range strings.Fields(strings.Trim(strings.TrimSpace(val), `"`)) {
+					if !strings.EqualFold(rel, "next") {
+						continue
+					}
+					u, err := base.Parse(strings.Trim(target, "<>"))
+					if err != nil {
+						return "", err
+					}
+					return u.String(), nil
+				}
+			}
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// serveTags answers the tag list of app with page, which gets the query
+// of the request and returns the tags and the Link header of the page
+func serveTags(r *testRegistry, page func(q url.Values) ([]string, string)) {
+	r.hook = func(w http.ResponseWriter, req *http.Request) bool {
+		if req.URL.Path != "/v2/app/tags/list" {
+			return false
+		}
+		tags, link := page(req.URL.Query())
+		if link != "" {
+			w.Header().Set("Link", link)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"name": "app", "tags": tags})
+		return true
+	}
+}
+
+func TestListTagsFollowsLink(t *testing.T) {
+	r := newTestRegistry(t)
+	serveTags(r, func(q url.Values) ([]string, string) {
+		switch q.Get("last") {
+		case "":
+			return []string{"a", "b"}, `</v2/app/tags/list?n=2&last=b>; rel="next"`
+		case "b":
+			return []string{"c", "d"}, ""
+		}
+		t.Errorf("unexpected tags page last=%s", q.Get("last"))
+		return nil, ""
+	})
+	tags, err := listTags(context.Background(), r.ref(t, "app", "1.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b", "c", "d"}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("listTags = %v, want %v", tags, want)
+	}
+}
+
+func TestListTagsLastFallback(t *testing.T) {
+	r := newTestRegistry(t)
+	full := make([]string, tagsPageSize)
+	for i := range full {
+		full[i] = fmt.Sprintf("t%04d", i)
+	}
+	var asked []string
+	serveTags(r, func(q url.Values) ([]string, string) {
+		asked = append(asked, q.Get("last"))
+		switch q.Get("last") {
+		case "":
+			return full, ""
+		case full[len(full)-1]:
+			return []string{"u1", "u2"}, ""
+		}
+		return nil, ""
+	})
+	tags, err := listTags(context.Background(), r.ref(t, "app", "1.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != tagsPageSize+2 || tags[len(tags)-1] != "u2" {
+		t.Errorf("listTags returned %d tags ending in %s, want %d ending in u2", len(tags), tags[len(tags)-1], tagsPageSize+2)
+	}
+	if want := []string{"", "t0999"}; !reflect.DeepEqual(asked, want) {
+		t.Errorf("asked for pages after %q, want %q", asked, want)
+	}
+}
+
+func TestListTagsShortPageWithoutLinkEnds(t *testing.T) {
+	r := newTestRegistry(t)
+	pages := 0
+	serveTags(r, func(q url.Values) ([]string, string) {
+		pages++
+		return []string{"a"}, ""
+	})
+	if _, err := listTags(context.Background(), r.ref(t, "app", "1.0")); err != nil {
+		t.Fatal(err)
+	}
+	if pages != 1 {
+		t.Errorf("listed %d pages, want 1 for a page shorter than %d without Link", pages, tagsPageSize)
+	}
+}
+
+func TestListTagsStopsAtMaxPages(t *testing.T) {
+	r := newTestRegistry(t)
+	pages := 0
+	serveTags(r, func(q url.Values) ([]string, string) {
+		pages++
+		n, _ := strconv.Atoi(q.Get("page"))
+		return []string{"t" + strconv.Itoa(n)}, fmt.Sprintf(`</v2/app/tags/list?page=%d>; rel="next"`, n+1)
+	})
+	_, err := listTags(context.Background(), r.ref(t, "app", "1.0"))
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("stopped after %d pages", maxTagPages)) {
+		t.Errorf("listTags = %v, want it stopped after %d pages", err, maxTagPages)
+	}
+	if pages != maxTagPages {
+		t.Errorf("listed %d pages, want %d", pages, maxTagPages)
+	}
+}
+
+func TestNextLink(t *testing.T) {
+	base, _ := url.Parse("https://registry.example.com/v2/app/tags/list?n=100")
+	tests := []struct {
+		values []string
+		want   string
+	}{
+		{nil, ""},
+		{[]string{`</v2/app/tags/list?n=100&last=b>; rel="next"`}, "https://registry.example.com/v2/app/tags/list?n=100&last=b"},
+		{[]string{`<https://other.example.com/page2>; rel=next`}, "https://other.example.com/page2"},
+		{[]string{`</first>; rel="first", </v2/app/tags/list?last=c>; rel="next"`}, "https://registry.example.com/v2/app/tags/list?last=c"},
+		{[]string{`</first>; rel="first"`, `</second>; rel="next"`}, "https://registry.example.com/second"},
+		{[]string{`</prev>; rel="prev"`}, ""},
+	}
+	for _, tt := range tests {
+		got, err := nextLink(tt.values, base)
+		if err != nil || got != tt.want {
+			t.Errorf("nextLink(%q) = %q, %v, want %q", tt.values, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DestTemplates are destinations rendered from the source image with
+// --dest-template
+var DestTemplates templateListFlag
+
+// templateListFlag is a repeatable flag whose values are kept whole, as
+// templates may contain commas
+type templateListFlag []string
+
+func (f *templateListFlag) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *templateListFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// templateData is what destination templates are rendered with: the
+// parts of the source reference and fields of the source image config
+type templateData struct {
+	Registry     string
+	Repository   string
+	Tag          string
+	Digest       string
+	Labels       map[string]string
+	Created      time.Time
+	Architecture string
+	OS           string
+}
+
+// renderDestTemplates renders the --dest-template destinations for the
+// source image. The source manifest and config are read once and used for
+// every template. Templates that use a label the image does not have
+// fail instead of rendering a tag with <no value> in it.
+func renderDestTemplates(source string, templates []string) ([]string, error) {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "renderDestTemplates",
+		"source":  source,
+	})
+	parsed := make([]*template.Template, len(templates))
+	var data templateData
+	for i, text := range templates {
+		t, err := template.New("dest-template").Option("missingkey=error").Funcs(template.FuncMap{
+			"label": func(name string) (string, error) {
+				v, ok := data.Labels[name]
+				if !ok {
+					return "", fmt.Errorf("image has no label %q", name)
+				}
+				return v, nil
+			},
+		}).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("parsing --dest-template %q: %w", text, err)
+		}
+		parsed[i] = t
+	}
+	data, err := sourceTemplateData(source)
+	if err != nil {
+		l.Error("Error reading source for --dest-template: ", err)
+		return nil, err
+	}
+	var rendered []string
+	for i, t := range parsed {
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("rendering --dest-template %q: %w", templates[i], err)
+		}
+		dest := strings.TrimSpace(buf.String())
+		if dest == "" {
+			return nil, fmt.Errorf("--dest-template %q rendered an empty destination", templates[i])
+		}
+		l.Infof("Rendered destination %s from --dest-template %q", dest, templates[i])
+		rendered = append(rendered, dest)
+	}
+	return rendered, nil
+}
+
+// sourceTemplateData reads the source manifest and its image config. For
+// an index the config of the first platform image is used.
+func sourceTemplateData(source string) (templateData, error) {
+	data := templateData{Tag: sourceTag(source), Labels: map[string]string{}}
+	if !isLocalSource(source) {
+		ref, err := urlToImageTag(source)
+		if err != nil {
+			return data, err
+		}
+		data.Registry = ref.Registry
+		data.Repository = ref.Image
+	}
+	src, err := newImageSource(source)
+	if err != nil {
+		return data, err
+	}
+	m, err := src.root()
+	if err != nil {
+		return data, err
+	}
+	data.Digest = m.Digest()
+	for _, d := range m.Manifests {
+		if d.Platform == nil || d.Platform.OS == "unknown" {
+			continue
+		}
+		if m, err = src.manifest(d.Digest); err != nil {
+			return data, err
+		}
+		break
+	}
+	if m.Config == nil || m.isIndex() {
+		return data, fmt.Errorf("%s has no image config to render templates from", source)
+	}
+	c, err := fetchConfig(src, m)
+	if err != nil {
+		return data, fmt.Errorf("reading config %s: %w", m.Config.Digest, err)
+	}
+	if c.Created != "" {
+		if data.Created, err = time.Parse(time.RFC3339Nano, c.Created); err != nil {
+			return data, fmt.Errorf("parsing created time of config %s: %w", m.Config.Digest, err)
+		}
+	}
+	data.Architecture = c.Architecture
+	data.OS = c.OS
+	if c.Config.Labels != nil {
+		data.Labels = c.Config.Labels
+	}
+	return data, nil
+}
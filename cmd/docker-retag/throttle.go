@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxThrottleWait bounds the wait between retries when a registry asks
+// for a longer one, so a single Retry-After cannot stall the run for hours
+const maxThrottleWait = 5 * time.Minute
+
+var (
+	backoffsMu sync.Mutex
+	// backoffs holds when requests to a throttled registry host may be
+	// sent again, so all requests to it back off together while requests
+	// to other registries go on
+	backoffs = map[string]time.Time{}
+)
+
+// backOff holds requests to host until the time
+func backOff(host string, until time.Time) {
+	backoffsMu.Lock()
+	defer backoffsMu.Unlock()
+	if until.After(backoffs[host]) {
+		backoffs[host] = until
+	}
+}
+
+// waitForBackoff blocks while host is backing off after throttling
+func waitForBackoff(host string) {
+	backoffsMu.Lock()
+	until := backoffs[host]
+	backoffsMu.Unlock()
+	if d := time.Until(until); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// throttledError is returned for a request the registry kept answering
+// with 429 Too Many Requests
+type throttledError struct {
+	host       string
+	attempts   int
+	limit      string
+	remaining  string
+	retryAfter time.Time
+}
+
+func (e *throttledError) Error() string {
+	msg := fmt.Sprintf("429 Too Many Requests from %s", e.host)
+	if e.attempts > 1 {
+		msg += fmt.Sprintf(" after %d attempts", e.attempts)
+	}
+	if e.limit != "" || e.remaining != "" {
+		msg += fmt.Sprintf(", rate limit %s, remaining %s", e.limit, e.remaining)
+	}
+	if !e.retryAfter.IsZero() {
+		msg += ", retry after " + e.retryAfter.Format(time.RFC3339)
+	}
+	return msg
+}
+
+// retryAfter returns how long the registry asked to wait before the
+// next request, from a Retry-After header in seconds or as a date. It
+// falls back to an exponential backoff for the attempt.
+func retryAfter(resp *http.Response, attempt int, now time.Time) time.Duration {
+	wait := time.Duration(1<<uint(attempt)) * time.Second
+	if v := resp.Header.Get("Retry-After"); v != "" {
+		if s, err := strconv.Atoi(v); err == nil && s >= 0 {
+			wait = time.Duration(s) * time.Second
+		} else if t, err := http.ParseTime(v); err == nil {
+			wait = t.Sub(now)
+		}
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+// throttled handles a 429 response to req. It returns how long to wait
+// before retrying, or the error to fail the request with once the retry
+// budget is used up, the wait would pass --deadline or the request cannot
+// be sent again.
+func throttled(req *http.Request, resp *http.Response, attempt int) (time.Duration, error) {
+	l := log.WithFields(log.Fields{
+		"package":   "main",
+		"fn":        "throttled",
+		"registry":  req.URL.Host,
+		"method":    req.Method,
+		"url":       req.URL.String(),
+		"limit":     resp.Header.Get("RateLimit-Limit"),
+		"remaining": resp.Header.Get("RateLimit-Remaining"),
+	})
+	now := time.Now()
+	wait := retryAfter(resp, attempt, now)
+	e := &throttledError{
+		host:      req.URL.Host,
+		attempts:  attempt + 1,
+		limit:     resp.Header.Get("RateLimit-Limit"),
+		remaining: resp.Header.Get("RateLimit-Remaining"),
+	}
+	if resp.Header.Get("Retry-After") != "" {
+		e.retryAfter = now.Add(wait).Truncate(time.Second)
+	}
+	if wait > maxThrottleWait {
+		wait = maxThrottleWait
+	}
+	if attempt >= Retries || !replayable(req) {
+		return 0, e
+	}
+	if !runDeadline.IsZero() && now.Add(wait).After(runDeadline) {
+		l.Warn("Rate limited by registry, not retrying as the wait would pass --deadline")
+		return 0, e
+	}
+	l.Warnf("Rate limited by registry, retrying at %s", now.Add(wait).Format(time.RFC3339))
+	metrics.add("throttled_retries", req.URL.Host, 1)
+	backOff(req.URL.Host, now.Add(wait))
+	return wait, nil
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultTokenLifetime is used when the token service does not say how
+	// long a token is valid for, as in the distribution token spec
+	defaultTokenLifetime = 60 * time.Second
+	// tokenExpiryMargin refreshes tokens shortly before they expire so a
+	// request is not sent with a token that expires in flight
+	tokenExpiryMargin = 10 * time.Second
+	// defaultAuthTimeout is the default of --auth-timeout
+	defaultAuthTimeout = 10 * time.Second
+)
+
+// AuthTimeout bounds each token request, including redirects and reading
+// the response, and each ECR API call, so a token service, SSO exchange
+// or cloud API that hangs fails the destinations waiting for it instead
+// of stalling the run. 0 disables it.
+var AuthTimeout = defaultAuthTimeout
+
+// tokens caches the bearer tokens for registries that answered with a
+// bearer challenge
+var tokens = &tokenCache{
+	challenges: map[string]bearerChallenge{},
+	entries:    map[tokenKey]*tokenEntry{},
+}
+
+// bearerChallenge is the token service a registry points clients at in a
+// WWW-Authenticate: Bearer challenge
+type bearerChallenge struct {
+	realm   string
+	service string
+	scope   string
+}
+
+// tokenCache holds the challenge of each registry host and a token per
+// host, scope set and credential provider
+type tokenCache struct {
+	mu         sync.Mutex
+	challenges map[string]bearerChallenge
+	entries    map[tokenKey]*tokenEntry
+}
+
+// tokenKey identifies a cached token. Tokens are kept per provider, so
+// a token issued for one identity is never sent for another.
+type tokenKey struct {
+	host  string
+	scope string
+	auth  AuthProvider
+}
+
+// tokenEntry is a cached token. Its lock is held while the token is
+// fetched, so concurrent requests for the same scope wait for a single
+// fetch instead of each asking the token service.
+type tokenEntry struct {
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// parseBearerChallenge parses a WWW-Authenticate header, returning false
+// if it is not a bearer challenge
+func parseBearerChallenge(header string) (bearerChallenge, bool) {
+	scheme, params, _ := strings.Cut(strings.TrimSpace(header), " ")
+	if !strings.EqualFold(scheme, "bearer") {
+		return bearerChallenge{}, false
+	}
+	ch := bearerChallenge{}
+	for params != "" {
+		var key, value string
+		key, params, _ = strings.Cut(strings.TrimLeft(params, " ,"), "=")
+		if strings.HasPrefix(params, `"`) {
+			end := strings.Index(params[1:], `"`)
+			if end < 0 {
+				value, params = params[1:], ""
+			} else {
+				value, params = params[1:end+1], params[end+2:]
+			}
+		} else {
+			value, params, _ = strings.Cut(params, ",")
+		}
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "realm":
+			ch.realm = value
+		case "service":
+			ch.service = value
+		case "scope":
+			ch.scope = value
+		}
+	}
+	return ch, ch.realm != ""
+}
+
+// requestScope returns the token scopes for a registry API request,
+// separated by spaces: pull for reads, pull,push for writes and delete
+// for deletes on the repository in the path. A cross-repository mount
+// also needs pull on the repository the blob is mounted from.
+func requestScope(req *http.Request) string {
+	path := req.URL.Path
+	i := strings.Index(path, "/v2/")
+	if i < 0 {
+		return ""
+	}
+	path = path[i+len("/v2/"):]
+	for _, api := range []string{"/manifests/", "/blobs/", "/tags/"} {
+		j := strings.Index(path, api)
+		if j <= 0 {
+			continue
+		}
+		repo := path[:j]
+		upload := strings.HasPrefix(path[j:], "/blobs/uploads/")
+		switch req.Method {
+		case "GET", "HEAD":
+			// the status of an upload session is part of a push
+			if !upload {
+				return "repository:" + repo + ":pull"
+			}
+		case "DELETE":
+			// cancelling an upload session is part of a push
+			if !upload {
+				return "repository:" + repo + ":delete"
+			}
+		}
+		scope := "repository:" + repo + ":pull,push"
+		if from := req.URL.Query().Get("from"); from != "" && req.URL.Query().Get("mount") != "" && from != repo {
+			scope = "repository:" + from + ":pull " + scope
+		}
+		return scope
+	}
+	return ""
+}
+
+// challenge returns the bearer challenge host answered with, if any
+func (c *tokenCache) challenge(host string) (bearerChallenge, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch, ok := c.challenges[host]
+	return ch, ok
+}
+
+// setChallenge records that host requires bearer tokens
+func (c *tokenCache) setChallenge(host string, ch bearerChallenge) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.challenges[host] = ch
+}
+
+// entry returns the cache entry for scope on host with the credentials
+// of auth
+func (c *tokenCache) entry(host, scope string, auth AuthProvider) *tokenEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := tokenKey{host: host, scope: scope, auth: auth}
+	e, ok := c.entries[key]
+	if !ok {
+		e = &tokenEntry{}
+		c.entries[key] = e
+	}
+	return e
+}
+
+// token returns a token for scope on host, fetching one with the
+// credentials of auth if none is cached or the cached one is about to
+// expire. It returns an empty token if host has not sent a bearer
+// challenge.
+func (c *tokenCache) token(host, scope string, auth AuthProvider) (string, error) {
+	ch, ok := c.challenge(host)
+	if !ok {
+		return "", nil
+	}
+	if scope == "" {
+		scope = ch.scope
+	}
+	e := c.entry(host, scope, auth)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.token != "" && time.Now().Before(e.expires) {
+		return e.token, nil
+	}
+	token, expires, err := fetchToken(host, ch, scope, auth)
+	if err != nil {
+		return "", err
+	}
+	e.token, e.expires = token, expires
+	return token, nil
+}
+
+// invalidate drops the cached token for scope on host if it is still
+// the token the registry rejected. Requests that fail with the same
+// token at once only cause one refresh, as the first to refresh replaces
+// the token the others compare against.
+func (c *tokenCache) invalidate(host, scope string, auth AuthProvider, rejected string) {
+	if scope == "" {
+		if ch, ok := c.challenge(host); ok {
+			scope = ch.scope
+		}
+	}
+	e := c.entry(host, scope, auth)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.token == rejected {
+		e.token = ""
+	}
+}
+
+// fetchToken asks the token service in the challenge of host for a token
+// for the scopes in scope, each sent as its own scope parameter,
+// authenticating with the credentials auth has for the registry, if any
+func fetchToken(host string, ch bearerChallenge, scope string, auth AuthProvider) (string, time.Time, error) {
+	l := log.WithFields(log.Fields{
+		"package":  "main",
+		"fn":       "fetchToken",
+		"registry": host,
+		"scope":    scope,
+	})
+	l.Debug("Requesting registry token")
+	u, err := url.Parse(ch.realm)
+	if err != nil {
+		l.Error("Error parsing token realm: ", err)
+		return "", time.Time{}, err
+	}
+	cred, err := auth.ResolveCredentials(host)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	var req *http.Request
+	if cred.IdentityToken != "" {
+		l.Debug("Exchanging identity token")
+		req, err = refreshTokenRequest(u, ch, scope, cred.IdentityToken)
+	} else {
+		q := u.Query()
+		if ch.service != "" {
+			q.Set("service", ch.service)
+		}
+		for _, s := range strings.Fields(scope) {
+			q.Add("scope", s)
+		}
+		u.RawQuery = q.Encode()
+		req, err = http.NewRequest("GET", u.String(), nil)
+		if basic := cred.basicAuth(); err == nil && basic != "" {
+			req.Header.Set("Authorization", "Basic "+basic)
+		}
+	}
+	if err != nil {
+		l.Error("Error creating request: ", err)
+		return "", time.Time{}, err
+	}
+	source := "token service " + u.Host
+	if cred.IdentityToken != "" {
+		source = "identity token exchange with " + u.Host
+	}
+	if AuthTimeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), AuthTimeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+	issued := time.Now()
+	resp, err := followRedirects(req)
+	if err != nil {
+		err = authTimedOut(req.Context(), host, source, err)
+		l.Error("Error requesting token: ", err)
+		return "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+	bd, err := ioutil.ReadAll(resp.Body)
+	if err == nil {
+		bd, err = gunzipBody(bd, 0)
+	}
+	if err != nil {
+		err = authTimedOut(req.Context(), host, source, err)
+		l.Error("Error reading token response: ", err)
+		return "", time.Time{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		l.Error("Error requesting token: ", resp.Status)
+		return "", time.Time{}, fmt.Errorf("requesting token for %s from %s: %s", host, u.Host, resp.Status)
+	}
+	var tr struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(bd, &tr); err != nil {
+		l.Error("Error parsing token response: ", err)
+		return "", time.Time{}, err
+	}
+	token := tr.Token
+	if token == "" {
+		token = tr.AccessToken
+	}
+	if token == "" {
+		return "", time.Time{}, fmt.Errorf("token service %s returned no token for %s", u.Host, host)
+	}
+	lifetime := defaultTokenLifetime
+	if tr.ExpiresIn > 0 {
+		lifetime = time.Duration(tr.ExpiresIn) * time.Second
+	}
+	if lifetime > 2*tokenExpiryMargin {
+		lifetime -= tokenExpiryMargin
+	}
+	return token, issued.Add(lifetime), nil
+}
+
+// authTimedOut returns an error naming the registry and where its
+// credentials were being resolved if err is due to --auth-timeout, and
+// err otherwise
+func authTimedOut(ctx context.Context, registry, source string, err error) error {
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return err
+	}
+	return fmt.Errorf("credential resolution timed out for %s via %s after %s, raise --auth-timeout if it is slow: %w", registry, source, AuthTimeout, err)
+}
+
+// refreshTokenRequest returns the request exchanging an identity token
+// for a token for the scopes in scope: a POST to the token service with
+// the OAuth2 refresh token grant, as docker does for identity tokens
+func refreshTokenRequest(realm *url.URL, ch bearerChallenge, scope, identityToken string) (*http.Request, error) {
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {identityToken},
+		"client_id":     {"docker-retag"},
+	}
+	if ch.service != "" {
+		form.Set("service", ch.service)
+	}
+	if scope != "" {
+		form.Set("scope", strings.Join(strings.Fields(scope), " "))
+	}
+	req, err := http.NewRequest("POST", realm.String(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
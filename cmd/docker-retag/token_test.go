@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestFetchTokenAuthTimeout(t *testing.T) {
+	hung := make(chan struct{})
+	realm := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hung
+	}))
+	defer realm.Close()
+	defer close(hung)
+	timeout := AuthTimeout
+	AuthTimeout = 50 * time.Millisecond
+	defer func() { AuthTimeout = timeout }()
+
+	host := strings.TrimPrefix(realm.URL, "http://")
+	_, _, err := fetchToken(host, bearerChallenge{realm: realm.URL + "/token"}, "repository:app:pull", newCredentialChain(Credential{}))
+	if err == nil || !strings.Contains(err.Error(), "credential resolution timed out for "+host+" via token service "+host) {
+		t.Errorf("fetchToken = %v, want an --auth-timeout error naming the token service", err)
+	}
+}
+
+// anonymousEnv keeps credentials of the environment and the docker
+// config out of the test
+func anonymousEnv(t *testing.T) {
+	t.Helper()
+	noDockerConfig := NoDockerConfig
+	NoDockerConfig = true
+	t.Cleanup(func() { NoDockerConfig = noDockerConfig })
+	for _, name := range []string{"DOCKER_RETAG_USERNAME", "DOCKER_RETAG_PASSWORD", "DOCKER_USER", "DOCKER_PASS", "CI_JOB_TOKEN", "GITHUB_TOKEN"} {
+		t.Setenv(name, "")
+	}
+}
+
+func TestFetchTokenAnonymous(t *testing.T) {
+	anonymousEnv(t)
+	var got *http.Request
+	realm := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		w.Write([]byte(`{"token":"anonymous-token","expires_in":300}`))
+	}))
+	defer realm.Close()
+
+	host := strings.TrimPrefix(realm.URL, "http://")
+	ch := bearerChallenge{realm: realm.URL + "/token", service: "registry.docker.io"}
+	token, _, err := fetchToken(host, ch, "repository:library/nginx:pull", newCredentialChain(Credential{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "anonymous-token" {
+		t.Errorf("token = %q, want anonymous-token", token)
+	}
+	if auth := got.Header.Get("Authorization"); auth != "" {
+		t.Errorf("anonymous token request sent Authorization %q", auth)
+	}
+	want := url.Values{"service": {"registry.docker.io"}, "scope": {"repository:library/nginx:pull"}}
+	if q := got.URL.Query(); q.Encode() != want.Encode() {
+		t.Errorf("token request query = %s, want %s", q.Encode(), want.Encode())
+	}
+}
+
+func TestAnonymousPullWithRateLimit(t *testing.T) {
+	anonymousEnv(t)
+	var tokenAuth []string
+	realm := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenAuth = append(tokenAuth, r.Header.Get("Authorization"))
+		w.Write([]byte(`{"token":"anonymous-token"}`))
+	}))
+	defer realm.Close()
+	r := newTestRegistry(t)
+	r.putManifest("library/nginx", "1.0", mediaTypeOCIManifest, testImageManifest(1))
+	r.hook = func(w http.ResponseWriter, req *http.Request) bool {
+		if req.Header.Get("Authorization") != "Bearer anonymous-token" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+realm.URL+`/token",service="registry.docker.io"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return true
+		}
+		w.Header().Set("RateLimit-Limit", "100;w=21600")
+		w.Header().Set("RateLimit-Remaining", "76;w=21600")
+		w.Header().Set("Docker-RateLimit-Source", "203.0.113.7")
+		return false
+	}
+	logs := new(test.Hook)
+	hooks := log.StandardLogger().ReplaceHooks(log.LevelHooks{})
+	defer log.StandardLogger().ReplaceHooks(hooks)
+	log.AddHook(logs)
+	level := log.GetLevel()
+	log.SetLevel(log.DebugLevel)
+	defer log.SetLevel(level)
+
+	if _, err := fetchManifest(r.ref(t, "library/nginx", "1.0"), "1.0"); err != nil {
+		t.Fatal(err)
+	}
+	if len(tokenAuth) != 1 || tokenAuth[0] != "" {
+		t.Errorf("token requests sent Authorization %q, want one anonymous request", tokenAuth)
+	}
+	found := false
+	for _, e := range logs.AllEntries() {
+		if e.Data["fn"] != "logRateLimit" {
+			continue
+		}
+		found = true
+		if e.Level != log.DebugLevel || e.Data["remaining"] != "76;w=21600" || e.Data["limit"] != "100;w=21600" || e.Data["source"] != "203.0.113.7" {
+			t.Errorf("rate limit logged at %s with %v, want debug with the limit, remaining and source", e.Level, e.Data)
+		}
+	}
+	if !found {
+		t.Error("the rate limit was not logged")
+	}
+}
+
+func TestRequestScope(t *testing.T) {
+	tests := []struct {
+		method, path, want string
+	}{
+		{"GET", "/v2/app/manifests/1.0", "repository:app:pull"},
+		{"HEAD", "/v2/team/app/blobs/sha256:abc", "repository:team/app:pull"},
+		{"PUT", "/v2/app/manifests/1.0", "repository:app:pull,push"},
+		{"DELETE", "/v2/app/manifests/sha256:abc", "repository:app:delete"},
+		{"POST", "/v2/app/blobs/uploads/", "repository:app:pull,push"},
+		{"GET", "/v2/app/blobs/uploads/1", "repository:app:pull,push"},
+		{"PATCH", "/v2/app/blobs/uploads/1", "repository:app:pull,push"},
+		{"DELETE", "/v2/app/blobs/uploads/1", "repository:app:pull,push"},
+		{"POST", "/v2/app/blobs/uploads/?mount=sha256:abc&from=team/base", "repository:team/base:pull repository:app:pull,push"},
+		{"POST", "/v2/app/blobs/uploads/?mount=sha256:abc&from=app", "repository:app:pull,push"},
+		{"POST", "/v2/app/blobs/uploads/?from=team/base", "repository:app:pull,push"},
+		{"GET", "/prefix/v2/app/tags/list", "repository:app:pull"},
+		{"GET", "/v2/", ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "https://registry.example.com"+tt.path, nil)
+		if got := requestScope(req); got != tt.want {
+			t.Errorf("requestScope(%s %s) = %q, want %q", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestMountRequestsBothScopes(t *testing.T) {
+	anonymousEnv(t)
+	var scopes [][]string
+	realm := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scopes = append(scopes, r.URL.Query()["scope"])
+		w.Write([]byte(`{"token":"mount-token"}`))
+	}))
+	defer realm.Close()
+	r := newTestRegistry(t)
+	digest := r.putBlob([]byte("layer"))
+	r.hook = func(w http.ResponseWriter, req *http.Request) bool {
+		if req.Header.Get("Authorization") == "Bearer mount-token" {
+			return false
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="`+realm.URL+`/token",service="registry.example.com"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return true
+	}
+	_, mounted, err := startUpload(r.ref(t, "app", "1.0"), url.Values{"mount": {digest}, "from": {"team/base"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mounted {
+		t.Error("blob was not mounted")
+	}
+	want := [][]string{{"repository:team/base:pull", "repository:app:pull,push"}}
+	if fmt.Sprint(scopes) != fmt.Sprint(want) {
+		t.Errorf("token requested with scope parameters %q, want %q in one request", scopes, want)
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TraceID is the trace the run is part of, given with --trace-id or read
+// from the TRACEPARENT environment variable
+var TraceID string
+
+// OTel exports spans of the run to an OTLP collector, configured by the
+// standard OTEL_EXPORTER_OTLP_* environment variables
+var OTel bool
+
+const (
+	// otlpDefaultEndpoint is where spans are sent without
+	// OTEL_EXPORTER_OTLP_ENDPOINT, the local collector
+	otlpDefaultEndpoint = "http://localhost:4318"
+	otlpDefaultTimeout  = 10 * time.Second
+)
+
+var (
+	traceIDPattern     = regexp.MustCompile(`^[0-9a-f]{32}$`)
+	traceparentPattern = regexp.MustCompile(`^([0-9a-f]{2})-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+)
+
+// tracing holds the trace context and spans of the run; it records
+// nothing until configured from main
+var tracing = &tracer{}
+
+// tracer is the trace context of the run and, with --otel, the spans
+// recorded to export when the run ends
+type tracer struct {
+	mu      sync.Mutex
+	traceID string
+	// parentID is the span of TRACEPARENT the run span is a child of
+	parentID string
+	export   bool
+	run      *span
+	spans    []*span
+}
+
+// span is an operation of the run exported to OTLP
+type span struct {
+	name     string
+	spanID   string
+	parentID string
+	start    time.Time
+	end      time.Time
+	mu       sync.Mutex
+	attrs    []spanAttribute
+	err      error
+}
+
+type spanAttribute struct {
+	key   string
+	value interface{}
+}
+
+// traceHook adds the trace id to every log line
+type traceHook struct {
+	traceID string
+}
+
+func (h traceHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h traceHook) Fire(e *log.Entry) error {
+	e.Data["trace_id"] = h.traceID
+	return nil
+}
+
+// randomID returns n random bytes in hex, the form of trace and span ids
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// setupTracing configures the trace context of the run from --trace-id,
+// or else the W3C traceparent in the TRACEPARENT environment variable,
+// and starts the run span with --otel. With --otel and no trace, a new
+// trace is started.
+func setupTracing(traceID string, export bool) error {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "setupTracing",
+	})
+	traceID = strings.ToLower(strings.TrimSpace(traceID))
+	if traceID != "" && (!traceIDPattern.MatchString(traceID) || strings.Trim(traceID, "0") == "") {
+		return fmt.Errorf("--trace-id %q is not a trace id of 32 hex digits", traceID)
+	}
+	var parentID string
+	if tp := strings.TrimSpace(os.Getenv("TRACEPARENT")); tp != "" {
+		m := traceparentPattern.FindStringSubmatch(strings.ToLower(tp))
+		switch {
+		case m == nil || m[1] == "ff":
+			l.Warnf("Ignoring TRACEPARENT %q, it is not a W3C traceparent", tp)
+		case traceID == "":
+			traceID, parentID = m[2], m[3]
+		case traceID == m[2]:
+			parentID = m[3]
+		default:
+			l.Debugf("Using --trace-id %s over the trace %s of TRACEPARENT", traceID, m[2])
+		}
+	}
+	if export && os.Getenv("OTEL_SDK_DISABLED") == "true" {
+		l.Debug("Not exporting spans, OTEL_SDK_DISABLED is true")
+		export = false
+	}
+	if traceID == "" && export {
+		traceID = randomID(16)
+	}
+	if traceID == "" {
+		return nil
+	}
+	tracing.traceID = traceID
+	tracing.parentID = parentID
+	tracing.export = export
+	log.AddHook(traceHook{traceID: traceID})
+	if export {
+		tracing.run = tracing.start("docker-retag", nil)
+	}
+	return nil
+}
+
+// start starts a span that is a child of parent, or of the run span if
+// parent is nil. It returns nil, which all span methods accept, unless
+// spans are exported.
+func (t *tracer) start(name string, parent *span) *span {
+	if !t.export {
+		return nil
+	}
+	s := &span{name: name, spanID: randomID(8), parentID: t.parentID, start: time.Now()}
+	switch {
+	case parent != nil:
+		s.parentID = parent.spanID
+	case t.run != nil:
+		s.parentID = t.run.spanID
+	}
+	t.mu.Lock()
+	t.spans = append(t.spans, s)
+	t.mu.Unlock()
+	return s
+}
+
+// traceparent returns the W3C traceparent header for requests of the run,
+// naming the run span, or the parent of TRACEPARENT without --otel
+func (t *tracer) traceparent() string {
+	switch {
+	case t.traceID == "":
+		return ""
+	case t.run != nil:
+		return "00-" + t.traceID + "-" + t.run.spanID + "-01"
+	case t.parentID != "":
+		return "00-" + t.traceID + "-" + t.parentID + "-01"
+	}
+	return ""
+}
+
+// set records an attribute of the span, ignoring empty strings
+func (s *span) set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	if v, ok := value.(string); ok && v == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, spanAttribute{key: key, value: value})
+}
+
+// setRef records the registry, repository, tag and digest of ref
+func (s *span) setRef(ref ImageRef) {
+	s.set("registry", ref.Registry)
+	s.set("repository", ref.Image)
+	s.set("tag", ref.Tag)
+	s.set("digest", ref.Digest)
+}
+
+// finish ends the span, as failed if err is set
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.end = time.Now()
+	s.err = err
+}
+
+// finish ends the run span and exports the spans of the run. An export
+// that fails is a single warning, it does not fail the run.
+func (t *tracer) finish(status string, err error) {
+	if !t.export {
+		return
+	}
+	if err == nil && status != "success" {
+		err = errors.New("the run failed")
+	}
+	t.run.set("status", status)
+	t.run.finish(err)
+	if err := t.exportSpans(); err != nil {
+		log.WithFields(log.Fields{
+			"package": "main",
+			"fn":      "tracer.finish",
+		}).Warn("Could not export OpenTelemetry spans: ", err)
+	}
+}
+
+// otelEnv returns the OTEL_EXPORTER_OTLP_TRACES_* variable of name, or
+// else the OTEL_EXPORTER_OTLP_* one, as the exporters of the SDKs read them
+func otelEnv(name string) (string, bool) {
+	if v := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_" + name); v != "" {
+		return v, true
+	}
+	v := os.Getenv("OTEL_EXPORTER_OTLP_" + name)
+	return v, false
+}
+
+// otlpEndpoint returns the url to post spans to. A traces endpoint is
+// used as is, while /v1/traces is appended to a general one.
+func otlpEndpoint() string {
+	v, traces := otelEnv("ENDPOINT")
+	if traces {
+		return v
+	}
+	if v == "" {
+		v = otlpDefaultEndpoint
+	}
+	return strings.TrimSuffix(v, "/") + "/v1/traces"
+}
+
+// parseOTelList parses the key=value,key=value lists of OTEL_* variables,
+// whose values are URL encoded
+func parseOTelList(s string) map[string]string {
+	kv := map[string]string{}
+	for _, p := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(p, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			continue
+		}
+		if dv, err := url.QueryUnescape(strings.TrimSpace(v)); err == nil {
+			v = dv
+		}
+		kv[strings.TrimSpace(k)] = v
+	}
+	return kv
+}
+
+// otlpAttributes encodes attributes as OTLP JSON key values
+func otlpAttributes(attrs []spanAttribute) []map[string]interface{} {
+	out := []map[string]interface{}{}
+	for _, a := range attrs {
+		var v map[string]interface{}
+		switch value := a.value.(type) {
+		case bool:
+			v = map[string]interface{}{"boolValue": value}
+		case int:
+			v = map[string]interface{}{"intValue": strconv.Itoa(value)}
+		case int64:
+			v = map[string]interface{}{"intValue": strconv.FormatInt(value, 10)}
+		default:
+			v = map[string]interface{}{"stringValue": fmt.Sprint(value)}
+		}
+		out = append(out, map[string]interface{}{"key": a.key, "value": v})
+	}
+	return out
+}
+
+// otlpPayload encodes the spans as an OTLP/HTTP JSON export request
+func (t *tracer) otlpPayload() ([]byte, error) {
+	resource := []spanAttribute{}
+	service := os.Getenv("OTEL_SERVICE_NAME")
+	for k, v := range parseOTelList(os.Getenv("OTEL_RESOURCE_ATTRIBUTES")) {
+		if k == "service.name" && service == "" {
+			service = v
+			continue
+		}
+		resource = append(resource, spanAttribute{key: k, value: v})
+	}
+	if service == "" {
+		service = "docker-retag"
+	}
+	resource = append(resource, spanAttribute{key: "service.name", value: service}, spanAttribute{key: "service.version", value: Version})
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var spans []map[string]interface{}
+	for _, s := range t.spans {
+		s.mu.Lock()
+		end := s.end
+		if end.IsZero() {
+			// still running when the run ended, as when it was interrupted
+			end = time.Now()
+		}
+		status := map[string]interface{}{"code": 1}
+		if s.err != nil {
+			status = map[string]interface{}{"code": 2, "message": s.err.Error()}
+		}
+		js := map[string]interface{}{
+			"traceId":           t.traceID,
+			"spanId":            s.spanID,
+			"name":              s.name,
+			"kind":              1,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attrs),
+			"status":            status,
+		}
+		if s.parentID != "" {
+			js["parentSpanId"] = s.parentID
+		}
+		s.mu.Unlock()
+		spans = append(spans, js)
+	}
+	return json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": otlpAttributes(resource)},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "docker-retag", "version": Version},
+				"spans": spans,
+			}},
+		}},
+	})
+}
+
+// exportSpans posts the spans of the run to the OTLP/HTTP endpoint as
+// JSON, which collectors accept along with protobuf. The gRPC protocol is
+// not supported.
+func (t *tracer) exportSpans() error {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "tracer.exportSpans",
+	})
+	if protocol, _ := otelEnv("PROTOCOL"); protocol == "grpc" {
+		return errors.New("OTEL_EXPORTER_OTLP_PROTOCOL grpc is not supported, use http/json or http/protobuf with the OTLP/HTTP port of the collector")
+	}
+	payload, err := t.otlpPayload()
+	if err != nil {
+		return err
+	}
+	timeout := otlpDefaultTimeout
+	if v, _ := otelEnv("TIMEOUT"); v != "" {
+		if ms, err := strconv.Atoi(v); err == nil && ms > 0 {
+			timeout = time.Duration(ms) * time.Millisecond
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	endpoint := otlpEndpoint()
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent())
+	for k, v := range parseOTelList(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS")) {
+		req.Header.Set(k, v)
+	}
+	for k, v := range parseOTelList(os.Getenv("OTEL_EXPORTER_OTLP_TRACES_HEADERS")) {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s responded %s", endpoint, resp.Status)
+	}
+	l.Debugf("Exported %d spans to %s", len(t.spans), endpoint)
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ResolveURLs downloads layers whose descriptors list urls from those urls
+// and pushes them as regular blobs, for destinations that cannot reach
+// where the urls point
+var ResolveURLs bool
+
+// external reports whether the blob is served from its urls rather than
+// from the registry: foreign and non-distributable layers, and layers of
+// any media type whose descriptor lists urls, such as base image layers
+// published to a CDN
+func (d Descriptor) external() bool {
+	return d.nonDistributable() || len(d.URLs) > 0
+}
+
+// skipExternal reports whether copying content leaves out the blob, as it
+// is served from its urls. --include-nondistributable copies such blobs
+// from the source, and --resolve-urls downloads those with urls from them.
+func skipExternal(d Descriptor) bool {
+	switch {
+	case !d.external():
+		return false
+	case ResolveURLs && len(d.URLs) > 0:
+		return false
+	}
+	return !IncludeNonDistributable
+}
+
+// urlSource serves the blobs whose descriptors list urls from those urls,
+// for --resolve-urls, and all other blobs from the source it wraps
+type urlSource struct {
+	imageSource
+}
+
+func (s *urlSource) openBlob(desc Descriptor) (io.ReadCloser, error) {
+	if len(desc.URLs) > 0 {
+		return openURLs(desc)
+	}
+	return s.imageSource.openBlob(desc)
+}
+
+func (s *urlSource) unwrap() imageSource {
+	return s.imageSource
+}
+
+// openURLs opens the blob from the first of its urls that serves it. The
+// content is verified against the digest and size of the descriptor while
+// it is read, so a url serving other content fails the copy.
+func openURLs(desc Descriptor) (io.ReadCloser, error) {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "openURLs",
+		"digest":  desc.Digest,
+	})
+	var errs []string
+	for _, u := range desc.URLs {
+		pu, err := url.Parse(u)
+		if err != nil || (pu.Scheme != "http" && pu.Scheme != "https") {
+			errs = append(errs, fmt.Sprintf("%s: not an http or https url", u))
+			continue
+		}
+		l.Debug("Downloading blob from ", pu.Redacted())
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", pu.Redacted(), err))
+			continue
+		}
+		req.Header.Set("User-Agent", userAgent())
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			errs = append(errs, fmt.Sprintf("%s: %s", pu.Redacted(), resp.Status))
+			continue
+		}
+		return verifyingReadCloser{newVerifyingReader(resp.Body, desc).in(pu.Redacted()), resp.Body}, nil
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("the descriptor has no urls")
+	}
+	l.Error("Error downloading blob: ", errs)
+	return nil, fmt.Errorf("downloading %s from its urls: %s", desc.Digest, strings.Join(errs, ", "))
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// buildInfo is the version of the binary: the Version and BuildDate
+// stamped with -ldflags, and what the Go toolchain records about the
+// module and the commit it was built from
+type buildInfo struct {
+	Version string `json:"version"`
+	// ModuleVersion is the version of the module, as go install
+	// module@version records it
+	ModuleVersion string `json:"module_version,omitempty"`
+	Revision      string `json:"revision,omitempty"`
+	// Dirty is set when the working tree had uncommitted changes
+	Dirty bool `json:"dirty"`
+	// CommitDate is the time of the commit built
+	CommitDate string `json:"commit_date,omitempty"`
+	BuildDate  string `json:"build_date,omitempty"`
+	GoVersion  string `json:"go_version"`
+	Platform   string `json:"platform"`
+}
+
+// build is the version of the running binary
+var build = readBuildInfo()
+
+func init() {
+	// go install module@version builds without -ldflags
+	if Version == "dev" && build.ModuleVersion != "" {
+		Version = build.ModuleVersion
+		build.Version = Version
+	}
+}
+
+// readBuildInfo reads the version of the binary from the build settings
+// the Go toolchain embeds, which have the commit only for binaries built
+// from a package in a git checkout, not from a list of files
+func readBuildInfo() buildInfo {
+	b := buildInfo{
+		Version:   Version,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return b
+	}
+	if v := info.Main.Version; v != "" && v != "(devel)" {
+		b.ModuleVersion = v
+	}
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			b.Revision = s.Value
+		case "vcs.modified":
+			b.Dirty = s.Value == "true"
+		case "vcs.time":
+			b.CommitDate = s.Value
+		}
+	}
+	return b
+}
+
+// shortRevision returns the first 12 characters of the commit, marked
+// when the tree was dirty
+func (b buildInfo) shortRevision() string {
+	rev := b.Revision
+	if len(rev) > 12 {
+		rev = rev[:12]
+	}
+	if rev != "" && b.Dirty {
+		rev += "-dirty"
+	}
+	return rev
+}
+
+// userAgent returns the User-Agent sent with every request, naming the
+// version, commit and platform so registry operators can tell clients
+// apart in their logs
+func (b buildInfo) userAgent() string {
+	details := []string{b.Platform, b.GoVersion}
+	if rev := b.shortRevision(); rev != "" {
+		details = append(details, "commit "+rev)
+	}
+	return "docker-retag/" + b.Version + " (" + strings.Join(details, "; ") + ")"
+}
+
+// printVersion prints the version for -v and --version, as lines of text
+// or, with --output json or ndjson, as an object
+func printVersion(format string) error {
+	b := build
+	var jd []byte
+	var err error
+	switch format {
+	case "text":
+	case "json":
+		jd, err = json.MarshalIndent(b, "", "  ")
+	case "ndjson":
+		jd, err = json.Marshal(b)
+	default:
+		return fmt.Errorf("unknown --output %q, expected text, json or ndjson", format)
+	}
+	if err != nil {
+		return err
+	}
+	if jd != nil {
+		fmt.Println(string(jd))
+		return nil
+	}
+	fmt.Println("docker-retag version:", b.Version)
+	if b.ModuleVersion != "" && b.ModuleVersion != b.Version {
+		fmt.Println("  module version:", b.ModuleVersion)
+	}
+	if b.Revision != "" {
+		rev := b.Revision
+		if b.Dirty {
+			rev += " (dirty)"
+		}
+		fmt.Println("  commit:        ", rev)
+	}
+	if b.CommitDate != "" {
+		fmt.Println("  commit date:   ", b.CommitDate)
+	}
+	if b.BuildDate != "" {
+		fmt.Println("  build date:    ", b.BuildDate)
+	}
+	fmt.Println("  go version:    ", b.GoVersion)
+	fmt.Println("  platform:      ", b.Platform)
+	return nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// watchMaxBackoff bounds how long --watch waits after repeated failures
+const watchMaxBackoff = 15 * time.Minute
+
+// watch keeps the destinations in sync with the source until it is
+// stopped with SIGINT or SIGTERM, checking every interval and backing
+// off while syncing fails
+func watch(image string, plan *Plan, opts *options) int {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "watch",
+		"image":   image,
+	})
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	// synced holds the source digest each destination was last synced to
+	synced := map[int]string{}
+	failures := 0
+	l.Infof("Watching %s every %s", image, *opts.interval)
+	for {
+		wait := *opts.interval
+		if err := watchSync(image, plan, opts, synced); err != nil {
+			failures++
+			for i := 1; i < failures && wait < watchMaxBackoff; i++ {
+				wait *= 2
+			}
+			if wait > watchMaxBackoff {
+				wait = watchMaxBackoff
+			}
+			l.Errorf("Error syncing, retrying in %s: %s", wait, err)
+		} else {
+			failures = 0
+		}
+		select {
+		case s := <-stop:
+			l.Info("Stopping on ", s)
+			report.finish(nil)
+			report.write()
+			return 0
+		case <-time.After(wait):
+		}
+	}
+}
+
+// watchSync resolves the source and retags the destinations that are not
+// at its current digest yet
+func watchSync(image string, plan *Plan, opts *options, synced map[int]string) error {
+	l := log.WithFields(log.Fields{
+		"package": "main",
+		"fn":      "watchSync",
+		"image":   image,
+	})
+	// the source tag may have moved since the last check
+	sourceManifests.forgetTags()
+	// and the destinations may have changed or failed to be checked
+	forgetBlobChecks()
+	forgetAPIChecks()
+	src, err := newImageSource(image)
+	if err != nil {
+		return err
+	}
+	var digest string
+	if rs, ok := src.(*registrySource); ok {
+		d, exists, err := manifestDigest(rs.ref, rs.ref.Reference())
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("%s does not exist", image)
+		}
+		digest = d
+	} else {
+		m, err := src.root()
+		if err != nil {
+			return err
+		}
+		digest = m.Digest()
+	}
+	// manifest is what the destinations get, which --format, --label and
+	// --annotation make differ from the source. It is only prepared once a
+	// destination is compared with it or pushed it.
+	var manifest Manifest
+	var sourceDigest string
+	prepared := false
+	prepare := func() error {
+		if prepared {
+			return nil
+		}
+		m, err := src.root()
+		if err != nil {
+			return err
+		}
+		sourceDigest = m.Digest()
+		report.setDigest(sourceDigest)
+		if src, manifest, err = prepareManifest(src, m, opts); err != nil {
+			return err
+		}
+		prepared = true
+		return nil
+	}
+	var pending []int
+	for i, d := range plan.Destinations {
+		if d.Duplicate {
+			continue
+		}
+		if last, ok := synced[i]; ok {
+			if last != digest {
+				pending = append(pending, i)
+			}
+			continue
+		}
+		// on the first check, destinations already at the digest they
+		// would be pushed are left alone
+		if d.Ref.Registry != "" {
+			current, exists, err := manifestDigest(d.Ref, d.Ref.Reference())
+			if err != nil {
+				return err
+			}
+			if exists {
+				if err := prepare(); err != nil {
+					return err
+				}
+				if current == manifest.Digest() {
+					synced[i] = digest
+					continue
+				}
+			}
+		}
+		pending = append(pending, i)
+	}
+	if len(pending) == 0 {
+		l.Debug("Source unchanged at ", digest)
+		return nil
+	}
+	l.Infof("Syncing %s to %d destinations", digest, len(pending))
+	if err := prepare(); err != nil {
+		return err
+	}
+	digest = sourceDigest
+	var signature *SignatureCheck
+	if verifier != nil {
+		if signature, err = verifier.verify(src, digest); err != nil {
+			return fmt.Errorf("verifying signature of %s: %w", digest, err)
+		}
+	}
+	if src, err = startSpool(src, manifest, plan, opts); err != nil {
+		return err
+	}
+	defer stopSpool()
+	var destinations []string
+	for _, i := range pending {
+		destinations = append(destinations, plan.Destinations[i].Arg)
+	}
+	jobs := newJobQueue(*opts.workers, destinations)
+	results := make(chan UploadResult, len(pending))
+	for i := 0; i < *opts.workers && i < len(pending); i++ {
+		go manifestUploadWorker(defaultAuth, jobs, results)
+	}
+	for _, i := range pending {
+		jobs.push(UploadJob{
+			Index:     i,
+			Manifest:  manifest,
+			Src:       src,
+			Source:    image,
+			Image:     plan.Destinations[i].Arg,
+			Signature: signature,
+		})
+	}
+	jobs.close()
+	failed := 0
+	for range pending {
+		r := <-results
+		if err := printResult(r); err != nil {
+			l.Error("Error printing result: ", err)
+		}
+		if r.Err != nil {
+			failed++
+			continue
+		}
+		synced[r.Index] = digest
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d destinations failed", failed, len(pending))
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestWatchSyncComparesPreparedManifest(t *testing.T) {
+	anonymousEnv(t)
+	r := newTestRegistry(t)
+	config := []byte(`{"architecture":"amd64","os":"linux","config":{}}`)
+	desc := Descriptor{Digest: r.putBlob(config), Size: int64(len(config))}
+	r.putManifest("app", "src", mediaTypeOCIManifest, imageFixture(t, desc).Raw)
+	opts := defineFlags(flag.NewFlagSet("docker-retag", flag.ContinueOnError))
+	*opts.workers = 1
+	opts.labels["team"] = "infra"
+	plan, err := newPlan(r.host+"/app:src", []string{r.host + "/app:a", r.host + "/app:b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := report
+	report = &runReport{}
+	defer func() { report = saved }()
+	puts := func() int {
+		n := 0
+		for _, req := range r.requested() {
+			if strings.HasPrefix(req, "PUT /v2/app/manifests/") {
+				n++
+			}
+		}
+		return n
+	}
+
+	if err := watchSync(r.host+"/app:src", plan, opts, map[int]string{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := puts(); n != 2 {
+		t.Fatalf("first sync pushed %d manifests, want both destinations", n)
+	}
+	// a restarted watch finds the destinations at the labeled manifest
+	synced := map[int]string{}
+	if err := watchSync(r.host+"/app:src", plan, opts, synced); err != nil {
+		t.Fatal(err)
+	}
+	if n := puts(); n != 2 {
+		t.Errorf("a restarted watch pushed %d manifests again, want none", n-2)
+	}
+	if len(synced) != 2 {
+		t.Errorf("synced %d destinations, want both recorded at the source digest", len(synced))
+	}
+}
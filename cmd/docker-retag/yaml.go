@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// parseYAML parses the subset of YAML used by the config file: nested
+// block mappings, block and flow sequences of scalars, quoted and plain
+// scalars, and comments. Scalars are returned as strings, mappings as
+// map[string]interface{} and sequences as []interface{}. Block scalars,
+// flow mappings, anchors, aliases and tags are rejected.
+func parseYAML(data []byte) (map[string]interface{}, error) {
+	var lines []yamlLine
+	for i, raw := range strings.Split(string(data), "\n") {
+		text := stripYAMLComment(strings.TrimRight(raw, " \t\r"))
+		if strings.TrimSpace(text) == "" || strings.TrimSpace(text) == "---" {
+			continue
+		}
+		indent := len(text) - len(strings.TrimLeft(text, " "))
+		if strings.HasPrefix(strings.TrimLeft(text, " "), "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", i+1)
+		}
+		lines = append(lines, yamlLine{num: i + 1, indent: indent, text: strings.TrimSpace(text)})
+	}
+	p := &yamlParser{lines: lines}
+	if len(lines) == 0 {
+		return map[string]interface{}{}, nil
+	}
+	v, err := p.parseBlock(lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, fmt.Errorf("line %d: unexpected indentation", p.lines[p.pos].num)
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("top level of document must be a mapping")
+	}
+	return m, nil
+}
+
+type yamlLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+// stripYAMLComment removes a trailing comment that is not inside quotes
+func stripYAMLComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\'' && quote == '\'' && i+1 < len(s) && s[i+1] == '\'' {
+				// '' is an escaped quote
+				i++
+			} else if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' {
+				i++
+			}
+		case (c == '"' || c == '\'') && startsYAMLScalar(s, i):
+			quote = c
+		case c == '#' && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t'):
+			return s[:i]
+		}
+	}
+	return s
+}
+
+// startsYAMLScalar reports whether s[i] is the first character of a
+// scalar, where a quote opens a quoted string. Elsewhere, as in it's, a
+// quote is part of a plain scalar.
+func startsYAMLScalar(s string, i int) bool {
+	j := i - 1
+	for j >= 0 && (s[j] == ' ' || s[j] == '\t') {
+		j--
+	}
+	if j < 0 {
+		return true
+	}
+	switch s[j] {
+	case '[', ',', '{':
+		return true
+	case ':', '-', '?':
+		// an indicator, when followed by a space
+		return j < i-1
+	}
+	return false
+}
+
+// splitYAMLFlow splits the items of a flow sequence on the commas that
+// are not inside quotes
+func splitYAMLFlow(s string) []string {
+	var items []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\'' && quote == '\'' && i+1 < len(s) && s[i+1] == '\'' {
+				// '' is an escaped quote
+				i++
+			} else if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' {
+				i++
+			}
+		case (c == '"' || c == '\'') && startsYAMLScalar(s, i):
+			quote = c
+		case c == ',':
+			items = append(items, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, s[start:])
+}
+
+var (
+	// yamlBlockScalar matches the header of a literal or folded block
+	// scalar, such as | or >-
+	yamlBlockScalar = regexp.MustCompile(`^[|>][-+0-9]*$`)
+	// yamlNodeProperty matches a value starting with an anchor, alias or
+	// tag, such as &name, *name or !!str
+	yamlNodeProperty = regexp.MustCompile(`^[&*!][^ ]`)
+)
+
+func (p *yamlParser) parseBlock(indent int) (interface{}, error) {
+	if strings.HasPrefix(p.lines[p.pos].text, "- ") || p.lines[p.pos].text == "-" {
+		return p.parseSequence(indent)
+	}
+	return p.parseMapping(indent)
+}
+
+func (p *yamlParser) parseSequence(indent int) (interface{}, error) {
+	var seq []interface{}
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", line.num)
+		}
+		if !strings.HasPrefix(line.text, "-") {
+			return nil, fmt.Errorf("line %d: expected a sequence item", line.num)
+		}
+		item := strings.TrimSpace(strings.TrimPrefix(line.text, "-"))
+		if _, _, isMap := splitYAMLKey(item); isMap && !strings.HasPrefix(item, "\"") && !strings.HasPrefix(item, "'") {
+			return nil, fmt.Errorf("line %d: mappings inside sequences are not supported", line.num)
+		}
+		v, err := parseYAMLScalar(item)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line.num, err)
+		}
+		seq = append(seq, v)
+		p.pos++
+	}
+	return seq, nil
+}
+
+func (p *yamlParser) parseMapping(indent int) (interface{}, error) {
+	m := map[string]interface{}{}
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", line.num)
+		}
+		key, value, ok := splitYAMLKey(line.text)
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key: value", line.num)
+		}
+		k, err := parseYAMLScalar(key)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line.num, err)
+		}
+		ks, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("line %d: mapping keys must be scalars", line.num)
+		}
+		if _, dup := m[ks]; dup {
+			return nil, fmt.Errorf("line %d: duplicate key %q", line.num, ks)
+		}
+		p.pos++
+		if value != "" {
+			v, err := parseYAMLScalar(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line.num, err)
+			}
+			m[ks] = v
+			continue
+		}
+		if p.pos < len(p.lines) && (p.lines[p.pos].indent > indent ||
+			(p.lines[p.pos].indent == indent && strings.HasPrefix(p.lines[p.pos].text, "-"))) {
+			v, err := p.parseBlock(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			m[ks] = v
+			continue
+		}
+		m[ks] = ""
+	}
+	return m, nil
+}
+
+// splitYAMLKey splits "key: value" on the first unquoted ": " or trailing ":"
+func splitYAMLKey(s string) (string, string, bool) {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\'' && quote == '\'' && i+1 < len(s) && s[i+1] == '\'' {
+				// '' is an escaped quote
+				i++
+			} else if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' {
+				i++
+			}
+		case (c == '"' || c == '\'') && i == 0:
+			quote = c
+		case c == ':' && (i == len(s)-1 || s[i+1] == ' '):
+			return strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+func parseYAMLScalar(s string) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(s, "\""):
+		if len(s) < 2 || !strings.HasSuffix(s, "\"") {
+			return nil, fmt.Errorf("unterminated string %s", s)
+		}
+		return strconv.Unquote(s)
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return nil, fmt.Errorf("unterminated string %s", s)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case strings.HasPrefix(s, "["):
+		if !strings.HasSuffix(s, "]") {
+			return nil, fmt.Errorf("unterminated sequence %s", s)
+		}
+		var seq []interface{}
+		inner := strings.TrimSpace(s[1 : len(s)-1])
+		if inner == "" {
+			return seq, nil
+		}
+		for _, item := range splitYAMLFlow(inner) {
+			v, err := parseYAMLScalar(strings.TrimSpace(item))
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+		}
+		return seq, nil
+	case strings.HasPrefix(s, "{"):
+		return nil, fmt.Errorf("flow mappings are not supported")
+	case yamlBlockScalar.MatchString(s):
+		return nil, fmt.Errorf("block scalars (%s) are not supported, write the value on one line", s)
+	case yamlNodeProperty.MatchString(s):
+		return nil, fmt.Errorf("anchors, aliases and tags (%s) are not supported", s)
+	}
+	return s, nil
+}
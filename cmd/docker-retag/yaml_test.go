@@ -0,0 +1,71 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name, in string
+		want     map[string]interface{}
+	}{
+		{"plain", "a: b\nc: d e\n", map[string]interface{}{"a": "b", "c": "d e"}},
+		{"double quoted", `a: "b: c # d"` + "\n" + `e: "f\"g"`, map[string]interface{}{"a": "b: c # d", "e": `f"g`}},
+		{"single quoted", "a: 'it''s # here'", map[string]interface{}{"a": "it's # here"}},
+		{"apostrophe in plain scalar", "name: it's # comment", map[string]interface{}{"name": "it's"}},
+		{"quote inside plain scalar", `name: say "hi" # comment`, map[string]interface{}{"name": `say "hi"`}},
+		{"comments", "# header\na: b # trailing\n  # indented\nc: d#not-a-comment", map[string]interface{}{"a": "b", "c": "d#not-a-comment"}},
+		{"document marker", "---\na: b", map[string]interface{}{"a": "b"}},
+		{"empty values", "a:\nb: ''\nc: \"\"", map[string]interface{}{"a": "", "b": "", "c": ""}},
+		{"empty document", "# nothing\n", map[string]interface{}{}},
+		{"flow sequence", "a: [b, 'c, d', \"e\"]\nf: []", map[string]interface{}{"a": []interface{}{"b", "c, d", "e"}, "f": []interface{}(nil)}},
+		{"block sequence", "a:\n  - b\n  - 'c'\n  - it's\nd:\n- e", map[string]interface{}{"a": []interface{}{"b", "c", "it's"}, "d": []interface{}{"e"}}},
+		{"nested mapping", "registries:\n  registry.example.com:\n    insecure: true\n    ca-file: /etc/ca.pem\nworkers: 4", map[string]interface{}{
+			"registries": map[string]interface{}{"registry.example.com": map[string]interface{}{"insecure": "true", "ca-file": "/etc/ca.pem"}},
+			"workers":    "4",
+		}},
+		{"url values", "proxy: http://proxy:3128", map[string]interface{}{"proxy": "http://proxy:3128"}},
+		{"windows line endings", "a: b\r\nc: d\r\n", map[string]interface{}{"a": "b", "c": "d"}},
+	}
+	for _, tt := range tests {
+		got, err := parseYAML([]byte(tt.in))
+		if err != nil {
+			t.Errorf("%s: parseYAML = %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: parseYAML = %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"literal block scalar", "a: |\n  line one\n  line two", "line 1: block scalars (|) are not supported"},
+		{"folded block scalar", "a: >-\n  text", "line 1: block scalars (>-) are not supported"},
+		{"anchor", "a: &base b", "line 1: anchors, aliases and tags (&base b) are not supported"},
+		{"alias", "a: b\nc: *base", "line 2: anchors, aliases and tags"},
+		{"tag", "a: !!str 5", "line 1: anchors, aliases and tags"},
+		{"flow mapping", "a: {b: c}", "line 1: flow mappings are not supported"},
+		{"mapping in sequence", "a:\n  - b: c", "line 2: mappings inside sequences are not supported"},
+		{"tab indentation", "a:\n\tb: c", "line 2: tabs are not allowed"},
+		{"unexpected indentation", "a: b\n  c: d", "line 2: unexpected indentation"},
+		{"deeper indentation in a mapping", "a:\n  b: c\n    d: e", "line 3: unexpected indentation"},
+		{"missing colon", "a: b\nc", "line 2: expected key: value"},
+		{"duplicate key", "a: b\na: c", `line 2: duplicate key "a"`},
+		{"unterminated double quote", `a: "b`, "line 1: unterminated string"},
+		{"unterminated single quote", "a: 'b", "line 1: unterminated string"},
+		{"unterminated flow sequence", "a: [b, c", "line 1: unterminated sequence"},
+		{"sequence at top level", "- a\n- b", "top level of document must be a mapping"},
+	}
+	for _, tt := range tests {
+		_, err := parseYAML([]byte(tt.in))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: parseYAML = %v, want an error containing %q", tt.name, err, tt.want)
+		}
+	}
+}